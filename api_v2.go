@@ -0,0 +1,395 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API v2 - the same handlers and DB layer as v1, only the views differ: ids are JSON strings (JavaScript
+// can't handle int64 numbers) and dates are RFC3339 in both directions. The version is selected by the
+// path ("/v2/..."), v1 stays unchanged.
+// ---------------------------------------------------------------------------------------------------------------//
+
+const apiV2PathPrefix = "/v2/"
+
+// v1 views which have a v2 representation
+type apiV2Writable interface {
+	toV2() interface{}
+}
+
+// v1 views which can be filled from a v2 request body
+type apiV2Readable interface {
+	readV2(request *restful.Request) error
+}
+
+func isAPIv2(request *restful.Request) bool {
+	return strings.HasPrefix(request.Request.URL.Path, apiV2PathPrefix)
+}
+
+// writeEntity replaces response.WriteHeaderAndEntity for all views which exist in v1 and v2
+func writeEntity(request *restful.Request, response *restful.Response, status int, entity interface{}) {
+	if v2, ok := entity.(apiV2Writable); ok && isAPIv2(request) {
+		entity = v2.toV2()
+	}
+	if fields := fieldsParameter(request); len(fields) > 0 {
+		if projected, err := projectFields(entity, fields); err == nil {
+			entity = projected
+		}
+	}
+	response.WriteHeaderAndEntity(status, entity)
+}
+
+// readEntity replaces request.ReadEntity for all views which exist in v1 and v2 - with "strict=true" the body
+// is checked against the JSON Schema of the view first (see "schema.go")
+func readEntity(request *restful.Request, entity interface{}) error {
+	if isStrictRequest(request) {
+		if err := validateStrictRequest(request, entity); err != nil {
+			return err
+		}
+	}
+	if v2, ok := entity.(apiV2Readable); ok && isAPIv2(request) {
+		return v2.readV2(request)
+	}
+	return request.ReadEntity(entity)
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+type CommonAPIHeaderV2 struct {
+	Id              string   `json:"id"`
+	Key             string   `json:"key"`
+	Name            string   `json:"name"`
+	Description     string   `json:"description"`
+	GcVersion       string   `json:"gcversion"`
+	LastChanged     string   `json:"lastChange"`
+	CreatorId       string   `json:"creatorId"`
+	Language        string   `json:"language"`
+	Curated         bool     `json:"curated"`
+	Deleted         bool     `json:"deleted"`
+	CurationState   string   `json:"curationState"`
+	CurationComment string   `json:"curationComment"`
+	Tags            []string `json:"tags"`
+	RatingCount     int      `json:"ratingCount"`
+	RatingAverage   float64  `json:"ratingAverage"`
+	PayloadSize     int      `json:"size"`    // output only
+	PayloadHash     string   `json:"hash"`    // output only
+	StarCount       int      `json:"starCount"` // output only
+	Unlisted        bool     `json:"unlisted"`
+	MergedInto      string   `json:"mergedInto"` // output only
+}
+
+type CommonAPIHeaderOnlyV2 struct {
+	Header CommonAPIHeaderV2 `json:"header"`
+}
+
+// the v2 payload views only replace the header of the v1 view
+type ChartAPIv2 struct {
+	ChartAPIv1
+	Header CommonAPIHeaderV2 `json:"header"`
+}
+
+type GChartAPIv2 struct {
+	GChartAPIv1
+	Header CommonAPIHeaderV2 `json:"header"`
+}
+
+type GChartAPIv2HeaderOnly struct {
+	GChartAPIv1HeaderOnly
+	Header CommonAPIHeaderV2 `json:"header"`
+}
+
+type UserMetricAPIv2 struct {
+	UserMetricAPIv1
+	Header CommonAPIHeaderV2 `json:"header"`
+}
+
+type ChartAPIv2Bulk struct {
+	Items   []ChartAPIv2 `json:"items"`
+	Missing []string     `json:"missing"`
+}
+
+type GChartAPIv2Bulk struct {
+	Items   []GChartAPIv2 `json:"items"`
+	Missing []string      `json:"missing"`
+}
+
+type UserMetricAPIv2Bulk struct {
+	Items   []UserMetricAPIv2 `json:"items"`
+	Missing []string          `json:"missing"`
+}
+
+type StatusEntityGetAPIv2 struct {
+	Id          string                  `json:"id"`
+	Status      int                     `json:"status"`
+	ChangeDate  string                  `json:"changeDate"`
+	Maintenance *MaintenanceWindowAPIv2 `json:"maintenance,omitempty"`
+	Stale       bool                    `json:"stale,omitempty"`
+}
+
+type MaintenanceWindowAPIv2 struct {
+	Id                 string   `json:"id"`
+	Start              string   `json:"start"`
+	End                string   `json:"end"`
+	Message            string   `json:"message"`
+	AffectedComponents []string `json:"affectedComponents"`
+	Active             bool     `json:"active"`
+}
+
+type StatusEntityPostAPIv2 struct {
+	Status     int    `json:"status"`
+	ChangeDate string `json:"changeDate"`
+	Text       string `json:"text"`
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// v1 <-> v2 mapping
+// ---------------------------------------------------------------------------------------------------------------//
+
+func formatIdV2(id int64) string {
+	if id == 0 {
+		return ""
+	}
+	return strconv.FormatInt(id, 10)
+}
+
+func parseIdV2(id string) (int64, error) {
+	if id == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(id, 10, 64)
+}
+
+// v1 dates are always UTC - so they only need to be re-formatted
+func formatDateV2(date string) string {
+	if t, err := time.Parse(dateTimeLayout, date); err == nil {
+		return t.UTC().Format(time.RFC3339)
+	}
+	return date
+}
+
+// invalid dates are passed unchanged - so the validation reports them
+func parseDateV2(date string) string {
+	if t, err := time.Parse(time.RFC3339, date); err == nil {
+		return t.UTC().Format(dateTimeLayout)
+	}
+	return date
+}
+
+func mapAPIv1toV2CommonHeader(v1 *CommonAPIHeaderV1, v2 *CommonAPIHeaderV2) {
+	v2.Id = formatIdV2(v1.Id)
+	v2.Key = v1.Key
+	v2.Name = v1.Name
+	v2.Description = v1.Description
+	v2.GcVersion = v1.GcVersion
+	v2.LastChanged = formatDateV2(v1.LastChanged)
+	v2.CreatorId = v1.CreatorId
+	v2.Language = v1.Language
+	v2.Curated = v1.Curated
+	v2.Deleted = v1.Deleted
+	v2.CurationState = v1.CurationState
+	v2.CurationComment = v1.CurationComment
+	v2.Tags = v1.Tags
+	v2.RatingCount = v1.RatingCount
+	v2.RatingAverage = v1.RatingAverage
+	v2.PayloadSize = v1.PayloadSize
+	v2.PayloadHash = v1.PayloadHash
+	v2.StarCount = v1.StarCount
+	v2.Unlisted = v1.Unlisted
+	v2.MergedInto = v1.MergedInto
+}
+
+func mapAPIv2toV1CommonHeader(v2 *CommonAPIHeaderV2, v1 *CommonAPIHeaderV1) error {
+	id, err := parseIdV2(v2.Id)
+	if err != nil {
+		return err
+	}
+	v1.Id = id
+	v1.Key = v2.Key
+	v1.Name = v2.Name
+	v1.Description = v2.Description
+	v1.GcVersion = v2.GcVersion
+	v1.LastChanged = parseDateV2(v2.LastChanged)
+	v1.CreatorId = v2.CreatorId
+	v1.Language = v2.Language
+	v1.Curated = v2.Curated
+	v1.Deleted = v2.Deleted
+	v1.CurationState = v2.CurationState
+	v1.CurationComment = v2.CurationComment
+	v1.Tags = v2.Tags
+	v1.Unlisted = v2.Unlisted
+	return nil
+}
+
+func (api *CommonAPIHeaderOnlyV1) toV2() interface{} {
+	var v2 CommonAPIHeaderOnlyV2
+	mapAPIv1toV2CommonHeader(&api.Header, &v2.Header)
+	return v2
+}
+
+// chart
+
+func (api *ChartAPIv1) toV2() interface{} {
+	v2 := ChartAPIv2{ChartAPIv1: *api}
+	mapAPIv1toV2CommonHeader(&api.Header, &v2.Header)
+	return v2
+}
+
+func (api *ChartAPIv1) readV2(request *restful.Request) error {
+	var v2 ChartAPIv2
+	if err := request.ReadEntity(&v2); err != nil {
+		return err
+	}
+	*api = v2.ChartAPIv1
+	return mapAPIv2toV1CommonHeader(&v2.Header, &api.Header)
+}
+
+func (list ChartAPIv1HeaderOnlyList) toV2() interface{} {
+	v2List := make([]CommonAPIHeaderOnlyV2, len(list))
+	for i := range list {
+		mapAPIv1toV2CommonHeader(&list[i].Header, &v2List[i].Header)
+	}
+	return v2List
+}
+
+func (bulk *ChartAPIv1Bulk) toV2() interface{} {
+	v2 := ChartAPIv2Bulk{Items: make([]ChartAPIv2, len(bulk.Items)), Missing: bulk.Missing}
+	for i := range bulk.Items {
+		v2.Items[i] = bulk.Items[i].toV2().(ChartAPIv2)
+	}
+	return v2
+}
+
+// gchart
+
+func (api *GChartAPIv1) toV2() interface{} {
+	v2 := GChartAPIv2{GChartAPIv1: *api}
+	mapAPIv1toV2CommonHeader(&api.Header, &v2.Header)
+	return v2
+}
+
+func (api *GChartAPIv1) readV2(request *restful.Request) error {
+	var v2 GChartAPIv2
+	if err := request.ReadEntity(&v2); err != nil {
+		return err
+	}
+	*api = v2.GChartAPIv1
+	return mapAPIv2toV1CommonHeader(&v2.Header, &api.Header)
+}
+
+func (list GChartAPIv1HeaderOnlyList) toV2() interface{} {
+	v2List := make([]GChartAPIv2HeaderOnly, len(list))
+	for i := range list {
+		v2List[i].GChartAPIv1HeaderOnly = list[i]
+		mapAPIv1toV2CommonHeader(&list[i].Header, &v2List[i].Header)
+	}
+	return v2List
+}
+
+func (bulk *GChartAPIv1Bulk) toV2() interface{} {
+	v2 := GChartAPIv2Bulk{Items: make([]GChartAPIv2, len(bulk.Items)), Missing: bulk.Missing}
+	for i := range bulk.Items {
+		v2.Items[i] = bulk.Items[i].toV2().(GChartAPIv2)
+	}
+	return v2
+}
+
+// usermetric
+
+func (api *UserMetricAPIv1) toV2() interface{} {
+	v2 := UserMetricAPIv2{UserMetricAPIv1: *api}
+	mapAPIv1toV2CommonHeader(&api.Header, &v2.Header)
+	return v2
+}
+
+func (api *UserMetricAPIv1) readV2(request *restful.Request) error {
+	var v2 UserMetricAPIv2
+	if err := request.ReadEntity(&v2); err != nil {
+		return err
+	}
+	*api = v2.UserMetricAPIv1
+	return mapAPIv2toV1CommonHeader(&v2.Header, &api.Header)
+}
+
+func (list UserMetricAPIv1HeaderOnlyList) toV2() interface{} {
+	v2List := make([]CommonAPIHeaderOnlyV2, len(list))
+	for i := range list {
+		mapAPIv1toV2CommonHeader(&list[i].Header, &v2List[i].Header)
+	}
+	return v2List
+}
+
+func (bulk *UserMetricAPIv1Bulk) toV2() interface{} {
+	v2 := UserMetricAPIv2Bulk{Items: make([]UserMetricAPIv2, len(bulk.Items)), Missing: bulk.Missing}
+	for i := range bulk.Items {
+		v2.Items[i] = bulk.Items[i].toV2().(UserMetricAPIv2)
+	}
+	return v2
+}
+
+// status
+
+func (api StatusEntityGetAPIv1) toV2() interface{} {
+	v2 := StatusEntityGetAPIv2{Id: formatIdV2(api.Id), Status: api.Status, ChangeDate: formatDateV2(api.ChangeDate), Stale: api.Stale}
+	if api.Maintenance != nil {
+		window := api.Maintenance.toV2().(MaintenanceWindowAPIv2)
+		v2.Maintenance = &window
+	}
+	return v2
+}
+
+func (api MaintenanceWindowAPIv1) toV2() interface{} {
+	return MaintenanceWindowAPIv2{Id: formatIdV2(api.Id), Start: formatDateV2(api.Start), End: formatDateV2(api.End),
+		Message: api.Message, AffectedComponents: api.AffectedComponents, Active: api.Active}
+}
+
+func (list MaintenanceWindowAPIv1List) toV2() interface{} {
+	v2List := make([]MaintenanceWindowAPIv2, len(list))
+	for i := range list {
+		v2List[i] = list[i].toV2().(MaintenanceWindowAPIv2)
+	}
+	return v2List
+}
+
+func (list StatusEntityGetAPIv1List) toV2() interface{} {
+	v2List := make([]StatusEntityGetAPIv2, len(list))
+	for i := range list {
+		v2List[i] = list[i].toV2().(StatusEntityGetAPIv2)
+	}
+	return v2List
+}
+
+func (api *StatusEntityPostAPIv1) readV2(request *restful.Request) error {
+	var v2 StatusEntityPostAPIv2
+	if err := request.ReadEntity(&v2); err != nil {
+		return err
+	}
+	api.Status = v2.Status
+	api.ChangeDate = parseDateV2(v2.ChangeDate)
+	api.Text = v2.Text
+	return nil
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Conditional GET by id - a client which still has the version of "lastChange" (If-Modified-Since) or of the
+// ETag (If-None-Match) gets 304 without the payload. The metadata (name, lastChange, size, hash) is read with a
+// projection query, so neither the payload nor a blob is read for the check. Charts and gcharts are read first
+// instead - "unlisted" is not in the projection and must be checked before any answer. Every change of an
+// entity sets "LastChanged", so it's the version of the entity.
+// ---------------------------------------------------------------------------------------------------------------//
+
+// the projected properties - in sync with the composite indexes in "index.yaml"
+var headerMetaProjection = []string{"Header.Name", "Header.LastChanged", "Header.PayloadHash", "Header.PayloadSize"}
+
+// the JSON fields which can be served by "headerMetaProjection"
+var headerMetaFields = map[string]bool{
+	"header.id":         true,
+	"header.key":        true,
+	"header.name":       true,
+	"header.lastChange": true,
+	"header.size":       true,
+	"header.hash":       true,
+}
+
+// getHeaderMeta reads the metadata of one entity - nil if the entity doesn't exist or was not stored (or
+// re-indexed, see "entity_reindex.go") since the metadata is indexed, a projection query skips such entities.
+// The entity itself is the ancestor, so the result is strongly consistent.
+func getHeaderMeta(ctx context.Context, key *datastore.Key) (*CommonEntityHeader, error) {
+	var metaOnDBList []CommonEntityHeaderOnly
+	_, err := datastore.NewQuery(key.Kind()).Ancestor(key).Filter("__key__ =", key).
+		Project(headerMetaProjection...).GetAll(ctx, &metaOnDBList)
+	if err != nil && !isErrFieldMismatch(err) {
+		return nil, err
+	}
+	if len(metaOnDBList) == 0 {
+		return nil, nil
+	}
+	return &metaOnDBList[0].Header, nil
+}
+
+// isHeaderMetaPossible is true if all requested fields are part of the metadata projection
+func isHeaderMetaPossible(request *restful.Request) bool {
+	fields := fieldsParameter(request)
+	if len(fields) == 0 {
+		return false
+	}
+	for _, field := range fields {
+		if !headerMetaFields[field] {
+			return false
+		}
+	}
+	return true
+}
+
+func entityTag(header *CommonEntityHeader) string {
+	return `"` + strconv.FormatInt(header.LastChanged.UnixNano(), 36) + `"`
+}
+
+// setConditionalHeaders adds the version of the entity to the response - for the next conditional GET
+func setConditionalHeaders(response *restful.Response, header *CommonEntityHeader) {
+	response.AddHeader("ETag", entityTag(header))
+	response.AddHeader("Last-Modified", header.LastChanged.UTC().Format(http.TimeFormat))
+}
+
+func isConditionalRequest(request *restful.Request) bool {
+	return request.HeaderParameter("If-None-Match") != "" || request.HeaderParameter("If-Modified-Since") != ""
+}
+
+// isNotModified checks If-None-Match first and ignores If-Modified-Since if both are sent (RFC 7232)
+func isNotModified(request *restful.Request, header *CommonEntityHeader) bool {
+	if match := request.HeaderParameter("If-None-Match"); match != "" {
+		for _, tag := range strings.Split(match, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == entityTag(header) {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(request.HeaderParameter("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	// the HTTP date has no fractions of a second
+	return !header.LastChanged.Truncate(time.Second).After(since)
+}
+
+// checkNotModified answers a conditional GET with 304 if the client's version is current - true if answered.
+// Entities without indexed metadata are always answered in full.
+func checkNotModified(ctx context.Context, request *restful.Request, response *restful.Response, key *datastore.Key) (bool, error) {
+	if !isConditionalRequest(request) {
+		return false, nil
+	}
+	meta, err := getHeaderMeta(ctx, key)
+	if err != nil || meta == nil {
+		return false, err
+	}
+	if !isNotModified(request, meta) {
+		return false, nil
+	}
+	setConditionalHeaders(response, meta)
+	response.WriteHeader(http.StatusNotModified)
+	return true, nil
+}
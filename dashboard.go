@@ -0,0 +1,286 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Curator dashboard - one server rendered page with the current status, the content waiting for curation,
+// the flag queue and the usage of today. Read only - all actions are still done with the API. The counts
+// are read with keys-only queries up to "maxDashboardCount", the usage comes from the shared metrics
+// counters (see "filter_metrics.go") and the client statistics (see "filter_clients.go").
+// ---------------------------------------------------------------------------------------------------------------//
+
+const mimeHTML = "text/html; charset=utf-8"
+
+// counts above are shown as "1000+"
+const maxDashboardCount = 1000
+
+// newest submissions shown per kind
+const maxDashboardSubmissions = 20
+
+type dashboardView struct {
+	Generated   string
+	Status      string
+	StatusSince string
+	Maintenance *MaintenanceWindowAPIv1
+	Pending     []dashboardPending
+	Flags       []dashboardCount
+	FlagsTotal  dashboardCount
+	Usage       []dashboardCount
+}
+
+type dashboardPending struct {
+	Kind        string
+	Count       dashboardCount
+	Submissions []dashboardSubmission
+}
+
+type dashboardSubmission struct {
+	Id          string
+	Name        string
+	State       string
+	LastChanged string
+}
+
+type dashboardCount struct {
+	Name  string
+	Value uint64
+	More  bool
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>CloudDB Dashboard</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; }
+.ok { color: #080; } .degraded { color: #c60; } .outage { color: #c00; }
+</style>
+</head>
+<body>
+<h1>CloudDB Dashboard</h1>
+<p>Generated {{.Generated}}</p>
+
+<h2>Status</h2>
+<p class="{{.Status}}">{{.Status}}{{if .StatusSince}} since {{.StatusSince}}{{end}}</p>
+{{with .Maintenance}}<p>Maintenance {{.Start}} - {{.End}}: {{.Message}}</p>{{end}}
+
+<h2>Pending curation</h2>
+{{range .Pending}}
+<h3>{{.Kind}} ({{template "count" .Count}})</h3>
+{{if .Submissions}}
+<table>
+<tr><th>Id</th><th>Name</th><th>State</th><th>Last changed</th></tr>
+{{range .Submissions}}<tr><td>{{.Id}}</td><td>{{.Name}}</td><td>{{.State}}</td><td>{{.LastChanged}}</td></tr>
+{{end}}
+</table>
+{{end}}
+{{end}}
+
+<h2>Flag queue ({{template "count" .FlagsTotal}})</h2>
+<table>
+{{range .Flags}}<tr><th>{{.Name}}</th><td>{{template "count" .}}</td></tr>
+{{end}}
+</table>
+
+<h2>Usage</h2>
+<table>
+{{range .Usage}}<tr><th>{{.Name}}</th><td>{{template "count" .}}</td></tr>
+{{end}}
+</table>
+</body>
+</html>
+{{define "count"}}{{.Value}}{{if .More}}+{{end}}{{end}}`))
+
+// supporting functions
+
+func statusName(status int) string {
+	switch status {
+	case Status_Ok:
+		return "ok"
+	case Status_PartialFailure:
+		return "degraded"
+	}
+	return "outage"
+}
+
+// countQuery counts the keys of a query up to "maxDashboardCount"
+func countQuery(ctx context.Context, name string, q *datastore.Query) (dashboardCount, error) {
+	n, err := q.KeysOnly().Limit(maxDashboardCount + 1).Count(ctx)
+	if err != nil {
+		return dashboardCount{}, err
+	}
+	if n > maxDashboardCount {
+		return dashboardCount{Name: name, Value: maxDashboardCount, More: true}, nil
+	}
+	return dashboardCount{Name: name, Value: uint64(n)}, nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+func getDashboard(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	view := dashboardView{Generated: time.Now().Format(dateTimeLayout)}
+
+	_, latest, err := internalGetLatestStatus(ctx)
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+	view.Status = statusName(Status_Ok)
+	if latest != nil {
+		view.Status = statusName(latest.Status)
+		view.StatusSince = latest.ChangeDate.Format(dateTimeLayout)
+	}
+	view.Maintenance = internalGetActiveMaintenanceWindow(ctx)
+
+	for _, entityType := range []string{sharedTypeChart, sharedTypeGChart, sharedTypeUserMetric} {
+		pending, err := internalGetPendingCuration(ctx, entityType)
+		if err != nil {
+			commonResponseErrorProcessing(request, response, err)
+			return
+		}
+		view.Pending = append(view.Pending, *pending)
+	}
+
+	flags := datastore.NewQuery(flagDBEntity).Ancestor(flagEntityRootKey(ctx))
+	if view.FlagsTotal, err = countQuery(ctx, "all", flags); err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+	for _, entityType := range []string{sharedTypeChart, sharedTypeGChart, sharedTypeUserMetric} {
+		count, err := countQuery(ctx, entityType, flags.Filter("EntityType =", entityType))
+		if err != nil {
+			commonResponseErrorProcessing(request, response, err)
+			return
+		}
+		view.Flags = append(view.Flags, count)
+	}
+
+	if view.Usage, err = internalGetUsage(newDefaultContext(request.Request)); err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	var buffer bytes.Buffer
+	if err := dashboardTemplate.Execute(&buffer, view); err != nil {
+		addError(request, response, http.StatusInternalServerError, errorCode_Internal, err.Error())
+		return
+	}
+
+	response.AddHeader("Content-Type", mimeHTML)
+	response.AddHeader("Cache-Control", "no-store")
+	response.WriteHeader(http.StatusOK)
+	response.Write(buffer.Bytes())
+}
+
+//---------------------------------------------------------------------------------------
+// internal functions
+//---------------------------------------------------------------------------------------
+
+// internalGetPendingCuration counts the content which is not curated yet (rejected content is decided) and
+// reads the names of the newest submissions with a projection - the payload is not loaded
+func internalGetPendingCuration(ctx context.Context, entityType string) (*dashboardPending, error) {
+	sharedType := sharedEntityTypes[entityType]
+	pending := &dashboardPending{Kind: entityType}
+
+	notCurated := datastore.NewQuery(sharedType.kind).Filter("Header.Curated =", false).Filter("Header.Deleted =", false)
+	count, err := countQuery(ctx, entityType, notCurated)
+	if err != nil {
+		return nil, err
+	}
+	rejected, err := countQuery(ctx, entityType, datastore.NewQuery(sharedType.kind).
+		Filter("Header.CurationState =", CurationState_Rejected).Filter("Header.Deleted =", false))
+	if err != nil {
+		return nil, err
+	}
+	pending.Count = count
+	if !count.More && count.Value >= rejected.Value {
+		pending.Count.Value -= rejected.Value
+	}
+
+	q := notCurated.Order("-Header.LastChanged").Project("Header.Name", "Header.CurationState", "Header.LastChanged").
+		Limit(maxDashboardSubmissions + int(rejected.Value))
+	for t := q.Run(ctx); len(pending.Submissions) < maxDashboardSubmissions; {
+		entityDB := sharedType.newEntity()
+		key, err := t.Next(entityDB)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil && !isErrFieldMismatch(err) {
+			return nil, err
+		}
+		header := entityDB.commonHeader()
+		if header.CurationState == CurationState_Rejected {
+			continue
+		}
+		pending.Submissions = append(pending.Submissions, dashboardSubmission{
+			Id:          entityIdOfKey(key),
+			Name:        header.Name,
+			State:       curationState(header),
+			LastChanged: header.LastChanged.Format(dateTimeLayout),
+		})
+	}
+	return pending, nil
+}
+
+// internalGetUsage reads the requests of today (all tenants) and the totals of the shared metrics counters
+// since they were last reset
+func internalGetUsage(ctx context.Context) ([]dashboardCount, error) {
+	today := time.Now().UTC().Format(telemetryDateLayout)
+	var clientDailyDB ClientDailyEntity
+	if err := getEntity(ctx, clientDailyEntityKey(ctx, today), &clientDailyDB); err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	var clientDaily ClientDailyAPIv1
+	mapDBtoAPIClientDaily(&clientDailyDB, &clientDaily)
+
+	counters, err := readMetricsCounters(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return []dashboardCount{
+		{Name: "API requests today (v1)", Value: uint64(clientDaily.V1Requests)},
+		{Name: "API requests today (v2)", Value: uint64(clientDaily.V2Requests)},
+		{Name: "requests since metrics reset", Value: sumMetricsCounters(counters, "clouddb_requests_total", "", "")},
+		{Name: "datastore calls", Value: sumMetricsCounters(counters, "clouddb_datastore_call_duration_seconds_count", "", "")},
+		{Name: "datastore errors", Value: sumMetricsCounters(counters, "clouddb_datastore_call_errors_total", "", "")},
+		{Name: "datastore retries", Value: sumMetricsCounters(counters, "clouddb_datastore_call_retries_total", "", "")},
+		{Name: "over quota responses", Value: sumMetricsCounters(counters, "clouddb_errors_total", "code", errorCode_OverQuota)},
+	}, nil
+}
@@ -0,0 +1,389 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/emicklei/go-restful"
+	"github.com/ugorji/go/codec"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Content negotiation - besides JSON all API views can be read and written as XML and MessagePack (Accept and
+// Content-Type). Both are a different encoding of the JSON document: the view is converted to JSON first, so
+// names, omitted fields and the v2 views are the same in every encoding.
+//
+// XML: the root element is <response> (any name when sent), objects are elements named by the JSON field,
+// array entries are <item> elements, map keys which are no XML names are <entry key="..."> elements. When read,
+// the types of the values are taken from the JSON Schema of the view (see "schema.go").
+// ---------------------------------------------------------------------------------------------------------------//
+
+const mimeMsgpack = "application/msgpack"
+
+// the encodings of the API web services - JSON is the default for "Accept: */*"
+var apiMimeTypes = []string{restful.MIME_JSON, restful.MIME_XML, mimeMsgpack}
+
+const xmlRootElement = "response"
+const xmlItemElement = "item"
+const xmlEntryElement = "entry"
+
+func init() {
+	restful.RegisterEntityAccessor(restful.MIME_XML, xmlEntityAccessor{})
+	restful.RegisterEntityAccessor(mimeMsgpack, msgpackEntityAccessor{})
+}
+
+// supporting functions
+
+// jsonDocument converts a view to the generic JSON document - numbers stay exact
+func jsonDocument(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var document interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	err = d.Decode(&document)
+	return document, err
+}
+
+// readJSONDocument fills the view from a generic JSON document - the same as reading a JSON body
+func readJSONDocument(document interface{}, v interface{}) error {
+	data, err := json.Marshal(document)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// XML
+// ---------------------------------------------------------------------------------------------------------------//
+
+type xmlEntityAccessor struct{}
+
+type xmlNode struct {
+	name     string
+	key      string
+	text     bytes.Buffer
+	children []*xmlNode
+}
+
+func (xmlEntityAccessor) Read(req *restful.Request, v interface{}) error {
+	root, err := parseXMLDocument(req.Request.Body)
+	if err != nil {
+		return err
+	}
+	document, err := xmlToJSON(root, newJSONSchema(reflect.TypeOf(v)))
+	if err != nil {
+		return err
+	}
+	return readJSONDocument(document, v)
+}
+
+func (xmlEntityAccessor) Write(resp *restful.Response, status int, v interface{}) error {
+	if v == nil {
+		resp.WriteHeader(status)
+		return nil
+	}
+	document, err := jsonDocument(v)
+	if err != nil {
+		return err
+	}
+
+	resp.Header().Set(restful.HEADER_ContentType, restful.MIME_XML+"; charset=utf-8")
+	resp.WriteHeader(status)
+	w := bufio.NewWriter(resp)
+	io.WriteString(w, xml.Header)
+	e := xml.NewEncoder(w)
+	if err := writeXMLValue(e, xmlRootElement, "", document); err != nil {
+		return err
+	}
+	if err := e.Flush(); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func isXMLName(name string) bool {
+	if name == "" || strings.HasPrefix(strings.ToLower(name), "xml") {
+		return false
+	}
+	for i, r := range name {
+		if !(unicode.IsLetter(r) || r == '_' || (i > 0 && (unicode.IsDigit(r) || r == '-' || r == '.'))) {
+			return false
+		}
+	}
+	return true
+}
+
+func writeXMLValue(e *xml.Encoder, name string, key string, value interface{}) error {
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	if key != "" {
+		start.Attr = []xml.Attr{{Name: xml.Name{Local: "key"}, Value: key}}
+	}
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+
+	switch val := value.(type) {
+	case nil:
+	case map[string]interface{}:
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			var err error
+			if isXMLName(k) {
+				err = writeXMLValue(e, k, "", val[k])
+			} else {
+				err = writeXMLValue(e, xmlEntryElement, k, val[k])
+			}
+			if err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, item := range val {
+			if err := writeXMLValue(e, xmlItemElement, "", item); err != nil {
+				return err
+			}
+		}
+	default:
+		if err := e.EncodeToken(xml.CharData(fmt.Sprint(val))); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+// parseXMLDocument reads the element tree - attributes other than "key" and comments are ignored
+func parseXMLDocument(r io.Reader) (*xmlNode, error) {
+	d := xml.NewDecoder(r)
+	var stack []*xmlNode
+	var root *xmlNode
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			node := &xmlNode{name: t.Name.Local}
+			for _, attr := range t.Attr {
+				if attr.Name.Local == "key" {
+					node.key = attr.Value
+				}
+			}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, node)
+			} else if root == nil {
+				root = node
+			}
+			stack = append(stack, node)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(t)
+			}
+		}
+	}
+	if root == nil {
+		return nil, errors.New("XML document has no root element")
+	}
+	return root, nil
+}
+
+// xmlToJSON converts an element into the JSON value the schema expects
+func xmlToJSON(node *xmlNode, schema jsonSchema) (interface{}, error) {
+	switch jsonSchemaType(schema) {
+	case "object":
+		properties, _ := schema["properties"].(map[string]interface{})
+		additional, _ := schema["additionalProperties"].(jsonSchema)
+		object := make(map[string]interface{})
+		for _, child := range node.children {
+			name := child.name
+			if name == xmlEntryElement && child.key != "" {
+				name = child.key
+			}
+			property, ok := properties[name].(jsonSchema)
+			if !ok {
+				property = additional
+			}
+			value, err := xmlToJSON(child, property)
+			if err != nil {
+				return nil, err
+			}
+			object[name] = value
+		}
+		return object, nil
+	case "array":
+		items, _ := schema["items"].(jsonSchema)
+		array := make([]interface{}, 0, len(node.children))
+		for _, child := range node.children {
+			value, err := xmlToJSON(child, items)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		return array, nil
+	}
+
+	text := strings.TrimSpace(node.text.String())
+	switch jsonSchemaType(schema) {
+	case "integer", "number":
+		if text == "" {
+			return nil, nil
+		}
+		if _, err := strconv.ParseFloat(text, 64); err != nil {
+			return nil, fmt.Errorf("Element %s must be a number", node.name)
+		}
+		return json.Number(text), nil
+	case "boolean":
+		if text == "" {
+			return nil, nil
+		}
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return nil, fmt.Errorf("Element %s must be true or false", node.name)
+		}
+		return b, nil
+	}
+	// strings keep their spaces
+	return node.text.String(), nil
+}
+
+// jsonSchemaType is the type of a schema without "null" - empty for unknown fields
+func jsonSchemaType(schema jsonSchema) string {
+	switch t := schema["type"].(type) {
+	case string:
+		return t
+	case []string:
+		for _, s := range t {
+			if s != "null" {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// MessagePack
+// ---------------------------------------------------------------------------------------------------------------//
+
+type msgpackEntityAccessor struct{}
+
+// nested arrays and maps deeper than this are rejected - no API view comes close, the limit only protects the
+// decoder against crafted bodies
+const maxMsgpackDepth = 32
+
+// msgpackHandle reads maps as JSON objects and strings as string - binaries are read as []byte which is a base64
+// string in the JSON document, the same as the images of the JSON views
+var msgpackHandle = newMsgpackHandle()
+
+func newMsgpackHandle() *codec.MsgpackHandle {
+	h := new(codec.MsgpackHandle)
+	h.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	h.RawToString = true
+	h.WriteExt = true
+	h.MaxDepth = maxMsgpackDepth
+	return h
+}
+
+func (msgpackEntityAccessor) Read(req *restful.Request, v interface{}) error {
+	var document interface{}
+	if err := codec.NewDecoder(req.Request.Body, msgpackHandle).Decode(&document); err != nil {
+		return err
+	}
+	return readJSONDocument(document, v)
+}
+
+func (msgpackEntityAccessor) Write(resp *restful.Response, status int, v interface{}) error {
+	if v == nil {
+		resp.WriteHeader(status)
+		return nil
+	}
+	document, err := jsonDocument(v)
+	if err != nil {
+		return err
+	}
+	document, err = msgpackNumbers(document)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	if err := codec.NewEncoderBytes(&data, msgpackHandle).Encode(document); err != nil {
+		return err
+	}
+	resp.Header().Set(restful.HEADER_ContentType, mimeMsgpack)
+	resp.WriteHeader(status)
+	_, err = resp.Write(data)
+	return err
+}
+
+// msgpackNumbers replaces the exact JSON numbers by int64 or float64 - else they would be written as strings
+func msgpackNumbers(value interface{}) (interface{}, error) {
+	switch val := value.(type) {
+	case json.Number:
+		if i, err := val.Int64(); err == nil {
+			return i, nil
+		}
+		return val.Float64()
+	case []interface{}:
+		for i, item := range val {
+			number, err := msgpackNumbers(item)
+			if err != nil {
+				return nil, err
+			}
+			val[i] = number
+		}
+	case map[string]interface{}:
+		for k, item := range val {
+			number, err := msgpackNumbers(item)
+			if err != nil {
+				return nil, err
+			}
+			val[k] = number
+		}
+	}
+	return value, nil
+}
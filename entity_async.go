@@ -0,0 +1,156 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/taskqueue"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Asynchronous inserts - the entity is staged (asyncinsertentity, a root entity of its own - so no contention on
+// the root shards) and persisted by "/tasks/insert/{type}". The task only carries the key - task payloads are
+// limited to 100KB, charts with images are not. Large images are offloaded to Cloud Storage before staging.
+// ---------------------------------------------------------------------------------------------------------------//
+
+// the types are activated in app.yaml - e.g. Async_Insert: 'chart,gchart'
+const asyncInsertConfig = "Async_Insert"
+const asyncInsertQueue = "insert"
+
+const asyncInsertDBEntity = "asyncinsertentity"
+
+// the staged entity is named by the encoded key of the final entity
+func asyncInsertEntityKey(ctx context.Context, key *datastore.Key) *datastore.Key {
+	return datastore.NewKey(ctx, asyncInsertDBEntity, key.Encode(), 0, nil)
+}
+
+// asyncType is one of the shared entity types - chart, gchart or usermetric
+func isAsyncInsert(asyncType string) bool {
+	for _, configured := range strings.Split(os.Getenv(asyncInsertConfig), ",") {
+		if strings.TrimSpace(configured) == asyncType {
+			return true
+		}
+	}
+	return false
+}
+
+// queueInsert allocates the final id (the tracking id returned to the client), stages the entity and queues
+// the insert with the key only
+func queueInsert(ctx context.Context, req *http.Request, asyncType string, key *datastore.Key, db sharedEntity) (*datastore.Key, error) {
+	key, err := offloadSharedEntityBlob(ctx, asyncType, key, db)
+	if err != nil {
+		return nil, err
+	}
+	if key.Incomplete() {
+		low, _, err := datastore.AllocateIDs(ctx, key.Kind(), key.Parent(), 1)
+		if err != nil {
+			return nil, err
+		}
+		key = datastore.NewKey(ctx, key.Kind(), "", low, key.Parent())
+	}
+
+	props, err := datastore.SaveStruct(db)
+	if err != nil {
+		return nil, err
+	}
+	stagedKey := asyncInsertEntityKey(ctx, key)
+	if err := checkEntitySize(stagedKey, props); err != nil {
+		return nil, err
+	}
+	propertyList := datastore.PropertyList(props)
+	if _, err := datastore.Put(ctx, stagedKey, &propertyList); err != nil {
+		return nil, err
+	}
+
+	path := fmt.Sprint("/v1/tasks/insert/", asyncType, "?", url.Values{"key": {key.Encode()}}.Encode())
+	task := taskqueue.NewPOSTTask(path, nil)
+	if _, err := taskqueue.Add(ctx, addRequestHeadersToTask(req, task), asyncInsertQueue); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+// processInsert is the task queue worker - any error response makes the task queue retry
+func processInsert(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	sharedType, ok := sharedEntityTypes[request.PathParameter("type")]
+	if !ok {
+		addError(request, response, http.StatusNotFound, errorCode_NotFound, "Unknown type for asynchronous insert")
+		return
+	}
+
+	key, err := datastore.DecodeKey(request.QueryParameter("key"))
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	// the tenant is part of the encoded key
+	ctx, err = appengine.Namespace(ctx, key.Namespace())
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	// a repeated task finds nothing staged - the entity is already stored
+	stagedKey := asyncInsertEntityKey(ctx, key)
+	var props datastore.PropertyList
+	if err := datastore.Get(ctx, stagedKey, &props); err == datastore.ErrNoSuchEntity {
+		response.WriteHeaderAndEntity(http.StatusNoContent, "")
+		return
+	} else if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	entityDB := sharedType.newEntity()
+	if err := datastore.LoadStruct(entityDB, props); err != nil && !isErrFieldMismatch(err) {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	if _, err := putSharedEntity(ctx, request.PathParameter("type"), key, entityDB); err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+	indexForSearch(ctx, request.PathParameter("type"), key, entityDB)
+
+	if err := datastore.Delete(ctx, stagedKey); err != nil {
+		logWarningf(ctx, "Staged insert %s not deleted: %v", key, err)
+	}
+
+	// Response is Empty for 204
+	response.WriteHeaderAndEntity(http.StatusNoContent, "")
+}
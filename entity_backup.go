@@ -0,0 +1,452 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/file"
+	"google.golang.org/appengine/taskqueue"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Backup runs (backuprunentity) which are stored in DB - every night each kind of "backupKinds" is exported
+// to NDJSON files (one entity per line, all properties with their type) in Cloud Storage. A kind is written
+// in parts - one task each, continued with the cursor of the previous part. Every part (backupfileentity, child
+// of the run) is recorded with the SHA-256 of the file, so a restore can check the integrity.
+// ---------------------------------------------------------------------------------------------------------------//
+type BackupRunEntity struct {
+	Started   time.Time
+	Finished  time.Time
+	Bucket    string   `datastore:",noindex"`
+	Prefix    string   `datastore:",noindex"` // of all objects of the run
+	KindsDone []string `datastore:",noindex"`
+}
+
+type BackupFileEntity struct {
+	Kind     string
+	Part     int
+	Object   string `datastore:",noindex"`
+	Entities int    `datastore:",noindex"`
+	Bytes    int64  `datastore:",noindex"`
+	Hash     string `datastore:",noindex"` // SHA-256 of the object (hex)
+	Created  time.Time
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+type BackupFileAPIv1 struct {
+	Kind     string `json:"kind"`
+	Part     int    `json:"part"`
+	Object   string `json:"object"`
+	Entities int    `json:"entities"`
+	Bytes    int64  `json:"bytes"`
+	Hash     string `json:"hash"`
+}
+
+type BackupRunAPIv1 struct {
+	Id        int64             `json:"id"`
+	Started   string            `json:"started"`
+	Finished  string            `json:"finished"`
+	Running   bool              `json:"running"`
+	Bucket    string            `json:"bucket"`
+	Prefix    string            `json:"prefix"`
+	KindsDone []string          `json:"kindsDone"`
+	Entities  int               `json:"entities"`
+	Bytes     int64             `json:"bytes"`
+	Files     []BackupFileAPIv1 `json:"files"`
+}
+
+type BackupRunAPIv1List []BackupRunAPIv1
+
+// one line of a backup file
+type BackupRecordAPIv1 struct {
+	Key        string                `json:"key"` // datastore.Key.Encode()
+	Properties []BackupPropertyAPIv1 `json:"properties"`
+}
+
+type BackupPropertyAPIv1 struct {
+	Name     string      `json:"name"`
+	Type     string      `json:"type"`
+	Value    interface{} `json:"value"`
+	NoIndex  bool        `json:"noIndex,omitempty"`
+	Multiple bool        `json:"multiple,omitempty"`
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Data Storage View
+// ---------------------------------------------------------------------------------------------------------------//
+
+const backupRunDBEntity = "backuprunentity"
+const backupRunDBEntityRootKey = "backuproot"
+const backupFileDBEntity = "backupfileentity"
+
+const backupQueue = "backup"
+
+// name of the Cloud Storage bucket - default is the bucket of the app
+const backupBucketConfig = "Backup_Bucket"
+
+const backupObjectPrefix = "backups/"
+
+// a part ends after this number of entities or the run time - whatever comes first
+const maxNumberOfEntitiesPerBackupPart = 20000
+
+// the kinds with content or configuration - not: transient data (upload sessions, idempotency records,
+// webhook deliveries) and the runs of re-index and backup themselves
+var backupKinds = []string{
+	chartDBEntity, gChartDBEntity, usermetricDBEntity, revisionDBEntity, blobDBEntity,
+	statusDBEntity, statusDBEntityText, messageDBEntity, versionDBEntity, maintenanceDBEntity,
+	curatorDBEntity, flagDBEntity, ratingDBEntity, commentDBEntity, starDBEntity, tagDBEntity, changeLogDBEntity,
+	counterShardDBEntity, downloadDBEntity, telemetryDBEntity, clientDailyDBEntity,
+	configDBEntity, retentionDBEntity, webhookDBEntity, banDBEntity, incidentDBEntity,
+	maintenanceWindowDBEntity, shareDBEntity,
+}
+
+func mapDBtoAPIBackupFile(db *BackupFileEntity, api *BackupFileAPIv1) {
+	api.Kind = db.Kind
+	api.Part = db.Part
+	api.Object = db.Object
+	api.Entities = db.Entities
+	api.Bytes = db.Bytes
+	api.Hash = db.Hash
+}
+
+func mapDBtoAPIBackupRun(db *BackupRunEntity, api *BackupRunAPIv1) {
+	api.Started = db.Started.Format(dateTimeLayout)
+	if !db.Finished.IsZero() {
+		api.Finished = db.Finished.Format(dateTimeLayout)
+	}
+	api.Running = db.Finished.IsZero()
+	api.Bucket = db.Bucket
+	api.Prefix = db.Prefix
+	api.KindsDone = db.KindsDone
+}
+
+// supporting functions
+
+func backupRunEntityRootKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, backupRunDBEntity, backupRunDBEntityRootKey, 0, nil)
+}
+
+func backupRunEntityKey(ctx context.Context, id int64) *datastore.Key {
+	return datastore.NewKey(ctx, backupRunDBEntity, "", id, backupRunEntityRootKey(ctx))
+}
+
+// the name of a part is unique per run - a retried part finds the one it already wrote
+func backupFileEntityKey(ctx context.Context, run *datastore.Key, kind string, part int) *datastore.Key {
+	return datastore.NewKey(ctx, backupFileDBEntity, fmt.Sprint(kind, "-", part), 0, run)
+}
+
+func backupBucketName(ctx context.Context) (string, error) {
+	if bucketName := os.Getenv(backupBucketConfig); bucketName != "" {
+		return bucketName, nil
+	}
+	return file.DefaultBucketName(ctx)
+}
+
+func backupPartTask(request *restful.Request, id int64, kind string, part int, cursor string) *taskqueue.Task {
+	path := fmt.Sprint("/v1/tasks/backup/", id, "/", kind, "?", url.Values{"part": {strconv.Itoa(part)}, "cursor": {cursor}}.Encode())
+	return addRequestHeadersToTask(request.Request, taskqueue.NewPOSTTask(path, nil))
+}
+
+// encodeBackupRecord keeps the type of every property - JSON alone can't tell an int from a float, a time
+// from a string or a key from a string
+func encodeBackupRecord(key *datastore.Key, props datastore.PropertyList) BackupRecordAPIv1 {
+	record := BackupRecordAPIv1{Key: key.Encode(), Properties: make([]BackupPropertyAPIv1, len(props))}
+	for i, p := range props {
+		property := BackupPropertyAPIv1{Name: p.Name, Value: p.Value, NoIndex: p.NoIndex, Multiple: p.Multiple}
+		switch v := p.Value.(type) {
+		case nil:
+			property.Type = "null"
+		case int64:
+			property.Type = "int"
+			// beyond 2^53 a JSON number is not exact
+			property.Value = strconv.FormatInt(v, 10)
+		case bool:
+			property.Type = "bool"
+		case string:
+			property.Type = "string"
+		case float64:
+			property.Type = "float"
+		case time.Time:
+			property.Type = "time"
+			property.Value = v.UTC().Format(time.RFC3339Nano)
+		case []byte:
+			property.Type = "bytes"
+		case datastore.ByteString:
+			property.Type = "bytestring"
+			property.Value = []byte(v)
+		case *datastore.Key:
+			property.Type = "key"
+			property.Value = v.Encode()
+		case appengine.GeoPoint:
+			property.Type = "geo"
+		default:
+			property.Type = fmt.Sprintf("%T", v)
+		}
+		record.Properties[i] = property
+	}
+	return record
+}
+
+// writeBackupPart writes the entities of {kind} from the cursor on - returns the file and the cursor of the
+// next part ("" if the kind is complete)
+func writeBackupPart(ctx context.Context, bucket *storage.BucketHandle, object string, kind string, cursor string, deadline time.Time) (*BackupFileEntity, string, error) {
+	q := datastore.NewQuery(kind)
+	if cursor != "" {
+		c, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		q = q.Start(c)
+	}
+
+	w := bucket.Object(object).NewWriter(ctx)
+	w.ContentType = "application/x-ndjson"
+
+	// the hash and the size of what is written - the object is the same
+	hash := sha256.New()
+	counter := &countingWriter{}
+	encoder := json.NewEncoder(io.MultiWriter(w, hash, counter))
+
+	fileDB := &BackupFileEntity{Kind: kind, Object: object, Created: time.Now()}
+	complete := false
+	t := q.Run(ctx)
+	for fileDB.Entities < maxNumberOfEntitiesPerBackupPart && time.Now().Before(deadline) {
+		var props datastore.PropertyList
+		key, err := t.Next(&props)
+		if err == datastore.Done {
+			complete = true
+			break
+		}
+		if err != nil {
+			w.CloseWithError(err)
+			return nil, "", err
+		}
+		if err := encoder.Encode(encodeBackupRecord(key, props)); err != nil {
+			w.CloseWithError(err)
+			return nil, "", err
+		}
+		fileDB.Entities++
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	fileDB.Bytes = counter.n
+	fileDB.Hash = hex.EncodeToString(hash.Sum(nil))
+
+	if complete {
+		return fileDB, "", nil
+	}
+	next, err := t.Cursor()
+	if err != nil {
+		return nil, "", err
+	}
+	return fileDB, next.String(), nil
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+// processBackup is called by cron - starts a run with one task per kind
+func processBackup(request *restful.Request, response *restful.Response) {
+	ctx := newDefaultContext(request.Request)
+
+	bucketName, err := backupBucketName(ctx)
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	now := time.Now().UTC()
+	runDB := &BackupRunEntity{
+		Started: now,
+		Bucket:  bucketName,
+		Prefix:  fmt.Sprint(backupObjectPrefix, now.Format("20060102T150405Z"), "/"),
+	}
+	key, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, backupRunDBEntity, backupRunEntityRootKey(ctx)), runDB)
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	tasks := make([]*taskqueue.Task, len(backupKinds))
+	for i, kind := range backupKinds {
+		tasks[i] = backupPartTask(request, key.IntID(), kind, 0, "")
+	}
+	if _, err := taskqueue.AddMulti(ctx, tasks, backupQueue); err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	logInfof(ctx, "Backup %d started - gs://%s/%s", key.IntID(), runDB.Bucket, runDB.Prefix)
+
+	run := BackupRunAPIv1{Id: key.IntID()}
+	mapDBtoAPIBackupRun(runDB, &run)
+	response.WriteHeaderAndEntity(http.StatusOK, run)
+}
+
+// processBackupPart writes one part of {kind} and records it - in the same transaction the next part is queued
+// or the kind is marked as done. A retry of a recorded part does nothing.
+func processBackupPart(request *restful.Request, response *restful.Response) {
+	ctx := newDefaultContext(request.Request)
+
+	// task requests have a 10 minute deadline - the rest is written by the next part
+	const maxRunTime = 8 * time.Minute
+	deadline := time.Now().Add(maxRunTime)
+
+	id, err := strconv.ParseInt(request.PathParameter("id"), 10, 64)
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+	kind := request.PathParameter("kind")
+	part, err := strconv.Atoi(request.QueryParameter("part"))
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	runKey := backupRunEntityKey(ctx, id)
+	runDB := new(BackupRunEntity)
+	if err := datastore.Get(ctx, runKey, runDB); err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+	fileKey := backupFileEntityKey(ctx, runKey, kind, part)
+	if err := datastore.Get(ctx, fileKey, new(BackupFileEntity)); err == nil {
+		response.WriteHeaderAndEntity(http.StatusOK, "")
+		return
+	}
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+	defer client.Close()
+
+	object := fmt.Sprintf("%s%s-%04d.ndjson", runDB.Prefix, kind, part)
+	fileDB, next, err := writeBackupPart(ctx, client.Bucket(runDB.Bucket), object, kind, request.QueryParameter("cursor"), deadline)
+	if err != nil {
+		logErrorf(ctx, "Backup %d of %s part %d failed: %v", id, kind, part, err)
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+	fileDB.Part = part
+
+	err = datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		if _, err := datastore.Put(tc, fileKey, fileDB); err != nil {
+			return err
+		}
+		if next != "" {
+			_, err := taskqueue.Add(tc, backupPartTask(request, id, kind, part+1, next), backupQueue)
+			return err
+		}
+
+		current := new(BackupRunEntity)
+		if err := datastore.Get(tc, runKey, current); err != nil && !isErrFieldMismatch(err) {
+			return err
+		}
+		current.KindsDone = append(current.KindsDone, kind)
+		if len(current.KindsDone) == len(backupKinds) {
+			current.Finished = time.Now()
+		}
+		_, err := datastore.Put(tc, runKey, current)
+		return err
+	}, nil)
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	logInfof(ctx, "Backup %d of %s part %d: %d entities, %d bytes", id, kind, part, fileDB.Entities, fileDB.Bytes)
+	response.WriteHeaderAndEntity(http.StatusOK, "")
+}
+
+// getBackups lists the latest runs with their files - newest first
+func getBackups(request *restful.Request, response *restful.Response) {
+	ctx := newDefaultContext(request.Request)
+
+	limit := 10
+	if l := request.QueryParameter("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > 100 {
+			addError(request, response, http.StatusBadRequest, errorCode_BadRequest, "limit must be between 1 and 100")
+			return
+		}
+	}
+
+	var runOnDBList []BackupRunEntity
+	k, err := datastore.NewQuery(backupRunDBEntity).Ancestor(backupRunEntityRootKey(ctx)).Order("-Started").Limit(limit).GetAll(ctx, &runOnDBList)
+	if err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	var runList BackupRunAPIv1List
+	for i, runDB := range runOnDBList {
+		run := BackupRunAPIv1{Id: k[i].IntID()}
+		mapDBtoAPIBackupRun(&runDB, &run)
+
+		var fileOnDBList []BackupFileEntity
+		if _, err := datastore.NewQuery(backupFileDBEntity).Ancestor(k[i]).GetAll(ctx, &fileOnDBList); err != nil && !isErrFieldMismatch(err) {
+			commonResponseErrorProcessing(request, response, err)
+			return
+		}
+		for _, fileDB := range fileOnDBList {
+			var f BackupFileAPIv1
+			mapDBtoAPIBackupFile(&fileDB, &f)
+			run.Files = append(run.Files, f)
+			run.Entities += f.Entities
+			run.Bytes += f.Bytes
+		}
+		runList = append(runList, run)
+	}
+
+	writeListResponse(request, response, runList, len(runList), "")
+}
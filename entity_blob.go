@@ -0,0 +1,289 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/file"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Blob storage - binary payloads (chart images) above "blobThreshold" are stored in the default Cloud Storage
+// bucket of the app, the entity only keeps the object name. Every object is registered (blobentity) with its
+// owner, so objects which are no longer referenced (replaced, deleted, failed writes) can be garbage collected.
+// ---------------------------------------------------------------------------------------------------------------//
+type BlobEntity struct {
+	EntityType string
+	Owner      *datastore.Key
+	Claimed    bool
+	ChangeDate time.Time
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+type BlobGCAPIv1 struct {
+	Checked int `json:"checked"`
+	Deleted int `json:"deleted"`
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Data Storage View
+// ---------------------------------------------------------------------------------------------------------------//
+
+const blobDBEntity = "blobentity"
+
+// payloads up to this size stay in the entity
+const blobThreshold = 256 * 1024
+
+// payloads stored as blob are limited by the max. request size of GAE (32MB) - base64 and JSON included
+const maxBlobSize = 16 * 1000 * 1000
+
+const blobObjectPrefix = "blobs/"
+
+// entities with a binary payload which may be stored as blob
+type blobHolder interface {
+	blobPayload() (data *[]byte, ref *string)
+}
+
+func (db *ChartEntity) blobPayload() (*[]byte, *string) {
+	return &db.Image, &db.ImageBlob
+}
+
+func (db *GChartEntity) blobPayload() (*[]byte, *string) {
+	return &db.Image, &db.ImageBlob
+}
+
+// inlineBlobSize is the part of a payload of "size" bytes which is stored in the entity itself
+func inlineBlobSize(size int) int {
+	if size > blobThreshold {
+		return 0
+	}
+	return size
+}
+
+// supporting functions
+
+func blobEntityKey(ctx context.Context, object string) *datastore.Key {
+	return datastore.NewKey(ctx, blobDBEntity, object, 0, nil)
+}
+
+func blobBucket(ctx context.Context) (*storage.Client, *storage.BucketHandle, error) {
+	bucketName, err := file.DefaultBucketName(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, client.Bucket(bucketName), nil
+}
+
+func newBlobObjectName(owner *datastore.Key) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprint(blobObjectPrefix, owner.Kind(), "/", hex.EncodeToString(b)), nil
+}
+
+// offloadBlob moves a payload above the threshold to Cloud Storage - the blob is registered unclaimed
+// and only claimed once the owner is stored
+func offloadBlob(ctx context.Context, entityType string, owner *datastore.Key, db blobHolder) error {
+	data, ref := db.blobPayload()
+	if len(*data) <= blobThreshold {
+		return nil
+	}
+
+	object, err := newBlobObjectName(owner)
+	if err != nil {
+		return err
+	}
+
+	blob := BlobEntity{EntityType: entityType, Owner: owner, Claimed: false, ChangeDate: time.Now()}
+	if _, err := datastore.Put(ctx, blobEntityKey(ctx, object), &blob); err != nil {
+		return err
+	}
+
+	client, bucket, err := blobBucket(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	w := bucket.Object(object).NewWriter(ctx)
+	w.ContentType = "application/octet-stream"
+	if _, err := w.Write(*data); err != nil {
+		w.CloseWithError(err)
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	*data = nil
+	*ref = object
+	return nil
+}
+
+// loadBlob reads a payload stored in Cloud Storage back into the entity
+func loadBlob(ctx context.Context, db blobHolder) error {
+	data, ref := db.blobPayload()
+	if *ref == "" {
+		return nil
+	}
+
+	client, bucket, err := blobBucket(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	r, err := bucket.Object(*ref).NewReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	*data, err = ioutil.ReadAll(r)
+	return err
+}
+
+// changeBlobClaim marks a blob as used (after the owner is stored) or as no longer used (replaced)
+func changeBlobClaim(ctx context.Context, object string, claimed bool) {
+	if object == "" {
+		return
+	}
+	key := blobEntityKey(ctx, object)
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		var blob BlobEntity
+		if err := datastore.Get(tc, key, &blob); err != nil {
+			return err
+		}
+		blob.Claimed = claimed
+		blob.ChangeDate = time.Now()
+		_, err := datastore.Put(tc, key, &blob)
+		return err
+	}, nil)
+	if err != nil {
+		// not critical - the garbage collection checks the owner before deleting
+		logWarningf(ctx, "Claim of blob %s not changed to %v: %v", object, claimed, err)
+	}
+}
+
+// isBlobReferenced checks whether the owner or one of its revisions still points to the blob
+func isBlobReferenced(ctx context.Context, object string, blob *BlobEntity) (bool, error) {
+	sharedType, ok := sharedEntityTypes[blob.EntityType]
+	if !ok || blob.Owner == nil {
+		return false, nil
+	}
+	owner := sharedType.newEntity()
+	if err := getEntity(ctx, blob.Owner, owner); err != nil && err != datastore.ErrNoSuchEntity {
+		return false, err
+	} else if err == nil {
+		if holder, ok := owner.(blobHolder); ok {
+			if _, ref := holder.blobPayload(); *ref == object {
+				return true, nil
+			}
+		}
+	}
+	return isBlobInRevision(ctx, object)
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+// processBlobGC is called by cron - deletes all blobs which are unclaimed for longer than the grace period
+func processBlobGC(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	// the tenants are processed by their own tasks
+	if err := queueTenantRuns(request.Request); err != nil {
+		logErrorf(ctx, "Cron %s not queued for the tenants: %v", request.Request.URL.Path, err)
+	}
+
+	// cron requests have a 10 minute deadline - the rest is done by the next run
+	const maxRunTime = 8 * time.Minute
+	start := time.Now()
+
+	q := datastore.NewQuery(blobDBEntity).Filter("Claimed =", false).
+		Filter("ChangeDate <", time.Now().Add(-configDuration(ctx, Config_BlobGraceHours, time.Hour))).Order("ChangeDate")
+
+	client, bucket, err := blobBucket(ctx)
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+	defer client.Close()
+
+	var result BlobGCAPIv1
+	t := q.Run(ctx)
+	for time.Since(start) < maxRunTime {
+		var blob BlobEntity
+		key, err := t.Next(&blob)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil && !isErrFieldMismatch(err) {
+			commonResponseErrorProcessing(request, response, err)
+			return
+		}
+		result.Checked++
+
+		object := key.StringID()
+		referenced, err := isBlobReferenced(ctx, object, &blob)
+		if err != nil {
+			logWarningf(ctx, "Blob %s not checked: %v", object, err)
+			continue
+		}
+		if referenced {
+			// the claim after the owner's put failed - repair it
+			changeBlobClaim(ctx, object, true)
+			continue
+		}
+
+		if err := bucket.Object(object).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+			logWarningf(ctx, "Blob %s not deleted: %v", object, err)
+			continue
+		}
+		if err := datastore.Delete(ctx, key); err != nil {
+			commonResponseErrorProcessing(request, response, err)
+			return
+		}
+		result.Deleted++
+	}
+
+	logInfof(ctx, "Blob garbage collection - checked: %d, deleted: %d", result.Checked, result.Deleted)
+	response.WriteHeaderAndEntity(http.StatusOK, result)
+}
@@ -0,0 +1,173 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/appengine/datastore"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Bulk GET - a list of ids is read with one datastore call (e.g. syncing the favourites of a user),
+// ids which don't exist are returned as "missing" instead of failing the whole request
+// ---------------------------------------------------------------------------------------------------------------//
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+type ChartAPIv1Bulk struct {
+	Items   ChartAPIv1List `json:"items"`
+	Missing []string       `json:"missing"`
+}
+
+type GChartAPIv1Bulk struct {
+	Items   GChartAPIv1List `json:"items"`
+	Missing []string        `json:"missing"`
+}
+
+type UserMetricAPIv1Bulk struct {
+	Items   UserMetricAPIv1List `json:"items"`
+	Missing []string            `json:"missing"`
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Data Storage View
+// ---------------------------------------------------------------------------------------------------------------//
+
+// GetMulti allows 1000 keys - but the payloads (images) make the response large
+const maxNumberOfIdsPerBulkGet = 100
+
+// getSharedEntitiesByIds reads all entities of the comma separated {param} - the result is in the order
+// of the ids, "missing" contains the ids which don't exist
+func getSharedEntitiesByIds(request *restful.Request, response *restful.Response, entityType string, param string) ([]string, []sharedEntity, []string, bool) {
+	ctx := newContext(request.Request)
+
+	var ids []string
+	for _, id := range strings.Split(request.QueryParameter(param), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 || len(ids) > maxNumberOfIdsPerBulkGet {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, fmt.Sprint("Parameter '", param, "' must contain 1 to ", maxNumberOfIdsPerBulkGet, " comma separated values"))
+		return nil, nil, nil, false
+	}
+
+	sharedType := sharedEntityTypes[entityType]
+	keys := make([]*datastore.Key, len(ids))
+	entities := make([]sharedEntity, len(ids))
+	for i, id := range ids {
+		key, err := sharedType.key(ctx, id)
+		if err != nil {
+			addError(request, response, http.StatusBadRequest, errorCode_BadRequest, fmt.Sprint("Invalid id '", id, "' - ", err.Error()))
+			return nil, nil, nil, false
+		}
+		keys[i] = key
+		entities[i] = sharedType.newEntity()
+	}
+
+	found, err := getEntities(ctx, keys, func(i int) interface{} { return entities[i] })
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return nil, nil, nil, false
+	}
+
+	var foundIds []string
+	var foundEntities []sharedEntity
+	var missing []string
+	for i := range ids {
+		// unlisted entities of others are not told apart from missing ones
+		if !found[i] || !isListedOrOwned(ctx, request, entities[i].commonHeader()) {
+			missing = append(missing, ids[i])
+			continue
+		}
+		if holder, ok := entities[i].(blobHolder); ok && isFieldRequested(request, "image") {
+			if err := loadBlob(ctx, holder); err != nil {
+				commonResponseErrorProcessing(request, response, err)
+				return nil, nil, nil, false
+			}
+		}
+		foundIds = append(foundIds, ids[i])
+		foundEntities = append(foundEntities, entities[i])
+	}
+	return foundIds, foundEntities, missing, true
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+func getChartsByIds(request *restful.Request, response *restful.Response) {
+	ids, entities, missing, ok := getSharedEntitiesByIds(request, response, sharedTypeChart, "ids")
+	if !ok {
+		return
+	}
+
+	bulk := ChartAPIv1Bulk{Missing: missing}
+	for i, entity := range entities {
+		var chart ChartAPIv1
+		mapDBtoAPIChart(entity.(*ChartEntity), &chart)
+		chart.Header.Id, _ = strconv.ParseInt(ids[i], 10, 64)
+		bulk.Items = append(bulk.Items, chart)
+	}
+
+	writeEntity(request, response, http.StatusOK, &bulk)
+}
+
+func getGChartsByIds(request *restful.Request, response *restful.Response) {
+	ids, entities, missing, ok := getSharedEntitiesByIds(request, response, sharedTypeGChart, "ids")
+	if !ok {
+		return
+	}
+
+	bulk := GChartAPIv1Bulk{Missing: missing}
+	for i, entity := range entities {
+		var chart GChartAPIv1
+		mapDBtoAPIGChart(entity.(*GChartEntity), &chart)
+		chart.Header.Id, _ = strconv.ParseInt(ids[i], 10, 64)
+		bulk.Items = append(bulk.Items, chart)
+	}
+
+	writeEntity(request, response, http.StatusOK, &bulk)
+}
+
+func getUserMetricsByKeys(request *restful.Request, response *restful.Response) {
+	keys, entities, missing, ok := getSharedEntitiesByIds(request, response, sharedTypeUserMetric, "keys")
+	if !ok {
+		return
+	}
+
+	bulk := UserMetricAPIv1Bulk{Missing: missing}
+	for i, entity := range entities {
+		var metric UserMetricAPIv1
+		mapDBtoAPIUserMetric(entity.(*UserMetricEntity), &metric)
+		metric.Header.Key = keys[i]
+		bulk.Items = append(bulk.Items, metric)
+	}
+
+	writeEntity(request, response, http.StatusOK, &bulk)
+}
@@ -19,9 +19,16 @@
 package goldencheetah
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"net/http"
 	"time"
+	"strings"
+	"strconv"
+	"fmt"
 
+	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 
@@ -33,7 +40,7 @@ import (
 // Common Structures and Functions for all CloudDB entities
 // ---------------------------------------------------------------------------------------------------------------//
 type CommonEntityHeader struct {
-	Name        string       `datastore:",noindex"`
+	Name        string       // indexed for the metadata projection - see "conditional.go"
 	Description string       `datastore:",noindex"`
 	Language    string       `datastore:",noindex"`
 	GcVersion   string
@@ -41,6 +48,18 @@ type CommonEntityHeader struct {
 	CreatorId   string
 	Curated     bool
 	Deleted     bool
+	CurationState   string
+	CurationComment string   `datastore:",noindex"`
+	Tags            []string
+	RatingCount     int      `datastore:",noindex"`
+	RatingAverage   float64
+	PayloadHash     string   // SHA-256 of the payload (hex) - identical payloads are only stored once
+	OwnerId         string   // client id of the creating installation - see "entity_owner.go"
+	Trashed         time.Time // set while a deleted entity can still be restored - see "entity_trash.go"
+	PayloadSize     int       // bytes of the payload - 0 if stored before the size was recorded
+	StarCount       int       `datastore:",noindex"` // clients which starred the entity - see "entity_star.go"
+	Unlisted        bool      `datastore:",noindex"` // not listed or searchable, readable by share links - see "entity_share.go"
+	MergedInto      string    `datastore:",noindex"` // id of the canonical entity of a merged duplicate - see "entity_duplicate.go"
 }
 
 // Internal Structure for Header
@@ -55,6 +74,25 @@ type CommonAPIHeaderV1 struct {
 	Language    string      `json:"language"`
 	Curated     bool        `json:"curated"`
 	Deleted     bool        `json:"deleted"`
+	CurationState   string  `json:"curationState"`
+	CurationComment string  `json:"curationComment"`
+	Tags            []string `json:"tags"`
+	RatingCount     int     `json:"ratingCount"`
+	RatingAverage   float64 `json:"ratingAverage"`
+	PayloadSize     int     `json:"size"`    // output only
+	PayloadHash     string  `json:"hash"`    // output only
+	StarCount       int     `json:"starCount"` // output only
+	Unlisted        bool    `json:"unlisted"`  // charts and gcharts only
+	MergedInto      string  `json:"mergedInto"` // output only
+}
+
+// Header only structures - valid for all entities with a CommonEntityHeader
+type CommonEntityHeaderOnly struct {
+	Header CommonEntityHeader
+}
+
+type CommonAPIHeaderOnlyV1 struct {
+	Header CommonAPIHeaderV1 `json:"header"`
 }
 
 func mapAPItoDBCommonHeader(api *CommonAPIHeaderV1, db *CommonEntityHeader) {
@@ -66,6 +104,10 @@ func mapAPItoDBCommonHeader(api *CommonAPIHeaderV1, db *CommonEntityHeader) {
 	db.CreatorId = api.CreatorId
 	db.Curated = api.Curated
 	db.Deleted = api.Deleted
+	db.CurationState = api.CurationState
+	db.CurationComment = api.CurationComment
+	db.Tags = normalizeTags(api.Tags)
+	db.Unlisted = api.Unlisted
 }
 
 func mapDBtoAPICommonHeader(db *CommonEntityHeader, api *CommonAPIHeaderV1) {
@@ -77,22 +119,314 @@ func mapDBtoAPICommonHeader(db *CommonEntityHeader, api *CommonAPIHeaderV1) {
 	api.CreatorId = db.CreatorId
 	api.Curated = db.Curated
 	api.Deleted = db.Deleted
+	api.CurationState = curationState(db)
+	api.CurationComment = db.CurationComment
+	api.Tags = db.Tags
+	api.RatingCount = db.RatingCount
+	api.RatingAverage = db.RatingAverage
+	api.PayloadSize = db.PayloadSize
+	api.PayloadHash = db.PayloadHash
+	api.StarCount = db.StarCount
+	api.Unlisted = db.Unlisted
+	api.MergedInto = db.MergedInto
+}
+
+// payloadHash is the SHA-256 of all payload parts - the length prefix keeps "ab"+"c" and "a"+"bc" apart
+func payloadHash(parts ...[]byte) string {
+	h := sha256.New()
+	for _, part := range parts {
+		binary.Write(h, binary.BigEndian, int64(len(part)))
+		h.Write(part)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// findDuplicate returns the key of a not deleted, listed entity with the same payload - or nil. Unlisted entities
+// are never returned, their id would be given to anyone posting the same payload ("unlisted" is not indexed).
+func findDuplicate(ctx context.Context, kind string, hash string) (*datastore.Key, error) {
+	const maxNumberOfDuplicates = 10
+
+	var headerOnDBList []CommonEntityHeaderOnly
+	keys, err := datastore.NewQuery(kind).Filter("Header.PayloadHash =", hash).Filter("Header.Deleted =", false).
+		Limit(maxNumberOfDuplicates).GetAll(ctx, &headerOnDBList)
+	if err != nil && !isErrFieldMismatch(err) {
+		return nil, err
+	}
+	for i := range keys {
+		if !headerOnDBList[i].Header.Unlisted {
+			return keys[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func validateCommonHeader(v *validator, api *CommonAPIHeaderV1) {
+	v.required("header.name", api.Name)
+	v.required("header.creatorId", api.CreatorId)
+	v.required("header.gcversion", api.GcVersion)
+	v.maxLength("header.name", api.Name, 500)
+	v.dateTime("header.lastChange", api.LastChanged)
+	if api.CurationState != "" {
+		if _, ok := curationTransitions[api.CurationState]; !ok {
+			v.fail("header.curationState", "is not a valid curation state")
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Shared entity types - generic access to all entities with a CommonEntityHeader (flags, ratings,...)
+// ---------------------------------------------------------------------------------------------------------------//
+const (
+	sharedTypeChart      = "chart"
+	sharedTypeGChart     = "gchart"
+	sharedTypeUserMetric = "usermetric"
+)
+
+type sharedEntity interface {
+	commonHeader() *CommonEntityHeader
+	creatorNick() string
+	clearPayload()
+}
+
+type sharedEntityType struct {
+	kind      string
+	newEntity func() sharedEntity
+	key       func(ctx context.Context, id string) (*datastore.Key, error)
+}
+
+var sharedEntityTypes = map[string]sharedEntityType{
+	sharedTypeChart: {
+		kind:      chartDBEntity,
+		newEntity: func() sharedEntity { return new(ChartEntity) },
+		key: func(ctx context.Context, id string) (*datastore.Key, error) {
+			i, err := strconv.ParseInt(id, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			return chartEntityKey(ctx, i), nil
+		},
+	},
+	sharedTypeGChart: {
+		kind:      gChartDBEntity,
+		newEntity: func() sharedEntity { return new(GChartEntity) },
+		key: func(ctx context.Context, id string) (*datastore.Key, error) {
+			i, err := strconv.ParseInt(id, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			return gchartEntityKey(ctx, i), nil
+		},
+	},
+	sharedTypeUserMetric: {
+		kind:      usermetricDBEntity,
+		newEntity: func() sharedEntity { return new(UserMetricEntity) },
+		key: func(ctx context.Context, id string) (*datastore.Key, error) {
+			if id == "" {
+				return nil, fmt.Errorf("Mandatory Key is missing or invalid")
+			}
+			return usermetricEntityKey(ctx, id), nil
+		},
+	},
+}
+
+// sharedEntityId returns the id as used in the API - usermetrics are identified by a string key
+func sharedEntityId(key *datastore.Key) string {
+	if key.StringID() != "" {
+		return key.StringID()
+	}
+	return strconv.FormatInt(key.IntID(), 10)
+}
+
+func (db *ChartEntity) commonHeader() *CommonEntityHeader      { return &db.Header }
+func (db *GChartEntity) commonHeader() *CommonEntityHeader     { return &db.Header }
+func (db *UserMetricEntity) commonHeader() *CommonEntityHeader { return &db.Header }
+
+func (db *ChartEntity) creatorNick() string      { return db.CreatorNick }
+func (db *GChartEntity) creatorNick() string     { return db.CreatorNick }
+func (db *UserMetricEntity) creatorNick() string { return db.CreatorNick }
+
+// clearPayload removes the content of a deleted entity - the header stays for the clients' sync
+func (db *ChartEntity) clearPayload() {
+	db.ChartXML = ""
+	db.Image = nil
+	db.ImageBlob = ""
+	db.Header.PayloadSize = 0
+}
+
+func (db *GChartEntity) clearPayload() {
+	db.ChartType = ""
+	db.ChartView = ""
+	db.ChartDef = ""
+	db.Image = nil
+	db.ImageBlob = ""
+	db.Header.PayloadSize = 0
+}
+
+func (db *UserMetricEntity) clearPayload() {
+	db.MetricXML = ""
+	db.Header.PayloadSize = 0
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Curation workflow - Submitted -> UnderReview -> Approved/Rejected
+// ---------------------------------------------------------------------------------------------------------------//
+const (
+	CurationState_Submitted   = "Submitted"
+	CurationState_UnderReview = "UnderReview"
+	CurationState_Approved    = "Approved"
+	CurationState_Rejected    = "Rejected"
+)
+
+// legal transitions - approved or rejected content can only be re-opened for review
+var curationTransitions = map[string][]string{
+	CurationState_Submitted:   {CurationState_UnderReview},
+	CurationState_UnderReview: {CurationState_Approved, CurationState_Rejected},
+	CurationState_Approved:    {CurationState_UnderReview},
+	CurationState_Rejected:    {CurationState_UnderReview},
+}
+
+// Structure for the PUT of a new curation state
+type CurationTransitionAPIv1 struct {
+	State   string `json:"state"`
+	Comment string `json:"comment"`
 }
 
-func commonResponseErrorProcessing(response *restful.Response, err error) {
+// entities stored before the workflow was introduced only know the "Curated" flag
+func curationState(db *CommonEntityHeader) string {
+	if db.CurationState != "" {
+		return db.CurationState
+	}
+	if db.Curated {
+		return CurationState_Approved
+	}
+	return CurationState_Submitted
+}
+
+func initialCurationState(curated bool) string {
+	if curated {
+		return CurationState_Approved
+	}
+	return CurationState_Submitted
+}
+
+func transitionCurationState(db *CommonEntityHeader, transition *CurationTransitionAPIv1) error {
+	current := curationState(db)
+	for _, legal := range curationTransitions[current] {
+		if legal == transition.State {
+			db.CurationState = transition.State
+			db.CurationComment = transition.Comment
+			db.Curated = transition.State == CurationState_Approved
+			db.LastChanged = time.Now()
+			return nil
+		}
+	}
+	return fmt.Errorf("Transition from %s to %s is not allowed", current, transition.State)
+}
+
+// public lists only contain approved content - unless "curationState" requests another state or "all"
+func curationStateParameter(request *restful.Request) string {
+	state := request.QueryParameter("curationState")
+	switch state {
+	case "":
+		return CurationState_Approved
+	case "all":
+		return ""
+	}
+	return state
+}
+
+func isCurationStateSelected(db *CommonEntityHeader, selectedState string) bool {
+	return selectedState == "" || curationState(db) == selectedState
+}
+
+func commonResponseErrorProcessing(request *restful.Request, response *restful.Response, err error) {
 	switch {
 	case appengine.IsOverQuota(err):
 		// return 503 and a text similar to what GAE is returning as well
-		addPlainTextError(response, http.StatusServiceUnavailable, "503 - Over Quota")
+		addError(request, response, http.StatusServiceUnavailable, errorCode_OverQuota, "503 - Over Quota")
 	case err == datastore.ErrNoSuchEntity:
-		addPlainTextError(response, http.StatusNotFound, err.Error())
+		addError(request, response, http.StatusNotFound, errorCode_NotFound, err.Error())
+	case isEntityTooLarge(err):
+		addEntityTooLargeError(request, response, err)
+	case isTransientDatastoreError(err):
+		addDatastoreError(request, response, err)
 	default:
-		addPlainTextError(response, http.StatusBadRequest, err.Error())
+		addError(request, response, http.StatusBadRequest, errorCode_Datastore, err.Error())
 	}
 }
 
 
 
+// ---------------------------------------------------------------------------------------------------------------//
+// List Envelope - optional wrapper for list responses (requested by "envelope=true" or "Accept-Profile: envelope")
+// ---------------------------------------------------------------------------------------------------------------//
+type ListEnvelopeAPIv1 struct {
+	Items       interface{} `json:"items"`
+	NextCursor  string      `json:"nextCursor"`
+	TotalApprox int         `json:"totalApprox"`
+	GeneratedAt string      `json:"generatedAt"`
+}
+
+const envelopeParameter = "envelope"
+const envelopeProfileHeader = "Accept-Profile"
+const envelopeProfile = "envelope"
+
+// the bare list remains the default response for existing GoldenCheetah clients
+func isEnvelopeRequested(request *restful.Request) bool {
+	if strings.EqualFold(request.QueryParameter(envelopeParameter), "true") {
+		return true
+	}
+	return strings.EqualFold(request.HeaderParameter(envelopeProfileHeader), envelopeProfile)
+}
+
+func writeListResponse(request *restful.Request, response *restful.Response, items interface{}, totalApprox int, nextCursor string) {
+	if v2, ok := items.(apiV2Writable); ok && isAPIv2(request) {
+		items = v2.toV2()
+	}
+	if fields := fieldsParameter(request); len(fields) > 0 {
+		if projected, err := projectFields(items, fields); err == nil {
+			items = projected
+		}
+	}
+	if !isEnvelopeRequested(request) {
+		response.WriteHeaderAndEntity(http.StatusOK, items)
+		return
+	}
+
+	var envelope ListEnvelopeAPIv1
+	envelope.Items = items
+	envelope.NextCursor = nextCursor
+	envelope.TotalApprox = totalApprox
+	envelope.GeneratedAt = time.Now().UTC().Format(dateTimeLayout)
+
+	response.WriteHeaderAndEntity(http.StatusOK, envelope)
+}
+
+// continue a previous list call at the position returned as "nextCursor"
+func applyCursorParameter(request *restful.Request, q *datastore.Query) (*datastore.Query, error) {
+	cursorString := request.QueryParameter("cursor")
+	if cursorString == "" {
+		return q, nil
+	}
+	cursor, err := datastore.DecodeCursor(cursorString)
+	if err != nil {
+		return q, err
+	}
+	return q.Start(cursor), nil
+}
+
+// a cursor is only returned if the bucket was filled completely - so there may be more data
+func nextCursor(t *datastore.Iterator, count int, limit int) string {
+	if count < limit {
+		return ""
+	}
+	cursor, err := t.Cursor()
+	if err != nil {
+		return ""
+	}
+	return cursor.String()
+}
+
 // ignore missing fields error when mapping to Header struct
 func isErrFieldMismatch(err error) bool {
 	_, ok := err.(*datastore.ErrFieldMismatch)
@@ -0,0 +1,262 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Configuration (configentity) which is stored in DB - one entity per setting which differs from its default.
+// Only the settings registered in "configSettings" exist, every one with default and limits, so the service
+// can be tuned without deploy but not broken by a typo.
+// ---------------------------------------------------------------------------------------------------------------//
+type ConfigEntity struct {
+	Value      int
+	ChangeDate time.Time
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+type ConfigAPIv1 struct {
+	Name         string `json:"name"`
+	Value        int    `json:"value"`
+	DefaultValue int    `json:"defaultValue"`
+	Min          int    `json:"min"`
+	Max          int    `json:"max"`
+	Description  string `json:"description"`
+	ChangeDate   string `json:"changeDate"` // empty while the default applies
+}
+
+type ConfigAPIv1List []ConfigAPIv1
+
+// PUT - only the listed settings are changed, null resets a setting to its default
+type ConfigPutAPIv1 map[string]*int
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Memcache constants
+// ---------------------------------------------------------------------------------------------------------------//
+
+const configMemcacheKey = "config"
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Data Storage View
+// ---------------------------------------------------------------------------------------------------------------//
+
+const configDBEntity = "configentity"
+const configDBEntityRootKey = "configroot"
+
+const (
+	Config_FlagThreshold      = "flagThreshold"
+	Config_TrashRetentionDays = "trashRetentionDays"
+	Config_MaxRevisions       = "maxRevisions"
+	Config_BlobGraceHours     = "blobGraceHours"
+	Config_SyncSettleSeconds  = "syncSettleSeconds"
+	Config_UploadSessionHours = "uploadSessionHours"
+	Config_CacheTTLSeconds    = "cacheTTLSeconds"
+	Config_MaxRequestKB       = "maxRequestKB"
+	Config_MaxContentKB       = "maxContentKB"
+)
+
+type configSetting struct {
+	defaultValue int
+	min          int
+	max          int
+	description  string
+}
+
+var configSettings = map[string]configSetting{
+	Config_FlagThreshold:      {flagThresholdDefault, 1, 1000, "number of flags after which shared content is hidden until reviewed - the default is Flag_Threshold of app.yaml"},
+	Config_TrashRetentionDays: {30, 1, 365, "days a deleted entity can be restored before its payload is purged"},
+	Config_MaxRevisions:       {20, 1, 100, "number of revisions kept per entity"},
+	Config_BlobGraceHours:     {24, 1, 24 * 30, "hours an unclaimed blob is kept before the garbage collection deletes it"},
+	Config_SyncSettleSeconds:  {10, 1, 300, "seconds a change must be old to be returned by /sync - the eventual consistency of the change log"},
+	Config_UploadSessionHours: {24, 1, 24 * 7, "hours a chunked upload session is kept without a new chunk"},
+	Config_CacheTTLSeconds:    {0, 0, 24 * 60 * 60, "max. age of the cached status, version and maintenance mode - 0 until the next change"},
+	Config_MaxRequestKB:       {256, 1, 32 * 1024, "max. request body in KB - all routes without content (see maxContentKB)"},
+	Config_MaxContentKB:       {16 * 1024, 1, 32 * 1024, "max. request body in KB of the routes with content (charts, gcharts, usermetrics, telemetry, uploads)"},
+}
+
+func mapDBtoAPIConfig(name string, db *ConfigEntity, api *ConfigAPIv1) {
+	setting := configSettings[name]
+	api.Name = name
+	api.Value = setting.defaultValue
+	api.DefaultValue = setting.defaultValue
+	api.Min = setting.min
+	api.Max = setting.max
+	api.Description = setting.description
+	if db != nil {
+		api.Value = db.Value
+		api.ChangeDate = db.ChangeDate.Format(dateTimeLayout)
+	}
+}
+
+func validateConfig(api ConfigPutAPIv1) *validator {
+	v := new(validator)
+	for name, value := range api {
+		setting, ok := configSettings[name]
+		if !ok {
+			v.fail(name, "is not a known setting")
+			continue
+		}
+		if value != nil && (*value < setting.min || *value > setting.max) {
+			v.fail(name, fmt.Sprint("must be between ", setting.min, " and ", setting.max))
+		}
+	}
+	return v
+}
+
+// supporting functions
+
+func configEntityRootKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, configDBEntity, configDBEntityRootKey, 0, nil)
+}
+
+// configValues returns the changed settings - cached until the next PUT
+func configValues(ctx context.Context) map[string]ConfigEntity {
+	values := make(map[string]ConfigEntity)
+	_, err := memcache.Gob.Get(ctx, configMemcacheKey, &values)
+	countCacheLookup("config", err == nil)
+	if err == nil {
+		return values
+	}
+
+	var configOnDBList []ConfigEntity
+	k, err := datastore.NewQuery(configDBEntity).Ancestor(configEntityRootKey(ctx)).GetAll(ctx, &configOnDBList)
+	if err != nil && !isErrFieldMismatch(err) {
+		// the defaults are always a valid configuration
+		logWarningf(ctx, "Configuration not read - using the defaults: %v", err)
+		return values
+	}
+	for i, configDB := range configOnDBList {
+		values[k[i].StringID()] = configDB
+	}
+
+	// add to memcache / overwrite existing / ignore errors
+	memcache.Gob.Set(ctx, &memcache.Item{Key: configMemcacheKey, Object: values})
+	return values
+}
+
+// configValue returns the setting only if it was changed
+func configValue(ctx context.Context, name string) (int, bool) {
+	value, ok := configValues(ctx)[name]
+	return value.Value, ok
+}
+
+// configInt returns the setting or its default
+func configInt(ctx context.Context, name string) int {
+	if value, ok := configValue(ctx, name); ok {
+		return value
+	}
+	return configSettings[name].defaultValue
+}
+
+// configDuration returns the setting in "unit"
+func configDuration(ctx context.Context, name string, unit time.Duration) time.Duration {
+	return time.Duration(configInt(ctx, name)) * unit
+}
+
+// cacheExpiration is the expiration for memcache items which are replaced on change
+func cacheExpiration(ctx context.Context) time.Duration {
+	return configDuration(ctx, Config_CacheTTLSeconds, time.Second)
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+func getConfig(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	values := configValues(ctx)
+
+	var names []string
+	for name := range configSettings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var configList ConfigAPIv1List
+	for _, name := range names {
+		var config ConfigAPIv1
+		if value, ok := values[name]; ok {
+			mapDBtoAPIConfig(name, &value, &config)
+		} else {
+			mapDBtoAPIConfig(name, nil, &config)
+		}
+		configList = append(configList, config)
+	}
+
+	writeListResponse(request, response, configList, len(configList), "")
+}
+
+func updateConfig(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	config := make(ConfigPutAPIv1)
+	if err := request.ReadEntity(&config); err != nil {
+		addError(request, response, http.StatusInternalServerError, errorCode_InvalidPayload, err.Error())
+		return
+	}
+
+	if v := validateConfig(config); !v.valid() {
+		addValidationError(request, response, v)
+		return
+	}
+
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		for name, value := range config {
+			key := datastore.NewKey(tc, configDBEntity, name, 0, configEntityRootKey(tc))
+			if value == nil {
+				if err := datastore.Delete(tc, key); err != nil && err != datastore.ErrNoSuchEntity {
+					return err
+				}
+				continue
+			}
+			if _, err := datastore.Put(tc, key, &ConfigEntity{Value: *value, ChangeDate: time.Now()}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	// the next read fills the cache again / ignore errors
+	memcache.Delete(ctx, configMemcacheKey)
+
+	logInfof(ctx, "Configuration changed: %d settings", len(config))
+
+	// Response is Empty for 204
+	response.WriteHeaderAndEntity(http.StatusNoContent, "")
+}
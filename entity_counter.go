@@ -0,0 +1,356 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Sharded counter (countershardentity) - every shard is its own entity group, so concurrent increments
+// of the same counter don't collide
+// ---------------------------------------------------------------------------------------------------------------//
+type CounterShardEntity struct {
+	Name  string
+	Count int64          `datastore:",noindex"`
+}
+
+// Consolidated download total per entity (downloadentity) - written by cron, used for sorting only
+type DownloadEntity struct {
+	EntityType string
+	EntityId   string
+	Count      int64
+}
+
+// Position of the consolidation (downloadrunentity) - a run which doesn't finish within the cron deadline is
+// continued by the next one
+type DownloadRunEntity struct {
+	Cursor       string    `datastore:",noindex"` // start of the first counter not consolidated - empty if done
+	LastRun      time.Time `datastore:",noindex"`
+	Consolidated int       `datastore:",noindex"` // totals written since the run started
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+type DownloadAPIv1 struct {
+	Header    CommonAPIHeaderV1 `json:"header"`
+	Downloads int64             `json:"downloads"`
+}
+
+type DownloadAPIv1List []DownloadAPIv1
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Data Storage View
+// ---------------------------------------------------------------------------------------------------------------//
+
+const counterShardDBEntity = "countershardentity"
+const downloadDBEntity = "downloadentity"
+const downloadRunDBEntity = "downloadrunentity"
+const downloadRunDBEntityCurrent = "current"
+
+const counterShards = 20
+const counterMemcachePrefix = "counter/"
+const downloadCounterPrefix = "download/"
+
+// supporting functions
+
+func counterShardKey(ctx context.Context, name string, shard int) *datastore.Key {
+	return datastore.NewKey(ctx, counterShardDBEntity, fmt.Sprint(name, "#", shard), 0, nil)
+}
+
+func downloadRunEntityKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, downloadRunDBEntity, downloadRunDBEntityCurrent, 0, nil)
+}
+
+// putDownloadTotals writes the totals by counter name - PutMulti is limited to 500 entities per call
+func putDownloadTotals(ctx context.Context, totals map[string]int64) (int, error) {
+	const maxNumberOfEntitiesPerPut = 500
+
+	var keys []*datastore.Key
+	var downloads []DownloadEntity
+	for name, count := range totals {
+		// name is "download/<type>/<id>"
+		parts := strings.SplitN(strings.TrimPrefix(name, downloadCounterPrefix), "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		keys = append(keys, datastore.NewKey(ctx, downloadDBEntity, name, 0, nil))
+		downloads = append(downloads, DownloadEntity{EntityType: parts[0], EntityId: parts[1], Count: count})
+	}
+
+	for start := 0; start < len(keys); start += maxNumberOfEntitiesPerPut {
+		end := start + maxNumberOfEntitiesPerPut
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if _, err := datastore.PutMulti(ctx, keys[start:end], downloads[start:end]); err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), nil
+}
+
+func downloadCounterName(entityType string, id string) string {
+	return fmt.Sprint(downloadCounterPrefix, entityType, "/", id)
+}
+
+// incrementCounter adds 1 to a random shard - the cached total is only incremented if it exists
+func incrementCounter(ctx context.Context, name string) error {
+	key := counterShardKey(ctx, name, rand.Intn(counterShards))
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		var shard CounterShardEntity
+		if err := datastore.Get(tc, key, &shard); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		shard.Name = name
+		shard.Count++
+		_, err := datastore.Put(tc, key, &shard)
+		return err
+	}, nil)
+	if err != nil {
+		return err
+	}
+	memcache.IncrementExisting(ctx, counterMemcachePrefix+name, 1)
+	return nil
+}
+
+// counterValue sums all shards of a counter
+func counterValue(ctx context.Context, name string) (int64, error) {
+	item, err := memcache.Get(ctx, counterMemcachePrefix+name)
+	countCacheLookup("counter", err == nil)
+	if err == nil {
+		if total, err := strconv.ParseInt(string(item.Value), 10, 64); err == nil {
+			return total, nil
+		}
+	}
+
+	keys := make([]*datastore.Key, counterShards)
+	for i := range keys {
+		keys[i] = counterShardKey(ctx, name, i)
+	}
+	shards := make([]CounterShardEntity, counterShards)
+	if err := datastore.GetMulti(ctx, keys, shards); err != nil {
+		multiErr, ok := err.(appengine.MultiError)
+		if !ok {
+			return 0, err
+		}
+		for _, e := range multiErr {
+			if e != nil && e != datastore.ErrNoSuchEntity {
+				return 0, err
+			}
+		}
+	}
+
+	var total int64
+	for _, shard := range shards {
+		total += shard.Count
+	}
+
+	// add to memcache / ignore errors
+	memcache.Set(ctx, &memcache.Item{Key: counterMemcachePrefix + name, Value: []byte(strconv.FormatInt(total, 10))})
+
+	return total, nil
+}
+
+// countDownload is called for every payload GET - a failing counter must not fail the GET
+func countDownload(ctx context.Context, entityType string, id string) int64 {
+	name := downloadCounterName(entityType, id)
+	if err := incrementCounter(ctx, name); err != nil {
+		logWarningf(ctx, "Download of %s %s not counted: %v", entityType, id, err)
+	}
+	total, _ := counterValue(ctx, name)
+	return total
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+// processDownloads is called by cron - consolidates the download shards to one total per entity, bucket by
+// bucket in the order of the counter names. The shards of a counter are never split: a bucket ends before the
+// counter it couldn't read completely, so the cursor always points to the first shard of a counter.
+func processDownloads(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	// the tenants are processed by their own tasks
+	if err := queueTenantRuns(request.Request); err != nil {
+		logErrorf(ctx, "Cron %s not queued for the tenants: %v", request.Request.URL.Path, err)
+	}
+
+	const maxNumberOfShardsPerBucket = 1000 // a multiple of "counterShards"
+	const maxRunTime = 8 * time.Minute     // cron requests are stopped after 10 minutes
+
+	start := time.Now()
+
+	var runDB DownloadRunEntity
+	if err := datastore.Get(ctx, downloadRunEntityKey(ctx), &runDB); err != nil && err != datastore.ErrNoSuchEntity && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+	if runDB.Cursor == "" {
+		runDB.Consolidated = 0
+	}
+
+	consolidated := 0
+	for time.Since(start) < maxRunTime {
+		// all download counters - '0' is the character after '/'
+		bucket := datastore.NewQuery(counterShardDBEntity).Filter("Name >=", downloadCounterPrefix).
+			Filter("Name <", strings.TrimSuffix(downloadCounterPrefix, "/")+"0").Order("Name").Limit(maxNumberOfShardsPerBucket)
+		if runDB.Cursor != "" {
+			if cursor, err := datastore.DecodeCursor(runDB.Cursor); err == nil {
+				bucket = bucket.Start(cursor)
+			}
+		}
+
+		totals := make(map[string]int64)
+		current := ""
+		var currentStart datastore.Cursor
+		read := 0
+		t := bucket.Run(ctx)
+		for {
+			position, err := t.Cursor()
+			if err != nil {
+				commonResponseErrorProcessing(request, response, err)
+				return
+			}
+			var shard CounterShardEntity
+			_, err = t.Next(&shard)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil && !isErrFieldMismatch(err) {
+				commonResponseErrorProcessing(request, response, err)
+				return
+			}
+			read++
+			if shard.Name != current {
+				current, currentStart = shard.Name, position
+			}
+			totals[shard.Name] += shard.Count
+		}
+
+		// a full bucket may end within the shards of the last counter - it's read again by the next bucket
+		runDB.Cursor = ""
+		if read == maxNumberOfShardsPerBucket {
+			delete(totals, current)
+			runDB.Cursor = currentStart.String()
+		}
+
+		n, err := putDownloadTotals(ctx, totals)
+		if err != nil {
+			commonResponseErrorProcessing(request, response, err)
+			return
+		}
+		consolidated += n
+		runDB.Consolidated += n
+		runDB.LastRun = time.Now()
+		if _, err := datastore.Put(ctx, downloadRunEntityKey(ctx), &runDB); err != nil {
+			commonResponseErrorProcessing(request, response, err)
+			return
+		}
+
+		if runDB.Cursor == "" {
+			break
+		}
+	}
+
+	logInfof(ctx, "Downloads: %d totals consolidated (continued by the next run: %t)", consolidated, runDB.Cursor != "")
+	response.WriteHeaderAndEntity(http.StatusOK, consolidated)
+}
+
+func getTopCharts(request *restful.Request, response *restful.Response) {
+	getTopSharedEntities(request, response, sharedTypeChart)
+}
+
+func getTopGCharts(request *restful.Request, response *restful.Response) {
+	getTopSharedEntities(request, response, sharedTypeGChart)
+}
+
+// ------------------- supporting functions ------------------------------------------------
+
+func getTopSharedEntities(request *restful.Request, response *restful.Response, entityType string) {
+	ctx := newContext(request.Request)
+
+	const maxNumberOfTopEntities = 100
+
+	n := 25
+	if nString := request.QueryParameter("n"); nString != "" {
+		if i, err := strconv.Atoi(nString); err == nil && i > 0 && i <= maxNumberOfTopEntities {
+			n = i
+		}
+	}
+
+	q := datastore.NewQuery(downloadDBEntity).Filter("EntityType =", entityType).Order("-Count").Limit(n)
+
+	var downloadOnDBList []DownloadEntity
+	if _, err := q.GetAll(ctx, &downloadOnDBList); err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	sharedType := sharedEntityTypes[entityType]
+	var keys []*datastore.Key
+	var counts []int64
+	for _, downloadDB := range downloadOnDBList {
+		if key, err := sharedType.key(ctx, downloadDB.EntityId); err == nil {
+			keys = append(keys, key)
+			counts = append(counts, downloadDB.Count)
+		}
+	}
+
+	headers := make([]CommonEntityHeaderOnly, len(keys))
+	err := datastore.GetMulti(ctx, keys, headers)
+	multiErr, _ := err.(appengine.MultiError)
+	if err != nil && multiErr == nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	var topList DownloadAPIv1List
+	for i, headerDB := range headers {
+		if multiErr != nil && multiErr[i] != nil && !isErrFieldMismatch(multiErr[i]) {
+			continue
+		}
+		if headerDB.Header.Deleted || headerDB.Header.Unlisted {
+			continue
+		}
+		var top DownloadAPIv1
+		mapDBtoAPICommonHeader(&headerDB.Header, &top.Header)
+		top.Header.Id = keys[i].IntID()
+		top.Downloads = counts[i]
+		topList = append(topList, top)
+	}
+
+	response.WriteHeaderAndEntity(http.StatusOK, topList)
+}
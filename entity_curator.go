@@ -19,8 +19,12 @@
 package goldencheetah
 
 import (
+	"crypto/hmac"
+	"errors"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
 
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
@@ -32,13 +36,16 @@ import (
 
 
 // ---------------------------------------------------------------------------------------------------------------//
-// Golden Cheetah curator (curatorentity) which is stored in DB
+// Golden Cheetah curator (curatorentity) which is stored in DB - the curatorId is unique, the caller identifies
+// with it and its secret (an HMAC of the id like the client secrets, see "entity_owner.go") which is returned
+// once by POST /curator. Curators registered before the secrets existed get it from an admin.
 // ---------------------------------------------------------------------------------------------------------------//
 type CuratorEntity struct {
 	CuratorId       string
 	Nickname	string
 	Email           string
-
+	Roles           []string  // empty for curators registered before roles existed - see "curatorRoles"
+	RolesAssigned   bool      `datastore:",noindex"` // the roles are granted by admins - no roles means no rights
 }
 
 // ---------------------------------------------------------------------------------------------------------------//
@@ -51,6 +58,8 @@ type CuratorAPIv1 struct {
 	CuratorId       string      `json:"curatorId"`
 	Nickname        string      `json:"nickname"`
 	Email           string      `json:"email"`
+	Roles           []string    `json:"roles"` // output only - see "/curator/{id}/roles/{role}"
+	Secret          string      `json:"secret,omitempty"` // output only - see "/curator/{id}/secret"
 }
 
 type CuratorAPIv1List []CuratorAPIv1
@@ -63,6 +72,26 @@ type CuratorAPIv1List []CuratorAPIv1
 const curatorDBEntity = "curatorentity"
 const curatorDBEntityRootKey = "curatorroot"
 
+// roles - every role includes the rights of the roles below it
+const (
+	Role_Admin   = "admin"   // grants roles, changes the server configuration
+	Role_Curator = "curator" // moderates the shared content
+	Role_Reader  = "reader"  // reads moderation and server data
+)
+
+var roleRank = map[string]int{
+	Role_Reader:  1,
+	Role_Curator: 2,
+	Role_Admin:   3,
+}
+
+// comma separated curatorIds which always have the admin role - to grant the first roles, see "app.yaml"
+const adminCuratorsConfig = "Admin_Curators"
+
+const curatorSecretHeader = "X-CloudDB-Curator-Secret"
+
+var errDuplicateCurator = errors.New("The curatorId is already registered")
+
 
 func mapAPItoDBCurator(api *CuratorAPIv1, db *CuratorEntity) {
 	db.CuratorId = api.CuratorId
@@ -75,11 +104,61 @@ func mapDBtoAPICurator(db *CuratorEntity, api *CuratorAPIv1 ) {
 	api.CuratorId = db.CuratorId
 	api.Nickname = db.Nickname
 	api.Email = db.Email
+	api.Roles = curatorRoles(db)
+}
+
+func validateCurator(api *CuratorAPIv1) *validator {
+	v := new(validator)
+	v.required("curatorId", api.CuratorId)
+	v.required("nickname", api.Nickname)
+	if api.Email != "" && !strings.Contains(api.Email, "@") {
+		v.fail("email", "is not a valid email address")
+	}
+	return v
 }
 
 
 // supporting functions
 
+// curatorRoles are the effective roles - curators registered before roles existed keep their rights
+func curatorRoles(db *CuratorEntity) []string {
+	if len(db.Roles) == 0 && !db.RolesAssigned {
+		return []string{Role_Curator}
+	}
+	return db.Roles
+}
+
+func isConfiguredAdmin(curatorId string) bool {
+	for _, configured := range strings.Split(os.Getenv(adminCuratorsConfig), ",") {
+		if strings.TrimSpace(configured) == curatorId {
+			return true
+		}
+	}
+	return false
+}
+
+// curatorSecret is derived from the client secret key - with a prefix, so a client secret is never a curator secret
+func curatorSecret(curatorId string) string {
+	return clientSecret("curator." + curatorId)
+}
+
+// requestCuratorId is the "curatorId" of the caller if the secret matches - "" otherwise. The secret is sent in
+// the header, browsers (the dashboard) may send it as "curatorSecret" parameter.
+func requestCuratorId(request *restful.Request) string {
+	curatorId := request.QueryParameter("curatorId")
+	secret := request.HeaderParameter(curatorSecretHeader)
+	if secret == "" {
+		secret = request.QueryParameter("curatorSecret")
+	}
+	if curatorId == "" || secret == "" || len(clientSecretKey()) == 0 {
+		return ""
+	}
+	if !hmac.Equal([]byte(secret), []byte(curatorSecret(curatorId))) {
+		return ""
+	}
+	return curatorId
+}
+
 // curatorEntityKey returns the key used for all curatorEntity entries.
 func curatorEntityRootKey(c context.Context) *datastore.Key {
 	return datastore.NewKey(c, curatorDBEntity, curatorDBEntityRootKey, 0, nil)
@@ -90,59 +169,98 @@ func curatorEntityRootKey(c context.Context) *datastore.Key {
 // ---------------------------------------------------------------------------------------------------------------//
 
 func insertCurator(request *restful.Request, response *restful.Response) {
-	ctx := appengine.NewContext(request.Request)
+	ctx := newContext(request.Request)
 
 	curator := new(CuratorAPIv1)
 	if err := request.ReadEntity(curator); err != nil {
-		addPlainTextError(response,http.StatusInternalServerError, err.Error())
+		addError(request, response, http.StatusInternalServerError, errorCode_InvalidPayload, err.Error())
 		return
 	}
 
-	// No checks if the necessary fields are filed or not - since GoldenCheetah is
-	// the only consumer of the APIs - any checks/response are to support this use-case
+	// all fields are checked before anything is stored
+	if v := validateCurator(curator); !v.valid() {
+		addValidationError(request, response, v)
+		return
+	}
 
 	curatorDB := new(CuratorEntity)
 	mapAPItoDBCurator(curator, curatorDB)
 
-	// and now store it
-	key := datastore.NewIncompleteKey(ctx, curatorDBEntity, curatorEntityRootKey(ctx))
-	key, err := datastore.Put(ctx, key, curatorDB);
+	if len(clientSecretKey()) == 0 {
+		addError(request, response, http.StatusInternalServerError, errorCode_Internal, "Client secret configuration missing on Server")
+		return
+	}
+
+	// new curators have no rights - all roles are granted by an admin (anyone with the Basic Auth secret
+	// can register)
+	curatorDB.Roles = nil
+	curatorDB.RolesAssigned = true
+
+	// and now store it - the check for the id and the insert are one transaction (same root), the configured
+	// admins are reserved since their secret would grant the admin role
+	var key *datastore.Key
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		if isConfiguredAdmin(curatorDB.CuratorId) {
+			return errDuplicateCurator
+		}
+		existing, err := datastore.NewQuery(curatorDBEntity).Ancestor(curatorEntityRootKey(tc)).
+			Filter("CuratorId =", curatorDB.CuratorId).KeysOnly().Limit(1).GetAll(tc, nil)
+		if err != nil {
+			return err
+		}
+		if len(existing) > 0 {
+			return errDuplicateCurator
+		}
+		key, err = datastore.Put(tc, datastore.NewIncompleteKey(tc, curatorDBEntity, curatorEntityRootKey(tc)), curatorDB)
+		return err
+	}, nil)
+	if err == errDuplicateCurator {
+		addError(request, response, http.StatusConflict, errorCode_Conflict, err.Error())
+		return
+	}
 	if  err != nil {
 		if appengine.IsOverQuota(err) {
 			// return 503 and a text similar to what GAE is returning as well
-			addPlainTextError(response, http.StatusServiceUnavailable, "503 - Over Quota")
+			addError(request, response, http.StatusServiceUnavailable, errorCode_OverQuota, "503 - Over Quota")
 		} else {
-			addPlainTextError(response, http.StatusInternalServerError, err.Error())
+			addDatastoreError(request, response, err)
 		}
 		return
 	}
 
-	// send back the key
+	// send back the key - the secret can't be read again
+	response.AddHeader(curatorSecretHeader, curatorSecret(curatorDB.CuratorId))
+	response.AddHeader("Cache-Control", "no-store")
 	response.WriteHeaderAndEntity(http.StatusCreated, strconv.FormatInt(key.IntID(), 10))
 
 }
 
 
+// getCurator returns the calling curator - only admins see all curators (to grant the roles)
 func getCurator(request *restful.Request, response *restful.Response) {
-	ctx := appengine.NewContext(request.Request)
+	ctx := newContext(request.Request)
 
-	curatorString := request.QueryParameter("curatorId");
+	// the lookup of a curatorId works without its secret like it always did (GoldenCheetah detects its
+	// curators this way), only the list of all curators is restricted to admins
+	curatorString := request.QueryParameter("curatorId")
 
 	var q *datastore.Query
-	if curatorString != "" {
+	if internalHasRole(ctx, requestCuratorId(request), Role_Admin) {
+		q = datastore.NewQuery(curatorDBEntity)
+	} else if curatorString != "" {
 		q = datastore.NewQuery(curatorDBEntity).Filter("CuratorId =", curatorString)
 	} else {
-		q = datastore.NewQuery(curatorDBEntity)
-
+		writeListResponse(request, response, CuratorAPIv1List{}, 0, "")
+		return
 	}
 	var curatorOnDBList []CuratorEntity
 	k, err := q.GetAll(ctx, &curatorOnDBList)
 	if err != nil {
 		if appengine.IsOverQuota(err) {
 			// return 503 and a text similar to what GAE is returning as well
-			addPlainTextError(response, http.StatusServiceUnavailable, "503 - Over Quota")
+			addError(request, response, http.StatusServiceUnavailable, errorCode_OverQuota, "503 - Over Quota")
 		} else {
-			addPlainTextError(response, http.StatusInternalServerError, err.Error())
+			addDatastoreError(request, response, err)
 		}
 		return
 	}
@@ -156,6 +274,115 @@ func getCurator(request *restful.Request, response *restful.Response) {
 		curatorList = append (curatorList, curator)
 	}
 
-	response.WriteEntity(curatorList)
+	writeListResponse(request, response, curatorList, len(curatorList), "")
+}
+
+
+func grantCuratorRole(request *restful.Request, response *restful.Response) {
+	changeCuratorRole(request, response, true)
+}
+
+func revokeCuratorRole(request *restful.Request, response *restful.Response) {
+	changeCuratorRole(request, response, false)
+}
+
+// getCuratorSecret returns the curator with its secret - admins hand it to curators registered before the
+// secrets existed
+func getCuratorSecret(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	id, err := strconv.ParseInt(request.PathParameter("id"), 10, 64)
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	curatorDB := new(CuratorEntity)
+	if err := datastore.Get(ctx, datastore.NewKey(ctx, curatorDBEntity, "", id, curatorEntityRootKey(ctx)), curatorDB); err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	curator := new(CuratorAPIv1)
+	mapDBtoAPICurator(curatorDB, curator)
+	curator.Id = id
+	curator.Secret = curatorSecret(curatorDB.CuratorId)
+	response.AddHeader("Cache-Control", "no-store")
+	response.WriteHeaderAndEntity(http.StatusOK, curator)
+}
+
+// ------------------- supporting functions ------------------------------------------------
+
+func changeCuratorRole(request *restful.Request, response *restful.Response, grant bool) {
+	ctx := newContext(request.Request)
+
+	id, err := strconv.ParseInt(request.PathParameter("id"), 10, 64)
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+	role := request.PathParameter("role")
+	if _, ok := roleRank[role]; !ok {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, "Unknown role - must be admin, curator or reader")
+		return
+	}
+
+	key := datastore.NewKey(ctx, curatorDBEntity, "", id, curatorEntityRootKey(ctx))
+	curatorDB := new(CuratorEntity)
+	err = datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		if err := datastore.Get(tc, key, curatorDB); err != nil {
+			return err
+		}
+		// the implicit role of old curators is made explicit on the first change
+		var roles []string
+		for _, r := range curatorRoles(curatorDB) {
+			if r != role {
+				roles = append(roles, r)
+			}
+		}
+		if grant {
+			roles = append(roles, role)
+		}
+		curatorDB.Roles = roles
+		curatorDB.RolesAssigned = true
+		_, err := datastore.Put(tc, key, curatorDB)
+		return err
+	}, nil)
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+	curator := new(CuratorAPIv1)
+	mapDBtoAPICurator(curatorDB, curator)
+	curator.Id = id
+	response.WriteHeaderAndEntity(http.StatusOK, curator)
 }
 
+//---------------------------------------------------------------------------------------
+// internal functions
+//---------------------------------------------------------------------------------------
+
+func internalIsCurator(ctx context.Context, curatorId string) bool {
+	return internalHasRole(ctx, curatorId, Role_Curator)
+}
+
+// internalHasRole is true if the curator has the role or a higher one
+func internalHasRole(ctx context.Context, curatorId string, role string) bool {
+	if curatorId == "" {
+		return false
+	}
+	if isConfiguredAdmin(curatorId) {
+		return true
+	}
+	var curatorOnDBList []CuratorEntity
+	curatorQuery := datastore.NewQuery(curatorDBEntity).Filter("CuratorId =", curatorId).Limit(2)
+	if _, err := curatorQuery.GetAll(ctx, &curatorOnDBList); err != nil || len(curatorOnDBList) != 1 {
+		return false // ignore errors/just treat as no curator - same for ambiguous ids
+	}
+	for _, r := range curatorRoles(&curatorOnDBList[0]) {
+		if roleRank[r] >= roleRank[role] {
+			return true
+		}
+	}
+	return false
+}
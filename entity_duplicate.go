@@ -0,0 +1,377 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Duplicates - the report groups the not deleted entities of a type into clusters of likely duplicates: the same
+// payload ("Header.PayloadHash") or the same name once case, punctuation and suffixes like "copy" or "2" are
+// ignored. A curator merges a cluster into its canonical entity: the others are deleted (restorable from the
+// trash) and remember the canonical id ("Header.MergedInto"), so a GET of an old id is redirected with 301.
+// Ratings, stars and comments stay with the merged entities - only the tags are added to the canonical one.
+// ---------------------------------------------------------------------------------------------------------------//
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+type DuplicateMemberAPIv1 struct {
+	Id          string `json:"id"`
+	Name        string `json:"name"`
+	Curated     bool   `json:"curated"`
+	LastChanged string `json:"lastChange"`
+	Hash        string `json:"hash"`
+}
+
+type DuplicateClusterAPIv1 struct {
+	Reason      string                 `json:"reason"` // "hash" (same payload) or "name" (similar name)
+	Match       string                 `json:"match"`  // the hash or the normalized name
+	CanonicalId string                 `json:"canonicalId"` // merge candidate - curated first, then the oldest
+	Members     []DuplicateMemberAPIv1 `json:"members"`
+}
+
+type DuplicatesAPIv1 struct {
+	Kind     string                  `json:"kind"`
+	Scanned  int                     `json:"scanned"`
+	More     bool                    `json:"more"` // more than "maxDuplicateScan" entities - not all are compared
+	Clusters []DuplicateClusterAPIv1 `json:"clusters"`
+}
+
+type MergeAPIv1 struct {
+	Kind        string   `json:"kind"`
+	CanonicalId string   `json:"canonicalId"`
+	Ids         []string `json:"ids"` // merged into the canonical entity
+}
+
+type MergeResultAPIv1 struct {
+	CanonicalId string   `json:"canonicalId"`
+	Merged      []string `json:"merged"`
+	Tags        []string `json:"tags"` // of the canonical entity after the merge
+}
+
+const (
+	Duplicate_Hash = "hash"
+	Duplicate_Name = "name"
+)
+
+// entities compared by one report - the projection reads only the header fields needed
+const maxDuplicateScan = 5000
+
+// one merge is one XG transaction - the entity groups of the merged entities, the tag counts and the change log
+const maxMergeIds = 20
+
+func validateMerge(api *MergeAPIv1) *validator {
+	v := new(validator)
+	if _, ok := sharedEntityTypes[api.Kind]; !ok {
+		v.fail("kind", "must be chart, gchart or usermetric")
+	}
+	v.required("canonicalId", api.CanonicalId)
+	if len(api.Ids) == 0 || len(api.Ids) > maxMergeIds {
+		v.fail("ids", fmt.Sprint("must have 1 to ", maxMergeIds, " ids"))
+	}
+	seen := make(map[string]bool)
+	for _, id := range api.Ids {
+		if id == api.CanonicalId {
+			v.fail("ids", "must not contain the canonicalId")
+		}
+		if seen[id] {
+			v.fail("ids", fmt.Sprint(id, " is listed twice"))
+		}
+		seen[id] = true
+	}
+	return v
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Data Storage View
+// ---------------------------------------------------------------------------------------------------------------//
+
+// errMergeConflict is returned from the merge transaction for entities which can't be merged
+type errMergeConflict struct {
+	reason string
+}
+
+func (err *errMergeConflict) Error() string {
+	return err.reason
+}
+
+// supporting functions
+
+// normalizedName is the name compared for duplicates - lower case words without punctuation, trailing
+// words like "copy", "new" or numbers are dropped ("My Chart (2)" and "my chart - copy" are the same)
+func normalizedName(name string) string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	all := strings.Join(words, " ")
+	for len(words) > 0 && isNameSuffix(words[len(words)-1]) {
+		words = words[:len(words)-1]
+	}
+	if len(words) == 0 {
+		return all
+	}
+	return strings.Join(words, " ")
+}
+
+// isNameSuffix is true for "copy", "new" and numbers or versions like "2" or "v2"
+func isNameSuffix(word string) bool {
+	return word == "copy" || word == "new" || strings.TrimFunc(strings.TrimPrefix(word, "v"), unicode.IsDigit) == ""
+}
+
+// newDuplicateCluster sorts the members - the canonical candidate first
+func newDuplicateCluster(reason string, match string, members []DuplicateMemberAPIv1) DuplicateClusterAPIv1 {
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].Curated != members[j].Curated {
+			return members[i].Curated
+		}
+		if members[i].LastChanged != members[j].LastChanged {
+			return members[i].LastChanged < members[j].LastChanged
+		}
+		return members[i].Id < members[j].Id
+	})
+	return DuplicateClusterAPIv1{Reason: reason, Match: match, CanonicalId: members[0].Id, Members: members}
+}
+
+// redirectMerged answers a GET of a merged duplicate with 301 to the canonical entity
+func redirectMerged(request *restful.Request, response *restful.Response, header *CommonEntityHeader) bool {
+	if header.MergedInto == "" {
+		return false
+	}
+	path := request.Request.URL.Path
+	response.AddHeader("Location", path[:strings.LastIndex(path, "/")+1]+header.MergedInto)
+	addError(request, response, http.StatusMovedPermanently, errorCode_Merged, fmt.Sprint("Merged into ", header.MergedInto))
+	return true
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+func getDuplicates(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	entityType := request.PathParameter("kind")
+	if _, ok := sharedEntityTypes[entityType]; !ok {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, "Invalid kind - must be chart, gchart or usermetric")
+		return
+	}
+
+	duplicates, err := internalGetDuplicates(ctx, entityType)
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	response.AddHeader("Cache-Control", "no-store")
+	writeEntity(request, response, http.StatusOK, duplicates)
+}
+
+func mergeDuplicates(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	merge := new(MergeAPIv1)
+	if err := readEntity(request, merge); err != nil {
+		addReadEntityError(request, response, err)
+		return
+	}
+	if v := validateMerge(merge); !v.valid() {
+		addValidationError(request, response, v)
+		return
+	}
+
+	result, err := internalMergeDuplicates(ctx, merge)
+	if conflict, ok := err.(*errMergeConflict); ok {
+		addError(request, response, http.StatusConflict, errorCode_Conflict, conflict.Error())
+		return
+	}
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	logInfof(ctx, "Merged %s %v into %s by curator %s", merge.Kind, result.Merged, merge.CanonicalId, request.QueryParameter("curatorId"))
+	writeEntity(request, response, http.StatusOK, result)
+}
+
+//---------------------------------------------------------------------------------------
+// internal functions
+//---------------------------------------------------------------------------------------
+
+// internalGetDuplicates compares the newest "maxDuplicateScan" entities - entities stored before the payload
+// hash was recorded have no "Header.PayloadHash" and are not part of the projection
+func internalGetDuplicates(ctx context.Context, entityType string) (*DuplicatesAPIv1, error) {
+	sharedType := sharedEntityTypes[entityType]
+	duplicates := &DuplicatesAPIv1{Kind: entityType, Clusters: []DuplicateClusterAPIv1{}}
+
+	byHash := make(map[string][]DuplicateMemberAPIv1)
+	byName := make(map[string][]DuplicateMemberAPIv1)
+	q := datastore.NewQuery(sharedType.kind).Filter("Header.Deleted =", false).Order("-Header.LastChanged").
+		Project("Header.LastChanged", "Header.Name", "Header.PayloadHash", "Header.Curated").Limit(maxDuplicateScan + 1)
+	for t := q.Run(ctx); ; {
+		entityDB := sharedType.newEntity()
+		key, err := t.Next(entityDB)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil && !isErrFieldMismatch(err) {
+			return nil, err
+		}
+		if duplicates.Scanned == maxDuplicateScan {
+			duplicates.More = true
+			break
+		}
+		duplicates.Scanned++
+
+		header := entityDB.commonHeader()
+		member := DuplicateMemberAPIv1{
+			Id:          sharedEntityId(key),
+			Name:        header.Name,
+			Curated:     header.Curated,
+			LastChanged: header.LastChanged.Format(dateTimeLayout),
+			Hash:        header.PayloadHash,
+		}
+		if header.PayloadHash != "" {
+			byHash[header.PayloadHash] = append(byHash[header.PayloadHash], member)
+		}
+		if name := normalizedName(header.Name); name != "" {
+			byName[name] = append(byName[name], member)
+		}
+	}
+
+	for hash, members := range byHash {
+		if len(members) > 1 {
+			duplicates.Clusters = append(duplicates.Clusters, newDuplicateCluster(Duplicate_Hash, hash, members))
+		}
+	}
+	for name, members := range byName {
+		// a name cluster of one payload is already reported as hash cluster
+		hashes := make(map[string]bool)
+		for _, member := range members {
+			hashes[member.Hash] = true
+		}
+		if len(members) > 1 && len(hashes) > 1 {
+			duplicates.Clusters = append(duplicates.Clusters, newDuplicateCluster(Duplicate_Name, name, members))
+		}
+	}
+
+	// biggest clusters first
+	sort.Slice(duplicates.Clusters, func(i, j int) bool {
+		ci, cj := duplicates.Clusters[i], duplicates.Clusters[j]
+		if len(ci.Members) != len(cj.Members) {
+			return len(ci.Members) > len(cj.Members)
+		}
+		if ci.Reason != cj.Reason {
+			return ci.Reason == Duplicate_Hash
+		}
+		return ci.Match < cj.Match
+	})
+	return duplicates, nil
+}
+
+// internalMergeDuplicates deletes the merged entities and adds their tags to the canonical one - in one unit
+// of work. Merging an entity again into the same canonical entity changes nothing.
+func internalMergeDuplicates(ctx context.Context, merge *MergeAPIv1) (*MergeResultAPIv1, error) {
+	sharedType := sharedEntityTypes[merge.Kind]
+
+	canonicalKey, err := sharedType.key(ctx, merge.CanonicalId)
+	if err != nil {
+		return nil, &errMergeConflict{reason: fmt.Sprint("Invalid canonicalId ", merge.CanonicalId)}
+	}
+	keys := make([]*datastore.Key, len(merge.Ids))
+	for i, id := range merge.Ids {
+		if keys[i], err = sharedType.key(ctx, id); err != nil {
+			return nil, &errMergeConflict{reason: fmt.Sprint("Invalid id ", id)}
+		}
+	}
+
+	var result *MergeResultAPIv1
+	err = runUnitOfWork(ctx, func(tc context.Context, uow *unitOfWork) error {
+		result = &MergeResultAPIv1{CanonicalId: merge.CanonicalId, Merged: []string{}}
+
+		canonicalDB := sharedType.newEntity()
+		if err := getEntity(tc, canonicalKey, canonicalDB); err != nil && !isErrFieldMismatch(err) {
+			return err
+		}
+		canonical := canonicalDB.commonHeader()
+		if canonical.Deleted {
+			return &errMergeConflict{reason: fmt.Sprint("The canonical entity ", merge.CanonicalId, " is deleted")}
+		}
+
+		now := time.Now()
+		tags := canonical.Tags
+		for i, key := range keys {
+			db := sharedType.newEntity()
+			if err := getEntity(tc, key, db); err != nil && !isErrFieldMismatch(err) {
+				return err
+			}
+			header := db.commonHeader()
+			if header.MergedInto == merge.CanonicalId {
+				continue
+			}
+			if header.Deleted {
+				return &errMergeConflict{reason: fmt.Sprint("The entity ", merge.Ids[i], " is deleted")}
+			}
+
+			tags = append(tags, header.Tags...)
+			header.Deleted = true
+			header.Trashed = now
+			header.MergedInto = merge.CanonicalId
+			header.LastChanged = now
+			if _, err := putSharedEntityInUnitOfWork(tc, uow, merge.Kind, key, db, nil, nil); err != nil {
+				return err
+			}
+			mergedKey := key
+			uow.onCommit(func(ctx context.Context) {
+				indexForSearch(ctx, merge.Kind, mergedKey, db)
+			})
+			result.Merged = append(result.Merged, merge.Ids[i])
+		}
+
+		if tags = normalizeTags(tags); len(tags) != len(canonical.Tags) {
+			canonical.Tags = tags
+			canonical.LastChanged = now
+			if _, err := putSharedEntityInUnitOfWork(tc, uow, merge.Kind, canonicalKey, canonicalDB, nil, nil); err != nil {
+				return err
+			}
+			uow.onCommit(func(ctx context.Context) {
+				indexForSearch(ctx, merge.Kind, canonicalKey, canonicalDB)
+			})
+		}
+		result.Tags = canonical.Tags
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// CSV export of the status history - for the analysis of outages in a spreadsheet. The history is read in
+// batches with a cursor and every batch is flushed, so the size of the history is not limited by the memory.
+// ---------------------------------------------------------------------------------------------------------------//
+
+const mimeCSV = "text/csv"
+
+var statusExportColumns = []string{"id", "status", "description", "changeDate"}
+
+// one batch is one datastore call
+const numberOfStatusPerExportBatch = 500
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+func getStatusExport(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	// the whole history if not restricted
+	var dateFrom, dateTo time.Time
+	for param, date := range map[string]*time.Time{"dateFrom": &dateFrom, "dateTo": &dateTo} {
+		if dateString := request.QueryParameter(param); dateString != "" {
+			d, err := time.Parse(time.RFC3339, dateString)
+			if err != nil {
+				addError(request, response, http.StatusBadRequest, errorCode_BadRequest, fmt.Sprint(err.Error(), " - Correct format is RFC3339"))
+				return
+			}
+			*date = d
+		}
+	}
+	if !dateTo.IsZero() && !dateFrom.Before(dateTo) {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, "dateFrom must be before dateTo")
+		return
+	}
+
+	q := datastore.NewQuery(statusDBEntity).Filter("ChangeDate >=", dateFrom).Order("ChangeDate")
+	if !dateTo.IsZero() {
+		q = q.Filter("ChangeDate <", dateTo)
+	}
+
+	response.Header().Set("Content-Type", mimeCSV+"; charset=utf-8")
+	response.Header().Set("Content-Disposition", `attachment; filename="clouddb-status.csv"`)
+	response.WriteHeader(http.StatusOK)
+
+	w := csv.NewWriter(response)
+	w.Write(statusExportColumns)
+
+	var cursor *datastore.Cursor
+	rows := 0
+	for {
+		batch := q.Limit(numberOfStatusPerExportBatch)
+		if cursor != nil {
+			batch = batch.Start(*cursor)
+		}
+
+		t := batch.Run(ctx)
+		n := 0
+		for {
+			var statusDB StatusEntity
+			k, err := t.Next(&statusDB)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil && !isErrFieldMismatch(err) {
+				// header is already written - the export ends early, the log tells why
+				logErrorf(ctx, "Status export stopped after %d rows: %v", rows, err)
+				w.Flush()
+				return
+			}
+			w.Write([]string{
+				strconv.FormatInt(k.IntID(), 10),
+				strconv.Itoa(statusDB.Status),
+				statusTitles[statusDB.Status],
+				statusDB.ChangeDate.UTC().Format(time.RFC3339),
+			})
+			n++
+		}
+		rows += n
+
+		w.Flush()
+		if flusher, ok := response.ResponseWriter.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		if n < numberOfStatusPerExportBatch {
+			break
+		}
+
+		c, err := t.Cursor()
+		if err != nil {
+			logErrorf(ctx, "Status export stopped after %d rows: %v", rows, err)
+			return
+		}
+		cursor = &c
+	}
+}
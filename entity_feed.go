@@ -0,0 +1,130 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Atom feed of the status history - public, so it can be used by any feed reader or the GoldenCheetah website
+// ---------------------------------------------------------------------------------------------------------------//
+
+const mimeAtom = "application/atom+xml"
+
+type AtomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type AtomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type AtomEntry struct {
+	Id      string       `xml:"id"`
+	Title   string       `xml:"title"`
+	Updated string       `xml:"updated"`
+	Content *AtomContent `xml:"content,omitempty"`
+}
+
+type AtomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Id      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  string      `xml:"author>name"`
+	Link    []AtomLink  `xml:"link"`
+	Entries []AtomEntry `xml:"entry"`
+}
+
+var statusTitles = map[int]string{
+	Status_Ok:             "CloudDB is available",
+	Status_PartialFailure: "CloudDB has a partial failure",
+	Status_Outage:         "CloudDB is not available",
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+func getStatusFeed(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	const maxNumberOfFeedEntries = 25
+
+	q := datastore.NewQuery(statusDBEntity).Order("-ChangeDate").Limit(maxNumberOfFeedEntries)
+
+	var statusOnDBList []StatusEntity
+	k, err := q.GetAll(ctx, &statusOnDBList)
+	if err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	host := request.Request.Host
+	feed := AtomFeed{
+		Id:      fmt.Sprint("tag:", host, ",2016:status"),
+		Title:   "GoldenCheetah CloudDB Status",
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Author:  "GoldenCheetah CloudDB",
+		Link: []AtomLink{
+			{Rel: "self", Href: fmt.Sprint("https://", host, request.Request.URL.Path)},
+		},
+	}
+	if len(statusOnDBList) > 0 {
+		feed.Updated = statusOnDBList[0].ChangeDate.UTC().Format(time.RFC3339)
+	}
+
+	for i, statusDB := range statusOnDBList {
+		entry := AtomEntry{
+			Id:      fmt.Sprint("tag:", host, ",2016:status/", k[i].IntID()),
+			Title:   statusTitles[statusDB.Status],
+			Updated: statusDB.ChangeDate.UTC().Format(time.RFC3339),
+		}
+		if entry.Title == "" {
+			entry.Title = fmt.Sprint("CloudDB status ", statusDB.Status)
+		}
+
+		// the optional text is a child of the status - max. 1 per status
+		var textOnDBList []StatusEntityText
+		textQuery := datastore.NewQuery(statusDBEntityText).Ancestor(k[i]).Limit(1)
+		if _, err := textQuery.GetAll(ctx, &textOnDBList); err == nil && len(textOnDBList) == 1 {
+			entry.Content = &AtomContent{Type: "text", Body: textOnDBList[0].Text}
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+
+	response.Header().Set("Content-Type", mimeAtom+"; charset=utf-8")
+	response.WriteHeader(http.StatusOK)
+	response.Write([]byte(xml.Header))
+	if err := xml.NewEncoder(response).Encode(feed); err != nil {
+		// header is already written - nothing left to report
+		return
+	}
+}
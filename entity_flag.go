@@ -0,0 +1,245 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Report of inappropriate or broken shared content (flagentity) which is stored in DB
+// ---------------------------------------------------------------------------------------------------------------//
+type FlagEntity struct {
+	EntityType string
+	EntityId   string
+	Reason     string       `datastore:",noindex"`
+	ReporterId string
+	FlagDate   time.Time
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+// Structure for POST
+type FlagPostAPIv1 struct {
+	Reason     string `json:"reason"`
+	ReporterId string `json:"reporterId"`
+}
+
+// Full structure for GET
+type FlagAPIv1 struct {
+	Id         int64  `json:"id"`
+	EntityType string `json:"entityType"`
+	EntityId   string `json:"entityId"`
+	Reason     string `json:"reason"`
+	ReporterId string `json:"reporterId"`
+	FlagDate   string `json:"flagDate"`
+}
+
+type FlagAPIv1List []FlagAPIv1
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Data Storage View
+// ---------------------------------------------------------------------------------------------------------------//
+
+const flagDBEntity = "flagentity"
+const flagDBEntityRootKey = "flagroot"
+
+// number of flags (of different reporters) after which the content is taken back for review
+const flagThresholdConfig = "Flag_Threshold"
+const flagThresholdDefault = 5
+
+var errDuplicateFlag = errors.New("Content was already flagged by this reporter")
+
+func mapDBtoAPIFlag(db *FlagEntity, api *FlagAPIv1) {
+	api.EntityType = db.EntityType
+	api.EntityId = db.EntityId
+	api.Reason = db.Reason
+	api.ReporterId = db.ReporterId
+	api.FlagDate = db.FlagDate.Format(dateTimeLayout)
+}
+
+// supporting functions
+
+// flagEntityRootKey returns the key used for all flagEntity entries.
+func flagEntityRootKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, flagDBEntity, flagDBEntityRootKey, 0, nil)
+}
+
+// flagThreshold is the configured one (see "entity_config.go"), else the one of app.yaml
+func flagThreshold(ctx context.Context) int {
+	if threshold, ok := configValue(ctx, Config_FlagThreshold); ok {
+		return threshold
+	}
+	if threshold, err := strconv.Atoi(os.Getenv(flagThresholdConfig)); err == nil && threshold > 0 {
+		return threshold
+	}
+	return flagThresholdDefault
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+func flagChartById(request *restful.Request, response *restful.Response) {
+	flagSharedEntity(request, response, sharedTypeChart, request.PathParameter("id"))
+}
+
+func flagGChartById(request *restful.Request, response *restful.Response) {
+	flagSharedEntity(request, response, sharedTypeGChart, request.PathParameter("id"))
+}
+
+func flagUserMetricByKey(request *restful.Request, response *restful.Response) {
+	flagSharedEntity(request, response, sharedTypeUserMetric, request.PathParameter("key"))
+}
+
+func getFlags(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	q := datastore.NewQuery(flagDBEntity).Ancestor(flagEntityRootKey(ctx))
+	if entityType := request.QueryParameter("type"); entityType != "" {
+		q = q.Filter("EntityType =", entityType)
+	}
+	q = q.Order("-FlagDate")
+
+	var flagOnDBList []FlagEntity
+	k, err := q.GetAll(ctx, &flagOnDBList)
+	if err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	// DB Entity needs to be mapped back
+	var flagList FlagAPIv1List
+	for i, flagDB := range flagOnDBList {
+		var flag FlagAPIv1
+		mapDBtoAPIFlag(&flagDB, &flag)
+		flag.Id = k[i].IntID()
+		flagList = append(flagList, flag)
+	}
+
+	writeListResponse(request, response, flagList, len(flagList), "")
+}
+
+// ------------------- supporting functions ------------------------------------------------
+
+func flagSharedEntity(request *restful.Request, response *restful.Response, entityType string, id string) {
+	ctx := newContext(request.Request)
+
+	flag := new(FlagPostAPIv1)
+	if err := request.ReadEntity(flag); err != nil {
+		addError(request, response, http.StatusInternalServerError, errorCode_InvalidPayload, err.Error())
+		return
+	}
+
+	if flag.ReporterId == "" {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, "Mandatory reporterId is missing")
+		return
+	}
+
+	sharedType := sharedEntityTypes[entityType]
+	key, err := sharedType.key(ctx, id)
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	// only existing content can be flagged
+	entityDB := sharedType.newEntity()
+	if err := getEntity(ctx, key, entityDB); err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	flagDB := new(FlagEntity)
+	flagDB.EntityType = entityType
+	flagDB.EntityId = sharedEntityId(key)
+	flagDB.Reason = flag.Reason
+	flagDB.ReporterId = flag.ReporterId
+	flagDB.FlagDate = time.Now()
+
+	// the flag and the auto-hide are one unit of work - a flag can't be counted without the hide
+	flagQuery := datastore.NewQuery(flagDBEntity).Ancestor(flagEntityRootKey(ctx)).
+		Filter("EntityType =", entityType).Filter("EntityId =", flagDB.EntityId)
+	threshold := flagThreshold(ctx)
+	var flagKey *datastore.Key
+	err = runUnitOfWork(ctx, func(tc context.Context, uow *unitOfWork) error {
+		// every reporter counts only once
+		counter, err := flagQuery.Filter("ReporterId =", flag.ReporterId).Count(tc)
+		if err != nil {
+			return err
+		}
+		if counter > 0 {
+			return errDuplicateFlag
+		}
+
+		flagKey, err = datastore.Put(tc, datastore.NewIncompleteKey(tc, flagDBEntity, flagEntityRootKey(tc)), flagDB)
+		if err != nil {
+			return err
+		}
+
+		// auto-hide - the content disappears from the public lists until a curator reviewed it
+		counter, err = flagQuery.Count(tc)
+		if err != nil {
+			return err
+		}
+		// the new flag is not yet visible to the query in the transaction
+		counter++
+		if counter < threshold {
+			return nil
+		}
+		hideDB := sharedType.newEntity()
+		if err := getEntity(tc, key, hideDB); err != nil {
+			return err
+		}
+		header := hideDB.commonHeader()
+		if curationState(header) != CurationState_Approved {
+			return nil
+		}
+		header.CurationState = CurationState_UnderReview
+		header.CurationComment = fmt.Sprint("Hidden after ", counter, " flags")
+		header.Curated = false
+		header.LastChanged = time.Now()
+		_, err = putSharedEntityInUnitOfWork(tc, uow, entityType, key, hideDB, nil, nil)
+		return err
+	})
+	if err == errDuplicateFlag {
+		addError(request, response, http.StatusConflict, errorCode_Conflict, err.Error())
+		return
+	}
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	// send back the key
+	response.WriteHeaderAndEntity(http.StatusCreated, strconv.FormatInt(flagKey.IntID(), 10))
+}
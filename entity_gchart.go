@@ -22,6 +22,7 @@ import (
 	"net/http"
 	"time"
 	"strconv"
+	"sort"
 	"fmt"
 
 	"golang.org/x/net/context"
@@ -44,8 +45,10 @@ type GChartEntity struct {
 	ChartView    string       `datastore:",noindex"`
 	ChartDef     string       `datastore:",noindex"`
 	Image        []byte       `datastore:",noindex"`
+	ImageBlob    string       `datastore:",noindex"` // Cloud Storage object of large images (Image is then empty)
 	CreatorNick  string       `datastore:",noindex"`
 	CreatorEmail string       `datastore:",noindex"`
+	SchemaVersion int         `datastore:",noindex"` // see "entity_mapper.go"
 }
 
 type GChartEntityHeaderOnly struct {
@@ -70,6 +73,7 @@ type GChartAPIv1 struct {
 	Image        string      `json:"image"`
 	CreatorNick  string      `json:"creatorNick"`
 	CreatorEmail string      `json:"creatorEmail"`
+	Downloads    int64       `json:"downloads"`
 }
 
 type GChartAPIv1List []GChartAPIv1
@@ -106,6 +110,8 @@ func mapAPItoDBGChart(api *GChartAPIv1, db *GChartEntity) {
 	}
 	db.CreatorNick = api.CreatorNick
 	db.CreatorEmail = api.CreatorEmail
+	db.Header.PayloadHash = payloadHash([]byte(db.ChartSport), []byte(db.ChartType), []byte(db.ChartView), []byte(db.ChartDef), db.Image)
+	db.Header.PayloadSize = len(db.ChartSport) + len(db.ChartType) + len(db.ChartView) + len(db.ChartDef) + len(db.Image)
 }
 
 
@@ -120,13 +126,28 @@ func mapDBtoAPIGChart(db *GChartEntity, api *GChartAPIv1) {
 	api.CreatorEmail = db.CreatorEmail
 }
 
+func validateGChart(api *GChartAPIv1) *validator {
+	v := new(validator)
+	validateCommonHeader(v, &api.Header)
+	v.required("chartDef", api.ChartDef)
+	imageSize := v.base64("image", api.Image)
+	v.blobSize("image", imageSize)
+	v.payloadSize("chartDef", len(api.ChartDef)+inlineBlobSize(imageSize))
+	return v
+}
+
 
 
 // supporting functions
 
-// chartEntityKey returns the key used for all chartEntity entries.
-func gchartEntityRootKey(ctx context.Context) *datastore.Key {
-	return datastore.NewKey(ctx, gChartDBEntity, gChartDBEntityRootKey, 0, nil)
+// gchartEntityKey returns the key of the gchart - in the root shard of its id, see "entity_shard.go"
+func gchartEntityKey(ctx context.Context, id int64) *datastore.Key {
+	return shardedIdKey(ctx, gChartDBEntity, gChartDBEntityRootKey, id)
+}
+
+// gchartEntityRootKeys returns the root keys of all shards
+func gchartEntityRootKeys(ctx context.Context) []*datastore.Key {
+	return shardRootKeys(ctx, gChartDBEntity, gChartDBEntityRootKey)
 }
 
 // ---------------------------------------------------------------------------------------------------------------//
@@ -134,41 +155,72 @@ func gchartEntityRootKey(ctx context.Context) *datastore.Key {
 // ---------------------------------------------------------------------------------------------------------------//
 
 func insertGChart(request *restful.Request, response *restful.Response) {
-	ctx := appengine.NewContext(request.Request)
+	ctx := newContext(request.Request)
 
 	chart := new(GChartAPIv1)
-	if err := request.ReadEntity(chart); err != nil {
-		addPlainTextError(response, http.StatusInternalServerError, err.Error())
+	if err := readEntity(request, chart); err != nil {
+		addReadEntityError(request, response, err)
 		return
 	}
 
-	// No checks if the necessary fields are filed or not - since GoldenCheetah is
-	// the only consumer of the APIs - any checks/response are to support this use-case
+	// all fields are checked before anything is stored
+	if v := validateGChart(chart); !v.valid() {
+		addValidationError(request, response, v)
+		return
+	}
 
 	chartDB := new(GChartEntity)
 	mapAPItoDBGChart(chart, chartDB)
 
+	// identical gcharts are only stored once - the id of the existing one is returned
+	if duplicate, err := findDuplicate(ctx, gChartDBEntity, chartDB.Header.PayloadHash); err != nil {
+		commonResponseErrorProcessing (request, response, err)
+		return
+	} else if duplicate != nil {
+		response.WriteHeaderAndEntity(http.StatusOK, strconv.FormatInt(duplicate.IntID(), 10))
+		return
+	}
+
 	// complete/set POST fields
 	chartDB.Header.LastChanged = time.Now()
 	chartDB.Header.Curated = false
 	chartDB.Header.Deleted = false
 
 	// auto-curate if a registered "curator" is adding a gchart
-	curatorQuery := datastore.NewQuery(curatorDBEntity).Filter("CuratorId =", chartDB.Header.CreatorId)
-	counter, _ := curatorQuery.Count(ctx) // ignore errors/just leave uncurated
-	if counter == 1 {
+	if internalIsCurator(ctx, requestCuratorId(request)) {
 		chartDB.Header.Curated = true
 	} else {
 		chartDB.Header.Curated = false
 	}
+	chartDB.Header.CurationState = initialCurationState(chartDB.Header.Curated)
+	chartDB.Header.CurationComment = ""
+	chartDB.Header.OwnerId = requestOwnerId(request)
+
+	// the id decides about the root shard - so it's allocated before the entity is stored
+	key, err := newShardedIdKey(ctx, gChartDBEntity, gChartDBEntityRootKey)
+	if err != nil {
+		commonResponseErrorProcessing (request, response, err)
+		return
+	}
+
+	// high volume - the entity is stored later by the task queue, the id is returned for tracking
+	if isAsyncInsert(sharedTypeGChart) {
+		key, err := queueInsert(ctx, request.Request, sharedTypeGChart, key, chartDB)
+		if err != nil {
+			commonResponseErrorProcessing (request, response, err)
+			return
+		}
+		response.WriteHeaderAndEntity(http.StatusAccepted, strconv.FormatInt(key.IntID(), 10))
+		return
+	}
 
 	// and now store it
-	key := datastore.NewIncompleteKey(ctx, gChartDBEntity, gchartEntityRootKey(ctx))
-	key, err := datastore.Put(ctx, key, chartDB);
+	key, err = putSharedEntity(ctx, sharedTypeGChart, key, chartDB);
 	if err != nil {
-		commonResponseErrorProcessing (response, err)
+		commonResponseErrorProcessing (request, response, err)
 		return
 	}
+	indexForSearch(ctx, sharedTypeGChart, key, chartDB)
 
 	// send back the key
 	response.WriteHeaderAndEntity(http.StatusCreated, strconv.FormatInt(key.IntID(), 10))
@@ -176,48 +228,57 @@ func insertGChart(request *restful.Request, response *restful.Response) {
 }
 
 func updateGChart(request *restful.Request, response *restful.Response) {
-	ctx := appengine.NewContext(request.Request)
+	ctx := newContext(request.Request)
 
 	chart := new(GChartAPIv1)
-	if err := request.ReadEntity(chart); err != nil {
-		addPlainTextError(response, http.StatusInternalServerError, err.Error())
+	if err := readEntity(request, chart); err != nil {
+		addReadEntityError(request, response, err)
 		return
 	}
 
 	if (chart.Header.Id == 0) {
-		addPlainTextError(response, http.StatusBadRequest, "Mandatory Id for Update is missing or invalid")
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, "Mandatory Id for Update is missing or invalid")
 		return
 	}
 
-	// No more checks if the necessary fields are filed or not - since GoldenCheetah is
-	// the only consumer of the APIs - any checks/response are to support this use-case
+	// all fields are checked before anything is stored
+	if v := validateGChart(chart); !v.valid() {
+		addValidationError(request, response, v)
+		return
+	}
 
 	chartDB := new(GChartEntity)
 	mapAPItoDBGChart(chart, chartDB)
 
+	chartDB.Header.OwnerId = requestOwnerId(request)
 	chartDB.Header.LastChanged = time.Now()
 
-	// and now store it
+	key := gchartEntityKey(ctx, chart.Header.Id)
 
-	key := datastore.NewKey(ctx, gChartDBEntity, "", chart.Header.Id, gchartEntityRootKey(ctx))
-	if _, err := datastore.Put(ctx, key, chartDB); err != nil {
-		commonResponseErrorProcessing (response, err)
+	// and now store it - only the owner or a curator may change an existing entity
+	if _, err := putSharedEntityRevision(ctx, sharedTypeGChart, key, chartDB, requestEditor(ctx, request)); err != nil {
+		if err == errNotOwner {
+			addError(request, response, http.StatusForbidden, errorCode_Forbidden, err.Error())
+			return
+		}
+		commonResponseErrorProcessing (request, response, err)
 		return
 	}
+	indexForSearch(ctx, sharedTypeGChart, key, chartDB)
 
 	// Response is Empty for 204
 	response.WriteHeaderAndEntity(http.StatusNoContent, "")
 
 }
 func getGChartHeader(request *restful.Request, response *restful.Response) {
-	ctx := appengine.NewContext(request.Request)
+	ctx := newContext(request.Request)
 
 	var date time.Time
 	var err error
 	if dateString := request.QueryParameter("dateFrom"); dateString != "" {
 		date, err = time.Parse(time.RFC3339, dateString)
 		if err != nil {
-			addPlainTextError(response, http.StatusBadRequest, fmt.Sprint(err.Error(), " - Correct format is RFC3339"))
+			addError(request, response, http.StatusBadRequest, errorCode_BadRequest, fmt.Sprint(err.Error(), " - Correct format is RFC3339"))
 			return
 		}
 	} else {
@@ -226,41 +287,94 @@ func getGChartHeader(request *restful.Request, response *restful.Response) {
 
 	const maxNumberOfHeadersPerCall = 200; // this has to be equal to GoldenCheetah - CloudDBChartClient class
 
-	q := datastore.NewQuery(gChartDBEntity).Filter("Header.LastChanged >=", date).Order("Header.LastChanged").Limit(maxNumberOfHeadersPerCall)
+	// strong consistency reads the root shards with ancestor queries - slower, but includes the latest writes
+	strong, err := consistencyParameter(request)
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
 
-	var chartHeaderList GChartAPIv1HeaderOnlyList
+	q := datastore.NewQuery(gChartDBEntity).Filter("Header.LastChanged >=", date).Order("Header.LastChanged")
+	tags := tagParameters(request)
+	if len(tags) > 0 {
+		q = q.Filter("Header.Tags =", tags[0])
+	}
 
-	var chartsOnDBList []GChartEntityHeaderOnly
-	k, err := q.GetAll(ctx, &chartsOnDBList)
-	if err != nil && !isErrFieldMismatch(err) {
-		commonResponseErrorProcessing (response, err)
+	// e.g. sync clients which only need ids and change dates - the projection only reads the index
+	if !strong && len(tags) == 0 && curationStateParameter(request) == "" && isHeaderProjectionPossible(request) {
+		q = q.Project(headerProjection...)
+	}
+
+	// total is only counted when the envelope is requested - it costs an additional query
+	totalApprox := 0
+	if isEnvelopeRequested(request) {
+		totalApprox, _ = q.Count(ctx) // ignore errors/just report what was read
+	}
+
+	q, err = applyCursorParameter(request, q.Limit(maxNumberOfHeadersPerCall))
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
 		return
 	}
 
-	// DB Entity needs to be mapped back
-	for i, chartDB := range chartsOnDBList {
-		var chart GChartAPIv1HeaderOnly
-		mapDBtoAPICommonHeader(&chartDB.Header, &chart.Header)
-		chart.Header.Id = k[i].IntID()
-		chart.ChartSport = chartDB.ChartSport
-		chart.ChartView = chartDB.ChartView
-		chart.ChartType = chartDB.ChartType
-		chartHeaderList = append(chartHeaderList, chart)
+	selectedState := curationStateParameter(request)
+
+	read := 0
+	var chartHeaderList GChartAPIv1HeaderOnlyList
+
+	iterators := runShardedQuery(ctx, q, strong, gchartEntityRootKeys(ctx))
+	for _, t := range iterators {
+		for {
+			var chartDB GChartEntityHeaderOnly
+			key, err := t.Next(&chartDB)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil && !isErrFieldMismatch(err) {
+				commonResponseErrorProcessing (request, response, err)
+				return
+			}
+			read++
+			if chartDB.Header.Unlisted || !isCurationStateSelected(&chartDB.Header, selectedState) || !hasAllTags(&chartDB.Header, tags) {
+				continue
+			}
+
+			// DB Entity needs to be mapped back
+			var chart GChartAPIv1HeaderOnly
+			mapDBtoAPICommonHeader(&chartDB.Header, &chart.Header)
+			chart.Header.Id = key.IntID()
+			chart.ChartSport = chartDB.ChartSport
+			chart.ChartView = chartDB.ChartView
+			chart.ChartType = chartDB.ChartType
+			chartHeaderList = append(chartHeaderList, chart)
+		}
+	}
+
+	// the shards are merged by change date - the last one is the next dateFrom, a cursor is not returned
+	if len(iterators) > 1 {
+		sort.SliceStable(chartHeaderList, func(i, j int) bool { return chartHeaderList[i].Header.LastChanged < chartHeaderList[j].Header.LastChanged })
+		if len(chartHeaderList) > maxNumberOfHeadersPerCall {
+			chartHeaderList = chartHeaderList[:maxNumberOfHeadersPerCall]
+		}
+	}
+
+	if totalApprox < len(chartHeaderList) {
+		totalApprox = len(chartHeaderList)
 	}
 
-	response.WriteHeaderAndEntity(http.StatusOK, chartHeaderList)
+	writeListResponse(request, response, chartHeaderList, totalApprox, shardedNextCursor(iterators, read, maxNumberOfHeadersPerCall))
 
 }
 
 func getGChartHeaderCount(request *restful.Request, response *restful.Response) {
-	ctx := appengine.NewContext(request.Request)
+	ctx := newContext(request.Request)
 
 	var date time.Time
 	var err error
 	if dateString := request.QueryParameter("dateFrom"); dateString != "" {
 		date, err = time.Parse(time.RFC3339, dateString)
 		if err != nil {
-			addPlainTextError(response, http.StatusBadRequest, fmt.Sprint(err.Error(), " - Correct format is RFC3339"))
+			addError(request, response, http.StatusBadRequest, errorCode_BadRequest, fmt.Sprint(err.Error(), " - Correct format is RFC3339"))
 			return
 		}
 	} else {
@@ -275,21 +389,41 @@ func getGChartHeaderCount(request *restful.Request, response *restful.Response)
 }
 
 func getGChartById(request *restful.Request, response *restful.Response) {
-	ctx := appengine.NewContext(request.Request)
+	ctx := newContext(request.Request)
 
 	id := request.PathParameter("id")
 	i, err := strconv.ParseInt(id, 10, 64)
 	if err != nil {
-		commonResponseErrorProcessing (response, err)
+		commonResponseErrorProcessing (request, response, err)
 		return
 	}
 
-	key := datastore.NewKey(ctx, gChartDBEntity, "", i, gchartEntityRootKey(ctx))
+	key := gchartEntityKey(ctx, i)
 
 	chartDB := new(GChartEntity)
-	err = datastore.Get(ctx, key, chartDB)
+	err = getEntity(ctx, key, chartDB)
 	if err != nil && !isErrFieldMismatch(err) {
-		commonResponseErrorProcessing (response, err)
+		commonResponseErrorProcessing (request, response, err)
+		return
+	}
+	// a merged duplicate answers with the canonical entity - see "entity_duplicate.go"
+	if redirectMerged(request, response, &chartDB.Header) {
+		return
+	}
+	if !isListedOrOwned(ctx, request, &chartDB.Header) {
+		addError(request, response, http.StatusNotFound, errorCode_NotFound, datastore.ErrNoSuchEntity.Error())
+		return
+	}
+
+	// the client's copy is current - the blob is not read. The check follows the unlisted check, a 304
+	// would tell that the entity exists
+	if isConditionalRequest(request) && isNotModified(request, &chartDB.Header) {
+		setConditionalHeaders(response, &chartDB.Header)
+		response.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if err := loadBlob(ctx, chartDB); err != nil {
+		commonResponseErrorProcessing (request, response, err)
 		return
 	}
 
@@ -297,8 +431,10 @@ func getGChartById(request *restful.Request, response *restful.Response) {
 	chart := new(GChartAPIv1)
 	mapDBtoAPIGChart(chartDB, chart)
 	chart.Header.Id = key.IntID()
+	chart.Downloads = countDownload(ctx, sharedTypeGChart, id)
 
-	response.WriteHeaderAndEntity(http.StatusOK, chart)
+	setConditionalHeaders(response, &chartDB.Header)
+	writeEntity(request, response, http.StatusOK, chart)
 }
 
 func deleteGChartById(request *restful.Request, response *restful.Response) {
@@ -312,31 +448,77 @@ func curateGChartById(request *restful.Request, response *restful.Response) {
 	newStatusString := request.QueryParameter("newStatus")
 	b, err := strconv.ParseBool(newStatusString)
 	if err != nil {
-		commonResponseErrorProcessing (response, err)
+		commonResponseErrorProcessing (request, response, err)
 		return
 	}
 	changeGChartById(request, response, false, true, b)
 
 }
 
+func transitionGChartCurationById(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	id := request.PathParameter("id")
+	i, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	transition := new(CurationTransitionAPIv1)
+	if err := request.ReadEntity(transition); err != nil {
+		addError(request, response, http.StatusInternalServerError, errorCode_InvalidPayload, err.Error())
+		return
+	}
+
+	key := gchartEntityKey(ctx, i)
+
+	chartDB := new(GChartEntity)
+	if err := getEntity(ctx, key, chartDB); err != nil {
+		commonResponseErrorProcessing (request, response, err)
+		return
+	}
+
+	if err := transitionCurationState(&chartDB.Header, transition); err != nil {
+		addError(request, response, http.StatusConflict, errorCode_Conflict, err.Error())
+		return
+	}
+
+	if _, err := putSharedEntity(ctx, sharedTypeGChart, key, chartDB); err != nil {
+		commonResponseErrorProcessing (request, response, err)
+		return
+	}
+	indexForSearch(ctx, sharedTypeGChart, key, chartDB)
+
+	// Response is Empty for 204
+	response.WriteHeaderAndEntity(http.StatusNoContent, "")
+
+}
+
 // ------------------- supporting functions ------------------------------------------------
 
 func changeGChartById(request *restful.Request, response *restful.Response, changeDeleted bool, changeCurated bool, newStatus bool) {
-	ctx := appengine.NewContext(request.Request)
+	ctx := newContext(request.Request)
 
 	id := request.PathParameter("id")
 	i, err := strconv.ParseInt(id, 10, 64)
 	if err != nil {
-		addPlainTextError(response, http.StatusBadRequest, err.Error())
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
 		return
 	}
 
-	key := datastore.NewKey(ctx, gChartDBEntity, "", i, gchartEntityRootKey(ctx))
+	key := gchartEntityKey(ctx, i)
 
 	chartDB := new(GChartEntity)
-	err = datastore.Get(ctx, key, chartDB)
+	err = getEntity(ctx, key, chartDB)
 	if err != nil && !isErrFieldMismatch(err) {
-		commonResponseErrorProcessing (response, err)
+		commonResponseErrorProcessing (request, response, err)
+		return
+	}
+
+	// only the owner or a curator may delete
+	if changeDeleted && !requestEditor(ctx, request).mayChange(&chartDB.Header) {
+		addError(request, response, http.StatusForbidden, errorCode_Forbidden, "Forbidden - only the owner or a curator may delete this entity")
 		return
 	}
 
@@ -344,29 +526,31 @@ func changeGChartById(request *restful.Request, response *restful.Response, chan
 
 	if changeDeleted {
 		chartDB.Header.Deleted = newStatus
+		// the payload is kept in the trash until it's purged - see "entity_trash.go"
 		if newStatus {
-			chartDB.ChartType = ""
-			chartDB.ChartView = ""
-			chartDB.ChartDef = ""
-			chartDB.Image = nil
+			chartDB.Header.Trashed = time.Now()
+		} else {
+			chartDB.Header.Trashed = time.Time{}
 		}
 		chartDB.Header.LastChanged = time.Now()
 	}
 
 	if changeCurated {
 		chartDB.Header.Curated = newStatus
+		chartDB.Header.CurationState = initialCurationState(newStatus)
 		chartDB.Header.LastChanged = time.Now()
 	}
 
-	if _, err := datastore.Put(ctx, key, chartDB); err != nil {
+	if _, err := putSharedEntity(ctx, sharedTypeGChart, key, chartDB); err != nil {
 		if appengine.IsOverQuota(err) {
 			// return 503 and a text similar to what GAE is returning as well
-			addPlainTextError(response, http.StatusServiceUnavailable, "503 - Over Quota")
+			addError(request, response, http.StatusServiceUnavailable, errorCode_OverQuota, "503 - Over Quota")
 		} else {
-			addPlainTextError(response, http.StatusInternalServerError, err.Error())
+			addDatastoreError(request, response, err)
 		}
 		return
 	}
+	indexForSearch(ctx, sharedTypeGChart, key, chartDB)
 
 	// Response is Empty for 204
 	response.WriteHeaderAndEntity(http.StatusNoContent, "")
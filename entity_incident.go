@@ -0,0 +1,361 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Incident (incidententity) which is stored in DB - the explanation of an outage by the curators, linked to
+// the status entries which belong to it. The incidents are the public timeline of the GoldenCheetah website.
+// ---------------------------------------------------------------------------------------------------------------//
+type IncidentEntity struct {
+	Title       string    `datastore:",noindex"`
+	Description string    `datastore:",noindex"`
+	Severity    string    `datastore:",noindex"`
+	StartedAt   time.Time
+	ResolvedAt  time.Time `datastore:",noindex"` // zero while the incident is ongoing
+	StatusIds   []int64   `datastore:",noindex"`
+	CuratorId   string    `datastore:",noindex"`
+	LastChanged time.Time `datastore:",noindex"`
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+// Full structure for POST, PUT and GET
+type IncidentAPIv1 struct {
+	Id          int64   `json:"id"`
+	Title       string  `json:"title"`
+	Description string  `json:"description"`
+	Severity    string  `json:"severity"`
+	StartedAt   string  `json:"startedAt"`
+	ResolvedAt  string  `json:"resolvedAt"` // empty while the incident is ongoing
+	StatusIds   []int64 `json:"statusIds"`
+	Ongoing     bool    `json:"ongoing"`    // output only
+	LastChanged string  `json:"lastChanged"` // output only
+}
+
+type IncidentAPIv1List []IncidentAPIv1
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Data Storage View
+// ---------------------------------------------------------------------------------------------------------------//
+
+const incidentDBEntity = "incidententity"
+const incidentDBEntityRootKey = "incidentroot"
+
+const (
+	Incident_Minor    = "minor"
+	Incident_Major    = "major"
+	Incident_Critical = "critical"
+)
+
+var incidentSeverities = []string{Incident_Minor, Incident_Major, Incident_Critical}
+
+const maxIncidentTitleLength = 200
+const maxIncidentDescriptionLength = 10000
+const maxStatusIdsPerIncident = 100
+
+// the timeline is a page of incidents - newest first
+const maxNumberOfIncidentsPerCall = 100
+
+func mapAPItoDBIncident(api *IncidentAPIv1, db *IncidentEntity) {
+	db.Title = api.Title
+	db.Description = api.Description
+	db.Severity = api.Severity
+	db.StartedAt, _ = time.Parse(dateTimeLayout, api.StartedAt)
+	db.ResolvedAt = time.Time{}
+	if api.ResolvedAt != "" {
+		db.ResolvedAt, _ = time.Parse(dateTimeLayout, api.ResolvedAt)
+	}
+	db.StatusIds = api.StatusIds
+	db.LastChanged = time.Now()
+}
+
+func mapDBtoAPIIncident(db *IncidentEntity, api *IncidentAPIv1) {
+	api.Title = db.Title
+	api.Description = db.Description
+	api.Severity = db.Severity
+	api.StartedAt = db.StartedAt.Format(dateTimeLayout)
+	if !db.ResolvedAt.IsZero() {
+		api.ResolvedAt = db.ResolvedAt.Format(dateTimeLayout)
+	}
+	api.StatusIds = db.StatusIds
+	api.Ongoing = db.ResolvedAt.IsZero()
+	api.LastChanged = db.LastChanged.Format(dateTimeLayout)
+}
+
+func validateIncident(api *IncidentAPIv1) *validator {
+	v := new(validator)
+	v.required("title", api.Title)
+	v.maxLength("title", api.Title, maxIncidentTitleLength)
+	v.maxLength("description", api.Description, maxIncidentDescriptionLength)
+	if !isIncidentSeverity(api.Severity) {
+		v.fail("severity", fmt.Sprint("must be one of ", incidentSeverities))
+	}
+	v.required("startedAt", api.StartedAt)
+	v.dateTime("startedAt", api.StartedAt)
+	v.dateTime("resolvedAt", api.ResolvedAt)
+	if api.ResolvedAt != "" && api.ResolvedAt < api.StartedAt {
+		// same layout - the strings compare like the times
+		v.fail("resolvedAt", "must not be before startedAt")
+	}
+	if len(api.StatusIds) > maxStatusIdsPerIncident {
+		v.fail("statusIds", fmt.Sprint("must not have more than ", maxStatusIdsPerIncident, " entries"))
+	}
+	return v
+}
+
+// supporting functions
+
+// incidentEntityRootKey returns the key used for all incidentEntity entries.
+func incidentEntityRootKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, incidentDBEntity, incidentDBEntityRootKey, 0, nil)
+}
+
+func incidentKey(ctx context.Context, id string) (*datastore.Key, error) {
+	i, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return datastore.NewKey(ctx, incidentDBEntity, "", i, incidentEntityRootKey(ctx)), nil
+}
+
+func isIncidentSeverity(severity string) bool {
+	for _, s := range incidentSeverities {
+		if s == severity {
+			return true
+		}
+	}
+	return false
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+func insertIncident(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	incident := new(IncidentAPIv1)
+	if err := request.ReadEntity(incident); err != nil {
+		addError(request, response, http.StatusInternalServerError, errorCode_InvalidPayload, err.Error())
+		return
+	}
+
+	if v := validateIncident(incident); !v.valid() {
+		addValidationError(request, response, v)
+		return
+	}
+	if v, err := validateIncidentStatusIds(ctx, incident.StatusIds); err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	} else if !v.valid() {
+		addValidationError(request, response, v)
+		return
+	}
+
+	incidentDB := new(IncidentEntity)
+	mapAPItoDBIncident(incident, incidentDB)
+	incidentDB.CuratorId = request.QueryParameter("curatorId")
+
+	key := datastore.NewIncompleteKey(ctx, incidentDBEntity, incidentEntityRootKey(ctx))
+	key, err := datastore.Put(ctx, key, incidentDB)
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	// send back the key
+	response.WriteHeaderAndEntity(http.StatusCreated, strconv.FormatInt(key.IntID(), 10))
+}
+
+func updateIncident(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	key, err := incidentKey(ctx, request.PathParameter("id"))
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	incident := new(IncidentAPIv1)
+	if err := request.ReadEntity(incident); err != nil {
+		addError(request, response, http.StatusInternalServerError, errorCode_InvalidPayload, err.Error())
+		return
+	}
+
+	if v := validateIncident(incident); !v.valid() {
+		addValidationError(request, response, v)
+		return
+	}
+	if v, err := validateIncidentStatusIds(ctx, incident.StatusIds); err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	} else if !v.valid() {
+		addValidationError(request, response, v)
+		return
+	}
+
+	err = datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		incidentDB := new(IncidentEntity)
+		if err := datastore.Get(tc, key, incidentDB); err != nil && !isErrFieldMismatch(err) {
+			return err
+		}
+		mapAPItoDBIncident(incident, incidentDB)
+		incidentDB.CuratorId = request.QueryParameter("curatorId")
+		_, err := datastore.Put(tc, key, incidentDB)
+		return err
+	}, nil)
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	// Response is Empty for 204
+	response.WriteHeaderAndEntity(http.StatusNoContent, "")
+}
+
+func deleteIncident(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	key, err := incidentKey(ctx, request.PathParameter("id"))
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	if err := datastore.Delete(ctx, key); err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	// Response is Empty for 204
+	response.WriteHeaderAndEntity(http.StatusNoContent, "")
+}
+
+func getIncidentById(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	key, err := incidentKey(ctx, request.PathParameter("id"))
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	incidentDB := new(IncidentEntity)
+	if err := datastore.Get(ctx, key, incidentDB); err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	incident := IncidentAPIv1{Id: key.IntID()}
+	mapDBtoAPIIncident(incidentDB, &incident)
+
+	response.WriteHeaderAndEntity(http.StatusOK, incident)
+}
+
+// getIncidents is the public timeline - newest first, ongoing incidents included
+func getIncidents(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	q := datastore.NewQuery(incidentDBEntity).Ancestor(incidentEntityRootKey(ctx)).Order("-StartedAt").Limit(maxNumberOfIncidentsPerCall)
+
+	if dateFrom := request.QueryParameter("dateFrom"); dateFrom != "" {
+		date, err := time.Parse(dateTimeLayout, dateFrom)
+		if err != nil {
+			addError(request, response, http.StatusBadRequest, errorCode_BadRequest, fmt.Sprint(err.Error(), " - Correct format is ", dateTimeLayout))
+			return
+		}
+		q = q.Filter("StartedAt >=", date)
+	}
+
+	q, err := applyCursorParameter(request, q)
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	var incidentList IncidentAPIv1List
+	t := q.Run(ctx)
+	for {
+		var incidentDB IncidentEntity
+		k, err := t.Next(&incidentDB)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil && !isErrFieldMismatch(err) {
+			commonResponseErrorProcessing(request, response, err)
+			return
+		}
+		incident := IncidentAPIv1{Id: k.IntID()}
+		mapDBtoAPIIncident(&incidentDB, &incident)
+		incidentList = append(incidentList, incident)
+	}
+
+	// only a full page has a next one
+	var nextCursor string
+	if len(incidentList) == maxNumberOfIncidentsPerCall {
+		if cursor, err := t.Cursor(); err == nil {
+			nextCursor = cursor.String()
+		}
+	}
+
+	writeListResponse(request, response, incidentList, len(incidentList), nextCursor)
+}
+
+//---------------------------------------------------------------------------------------
+// internal functions
+//---------------------------------------------------------------------------------------
+
+// validateIncidentStatusIds checks that all linked status entries exist
+func validateIncidentStatusIds(ctx context.Context, statusIds []int64) (*validator, error) {
+	v := new(validator)
+	if len(statusIds) == 0 {
+		return v, nil
+	}
+
+	keys := make([]*datastore.Key, len(statusIds))
+	for i, id := range statusIds {
+		keys[i] = datastore.NewKey(ctx, statusDBEntity, "", id, statusEntityRootKey(ctx))
+	}
+	statusOnDBList := make([]StatusEntity, len(keys))
+	found, err := getEntities(ctx, keys, func(i int) interface{} { return &statusOnDBList[i] })
+	if err != nil {
+		return nil, err
+	}
+	for i, id := range statusIds {
+		if !found[i] {
+			v.fail(fmt.Sprint("statusIds[", i, "]"), fmt.Sprint("status ", id, " does not exist"))
+		}
+	}
+	return v, nil
+}
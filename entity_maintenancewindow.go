@@ -0,0 +1,314 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Maintenance window (maintenancewindowentity) which is stored in DB - a planned maintenance announced by the
+// curators, so the client can warn its users in advance. Unlike the maintenance mode (see "filter_maintenance.go")
+// a window does not block any request, it is information only.
+// ---------------------------------------------------------------------------------------------------------------//
+type MaintenanceWindowEntity struct {
+	Start              time.Time `datastore:",noindex"`
+	End                time.Time
+	Message            string    `datastore:",noindex"`
+	AffectedComponents []string  `datastore:",noindex"`
+	CuratorId          string    `datastore:",noindex"`
+	LastChanged        time.Time `datastore:",noindex"`
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+// Full structure for POST, PUT and GET
+type MaintenanceWindowAPIv1 struct {
+	Id                 int64    `json:"id"`
+	Start              string   `json:"start"`
+	End                string   `json:"end"`
+	Message            string   `json:"message"`
+	AffectedComponents []string `json:"affectedComponents"`
+	Active             bool     `json:"active"` // output only
+}
+
+type MaintenanceWindowAPIv1List []MaintenanceWindowAPIv1
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Memcache constants
+// ---------------------------------------------------------------------------------------------------------------//
+
+// all windows which did not end yet - the active one is selected when read
+const maintenanceWindowMemcacheKey = "maintenancewindows"
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Data Storage View
+// ---------------------------------------------------------------------------------------------------------------//
+
+const maintenanceWindowDBEntity = "maintenancewindowentity"
+const maintenanceWindowDBEntityRootKey = "maintenancewindowroot"
+
+const maxMaintenanceWindowComponents = 20
+const maxMaintenanceWindowComponentLength = 100
+
+// more are not announced - the client shows the next ones only
+const maxNumberOfUpcomingMaintenanceWindows = 20
+
+func mapAPItoDBMaintenanceWindow(api *MaintenanceWindowAPIv1, db *MaintenanceWindowEntity) {
+	db.Start, _ = time.Parse(dateTimeLayout, api.Start)
+	db.End, _ = time.Parse(dateTimeLayout, api.End)
+	db.Message = api.Message
+	db.AffectedComponents = api.AffectedComponents
+	db.LastChanged = time.Now()
+}
+
+func mapDBtoAPIMaintenanceWindow(db *MaintenanceWindowEntity, api *MaintenanceWindowAPIv1) {
+	api.Start = db.Start.Format(dateTimeLayout)
+	api.End = db.End.Format(dateTimeLayout)
+	api.Message = db.Message
+	api.AffectedComponents = db.AffectedComponents
+}
+
+func validateMaintenanceWindow(api *MaintenanceWindowAPIv1) *validator {
+	v := new(validator)
+	v.required("start", api.Start)
+	v.dateTime("start", api.Start)
+	v.required("end", api.End)
+	v.dateTime("end", api.End)
+	if api.Start != "" && api.End <= api.Start {
+		// same layout - the strings compare like the times
+		v.fail("end", "must be after start")
+	}
+	v.required("message", api.Message)
+	v.payloadSize("message", len(api.Message))
+	if len(api.AffectedComponents) > maxMaintenanceWindowComponents {
+		v.fail("affectedComponents", fmt.Sprint("must not have more than ", maxMaintenanceWindowComponents, " entries"))
+	}
+	for i, component := range api.AffectedComponents {
+		field := fmt.Sprint("affectedComponents[", i, "]")
+		v.required(field, component)
+		v.maxLength(field, component, maxMaintenanceWindowComponentLength)
+	}
+	return v
+}
+
+// supporting functions
+
+// maintenanceWindowEntityRootKey returns the key used for all maintenanceWindowEntity entries.
+func maintenanceWindowEntityRootKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, maintenanceWindowDBEntity, maintenanceWindowDBEntityRootKey, 0, nil)
+}
+
+func maintenanceWindowKey(ctx context.Context, id string) (*datastore.Key, error) {
+	i, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return datastore.NewKey(ctx, maintenanceWindowDBEntity, "", i, maintenanceWindowEntityRootKey(ctx)), nil
+}
+
+func (api *MaintenanceWindowAPIv1) isActive(now time.Time) bool {
+	start, _ := time.Parse(dateTimeLayout, api.Start)
+	end, _ := time.Parse(dateTimeLayout, api.End)
+	return !now.Before(start) && now.Before(end)
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+func insertMaintenanceWindow(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	window := new(MaintenanceWindowAPIv1)
+	if err := request.ReadEntity(window); err != nil {
+		addError(request, response, http.StatusInternalServerError, errorCode_InvalidPayload, err.Error())
+		return
+	}
+
+	if v := validateMaintenanceWindow(window); !v.valid() {
+		addValidationError(request, response, v)
+		return
+	}
+
+	windowDB := new(MaintenanceWindowEntity)
+	mapAPItoDBMaintenanceWindow(window, windowDB)
+	windowDB.CuratorId = request.QueryParameter("curatorId")
+
+	key := datastore.NewIncompleteKey(ctx, maintenanceWindowDBEntity, maintenanceWindowEntityRootKey(ctx))
+	key, err := datastore.Put(ctx, key, windowDB)
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	// the announced windows changed / ignore errors
+	memcache.Delete(ctx, maintenanceWindowMemcacheKey)
+
+	// send back the key
+	response.WriteHeaderAndEntity(http.StatusCreated, strconv.FormatInt(key.IntID(), 10))
+}
+
+func updateMaintenanceWindow(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	key, err := maintenanceWindowKey(ctx, request.PathParameter("id"))
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	window := new(MaintenanceWindowAPIv1)
+	if err := request.ReadEntity(window); err != nil {
+		addError(request, response, http.StatusInternalServerError, errorCode_InvalidPayload, err.Error())
+		return
+	}
+
+	if v := validateMaintenanceWindow(window); !v.valid() {
+		addValidationError(request, response, v)
+		return
+	}
+
+	err = datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		windowDB := new(MaintenanceWindowEntity)
+		if err := datastore.Get(tc, key, windowDB); err != nil && !isErrFieldMismatch(err) {
+			return err
+		}
+		mapAPItoDBMaintenanceWindow(window, windowDB)
+		windowDB.CuratorId = request.QueryParameter("curatorId")
+		_, err := datastore.Put(tc, key, windowDB)
+		return err
+	}, nil)
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	// the announced windows changed / ignore errors
+	memcache.Delete(ctx, maintenanceWindowMemcacheKey)
+
+	// Response is Empty for 204
+	response.WriteHeaderAndEntity(http.StatusNoContent, "")
+}
+
+func deleteMaintenanceWindow(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	key, err := maintenanceWindowKey(ctx, request.PathParameter("id"))
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	if err := datastore.Delete(ctx, key); err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	// the announced windows changed / ignore errors
+	memcache.Delete(ctx, maintenanceWindowMemcacheKey)
+
+	// Response is Empty for 204
+	response.WriteHeaderAndEntity(http.StatusNoContent, "")
+}
+
+// getUpcomingMaintenanceWindows returns the active and the planned windows - the next one first
+func getUpcomingMaintenanceWindows(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	windowList, err := internalGetUpcomingMaintenanceWindows(ctx)
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	writeListResponse(request, response, windowList, len(windowList), "")
+}
+
+//---------------------------------------------------------------------------------------
+// internal functions
+//---------------------------------------------------------------------------------------
+
+// internalGetUpcomingMaintenanceWindows returns the windows which did not end yet - the cached list is
+// filtered again, since windows end while they are cached
+func internalGetUpcomingMaintenanceWindows(ctx context.Context) (MaintenanceWindowAPIv1List, error) {
+	var cachedList MaintenanceWindowAPIv1List
+	_, err := memcache.Gob.Get(ctx, maintenanceWindowMemcacheKey, &cachedList)
+	countCacheLookup("maintenancewindow", err == nil)
+	if err != nil {
+		q := datastore.NewQuery(maintenanceWindowDBEntity).Ancestor(maintenanceWindowEntityRootKey(ctx)).
+			Filter("End >", time.Now()).Order("End").Limit(maxNumberOfUpcomingMaintenanceWindows)
+
+		var windowOnDBList []MaintenanceWindowEntity
+		k, err := q.GetAll(ctx, &windowOnDBList)
+		if err != nil && !isErrFieldMismatch(err) {
+			return nil, err
+		}
+
+		// DB Entity needs to be mapped back
+		cachedList = MaintenanceWindowAPIv1List{}
+		for i, windowDB := range windowOnDBList {
+			window := MaintenanceWindowAPIv1{Id: k[i].IntID()}
+			mapDBtoAPIMaintenanceWindow(&windowDB, &window)
+			cachedList = append(cachedList, window)
+		}
+
+		// add to memcache / overwrite existing / ignore errors
+		memcache.Gob.Set(ctx, &memcache.Item{Key: maintenanceWindowMemcacheKey, Object: cachedList, Expiration: cacheExpiration(ctx)})
+	}
+
+	now := time.Now()
+	windowList := MaintenanceWindowAPIv1List{}
+	for _, window := range cachedList {
+		if end, _ := time.Parse(dateTimeLayout, window.End); !now.Before(end) {
+			continue
+		}
+		window.Active = window.isActive(now)
+		windowList = append(windowList, window)
+	}
+	return windowList, nil
+}
+
+// internalGetActiveMaintenanceWindow returns the window which is active now - nil if there is none, errors
+// are only logged since the status must be answered anyway
+func internalGetActiveMaintenanceWindow(ctx context.Context) *MaintenanceWindowAPIv1 {
+	windowList, err := internalGetUpcomingMaintenanceWindows(ctx)
+	if err != nil {
+		logWarningf(ctx, "Maintenance windows not read: %v", err)
+		return nil
+	}
+	for i := range windowList {
+		if windowList[i].Active {
+			return &windowList[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/taskqueue"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Schema evolution - every stored entity carries a "SchemaVersion" property, older shapes are upgraded
+// step by step (on the property level) before they are mapped to the current struct
+// ---------------------------------------------------------------------------------------------------------------//
+
+// schemaUpgrade lifts the properties of one entity from version n to n+1
+type schemaUpgrade func(props []datastore.Property) []datastore.Property
+
+type entityMapper struct {
+	kind           string
+	currentVersion int
+	upgrades       []schemaUpgrade // upgrades[n] upgrades from version n to n+1
+}
+
+const schemaVersionProperty = "SchemaVersion"
+
+// version 0 entities were stored before the versioning was introduced - the shape is identical to version 1
+func unchangedShape(props []datastore.Property) []datastore.Property {
+	return props
+}
+
+// the structs of these kinds have a "SchemaVersion" field - so queries into the structs don't fail with
+// ErrFieldMismatch on the stamped property
+var entityMappers = map[string]*entityMapper{
+	chartDBEntity:      {kind: chartDBEntity, currentVersion: 1, upgrades: []schemaUpgrade{unchangedShape}},
+	gChartDBEntity:     {kind: gChartDBEntity, currentVersion: 1, upgrades: []schemaUpgrade{unchangedShape}},
+	usermetricDBEntity: {kind: usermetricDBEntity, currentVersion: 1, upgrades: []schemaUpgrade{unchangedShape}},
+	statusDBEntity:     {kind: statusDBEntity, currentVersion: 1, upgrades: []schemaUpgrade{unchangedShape}},
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+type MigrationAPIv1 struct {
+	Kind       string `json:"kind"`
+	Read       int    `json:"read"`
+	Migrated   int    `json:"migrated"`
+	NextCursor string `json:"nextCursor"`
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// mapper functions
+// ---------------------------------------------------------------------------------------------------------------//
+
+// upgrade returns the properties in the current shape (without the version property) and
+// the version the entity was stored with
+func (m *entityMapper) upgrade(props []datastore.Property) ([]datastore.Property, int) {
+	version := 0
+	var current []datastore.Property
+	for _, p := range props {
+		if p.Name == schemaVersionProperty {
+			if v, ok := p.Value.(int64); ok {
+				version = int(v)
+			}
+			continue
+		}
+		current = append(current, p)
+	}
+
+	for v := version; v < m.currentVersion && v < len(m.upgrades); v++ {
+		current = m.upgrades[v](current)
+	}
+	return current, version
+}
+
+// stamp sets the current version - the "SchemaVersion" saved from the struct is replaced
+func (m *entityMapper) stamp(props []datastore.Property) []datastore.Property {
+	var stamped []datastore.Property
+	for _, p := range props {
+		if p.Name != schemaVersionProperty {
+			stamped = append(stamped, p)
+		}
+	}
+	return append(stamped, datastore.Property{Name: schemaVersionProperty, Value: int64(m.currentVersion), NoIndex: true})
+}
+
+// load maps the (upgraded) properties to the current struct - unknown fields are logged and ignored
+func (m *entityMapper) load(ctx context.Context, key *datastore.Key, props []datastore.Property, dst interface{}) error {
+	current, _ := m.upgrade(props)
+	err := datastore.LoadStruct(dst, m.stamp(current))
+	if fieldErr, ok := err.(*datastore.ErrFieldMismatch); ok {
+		logWarningf(ctx, "Entity %v: field %s ignored - %s", key, fieldErr.FieldName, fieldErr.Reason)
+		return nil
+	}
+	return err
+}
+
+// getEntity replaces datastore.Get for all versioned kinds
+func getEntity(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	mapper, ok := entityMappers[key.Kind()]
+	if !ok {
+		err := datastore.Get(ctx, key, dst)
+		if isErrFieldMismatch(err) {
+			return nil
+		}
+		return err
+	}
+
+	var props datastore.PropertyList
+	if err := datastore.Get(ctx, key, &props); err != nil {
+		return err
+	}
+	return mapper.load(ctx, key, props, dst)
+}
+
+// getEntities replaces datastore.GetMulti for all versioned kinds - dst(i) returns the struct for keys[i],
+// missing entities are not an error but reported as not found
+func getEntities(ctx context.Context, keys []*datastore.Key, dst func(i int) interface{}) ([]bool, error) {
+	props := make([]datastore.PropertyList, len(keys))
+	err := datastore.GetMulti(ctx, keys, props)
+	multiErr, isMultiErr := err.(appengine.MultiError)
+	if err != nil && !isMultiErr {
+		return nil, err
+	}
+
+	found := make([]bool, len(keys))
+	for i, key := range keys {
+		if isMultiErr && multiErr[i] != nil {
+			if multiErr[i] == datastore.ErrNoSuchEntity {
+				continue
+			}
+			return nil, multiErr[i]
+		}
+		if mapper, ok := entityMappers[key.Kind()]; ok {
+			err = mapper.load(ctx, key, props[i], dst(i))
+		} else if err = datastore.LoadStruct(dst(i), props[i]); isErrFieldMismatch(err) {
+			err = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		found[i] = true
+	}
+	return found, nil
+}
+
+// putEntity replaces datastore.Put for all versioned kinds - it stores the current schema version
+func putEntity(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	mapper, ok := entityMappers[key.Kind()]
+	if !ok {
+		// entities which are no structs (PropertyLoadSaver) are not measured
+		if props, err := datastore.SaveStruct(src); err == nil {
+			if err := checkEntitySize(key, props); err != nil {
+				return nil, err
+			}
+		}
+		return datastore.Put(ctx, key, src)
+	}
+
+	props, err := datastore.SaveStruct(src)
+	if err != nil {
+		return nil, err
+	}
+	propertyList := datastore.PropertyList(mapper.stamp(props))
+	if err := checkEntitySize(key, propertyList); err != nil {
+		return nil, err
+	}
+	return datastore.Put(ctx, key, &propertyList)
+}
+
+// putEntities replaces datastore.PutMulti for all versioned kinds - src(i) returns the struct for keys[i]
+func putEntities(ctx context.Context, keys []*datastore.Key, src func(i int) interface{}) error {
+	propertyLists := make([]datastore.PropertyList, len(keys))
+	for i, key := range keys {
+		props, err := datastore.SaveStruct(src(i))
+		if err != nil {
+			return err
+		}
+		if mapper, ok := entityMappers[key.Kind()]; ok {
+			props = mapper.stamp(props)
+		}
+		if err := checkEntitySize(key, props); err != nil {
+			return err
+		}
+		propertyLists[i] = props
+	}
+	_, err := datastore.PutMulti(ctx, keys, propertyLists)
+	return err
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+// migrateEntities rewrites one bucket of legacy entities of {kind} in place and re-queues itself
+// with the cursor until all entities are processed
+func migrateEntities(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	kind := request.PathParameter("kind")
+	mapper, ok := entityMappers[kind]
+	if !ok {
+		addError(request, response, http.StatusNotFound, errorCode_NotFound, "Unknown kind - no mapper registered")
+		return
+	}
+
+	const maxNumberOfEntitiesPerTask = 100
+
+	q, err := applyCursorParameter(request, datastore.NewQuery(kind).Limit(maxNumberOfEntitiesPerTask))
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	var migration MigrationAPIv1
+	migration.Kind = kind
+
+	t := q.Run(ctx)
+	for {
+		var props datastore.PropertyList
+		key, err := t.Next(&props)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			commonResponseErrorProcessing(request, response, err)
+			return
+		}
+		migration.Read++
+
+		current, version := mapper.upgrade(props)
+		if version >= mapper.currentVersion {
+			continue
+		}
+		propertyList := datastore.PropertyList(mapper.stamp(current))
+		if _, err := datastore.Put(ctx, key, &propertyList); err != nil {
+			commonResponseErrorProcessing(request, response, err)
+			return
+		}
+		migration.Migrated++
+	}
+
+	migration.NextCursor = nextCursor(t, migration.Read, maxNumberOfEntitiesPerTask)
+	logInfof(ctx, "Migration of %s: %d read, %d migrated", kind, migration.Read, migration.Migrated)
+
+	// continue with the next bucket in a new task (new request deadline)
+	if migration.NextCursor != "" {
+		task := taskqueue.NewPOSTTask(fmt.Sprint(request.Request.URL.Path, "?", url.Values{"cursor": {migration.NextCursor}}.Encode()), nil)
+		if _, err := taskqueue.Add(ctx, addRequestHeadersToTask(request.Request, task), ""); err != nil {
+			commonResponseErrorProcessing(request, response, err)
+			return
+		}
+	}
+
+	response.WriteHeaderAndEntity(http.StatusOK, migration)
+}
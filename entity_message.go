@@ -0,0 +1,304 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Localized service messages (messageentity) which are stored in DB - translations of the status text, the
+// version and the maintenance message, child of the translated entity and keyed by locale. The text of the
+// entity itself is the "defaultLocale" one and is used if there is no translation for the client's languages.
+// ---------------------------------------------------------------------------------------------------------------//
+type MessageEntity struct {
+	Text       string    `datastore:",noindex"`
+	ChangeDate time.Time
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+type MessageAPIv1 struct {
+	Locale     string `json:"locale"`
+	Text       string `json:"text"`
+	ChangeDate string `json:"changeDate"`
+}
+
+type MessageAPIv1List []MessageAPIv1
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Memcache constants
+// ---------------------------------------------------------------------------------------------------------------//
+
+const messageMemcachePrefix = "messages/"
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Data Storage View
+// ---------------------------------------------------------------------------------------------------------------//
+
+const messageDBEntity = "messageentity"
+
+// the language of the texts stored with the status and the version
+const defaultLocale = "en"
+
+// e.g. "de", "pt-br", "zh-hant-tw" - compared in lower case
+var validLocale = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,8})*$`)
+
+func mapAPItoDBMessage(api *MessageAPIv1, db *MessageEntity) {
+	db.Text = api.Text
+	db.ChangeDate = time.Now()
+}
+
+func mapDBtoAPIMessage(db *MessageEntity, api *MessageAPIv1) {
+	api.Text = db.Text
+	api.ChangeDate = db.ChangeDate.Format(dateTimeLayout)
+}
+
+func validateMessage(api *MessageAPIv1) *validator {
+	v := new(validator)
+	v.required("text", api.Text)
+	v.payloadSize("text", len(api.Text))
+	return v
+}
+
+// supporting functions
+
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(locale), "_", "-", -1))
+}
+
+// acceptedLocales are the locales of the Accept-Language header by preference - "de-ch" is followed by "de"
+func acceptedLocales(request *restful.Request) []string {
+	type weighted struct {
+		locale string
+		q      float64
+	}
+	var accepted []weighted
+	for _, part := range strings.Split(request.HeaderParameter("Accept-Language"), ",") {
+		fields := strings.Split(part, ";")
+		locale := normalizeLocale(fields[0])
+		if !validLocale.MatchString(locale) {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			if param = strings.TrimSpace(param); strings.HasPrefix(param, "q=") {
+				if value, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = value
+				}
+			}
+		}
+		if q > 0 {
+			accepted = append(accepted, weighted{locale, q})
+		}
+	}
+	sort.SliceStable(accepted, func(i, j int) bool { return accepted[i].q > accepted[j].q })
+
+	var locales []string
+	seen := make(map[string]bool)
+	for _, a := range accepted {
+		for locale := a.locale; locale != ""; {
+			if !seen[locale] {
+				seen[locale] = true
+				locales = append(locales, locale)
+			}
+			i := strings.LastIndex(locale, "-")
+			if i < 0 {
+				break
+			}
+			locale = locale[:i]
+		}
+	}
+	return locales
+}
+
+// messagesOf returns all translations of the entity - cached, messages are read with every version check
+func messagesOf(ctx context.Context, parent *datastore.Key) (map[string]string, error) {
+	messages := make(map[string]string)
+	_, err := memcache.Gob.Get(ctx, messageMemcachePrefix+parent.Encode(), &messages)
+	countCacheLookup("message", err == nil)
+	if err == nil {
+		return messages, nil
+	}
+
+	var messageOnDBList []MessageEntity
+	k, err := datastore.NewQuery(messageDBEntity).Ancestor(parent).GetAll(ctx, &messageOnDBList)
+	if err != nil && !isErrFieldMismatch(err) {
+		return nil, err
+	}
+	for i, messageDB := range messageOnDBList {
+		messages[k[i].StringID()] = messageDB.Text
+	}
+
+	// add to memcache / overwrite existing / ignore errors
+	memcache.Gob.Set(ctx, &memcache.Item{Key: messageMemcachePrefix + parent.Encode(), Object: messages})
+	return messages, nil
+}
+
+// localizedMessage picks the best translation for the client and sets the Content-Language - errors just
+// fall back to the default text
+func localizedMessage(ctx context.Context, request *restful.Request, response *restful.Response, parent *datastore.Key, defaultText string) string {
+	locales := acceptedLocales(request)
+	if len(locales) > 0 {
+		messages, err := messagesOf(ctx, parent)
+		if err != nil {
+			logWarningf(ctx, "Messages of %s not read: %v", parent, err)
+		}
+		for _, locale := range locales {
+			if locale == defaultLocale {
+				break
+			}
+			if text, ok := messages[locale]; ok {
+				response.AddHeader("Content-Language", locale)
+				return text
+			}
+		}
+	}
+	response.AddHeader("Content-Language", defaultLocale)
+	return defaultText
+}
+
+// statusMessageParent is the status entry - translations are children of it
+func statusMessageParent(ctx context.Context, id string) (*datastore.Key, error) {
+	i, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return datastore.NewKey(ctx, statusDBEntity, "", i, statusEntityRootKey(ctx)), nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+func getStatusMessages(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	parent, err := statusMessageParent(ctx, request.PathParameter("id"))
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+	getMessages(request, response, parent)
+}
+
+func updateStatusMessage(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	parent, err := statusMessageParent(ctx, request.PathParameter("id"))
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+	updateMessage(request, response, parent)
+}
+
+func getVersionMessages(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+	getMessages(request, response, versionEntityCurrentKey(ctx))
+}
+
+func updateVersionMessage(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+	updateMessage(request, response, versionEntityCurrentKey(ctx))
+}
+
+func updateMaintenanceMessage(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+	updateMessage(request, response, maintenanceEntityCurrentKey(ctx))
+}
+
+// ------------------- supporting functions ------------------------------------------------
+
+func getMessages(request *restful.Request, response *restful.Response, parent *datastore.Key) {
+	ctx := newContext(request.Request)
+
+	var messageOnDBList []MessageEntity
+	k, err := datastore.NewQuery(messageDBEntity).Ancestor(parent).GetAll(ctx, &messageOnDBList)
+	if err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	var messageList MessageAPIv1List
+	for i, messageDB := range messageOnDBList {
+		var message MessageAPIv1
+		mapDBtoAPIMessage(&messageDB, &message)
+		message.Locale = k[i].StringID()
+		messageList = append(messageList, message)
+	}
+
+	writeListResponse(request, response, messageList, len(messageList), "")
+}
+
+// updateMessage stores the translation for {locale} - an empty text deletes it
+func updateMessage(request *restful.Request, response *restful.Response, parent *datastore.Key) {
+	ctx := newContext(request.Request)
+
+	locale := normalizeLocale(request.PathParameter("locale"))
+	if !validLocale.MatchString(locale) || locale == defaultLocale {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, "Invalid locale - e.g. de or pt-br, the default locale is the text of the entity itself")
+		return
+	}
+
+	message := new(MessageAPIv1)
+	if err := request.ReadEntity(message); err != nil {
+		addError(request, response, http.StatusInternalServerError, errorCode_InvalidPayload, err.Error())
+		return
+	}
+
+	key := datastore.NewKey(ctx, messageDBEntity, locale, 0, parent)
+	if message.Text == "" {
+		if err := datastore.Delete(ctx, key); err != nil && err != datastore.ErrNoSuchEntity {
+			commonResponseErrorProcessing(request, response, err)
+			return
+		}
+	} else {
+		if v := validateMessage(message); !v.valid() {
+			addValidationError(request, response, v)
+			return
+		}
+		messageDB := new(MessageEntity)
+		mapAPItoDBMessage(message, messageDB)
+		if _, err := datastore.Put(ctx, key, messageDB); err != nil {
+			commonResponseErrorProcessing(request, response, err)
+			return
+		}
+	}
+
+	// the next read fills the cache again / ignore errors
+	memcache.Delete(ctx, messageMemcachePrefix+parent.Encode())
+
+	// Response is Empty for 204
+	response.WriteHeaderAndEntity(http.StatusNoContent, "")
+}
@@ -0,0 +1,215 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Ownership - all GoldenCheetah installations share the Basic Auth secret, so each installation registers once
+// with POST /v1/client and gets a random client id and its secret (an HMAC of the id, so nothing is stored).
+// The caller is the client id sent in "X-CloudDB-Client-Id" - but only together with the matching secret in
+// "X-CloudDB-Client-Secret", ids of the payload or without the secret are never trusted. Only the owner or a
+// curator may change or delete a shared entity. Entities stored without a verified owner (existing ones and those
+// of installations which don't send credentials yet) stay open to every client, like before ownership existed.
+// ---------------------------------------------------------------------------------------------------------------//
+
+const clientIdHeader = "X-CloudDB-Client-Id"
+const clientSecretHeader = "X-CloudDB-Client-Secret"
+
+// the key the client secrets are derived from - all registered installations lose their ownership if it's changed
+const clientSecretKeyConfig = "Client_Secret_Key"
+
+const missingClientMessage = "Mandatory " + clientIdHeader + " and " + clientSecretHeader + " headers are missing or invalid"
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+type MineAPIv1 struct {
+	Charts      []CommonAPIHeaderOnlyV1 `json:"charts"`
+	GCharts     []CommonAPIHeaderOnlyV1 `json:"gcharts"`
+	UserMetrics []CommonAPIHeaderOnlyV1 `json:"usermetrics"`
+}
+
+// Response of POST /client - the secret can't be read again, the installation must keep it
+type ClientAPIv1 struct {
+	ClientId string `json:"clientId"`
+	Secret   string `json:"secret"`
+}
+
+// supporting functions
+
+func clientSecretKey() []byte {
+	return []byte(os.Getenv(clientSecretKeyConfig))
+}
+
+func clientSecret(clientId string) string {
+	mac := hmac.New(sha256.New, clientSecretKey())
+	mac.Write([]byte(clientId))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// requestOwnerId is the verified client id of the caller - "" if the id or its secret is missing or wrong
+func requestOwnerId(request *restful.Request) string {
+	clientId := request.HeaderParameter(clientIdHeader)
+	secret := request.HeaderParameter(clientSecretHeader)
+	if clientId == "" || secret == "" || len(clientSecretKey()) == 0 {
+		return ""
+	}
+	if !hmac.Equal([]byte(secret), []byte(clientSecret(clientId))) {
+		return ""
+	}
+	return clientId
+}
+
+// ownerId is the verified client id which stored the entity - "" for entities without one
+func ownerId(header *CommonEntityHeader) string {
+	return header.OwnerId
+}
+
+// isOwnerOrCurator checks the stored entity - curators identify with the "curatorId" parameter and its secret.
+// Unlike "mayChange" entities without an owner are curators only (share links, unlisted entities).
+func isOwnerOrCurator(ctx context.Context, request *restful.Request, header *CommonEntityHeader) bool {
+	if caller := requestOwnerId(request); caller != "" && caller == ownerId(header) {
+		return true
+	}
+	return internalIsCurator(ctx, requestCuratorId(request))
+}
+
+// errNotOwner is returned by the unit of work of "putSharedEntityRevision" if the editor may not change the entity
+var errNotOwner = errors.New("Forbidden - only the owner or a curator may change this entity")
+
+// editor is the caller of a change - resolved before the unit of work, the curator lookup is not transactional
+type editor struct {
+	clientId string
+	curator  bool
+}
+
+func requestEditor(ctx context.Context, request *restful.Request) *editor {
+	return &editor{clientId: requestOwnerId(request), curator: internalIsCurator(ctx, requestCuratorId(request))}
+}
+
+// mayChange checks the stored entity - entities without an owner may be changed by every client
+func (e *editor) mayChange(header *CommonEntityHeader) bool {
+	if ownerId(header) == "" || e.curator {
+		return true
+	}
+	return e.clientId != "" && e.clientId == ownerId(header)
+}
+
+// queryOwned calls "found" for every entity of {kind} owned by the client
+func queryOwned(ctx context.Context, kind string, clientId string, deletedOnly bool, found func(key *datastore.Key, header *CommonEntityHeader)) error {
+	const maxNumberOfOwnedEntities = 500
+
+	q := datastore.NewQuery(kind).Filter("Header.OwnerId =", clientId).Limit(maxNumberOfOwnedEntities)
+	if deletedOnly {
+		q = q.Filter("Header.Deleted =", true)
+	}
+	t := q.Run(ctx)
+	for {
+		var headerDB CommonEntityHeaderOnly
+		key, err := t.Next(&headerDB)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil && !isErrFieldMismatch(err) {
+			return err
+		}
+		found(key, &headerDB.Header)
+	}
+	return nil
+}
+
+// ownedHeaders returns the headers of all entities of {kind} owned by the client
+func ownedHeaders(ctx context.Context, kind string, clientId string) ([]CommonAPIHeaderOnlyV1, error) {
+	var headers []CommonAPIHeaderOnlyV1
+	err := queryOwned(ctx, kind, clientId, false, func(key *datastore.Key, headerDB *CommonEntityHeader) {
+		var header CommonAPIHeaderOnlyV1
+		mapDBtoAPICommonHeader(headerDB, &header.Header)
+		header.Header.Id = key.IntID()
+		header.Header.Key = key.StringID()
+		headers = append(headers, header)
+	})
+	return headers, err
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+// registerClient issues a new client id and its secret - no state is stored, the secret is derived from the id
+func registerClient(request *restful.Request, response *restful.Response) {
+	if len(clientSecretKey()) == 0 {
+		addError(request, response, http.StatusInternalServerError, errorCode_Internal, "Client secret configuration missing on Server")
+		return
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+	clientId := hex.EncodeToString(id)
+
+	response.AddHeader("Cache-Control", "no-store")
+	response.WriteHeaderAndEntity(http.StatusCreated, ClientAPIv1{ClientId: clientId, Secret: clientSecret(clientId)})
+}
+
+// getMine lists the headers of all charts, gcharts and usermetrics of the caller
+func getMine(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	clientId := requestOwnerId(request)
+	if clientId == "" {
+		addError(request, response, http.StatusUnauthorized, errorCode_Unauthorized, missingClientMessage)
+		return
+	}
+
+	var mine MineAPIv1
+	var err error
+	if mine.Charts, err = ownedHeaders(ctx, chartDBEntity, clientId); err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+	if mine.GCharts, err = ownedHeaders(ctx, gChartDBEntity, clientId); err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+	if mine.UserMetrics, err = ownedHeaders(ctx, usermetricDBEntity, clientId); err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	response.WriteHeaderAndEntity(http.StatusOK, mine)
+}
@@ -0,0 +1,317 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Rating and comment of shared content (ratingentity, commententity) which are stored in DB - both are
+// children of the rated entity, the rating key is the verified client id of the caller (one vote per client,
+// see "entity_owner.go")
+// ---------------------------------------------------------------------------------------------------------------//
+type RatingEntity struct {
+	Stars      int
+	RatingDate time.Time
+}
+
+type CommentEntity struct {
+	ClientId    string
+	Nickname    string       `datastore:",noindex"`
+	Text        string       `datastore:",noindex"`
+	CommentDate time.Time
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+// Structure for POST
+type RatingPostAPIv1 struct {
+	Stars int `json:"stars"`
+}
+
+// Aggregated rating for GET
+type RatingAPIv1 struct {
+	RatingCount   int     `json:"ratingCount"`
+	RatingAverage float64 `json:"ratingAverage"`
+}
+
+// Full structure for POST and GET
+type CommentAPIv1 struct {
+	Id          int64  `json:"id"`
+	ClientId    string `json:"clientId"`
+	Nickname    string `json:"nickname"`
+	Text        string `json:"text"`
+	CommentDate string `json:"commentDate"`
+}
+
+type CommentAPIv1List []CommentAPIv1
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Data Storage View
+// ---------------------------------------------------------------------------------------------------------------//
+
+const ratingDBEntity = "ratingentity"
+const commentDBEntity = "commententity"
+
+var errDuplicateRating = errors.New("Content was already rated by this client")
+
+func mapAPItoDBComment(api *CommentAPIv1, db *CommentEntity) {
+	db.ClientId = api.ClientId
+	db.Nickname = api.Nickname
+	db.Text = api.Text
+	db.CommentDate = time.Now()
+}
+
+func mapDBtoAPIComment(db *CommentEntity, api *CommentAPIv1) {
+	api.ClientId = db.ClientId
+	api.Nickname = db.Nickname
+	api.Text = db.Text
+	api.CommentDate = db.CommentDate.Format(dateTimeLayout)
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+func rateChartById(request *restful.Request, response *restful.Response) {
+	rateSharedEntity(request, response, sharedTypeChart, request.PathParameter("id"))
+}
+
+func rateGChartById(request *restful.Request, response *restful.Response) {
+	rateSharedEntity(request, response, sharedTypeGChart, request.PathParameter("id"))
+}
+
+func rateUserMetricByKey(request *restful.Request, response *restful.Response) {
+	rateSharedEntity(request, response, sharedTypeUserMetric, request.PathParameter("key"))
+}
+
+func getChartRatingById(request *restful.Request, response *restful.Response) {
+	getSharedEntityRating(request, response, sharedTypeChart, request.PathParameter("id"))
+}
+
+func getGChartRatingById(request *restful.Request, response *restful.Response) {
+	getSharedEntityRating(request, response, sharedTypeGChart, request.PathParameter("id"))
+}
+
+func getUserMetricRatingByKey(request *restful.Request, response *restful.Response) {
+	getSharedEntityRating(request, response, sharedTypeUserMetric, request.PathParameter("key"))
+}
+
+func insertChartComment(request *restful.Request, response *restful.Response) {
+	insertSharedEntityComment(request, response, sharedTypeChart)
+}
+
+func insertGChartComment(request *restful.Request, response *restful.Response) {
+	insertSharedEntityComment(request, response, sharedTypeGChart)
+}
+
+func getChartComments(request *restful.Request, response *restful.Response) {
+	getSharedEntityComments(request, response, sharedTypeChart)
+}
+
+func getGChartComments(request *restful.Request, response *restful.Response) {
+	getSharedEntityComments(request, response, sharedTypeGChart)
+}
+
+// ------------------- supporting functions ------------------------------------------------
+
+// rateSharedEntity stores the vote and the new average of the parent in one transaction
+func rateSharedEntity(request *restful.Request, response *restful.Response, entityType string, id string) {
+	ctx := newContext(request.Request)
+
+	clientId := requestOwnerId(request)
+	if clientId == "" {
+		addError(request, response, http.StatusUnauthorized, errorCode_Unauthorized, missingClientMessage)
+		return
+	}
+
+	rating := new(RatingPostAPIv1)
+	if err := request.ReadEntity(rating); err != nil {
+		addError(request, response, http.StatusInternalServerError, errorCode_InvalidPayload, err.Error())
+		return
+	}
+
+	if rating.Stars < 1 || rating.Stars > 5 {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, "Stars must be between 1 and 5")
+		return
+	}
+
+	sharedType := sharedEntityTypes[entityType]
+	key, err := sharedType.key(ctx, id)
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	// the rating and the aggregate of the entity are one unit of work
+	err = runUnitOfWork(ctx, func(tc context.Context, uow *unitOfWork) error {
+		entityDB := sharedType.newEntity()
+		if err := getEntity(tc, key, entityDB); err != nil {
+			return err
+		}
+
+		ratingKey := datastore.NewKey(tc, ratingDBEntity, clientId, 0, key)
+		var ratingDB RatingEntity
+		err := datastore.Get(tc, ratingKey, &ratingDB)
+		if err == nil {
+			return errDuplicateRating
+		}
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		ratingDB.Stars = rating.Stars
+		ratingDB.RatingDate = time.Now()
+		if _, err := datastore.Put(tc, ratingKey, &ratingDB); err != nil {
+			return err
+		}
+
+		header := entityDB.commonHeader()
+		sum := header.RatingAverage*float64(header.RatingCount) + float64(rating.Stars)
+		header.RatingCount++
+		header.RatingAverage = sum / float64(header.RatingCount)
+		if _, err := putEntity(tc, key, entityDB); err != nil {
+			return err
+		}
+		return logUpdate(tc, entityType, key, entityDB)
+	})
+
+	if err == errDuplicateRating {
+		addError(request, response, http.StatusConflict, errorCode_Conflict, err.Error())
+		return
+	}
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	// Response is Empty for 204
+	response.WriteHeaderAndEntity(http.StatusNoContent, "")
+}
+
+func getSharedEntityRating(request *restful.Request, response *restful.Response, entityType string, id string) {
+	ctx := newContext(request.Request)
+
+	sharedType := sharedEntityTypes[entityType]
+	key, err := sharedType.key(ctx, id)
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	entityDB := sharedType.newEntity()
+	if err := getEntity(ctx, key, entityDB); err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+	if !isListedOrOwned(ctx, request, entityDB.commonHeader()) {
+		addError(request, response, http.StatusNotFound, errorCode_NotFound, datastore.ErrNoSuchEntity.Error())
+		return
+	}
+
+	var rating RatingAPIv1
+	rating.RatingCount = entityDB.commonHeader().RatingCount
+	rating.RatingAverage = entityDB.commonHeader().RatingAverage
+
+	response.WriteHeaderAndEntity(http.StatusOK, rating)
+}
+
+func insertSharedEntityComment(request *restful.Request, response *restful.Response, entityType string) {
+	ctx := newContext(request.Request)
+
+	comment := new(CommentAPIv1)
+	if err := request.ReadEntity(comment); err != nil {
+		addError(request, response, http.StatusInternalServerError, errorCode_InvalidPayload, err.Error())
+		return
+	}
+
+	if comment.ClientId == "" || comment.Text == "" {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, "Mandatory clientId or text is missing")
+		return
+	}
+
+	sharedType := sharedEntityTypes[entityType]
+	key, err := sharedType.key(ctx, request.PathParameter("id"))
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	// only existing content can be commented
+	entityDB := sharedType.newEntity()
+	if err := getEntity(ctx, key, entityDB); err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	commentDB := new(CommentEntity)
+	mapAPItoDBComment(comment, commentDB)
+
+	commentKey := datastore.NewIncompleteKey(ctx, commentDBEntity, key)
+	commentKey, err = datastore.Put(ctx, commentKey, commentDB)
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	// send back the key
+	response.WriteHeaderAndEntity(http.StatusCreated, strconv.FormatInt(commentKey.IntID(), 10))
+}
+
+func getSharedEntityComments(request *restful.Request, response *restful.Response, entityType string) {
+	ctx := newContext(request.Request)
+
+	key, err := sharedEntityTypes[entityType].key(ctx, request.PathParameter("id"))
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	q := datastore.NewQuery(commentDBEntity).Ancestor(key).Order("CommentDate")
+
+	var commentOnDBList []CommentEntity
+	k, err := q.GetAll(ctx, &commentOnDBList)
+	if err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	// DB Entity needs to be mapped back
+	var commentList CommentAPIv1List
+	for i, commentDB := range commentOnDBList {
+		var comment CommentAPIv1
+		mapDBtoAPIComment(&commentDB, &comment)
+		comment.Id = k[i].IntID()
+		commentList = append(commentList, comment)
+	}
+
+	response.WriteHeaderAndEntity(http.StatusOK, commentList)
+}
@@ -0,0 +1,316 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/taskqueue"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Re-index runs (reindexentity) which are stored in DB - one per kind. A new indexed field only gets into the
+// datastore index with the next Put of an entity, so a run loads every entity into its current struct and
+// stores it again. The progress (cursor, batch) is stored after every batch, a retried task continues there.
+// ---------------------------------------------------------------------------------------------------------------//
+type ReindexEntity struct {
+	Started    time.Time
+	Finished   time.Time
+	Batch      int       // the next batch - its task carries the number
+	Cursor     string    `datastore:",noindex"`
+	Read       int       `datastore:",noindex"`
+	Written    int       `datastore:",noindex"`
+	ChangeDate time.Time
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+type ReindexAPIv1 struct {
+	Kind       string `json:"kind"`
+	Running    bool   `json:"running"`
+	Started    string `json:"started"`
+	Finished   string `json:"finished"`
+	Batch      int    `json:"batch"`
+	Read       int    `json:"read"`
+	Written    int    `json:"written"`
+	ChangeDate string `json:"changeDate"`
+}
+
+type ReindexAPIv1List []ReindexAPIv1
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Data Storage View
+// ---------------------------------------------------------------------------------------------------------------//
+
+const reindexDBEntity = "reindexentity"
+const reindexDBEntityRootKey = "reindexroot"
+
+const reindexQueue = "reindex"
+
+// one batch is one PutMulti - far below the 500 entities / 10MB of a datastore call
+const maxNumberOfEntitiesPerReindex = 100
+
+// the kinds which can be re-indexed - with the struct defining the current indexes
+var reindexKinds = map[string]func() interface{}{
+	chartDBEntity:      func() interface{} { return new(ChartEntity) },
+	gChartDBEntity:     func() interface{} { return new(GChartEntity) },
+	usermetricDBEntity: func() interface{} { return new(UserMetricEntity) },
+	statusDBEntity:     func() interface{} { return new(StatusEntity) },
+	curatorDBEntity:    func() interface{} { return new(CuratorEntity) },
+	flagDBEntity:       func() interface{} { return new(FlagEntity) },
+	ratingDBEntity:     func() interface{} { return new(RatingEntity) },
+	commentDBEntity:    func() interface{} { return new(CommentEntity) },
+}
+
+func mapDBtoAPIReindex(db *ReindexEntity, api *ReindexAPIv1) {
+	api.Running = !db.Started.IsZero() && db.Finished.IsZero()
+	api.Started = db.Started.Format(dateTimeLayout)
+	if !db.Finished.IsZero() {
+		api.Finished = db.Finished.Format(dateTimeLayout)
+	}
+	api.Batch = db.Batch
+	api.Read = db.Read
+	api.Written = db.Written
+	api.ChangeDate = db.ChangeDate.Format(dateTimeLayout)
+}
+
+// supporting functions
+
+func reindexEntityRootKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, reindexDBEntity, reindexDBEntityRootKey, 0, nil)
+}
+
+func reindexEntityKey(ctx context.Context, kind string) *datastore.Key {
+	return datastore.NewKey(ctx, reindexDBEntity, kind, 0, reindexEntityRootKey(ctx))
+}
+
+// reindexTask is the task of batch number "batch" - the run only accepts the one it expects
+func reindexTask(request *restful.Request, kind string, batch int) *taskqueue.Task {
+	path := fmt.Sprint("/v1/tasks/reindex/", kind, "?", url.Values{"batch": {strconv.Itoa(batch)}}.Encode())
+	return addRequestHeadersToTask(request.Request, taskqueue.NewPOSTTask(path, nil))
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+func getReindexRuns(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	var reindexOnDBList []ReindexEntity
+	k, err := datastore.NewQuery(reindexDBEntity).Ancestor(reindexEntityRootKey(ctx)).GetAll(ctx, &reindexOnDBList)
+	if err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	var reindexList ReindexAPIv1List
+	for i, reindexDB := range reindexOnDBList {
+		var reindex ReindexAPIv1
+		mapDBtoAPIReindex(&reindexDB, &reindex)
+		reindex.Kind = k[i].StringID()
+		reindexList = append(reindexList, reindex)
+	}
+
+	writeListResponse(request, response, reindexList, len(reindexList), "")
+}
+
+// startReindex starts a new run for {kind} - a running one is only replaced with "restart=true"
+func startReindex(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	kind := request.PathParameter("kind")
+	if _, ok := reindexKinds[kind]; !ok {
+		addError(request, response, http.StatusNotFound, errorCode_NotFound, "Unknown kind - not registered for re-indexing")
+		return
+	}
+	restart := request.QueryParameter("restart") == "true"
+
+	var running bool
+	reindexDB := new(ReindexEntity)
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		running = false
+		key := reindexEntityKey(tc, kind)
+		if err := datastore.Get(tc, key, reindexDB); err != nil && err != datastore.ErrNoSuchEntity && !isErrFieldMismatch(err) {
+			return err
+		}
+		if !reindexDB.Started.IsZero() && reindexDB.Finished.IsZero() && !restart {
+			running = true
+			return nil
+		}
+		// a new run starts with the next batch number - tasks of the replaced run are ignored
+		batch := reindexDB.Batch + 1
+		*reindexDB = ReindexEntity{Started: time.Now(), Batch: batch, ChangeDate: time.Now()}
+		if _, err := datastore.Put(tc, key, reindexDB); err != nil {
+			return err
+		}
+		_, err := taskqueue.Add(tc, reindexTask(request, kind, batch), reindexQueue)
+		return err
+	}, nil)
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+	if running {
+		addError(request, response, http.StatusConflict, errorCode_Conflict, "Re-index of "+kind+" is running - use restart=true to start it again")
+		return
+	}
+
+	logInfof(ctx, "Re-index of %s started", kind)
+
+	reindex := ReindexAPIv1{Kind: kind}
+	mapDBtoAPIReindex(reindexDB, &reindex)
+	response.WriteHeaderAndEntity(http.StatusAccepted, reindex)
+}
+
+// processReindex re-Puts one batch of {kind} and queues the next one - in the same transaction as the
+// progress, so every batch is queued exactly once. A task whose batch is not the expected one is outdated
+// (retry of a completed batch, replaced run) and does nothing.
+func processReindex(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	kind := request.PathParameter("kind")
+	newEntity, ok := reindexKinds[kind]
+	if !ok {
+		addError(request, response, http.StatusNotFound, errorCode_NotFound, "Unknown kind - not registered for re-indexing")
+		return
+	}
+	batch, err := strconv.Atoi(request.QueryParameter("batch"))
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	reindexDB := new(ReindexEntity)
+	if err := datastore.Get(ctx, reindexEntityKey(ctx, kind), reindexDB); err != nil && !isErrFieldMismatch(err) {
+		if err == datastore.ErrNoSuchEntity {
+			response.WriteHeaderAndEntity(http.StatusOK, ReindexAPIv1{Kind: kind})
+			return
+		}
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+	if batch != reindexDB.Batch || !reindexDB.Finished.IsZero() {
+		logInfof(ctx, "Re-index of %s: outdated task for batch %d ignored", kind, batch)
+		reindex := ReindexAPIv1{Kind: kind}
+		mapDBtoAPIReindex(reindexDB, &reindex)
+		response.WriteHeaderAndEntity(http.StatusOK, reindex)
+		return
+	}
+
+	q := datastore.NewQuery(kind).KeysOnly().Limit(maxNumberOfEntitiesPerReindex)
+	if reindexDB.Cursor != "" {
+		cursor, err := datastore.DecodeCursor(reindexDB.Cursor)
+		if err != nil {
+			addError(request, response, http.StatusInternalServerError, errorCode_Internal, err.Error())
+			return
+		}
+		q = q.Start(cursor)
+	}
+
+	var keys []*datastore.Key
+	t := q.Run(ctx)
+	for {
+		key, err := t.Next(nil)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			commonResponseErrorProcessing(request, response, err)
+			return
+		}
+		keys = append(keys, key)
+	}
+	cursor := nextCursor(t, len(keys), maxNumberOfEntitiesPerReindex)
+
+	// deleted in the meantime - only the found ones are written again
+	entities := make([]interface{}, len(keys))
+	found, err := getEntities(ctx, keys, func(i int) interface{} {
+		entities[i] = newEntity()
+		return entities[i]
+	})
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+	var foundKeys []*datastore.Key
+	var foundEntities []interface{}
+	for i := range keys {
+		if found[i] {
+			foundKeys = append(foundKeys, keys[i])
+			foundEntities = append(foundEntities, entities[i])
+		}
+	}
+	if err := putEntities(ctx, foundKeys, func(i int) interface{} { return foundEntities[i] }); err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	err = datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		current := new(ReindexEntity)
+		if err := datastore.Get(tc, reindexEntityKey(tc, kind), current); err != nil && !isErrFieldMismatch(err) {
+			return err
+		}
+		// replaced by a restart while the batch was written
+		if current.Batch != batch {
+			*reindexDB = *current
+			return nil
+		}
+		*reindexDB = *current
+		reindexDB.Batch++
+		reindexDB.Cursor = cursor
+		reindexDB.Read += len(keys)
+		reindexDB.Written += len(foundKeys)
+		reindexDB.ChangeDate = time.Now()
+		if cursor == "" {
+			reindexDB.Finished = time.Now()
+		}
+		if _, err := datastore.Put(tc, reindexEntityKey(tc, kind), reindexDB); err != nil {
+			return err
+		}
+		if cursor == "" {
+			return nil
+		}
+		_, err := taskqueue.Add(tc, reindexTask(request, kind, reindexDB.Batch), reindexQueue)
+		return err
+	}, nil)
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	if !reindexDB.Finished.IsZero() {
+		logInfof(ctx, "Re-index of %s finished: %d read, %d written", kind, reindexDB.Read, reindexDB.Written)
+	}
+
+	reindex := ReindexAPIv1{Kind: kind}
+	mapDBtoAPIReindex(reindexDB, &reindex)
+	response.WriteHeaderAndEntity(http.StatusOK, reindex)
+}
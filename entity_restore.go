@@ -0,0 +1,616 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+	"google.golang.org/appengine/taskqueue"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Restore runs (restorerunentity) which are stored in DB - the files of a backup run (see "entity_backup.go")
+// are written back kind by kind. Every kind is a chain of tasks, each restores one batch of a file and stores
+// the position (restorekindentity, child of the run) in the same transaction as the entities and the next task.
+// So a retried or outdated task finds another position and does nothing - the restore is idempotent and can
+// be continued after any failure. The hash of a file is checked before its first batch.
+// ---------------------------------------------------------------------------------------------------------------//
+type RestoreRunEntity struct {
+	BackupId  int64
+	Kinds     []string `datastore:",noindex"`
+	Policy    string   `datastore:",noindex"`
+	DryRun    bool     `datastore:",noindex"`
+	CuratorId string   `datastore:",noindex"`
+	Started   time.Time
+	Finished  time.Time
+	KindsDone []string `datastore:",noindex"`
+	Failed    string   `datastore:",noindex"` // a file with a wrong hash stops the whole run
+}
+
+type RestoreKindEntity struct {
+	Part       int
+	Offset     int64 // position in the file of the part
+	Read       int
+	Written    int
+	Skipped    int
+	Duplicated int
+	Done       bool
+	ChangeDate time.Time
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+type RestoreAPIv1 struct {
+	Id        int64                 `json:"id"`         // output only
+	BackupId  int64                 `json:"backupId"`
+	Kinds     []string              `json:"kinds"`      // default: all kinds of the backup
+	Policy    string                `json:"policy"`     // skip (default), overwrite or duplicate
+	DryRun    bool                  `json:"dryRun"`     // only count what would be written
+	CuratorId string                `json:"curatorId"`  // output only
+	Started   string                `json:"started"`    // output only
+	Finished  string                `json:"finished"`   // output only
+	Running   bool                  `json:"running"`    // output only
+	Failed    string                `json:"failed"`     // output only
+	Progress  []RestoreKindAPIv1    `json:"progress"`   // output only
+}
+
+type RestoreKindAPIv1 struct {
+	Kind       string `json:"kind"`
+	Part       int    `json:"part"`
+	Read       int    `json:"read"`
+	Written    int    `json:"written"`
+	Skipped    int    `json:"skipped"`
+	Duplicated int    `json:"duplicated"`
+	Done       bool   `json:"done"`
+}
+
+type RestoreAPIv1List []RestoreAPIv1
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Data Storage View
+// ---------------------------------------------------------------------------------------------------------------//
+
+const restoreRunDBEntity = "restorerunentity"
+const restoreRunDBEntityRootKey = "restoreroot"
+const restoreKindDBEntity = "restorekindentity"
+
+const restoreQueue = "restore"
+
+// conflict policies - for entities which exist with the same key
+const (
+	Restore_Skip      = "skip"
+	Restore_Overwrite = "overwrite"
+	Restore_Duplicate = "duplicate" // stored with a new id next to the existing one
+)
+
+// one batch is one cross-group transaction - max. 25 entity groups (one is the run) and 10MB
+const maxNumberOfEntitiesPerRestore = 100
+const maxNumberOfGroupsPerRestore = 24
+const maxBytesPerRestore = 8 * 1000 * 1000
+
+func mapAPItoDBRestore(api *RestoreAPIv1, db *RestoreRunEntity) {
+	db.BackupId = api.BackupId
+	db.Kinds = api.Kinds
+	if len(db.Kinds) == 0 {
+		db.Kinds = backupKinds
+	}
+	db.Policy = api.Policy
+	if db.Policy == "" {
+		db.Policy = Restore_Skip
+	}
+	db.DryRun = api.DryRun
+	db.Started = time.Now()
+}
+
+func mapDBtoAPIRestore(db *RestoreRunEntity, api *RestoreAPIv1) {
+	api.BackupId = db.BackupId
+	api.Kinds = db.Kinds
+	api.Policy = db.Policy
+	api.DryRun = db.DryRun
+	api.CuratorId = db.CuratorId
+	api.Started = db.Started.Format(dateTimeLayout)
+	if !db.Finished.IsZero() {
+		api.Finished = db.Finished.Format(dateTimeLayout)
+	}
+	api.Running = db.Finished.IsZero()
+	api.Failed = db.Failed
+}
+
+func mapDBtoAPIRestoreKind(db *RestoreKindEntity, api *RestoreKindAPIv1) {
+	api.Part = db.Part
+	api.Read = db.Read
+	api.Written = db.Written
+	api.Skipped = db.Skipped
+	api.Duplicated = db.Duplicated
+	api.Done = db.Done
+}
+
+func validateRestore(api *RestoreAPIv1) *validator {
+	v := new(validator)
+	if api.BackupId <= 0 {
+		v.fail("backupId", "is mandatory")
+	}
+	known := make(map[string]bool)
+	for _, kind := range backupKinds {
+		known[kind] = true
+	}
+	for _, kind := range api.Kinds {
+		if !known[kind] {
+			v.fail("kinds", fmt.Sprint(kind, " is not a kind of the backup"))
+		}
+	}
+	switch api.Policy {
+	case "", Restore_Skip, Restore_Overwrite, Restore_Duplicate:
+	default:
+		v.fail("policy", "must be skip, overwrite or duplicate")
+	}
+	return v
+}
+
+// supporting functions
+
+func restoreRunEntityRootKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, restoreRunDBEntity, restoreRunDBEntityRootKey, 0, nil)
+}
+
+func restoreRunEntityKey(ctx context.Context, id int64) *datastore.Key {
+	return datastore.NewKey(ctx, restoreRunDBEntity, "", id, restoreRunEntityRootKey(ctx))
+}
+
+func restoreKindEntityKey(ctx context.Context, run *datastore.Key, kind string) *datastore.Key {
+	return datastore.NewKey(ctx, restoreKindDBEntity, kind, 0, run)
+}
+
+// restoreTask is the task of the position part/offset - the task only runs if the kind is still there
+func restoreTask(request *restful.Request, id int64, kind string, part int, offset int64) *taskqueue.Task {
+	path := fmt.Sprint("/v1/tasks/restore/", id, "/", kind, "?",
+		url.Values{"part": {strconv.Itoa(part)}, "offset": {strconv.FormatInt(offset, 10)}}.Encode())
+	return addRequestHeadersToTask(request.Request, taskqueue.NewPOSTTask(path, nil))
+}
+
+// decodeBackupRecord is the reverse of "encodeBackupRecord"
+func decodeBackupRecord(record *BackupRecordAPIv1) (*datastore.Key, datastore.PropertyList, error) {
+	key, err := datastore.DecodeKey(record.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+	props := make(datastore.PropertyList, len(record.Properties))
+	for i, p := range record.Properties {
+		props[i] = datastore.Property{Name: p.Name, NoIndex: p.NoIndex, Multiple: p.Multiple}
+		s, _ := p.Value.(string)
+		switch p.Type {
+		case "null":
+			props[i].Value = nil
+		case "int":
+			props[i].Value, err = strconv.ParseInt(s, 10, 64)
+		case "bool", "string", "float":
+			props[i].Value = p.Value
+		case "time":
+			props[i].Value, err = time.Parse(time.RFC3339Nano, s)
+		case "bytes":
+			props[i].Value, err = base64.StdEncoding.DecodeString(s)
+		case "bytestring":
+			var b []byte
+			b, err = base64.StdEncoding.DecodeString(s)
+			props[i].Value = datastore.ByteString(b)
+		case "key":
+			props[i].Value, err = datastore.DecodeKey(s)
+		case "geo":
+			var geo appengine.GeoPoint
+			data, _ := json.Marshal(p.Value)
+			err = json.Unmarshal(data, &geo)
+			props[i].Value = geo
+		default:
+			err = fmt.Errorf("Property %s has the unknown type %s", p.Name, p.Type)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return key, props, nil
+}
+
+func rootKey(key *datastore.Key) *datastore.Key {
+	for key.Parent() != nil {
+		key = key.Parent()
+	}
+	return key
+}
+
+// verifyBackupFile compares the SHA-256 of the object with the one recorded by the backup
+func verifyBackupFile(ctx context.Context, bucket *storage.BucketHandle, fileDB *BackupFileEntity) error {
+	r, err := bucket.Object(fileDB.Object).NewReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return err
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != fileDB.Hash {
+		return fmt.Errorf("%s does not match the hash of the backup - the file was changed", fileDB.Object)
+	}
+	return nil
+}
+
+// readRestoreBatch reads the records from offset on - up to the limits of one transaction. Returns the
+// offset after the batch, which is the size of the object at the end of the file.
+func readRestoreBatch(ctx context.Context, bucket *storage.BucketHandle, object string, offset int64) ([]*datastore.Key, []datastore.PropertyList, int64, error) {
+	r, err := bucket.Object(object).NewRangeReader(ctx, offset, -1)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer r.Close()
+
+	var keys []*datastore.Key
+	var entities []datastore.PropertyList
+	groups := make(map[string]bool)
+	var bytes int64
+
+	reader := bufio.NewReaderSize(r, 64*1024)
+	for len(keys) < maxNumberOfEntitiesPerRestore {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return nil, nil, 0, err
+		}
+
+		var record BackupRecordAPIv1
+		if err := json.Unmarshal(line, &record); err != nil {
+			return nil, nil, 0, err
+		}
+		key, props, err := decodeBackupRecord(&record)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+
+		// the record is left for the next batch if it doesn't fit into the transaction
+		group := rootKey(key).Encode()
+		if len(keys) > 0 && ((!groups[group] && len(groups) == maxNumberOfGroupsPerRestore) || bytes+int64(len(line)) > maxBytesPerRestore) {
+			break
+		}
+		groups[group] = true
+		bytes += int64(len(line))
+		keys = append(keys, key)
+		entities = append(entities, props)
+	}
+	return keys, entities, offset + bytes, nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+func getRestores(request *restful.Request, response *restful.Response) {
+	ctx := newDefaultContext(request.Request)
+
+	var runOnDBList []RestoreRunEntity
+	k, err := datastore.NewQuery(restoreRunDBEntity).Ancestor(restoreRunEntityRootKey(ctx)).Order("-Started").Limit(10).GetAll(ctx, &runOnDBList)
+	if err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	var restoreList RestoreAPIv1List
+	for i, runDB := range runOnDBList {
+		restore := RestoreAPIv1{Id: k[i].IntID()}
+		mapDBtoAPIRestore(&runDB, &restore)
+
+		var kindOnDBList []RestoreKindEntity
+		kk, err := datastore.NewQuery(restoreKindDBEntity).Ancestor(k[i]).GetAll(ctx, &kindOnDBList)
+		if err != nil && !isErrFieldMismatch(err) {
+			commonResponseErrorProcessing(request, response, err)
+			return
+		}
+		for j, kindDB := range kindOnDBList {
+			progress := RestoreKindAPIv1{Kind: kk[j].StringID()}
+			mapDBtoAPIRestoreKind(&kindDB, &progress)
+			restore.Progress = append(restore.Progress, progress)
+		}
+		restoreList = append(restoreList, restore)
+	}
+
+	writeListResponse(request, response, restoreList, len(restoreList), "")
+}
+
+// startRestore starts a run with one task chain per kind - the backup must be complete
+func startRestore(request *restful.Request, response *restful.Response) {
+	ctx := newDefaultContext(request.Request)
+
+	restore := new(RestoreAPIv1)
+	if err := request.ReadEntity(restore); err != nil {
+		addError(request, response, http.StatusInternalServerError, errorCode_InvalidPayload, err.Error())
+		return
+	}
+	if v := validateRestore(restore); !v.valid() {
+		addValidationError(request, response, v)
+		return
+	}
+
+	backupDB := new(BackupRunEntity)
+	if err := datastore.Get(ctx, backupRunEntityKey(ctx, restore.BackupId), backupDB); err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+	if backupDB.Finished.IsZero() {
+		addError(request, response, http.StatusConflict, errorCode_Conflict, "Backup is not finished - only complete backups can be restored")
+		return
+	}
+
+	runDB := new(RestoreRunEntity)
+	mapAPItoDBRestore(restore, runDB)
+	runDB.CuratorId = request.QueryParameter("curatorId")
+
+	var key *datastore.Key
+	err := runUnitOfWork(ctx, func(tc context.Context, uow *unitOfWork) error {
+		var err error
+		key, err = datastore.Put(tc, datastore.NewIncompleteKey(tc, restoreRunDBEntity, restoreRunEntityRootKey(tc)), runDB)
+		if err != nil {
+			return err
+		}
+		keys := make([]*datastore.Key, len(runDB.Kinds))
+		kinds := make([]RestoreKindEntity, len(runDB.Kinds))
+		for i, kind := range runDB.Kinds {
+			keys[i] = restoreKindEntityKey(tc, key, kind)
+			kinds[i].ChangeDate = time.Now()
+		}
+		_, err = datastore.PutMulti(tc, keys, kinds)
+		return err
+	})
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	// the first task of every kind - the position (part 0, offset 0) makes it idempotent
+	tasks := make([]*taskqueue.Task, len(runDB.Kinds))
+	for i, kind := range runDB.Kinds {
+		tasks[i] = restoreTask(request, key.IntID(), kind, 0, 0)
+	}
+	if _, err := taskqueue.AddMulti(ctx, tasks, restoreQueue); err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	logInfof(ctx, "Restore %d of backup %d started by %s - policy %s, dry run %t", key.IntID(), runDB.BackupId, runDB.CuratorId, runDB.Policy, runDB.DryRun)
+
+	restore.Id = key.IntID()
+	mapDBtoAPIRestore(runDB, restore)
+	response.WriteHeaderAndEntity(http.StatusAccepted, restore)
+}
+
+// processRestore restores one batch of {kind} at the position part/offset - in one transaction with the new
+// position and the task of the next batch
+func processRestore(request *restful.Request, response *restful.Response) {
+	ctx := newDefaultContext(request.Request)
+
+	id, err := strconv.ParseInt(request.PathParameter("id"), 10, 64)
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+	kind := request.PathParameter("kind")
+	part, err := strconv.Atoi(request.QueryParameter("part"))
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+	offset, err := strconv.ParseInt(request.QueryParameter("offset"), 10, 64)
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	runKey := restoreRunEntityKey(ctx, id)
+	runDB := new(RestoreRunEntity)
+	if err := datastore.Get(ctx, runKey, runDB); err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+	if runDB.Failed != "" {
+		response.WriteHeaderAndEntity(http.StatusOK, "")
+		return
+	}
+
+	// the file of the part - none is the end of the kind
+	backupKey := backupRunEntityKey(ctx, runDB.BackupId)
+	fileDB := new(BackupFileEntity)
+	fileFound := true
+	if err := datastore.Get(ctx, backupFileEntityKey(ctx, backupKey, kind, part), fileDB); err == datastore.ErrNoSuchEntity {
+		fileFound = false
+	} else if err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	var keys []*datastore.Key
+	var entities []datastore.PropertyList
+	next := offset
+	if fileFound {
+		backupDB := new(BackupRunEntity)
+		if err := datastore.Get(ctx, backupKey, backupDB); err != nil && !isErrFieldMismatch(err) {
+			commonResponseErrorProcessing(request, response, err)
+			return
+		}
+		client, err := storage.NewClient(ctx)
+		if err != nil {
+			commonResponseErrorProcessing(request, response, err)
+			return
+		}
+		defer client.Close()
+		bucket := client.Bucket(backupDB.Bucket)
+
+		if offset == 0 {
+			if err := verifyBackupFile(ctx, bucket, fileDB); err != nil {
+				logErrorf(ctx, "Restore %d stopped: %v", id, err)
+				runDB.Failed = err.Error()
+				runDB.Finished = time.Now()
+				if _, err := datastore.Put(ctx, runKey, runDB); err != nil {
+					commonResponseErrorProcessing(request, response, err)
+					return
+				}
+				response.WriteHeaderAndEntity(http.StatusOK, "")
+				return
+			}
+		}
+
+		if keys, entities, next, err = readRestoreBatch(ctx, bucket, fileDB.Object, offset); err != nil {
+			commonResponseErrorProcessing(request, response, err)
+			return
+		}
+	}
+
+	var outdated bool
+	kindDB := new(RestoreKindEntity)
+	err = runUnitOfWork(ctx, func(tc context.Context, uow *unitOfWork) error {
+		outdated = false
+		kindKey := restoreKindEntityKey(tc, runKey, kind)
+		if err := datastore.Get(tc, kindKey, kindDB); err != nil && !isErrFieldMismatch(err) {
+			return err
+		}
+		// retry of a completed batch - the position moved on
+		if kindDB.Done || kindDB.Part != part || kindDB.Offset != offset {
+			outdated = true
+			return nil
+		}
+
+		if !fileFound {
+			kindDB.Done = true
+			current := new(RestoreRunEntity)
+			if err := datastore.Get(tc, runKey, current); err != nil && !isErrFieldMismatch(err) {
+				return err
+			}
+			current.KindsDone = append(current.KindsDone, kind)
+			if len(current.KindsDone) == len(current.Kinds) {
+				current.Finished = time.Now()
+				if !current.DryRun {
+					// cached lists, status, configuration,... may be older than the restored entities
+					uow.onCommit(func(ctx context.Context) { memcache.Flush(ctx) })
+				}
+			}
+			if _, err := datastore.Put(tc, runKey, current); err != nil {
+				return err
+			}
+		} else {
+			if err := restoreBatch(tc, runDB, kindDB, keys, entities); err != nil {
+				return err
+			}
+			// the end of a file continues with the next part
+			kindDB.Offset = next
+			if len(keys) == 0 {
+				kindDB.Part++
+				kindDB.Offset = 0
+			}
+			if _, err := taskqueue.Add(tc, restoreTask(request, id, kind, kindDB.Part, kindDB.Offset), restoreQueue); err != nil {
+				return err
+			}
+		}
+
+		kindDB.ChangeDate = time.Now()
+		_, err := datastore.Put(tc, kindKey, kindDB)
+		return err
+	})
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	if !outdated && !fileFound {
+		logInfof(ctx, "Restore %d of %s done: %d read, %d written, %d skipped, %d duplicated", id, kind, kindDB.Read, kindDB.Written, kindDB.Skipped, kindDB.Duplicated)
+	}
+	response.WriteHeaderAndEntity(http.StatusOK, "")
+}
+
+//---------------------------------------------------------------------------------------
+// internal functions
+//---------------------------------------------------------------------------------------
+
+// restoreBatch writes the entities according to the policy of the run - a dry run only counts
+func restoreBatch(tc context.Context, runDB *RestoreRunEntity, kindDB *RestoreKindEntity, keys []*datastore.Key, entities []datastore.PropertyList) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	kindDB.Read += len(keys)
+
+	exists := make([]bool, len(keys))
+	if runDB.Policy != Restore_Overwrite {
+		existing := make([]datastore.PropertyList, len(keys))
+		err := datastore.GetMulti(tc, keys, existing)
+		multiErr, isMultiErr := err.(appengine.MultiError)
+		if err != nil && !isMultiErr {
+			return err
+		}
+		for i := range keys {
+			if isMultiErr && multiErr[i] != nil {
+				if multiErr[i] != datastore.ErrNoSuchEntity {
+					return multiErr[i]
+				}
+				continue
+			}
+			exists[i] = true
+		}
+	}
+
+	var putKeys []*datastore.Key
+	var putEntities []datastore.PropertyList
+	for i, key := range keys {
+		switch {
+		case !exists[i]:
+			putKeys = append(putKeys, key)
+			kindDB.Written++
+		case runDB.Policy == Restore_Duplicate:
+			putKeys = append(putKeys, datastore.NewIncompleteKey(tc, key.Kind(), key.Parent()))
+			kindDB.Duplicated++
+		default:
+			kindDB.Skipped++
+			continue
+		}
+		putEntities = append(putEntities, entities[i])
+	}
+
+	if runDB.DryRun || len(putKeys) == 0 {
+		return nil
+	}
+	_, err := datastore.PutMulti(tc, putKeys, putEntities)
+	return err
+}
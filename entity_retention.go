@@ -0,0 +1,289 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Retention configuration (retentionentity) which is stored in DB - the kind is the key, the cursor
+// of an unfinished cleanup is kept so the next cron run resumes where the last one stopped
+// ---------------------------------------------------------------------------------------------------------------//
+type RetentionEntity struct {
+	MaxAgeDays int
+	Cursor     string       `datastore:",noindex"`
+	Expiry     time.Time    `datastore:",noindex"`
+	LastRun    time.Time
+	Deleted    int          `datastore:",noindex"`
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+// Full structure for PUT and GET
+type RetentionAPIv1 struct {
+	Kind       string `json:"kind"`
+	MaxAgeDays int    `json:"maxAgeDays"`
+	LastRun    string `json:"lastRun"`
+	Deleted    int    `json:"deleted"`
+}
+
+type RetentionAPIv1List []RetentionAPIv1
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Data Storage View
+// ---------------------------------------------------------------------------------------------------------------//
+
+const retentionDBEntity = "retentionentity"
+const retentionDBEntityRootKey = "retentionroot"
+
+// time-series kinds which can be cleaned up - further kinds (e.g. audit) just need to be registered here
+type retentionKind struct {
+	dateProperty string
+	childKinds   []string // children are deleted together with their parent
+	keepNewest   bool     // the newest entry is never deleted (e.g. the current status)
+}
+
+var retentionKinds = map[string]retentionKind{
+	statusDBEntity:      {dateProperty: "ChangeDate", childKinds: []string{statusDBEntityText, messageDBEntity}, keepNewest: true},
+	telemetryDBEntity:   {dateProperty: "ReceivedDate"},
+	changeLogDBEntity:   {dateProperty: "ChangeDate"},
+	clientDailyDBEntity: {dateProperty: "ChangeDate"},
+}
+
+func mapDBtoAPIRetention(db *RetentionEntity, api *RetentionAPIv1) {
+	api.MaxAgeDays = db.MaxAgeDays
+	if !db.LastRun.IsZero() {
+		api.LastRun = db.LastRun.Format(dateTimeLayout)
+	}
+	api.Deleted = db.Deleted
+}
+
+// supporting functions
+
+// retentionEntityRootKey returns the key used for all retentionEntity entries.
+func retentionEntityRootKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, retentionDBEntity, retentionDBEntityRootKey, 0, nil)
+}
+
+// newestDate is the latest {property} of all entries of {kind} - zero if there are none
+func newestDate(ctx context.Context, kind string, property string) (time.Time, error) {
+	var newest []datastore.PropertyList
+	if _, err := datastore.NewQuery(kind).Project(property).Order("-"+property).Limit(1).GetAll(ctx, &newest); err != nil {
+		return time.Time{}, err
+	}
+	if len(newest) == 0 {
+		return time.Time{}, nil
+	}
+	for _, p := range newest[0] {
+		if date, ok := p.Value.(time.Time); ok && p.Name == property {
+			return date, nil
+		}
+	}
+	return time.Time{}, nil
+}
+
+// deleteWithChildren deletes the entities and all their children of {childKinds}
+func deleteWithChildren(ctx context.Context, keys []*datastore.Key, childKinds ...string) error {
+	var allKeys []*datastore.Key
+	for _, key := range keys {
+		for _, childKind := range childKinds {
+			childKeys, err := datastore.NewQuery(childKind).Ancestor(key).KeysOnly().GetAll(ctx, nil)
+			if err != nil {
+				return err
+			}
+			allKeys = append(allKeys, childKeys...)
+		}
+		allKeys = append(allKeys, key)
+	}
+	return datastore.DeleteMulti(ctx, allKeys)
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+func getRetention(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	q := datastore.NewQuery(retentionDBEntity).Ancestor(retentionEntityRootKey(ctx))
+
+	var retentionOnDBList []RetentionEntity
+	k, err := q.GetAll(ctx, &retentionOnDBList)
+	if err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	// DB Entity needs to be mapped back
+	var retentionList RetentionAPIv1List
+	for i, retentionDB := range retentionOnDBList {
+		var retention RetentionAPIv1
+		mapDBtoAPIRetention(&retentionDB, &retention)
+		retention.Kind = k[i].StringID()
+		retentionList = append(retentionList, retention)
+	}
+
+	response.WriteHeaderAndEntity(http.StatusOK, retentionList)
+}
+
+// updateRetention sets the max. age of {kind} - 0 switches the cleanup off
+func updateRetention(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	kind := request.PathParameter("kind")
+	if _, ok := retentionKinds[kind]; !ok {
+		addError(request, response, http.StatusNotFound, errorCode_NotFound, "Unknown kind - no retention supported")
+		return
+	}
+
+	retention := new(RetentionAPIv1)
+	if err := request.ReadEntity(retention); err != nil {
+		addError(request, response, http.StatusInternalServerError, errorCode_InvalidPayload, err.Error())
+		return
+	}
+	if retention.MaxAgeDays < 0 {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, "maxAgeDays must not be negative")
+		return
+	}
+
+	key := datastore.NewKey(ctx, retentionDBEntity, kind, 0, retentionEntityRootKey(ctx))
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		var retentionDB RetentionEntity
+		if err := datastore.Get(tc, key, &retentionDB); err != nil && err != datastore.ErrNoSuchEntity && !isErrFieldMismatch(err) {
+			return err
+		}
+		retentionDB.MaxAgeDays = retention.MaxAgeDays
+		// a new max. age invalidates the position of the last run
+		retentionDB.Cursor = ""
+		_, err := datastore.Put(tc, key, &retentionDB)
+		return err
+	}, nil)
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	// Response is Empty for 204
+	response.WriteHeaderAndEntity(http.StatusNoContent, "")
+}
+
+// processRetention is called by cron - deletes the expired entries of all configured kinds, the
+// position is stored after every bucket so a run stopped by the deadline is continued by the next one
+func processRetention(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	// the tenants are processed by their own tasks
+	if err := queueTenantRuns(request.Request); err != nil {
+		logErrorf(ctx, "Cron %s not queued for the tenants: %v", request.Request.URL.Path, err)
+	}
+
+	const maxNumberOfEntitiesPerBucket = 100
+	const maxRunTime = 8 * time.Minute // cron requests are stopped after 10 minutes
+
+	start := time.Now()
+
+	q := datastore.NewQuery(retentionDBEntity).Ancestor(retentionEntityRootKey(ctx))
+	var retentionOnDBList []RetentionEntity
+	k, err := q.GetAll(ctx, &retentionOnDBList)
+	if err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	deleted := 0
+	for i := range retentionOnDBList {
+		retentionDB := &retentionOnDBList[i]
+		kind := k[i].StringID()
+		retentionKind, ok := retentionKinds[kind]
+		if !ok || retentionDB.MaxAgeDays == 0 {
+			continue
+		}
+
+		// a cursor is only valid for the same query - so a resumed run keeps the expiry of its start
+		if retentionDB.Cursor == "" {
+			retentionDB.Expiry = start.AddDate(0, 0, -retentionDB.MaxAgeDays)
+			if retentionKind.keepNewest {
+				newest, err := newestDate(ctx, kind, retentionKind.dateProperty)
+				if err != nil {
+					commonResponseErrorProcessing(request, response, err)
+					return
+				}
+				if !newest.IsZero() && newest.Before(retentionDB.Expiry) {
+					retentionDB.Expiry = newest
+				}
+			}
+		}
+		expiry := retentionDB.Expiry
+		for time.Since(start) < maxRunTime {
+			bucket := datastore.NewQuery(kind).Filter(retentionKind.dateProperty+" <", expiry).
+				KeysOnly().Limit(maxNumberOfEntitiesPerBucket)
+			if retentionDB.Cursor != "" {
+				if cursor, err := datastore.DecodeCursor(retentionDB.Cursor); err == nil {
+					bucket = bucket.Start(cursor)
+				}
+			}
+
+			var keys []*datastore.Key
+			t := bucket.Run(ctx)
+			for {
+				key, err := t.Next(nil)
+				if err == datastore.Done {
+					break
+				}
+				if err != nil {
+					commonResponseErrorProcessing(request, response, err)
+					return
+				}
+				keys = append(keys, key)
+			}
+
+			if err := deleteWithChildren(ctx, keys, retentionKind.childKinds...); err != nil {
+				commonResponseErrorProcessing(request, response, err)
+				return
+			}
+
+			retentionDB.Cursor = nextCursor(t, len(keys), maxNumberOfEntitiesPerBucket)
+			retentionDB.Deleted += len(keys)
+			retentionDB.LastRun = time.Now()
+			if _, err := datastore.Put(ctx, k[i], retentionDB); err != nil {
+				commonResponseErrorProcessing(request, response, err)
+				return
+			}
+			deleted += len(keys)
+			logInfof(ctx, "Retention of %s: %d entries older than %s deleted", kind, len(keys), expiry.Format(dateTimeLayout))
+
+			if retentionDB.Cursor == "" {
+				break
+			}
+		}
+	}
+
+	logInfof(ctx, "Retention: %d entries deleted", deleted)
+	response.WriteHeaderAndEntity(http.StatusOK, deleted)
+}
@@ -0,0 +1,256 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Revisions (revisionentity) which are stored in DB - child of the shared entity, a snapshot of the version
+// before each PUT. Images stored as blob are referenced by the snapshot, the blob stays claimed until the
+// revision is pruned.
+// ---------------------------------------------------------------------------------------------------------------//
+type RevisionEntity struct {
+	Created     time.Time
+	EditorId    string    `datastore:",noindex"` // client id of the change which replaced this version
+	Name        string    `datastore:",noindex"`
+	LastChanged time.Time `datastore:",noindex"`
+	Blob        string    // image blob of the snapshot - see "isBlobReferenced"
+	Snapshot    []byte    `datastore:",noindex"` // JSON of the DB entity
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+type RevisionAPIv1 struct {
+	Rev         int64  `json:"rev"`
+	Created     string `json:"created"`
+	EditorId    string `json:"editorId"`
+	Name        string `json:"name"`
+	LastChanged string `json:"lastChange"`
+}
+
+type RevisionAPIv1List []RevisionAPIv1
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Data Storage View
+// ---------------------------------------------------------------------------------------------------------------//
+
+const revisionDBEntity = "revisionentity"
+
+func mapDBtoAPIRevision(db *RevisionEntity, api *RevisionAPIv1) {
+	api.Created = db.Created.Format(dateTimeLayout)
+	api.EditorId = db.EditorId
+	api.Name = db.Name
+	api.LastChanged = db.LastChanged.Format(dateTimeLayout)
+}
+
+// supporting functions
+
+// keepRevision stores the old version - called in the transaction of the update
+func keepRevision(tc context.Context, key *datastore.Key, old sharedEntity, revision *RevisionEntity) error {
+	snapshot, err := json.Marshal(old)
+	if err != nil {
+		return err
+	}
+	revision.Created = time.Now()
+	revision.Name = old.commonHeader().Name
+	revision.LastChanged = old.commonHeader().LastChanged
+	revision.Snapshot = snapshot
+	revision.Blob = ""
+	if holder, ok := old.(blobHolder); ok {
+		_, ref := holder.blobPayload()
+		revision.Blob = *ref
+	}
+	_, err = datastore.Put(tc, datastore.NewIncompleteKey(tc, revisionDBEntity, key), revision)
+	return err
+}
+
+// pruneRevisions deletes all but the newest "maxRevisions" revisions - not critical, done with the next update
+func pruneRevisions(ctx context.Context, key *datastore.Key) {
+	q := datastore.NewQuery(revisionDBEntity).Ancestor(key).Order("-Created").Offset(configInt(ctx, Config_MaxRevisions))
+
+	var revisions []RevisionEntity
+	keys, err := q.GetAll(ctx, &revisions)
+	if err != nil && !isErrFieldMismatch(err) {
+		logWarningf(ctx, "Revisions of %s not pruned: %v", key, err)
+		return
+	}
+	if len(keys) == 0 {
+		return
+	}
+	if err := datastore.DeleteMulti(ctx, keys); err != nil {
+		logWarningf(ctx, "Revisions of %s not pruned: %v", key, err)
+		return
+	}
+	// the garbage collection keeps blobs which are still used by the entity or another revision
+	for _, revision := range revisions {
+		changeBlobClaim(ctx, revision.Blob, false)
+	}
+}
+
+// isBlobInRevision is true if any revision still uses the blob
+func isBlobInRevision(ctx context.Context, object string) (bool, error) {
+	keys, err := datastore.NewQuery(revisionDBEntity).Filter("Blob =", object).KeysOnly().Limit(1).GetAll(ctx, nil)
+	return len(keys) > 0, err
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+func getChartRevisions(request *restful.Request, response *restful.Response) {
+	getSharedEntityRevisions(request, response, sharedTypeChart, "id")
+}
+
+func getGChartRevisions(request *restful.Request, response *restful.Response) {
+	getSharedEntityRevisions(request, response, sharedTypeGChart, "id")
+}
+
+func getUserMetricRevisions(request *restful.Request, response *restful.Response) {
+	getSharedEntityRevisions(request, response, sharedTypeUserMetric, "key")
+}
+
+func revertChart(request *restful.Request, response *restful.Response) {
+	revertSharedEntity(request, response, sharedTypeChart, "id")
+}
+
+func revertGChart(request *restful.Request, response *restful.Response) {
+	revertSharedEntity(request, response, sharedTypeGChart, "id")
+}
+
+func revertUserMetric(request *restful.Request, response *restful.Response) {
+	revertSharedEntity(request, response, sharedTypeUserMetric, "key")
+}
+
+// ------------------- supporting functions ------------------------------------------------
+
+// getSharedEntityRevisions lists the revisions of an entity - newest first, the snapshot is not returned
+func getSharedEntityRevisions(request *restful.Request, response *restful.Response, entityType string, param string) {
+	ctx := newContext(request.Request)
+
+	key, err := sharedEntityTypes[entityType].key(ctx, request.PathParameter(param))
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	// the revisions of an unlisted entity are as hidden as the entity
+	var headerDB CommonEntityHeaderOnly
+	if err := datastore.Get(ctx, key, &headerDB); err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+	if !isListedOrOwned(ctx, request, &headerDB.Header) {
+		addError(request, response, http.StatusNotFound, errorCode_NotFound, datastore.ErrNoSuchEntity.Error())
+		return
+	}
+
+	q := datastore.NewQuery(revisionDBEntity).Ancestor(key).Order("-Created")
+
+	var revisionOnDBList []RevisionEntity
+	k, err := q.GetAll(ctx, &revisionOnDBList)
+	if err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	var revisionList RevisionAPIv1List
+	for i, revisionDB := range revisionOnDBList {
+		var revision RevisionAPIv1
+		mapDBtoAPIRevision(&revisionDB, &revision)
+		revision.Rev = k[i].IntID()
+		revisionList = append(revisionList, revision)
+	}
+
+	writeListResponse(request, response, revisionList, len(revisionList), "")
+}
+
+// revertSharedEntity replaces the content with the one of the revision - the replaced content is kept as
+// revision as well, so a revert can be reverted. State (deleted, curation) and ratings are not reverted.
+func revertSharedEntity(request *restful.Request, response *restful.Response, entityType string, param string) {
+	ctx := newContext(request.Request)
+
+	key, err := sharedEntityTypes[entityType].key(ctx, request.PathParameter(param))
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+	rev, err := strconv.ParseInt(request.PathParameter("rev"), 10, 64)
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	current := sharedEntityTypes[entityType].newEntity()
+	if err := getEntity(ctx, key, current); err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+	e := requestEditor(ctx, request)
+	if !e.mayChange(current.commonHeader()) {
+		addError(request, response, http.StatusForbidden, errorCode_Forbidden, "Forbidden - only the owner or a curator may revert this entity")
+		return
+	}
+
+	var revisionDB RevisionEntity
+	if err := datastore.Get(ctx, datastore.NewKey(ctx, revisionDBEntity, "", rev, key), &revisionDB); err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	reverted := sharedEntityTypes[entityType].newEntity()
+	if err := json.Unmarshal(revisionDB.Snapshot, reverted); err != nil {
+		addError(request, response, http.StatusInternalServerError, errorCode_Internal, err.Error())
+		return
+	}
+
+	header := reverted.commonHeader()
+	header.Deleted = current.commonHeader().Deleted
+	header.Trashed = current.commonHeader().Trashed
+	header.Curated = current.commonHeader().Curated
+	header.CurationState = current.commonHeader().CurationState
+	header.CurationComment = current.commonHeader().CurationComment
+	header.Unlisted = current.commonHeader().Unlisted
+	header.LastChanged = time.Now()
+
+	if _, err := putSharedEntityRevision(ctx, entityType, key, reverted, e); err != nil {
+		if err == errNotOwner {
+			addError(request, response, http.StatusForbidden, errorCode_Forbidden, err.Error())
+			return
+		}
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+	indexForSearch(ctx, entityType, key, reverted)
+
+	// Response is Empty for 204
+	response.WriteHeaderAndEntity(http.StatusNoContent, "")
+}
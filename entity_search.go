@@ -0,0 +1,203 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/search"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Full text search over the chart metadata (GAE Search API) - the index is maintained with every write
+// ---------------------------------------------------------------------------------------------------------------//
+type SearchDocument struct {
+	Name        string
+	Description string
+	Author      string
+	Tags        string
+	Language    search.Atom
+	LastChanged time.Time
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+type SearchResultAPIv1 struct {
+	Items      interface{} `json:"items"`
+	NextCursor string      `json:"nextCursor"`
+	Count      int         `json:"count"`
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Search index definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+// only shared types with an index are searchable
+var searchIndexes = map[string]string{
+	sharedTypeChart:  "chartsearch",
+	sharedTypeGChart: "gchartsearch",
+}
+
+func mapDBtoSearchDocument(db sharedEntity, doc *SearchDocument) {
+	header := db.commonHeader()
+	doc.Name = header.Name
+	doc.Description = header.Description
+	doc.Author = db.creatorNick()
+	doc.Tags = strings.Join(header.Tags, " ")
+	doc.Language = search.Atom(header.Language)
+	doc.LastChanged = header.LastChanged
+}
+
+// indexForSearch is called after every write - deleted and unlisted content is removed from the index,
+// errors are only logged since the datastore entity is already stored
+func indexForSearch(ctx context.Context, entityType string, key *datastore.Key, db sharedEntity) {
+	indexName, ok := searchIndexes[entityType]
+	if !ok {
+		return
+	}
+	index, err := search.Open(indexName)
+	if err != nil {
+		logErrorf(ctx, "Search index %s not available: %v", indexName, err)
+		return
+	}
+
+	if db.commonHeader().Deleted || db.commonHeader().Unlisted {
+		if err := index.Delete(ctx, sharedEntityId(key)); err != nil && err != search.ErrNoSuchDocument {
+			logErrorf(ctx, "Search document %s not deleted: %v", sharedEntityId(key), err)
+		}
+		return
+	}
+
+	doc := new(SearchDocument)
+	mapDBtoSearchDocument(db, doc)
+	if _, err := index.Put(ctx, sharedEntityId(key), doc); err != nil {
+		logErrorf(ctx, "Search document %s not indexed: %v", sharedEntityId(key), err)
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+func searchCharts(request *restful.Request, response *restful.Response) {
+	searchSharedEntities(request, response, sharedTypeChart)
+}
+
+func searchGCharts(request *restful.Request, response *restful.Response) {
+	searchSharedEntities(request, response, sharedTypeGChart)
+}
+
+// ------------------- supporting functions ------------------------------------------------
+
+// searchSharedEntities returns the headers of the best matching (approved) content
+func searchSharedEntities(request *restful.Request, response *restful.Response, entityType string) {
+	ctx := newContext(request.Request)
+
+	queryString := request.QueryParameter("q")
+	if queryString == "" {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, "Mandatory query parameter q is missing")
+		return
+	}
+
+	const maxNumberOfResultsPerCall = 50
+
+	limit := maxNumberOfResultsPerCall
+	if limitString := request.QueryParameter("limit"); limitString != "" {
+		if l, err := strconv.Atoi(limitString); err == nil && l > 0 && l <= maxNumberOfResultsPerCall {
+			limit = l
+		}
+	}
+
+	index, err := search.Open(searchIndexes[entityType])
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	options := &search.SearchOptions{
+		Limit:   limit,
+		IDsOnly: true,
+		Cursor:  search.Cursor(request.QueryParameter("cursor")),
+		Sort: &search.SortOptions{
+			Scorer: search.MatchScorer,
+		},
+	}
+
+	// collect the ids in ranking order - the headers are read from the datastore
+	sharedType := sharedEntityTypes[entityType]
+	var keys []*datastore.Key
+	t := index.Search(ctx, queryString, options)
+	for {
+		id, err := t.Next(nil)
+		if err == search.Done {
+			break
+		}
+		if err != nil {
+			addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+			return
+		}
+		if key, err := sharedType.key(ctx, id); err == nil {
+			keys = append(keys, key)
+		}
+	}
+
+	var result SearchResultAPIv1
+	result.Count = t.Count()
+	if len(keys) == limit {
+		result.NextCursor = string(t.Cursor())
+	}
+
+	selectedState := curationStateParameter(request)
+	headers := make([]CommonEntityHeaderOnly, len(keys))
+	err = datastore.GetMulti(ctx, keys, headers)
+	multiErr, _ := err.(appengine.MultiError)
+	if err != nil && multiErr == nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	var headerList []CommonAPIHeaderOnlyV1
+	for i, headerDB := range headers {
+		// entities removed after indexing are simply skipped
+		if multiErr != nil && multiErr[i] != nil && !isErrFieldMismatch(multiErr[i]) {
+			continue
+		}
+		if headerDB.Header.Deleted || headerDB.Header.Unlisted || !isCurationStateSelected(&headerDB.Header, selectedState) {
+			continue
+		}
+		var header CommonAPIHeaderOnlyV1
+		mapDBtoAPICommonHeader(&headerDB.Header, &header.Header)
+		header.Header.Id = keys[i].IntID()
+		headerList = append(headerList, header)
+	}
+	result.Items = headerList
+
+	response.WriteHeaderAndEntity(http.StatusOK, result)
+}
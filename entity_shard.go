@@ -0,0 +1,251 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/taskqueue"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Sharded root keys - charts, gcharts and usermetrics are children of one of "Root_Shards" root entities
+// instead of a single one, an entity group takes ~1 write/sec, so the shards multiply the write throughput
+// of a kind. The shard is derived from the id (usermetrics: from the key), so a lookup by id needs no query.
+// Shard 0 is the root of the unsharded layout - with one shard nothing changes, after an increase the
+// existing entities are moved by "migrateShards".
+// ---------------------------------------------------------------------------------------------------------------//
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+type ShardMigrationAPIv1 struct {
+	Type       string `json:"type"`
+	Shards     int    `json:"shards"`
+	Read       int    `json:"read"`
+	Moved      int    `json:"moved"`
+	NextCursor string `json:"nextCursor"`
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Data Storage View
+// ---------------------------------------------------------------------------------------------------------------//
+
+const rootShardsConfig = "Root_Shards"
+const rootShardsDefault = 1
+
+const (
+	Consistency_Strong   = "strong"
+	Consistency_Eventual = "eventual"
+)
+
+// supporting functions
+
+// rootShards must not change while entities are stored - they are only found in the shard of their id
+func rootShards() int {
+	if shards, err := strconv.Atoi(os.Getenv(rootShardsConfig)); err == nil && shards > 0 {
+		return shards
+	}
+	return rootShardsDefault
+}
+
+// shardRootKey is the root of "shard" - shard 0 keeps the name of the unsharded root
+func shardRootKey(ctx context.Context, kind string, rootName string, shard int) *datastore.Key {
+	if shard == 0 {
+		return datastore.NewKey(ctx, kind, rootName, 0, nil)
+	}
+	return datastore.NewKey(ctx, kind, fmt.Sprint(rootName, "-", shard), 0, nil)
+}
+
+// shardRootKeys are all roots of the kind - for strong consistent (ancestor) queries
+func shardRootKeys(ctx context.Context, kind string, rootName string) []*datastore.Key {
+	keys := make([]*datastore.Key, rootShards())
+	for shard := range keys {
+		keys[shard] = shardRootKey(ctx, kind, rootName, shard)
+	}
+	return keys
+}
+
+func shardedIdKey(ctx context.Context, kind string, rootName string, id int64) *datastore.Key {
+	shard := int(id % int64(rootShards()))
+	if shard < 0 {
+		shard = -shard
+	}
+	return datastore.NewKey(ctx, kind, "", id, shardRootKey(ctx, kind, rootName, shard))
+}
+
+func shardedNameKey(ctx context.Context, kind string, rootName string, name string) *datastore.Key {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	shard := int(h.Sum32() % uint32(rootShards()))
+	return datastore.NewKey(ctx, kind, name, 0, shardRootKey(ctx, kind, rootName, shard))
+}
+
+// newShardedIdKey allocates the id first, the shard depends on it - ids are allocated in the sequence of
+// shard 0, which is the one of the unsharded layout, so a new id never collides with a migrated entity
+func newShardedIdKey(ctx context.Context, kind string, rootName string) (*datastore.Key, error) {
+	low, _, err := datastore.AllocateIDs(ctx, kind, shardRootKey(ctx, kind, rootName, 0), 1)
+	if err != nil {
+		return nil, err
+	}
+	return shardedIdKey(ctx, kind, rootName, low), nil
+}
+
+// consistencyParameter is true for "consistency=strong" - the default is eventual
+func consistencyParameter(request *restful.Request) (bool, error) {
+	switch request.QueryParameter("consistency") {
+	case "", Consistency_Eventual:
+		return false, nil
+	case Consistency_Strong:
+		return true, nil
+	}
+	return false, fmt.Errorf("Invalid consistency - use %s or %s", Consistency_Strong, Consistency_Eventual)
+}
+
+// runShardedQuery runs q as one (eventual consistent) query, or strong consistent as one ancestor query per
+// root shard - the results of several shards are not ordered across the shards
+func runShardedQuery(ctx context.Context, q *datastore.Query, strong bool, roots []*datastore.Key) []*datastore.Iterator {
+	if !strong {
+		return []*datastore.Iterator{q.Run(ctx)}
+	}
+	iterators := make([]*datastore.Iterator, len(roots))
+	for i, root := range roots {
+		iterators[i] = q.Ancestor(root).Run(ctx)
+	}
+	return iterators
+}
+
+// shardedNextCursor is only returned for a single query - the results of several shards are paged by date
+func shardedNextCursor(iterators []*datastore.Iterator, count int, limit int) string {
+	if len(iterators) != 1 {
+		return ""
+	}
+	return nextCursor(iterators[0], count, limit)
+}
+
+// reparentKey replaces the ancestor "from" of key by "to"
+func reparentKey(ctx context.Context, key *datastore.Key, from *datastore.Key, to *datastore.Key) *datastore.Key {
+	if key.Equal(from) {
+		return to
+	}
+	return datastore.NewKey(ctx, key.Kind(), key.StringID(), key.IntID(), reparentKey(ctx, key.Parent(), from, to))
+}
+
+// moveToShard moves the entity with all its children (revisions, comments,...) to the key of its shard
+func moveToShard(ctx context.Context, from *datastore.Key, to *datastore.Key) error {
+	return runUnitOfWork(ctx, func(tc context.Context, uow *unitOfWork) error {
+		var props []datastore.PropertyList
+		keys, err := datastore.NewQuery("").Ancestor(from).GetAll(tc, &props)
+		if err != nil {
+			return err
+		}
+		// moved in the meantime
+		if len(keys) == 0 {
+			return nil
+		}
+		newKeys := make([]*datastore.Key, len(keys))
+		for i, key := range keys {
+			newKeys[i] = reparentKey(tc, key, from, to)
+		}
+		if _, err := datastore.PutMulti(tc, newKeys, props); err != nil {
+			return err
+		}
+		return datastore.DeleteMulti(tc, keys)
+	})
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+// migrateShards moves one bucket of entities of {type} which are not stored in the shard of their id and
+// re-queues itself with the cursor until all entities are processed - run it in maintenance mode after
+// "Root_Shards" was changed, entities which are not yet moved are not found by id
+func migrateShards(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	entityType := request.PathParameter("type")
+	sharedType, ok := sharedEntityTypes[entityType]
+	if !ok {
+		addError(request, response, http.StatusNotFound, errorCode_NotFound, "Unknown type - use chart, gchart or usermetric")
+		return
+	}
+
+	const maxNumberOfEntitiesPerTask = 100
+
+	q, err := applyCursorParameter(request, datastore.NewQuery(sharedType.kind).KeysOnly().Limit(maxNumberOfEntitiesPerTask))
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	migration := ShardMigrationAPIv1{Type: entityType, Shards: rootShards()}
+
+	t := q.Run(ctx)
+	for {
+		key, err := t.Next(nil)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			commonResponseErrorProcessing(request, response, err)
+			return
+		}
+		migration.Read++
+
+		target, err := sharedType.key(ctx, sharedEntityId(key))
+		if err != nil {
+			logWarningf(ctx, "Entity %v not moved: %v", key, err)
+			continue
+		}
+		if target.Equal(key) {
+			continue
+		}
+		if err := moveToShard(ctx, key, target); err != nil {
+			commonResponseErrorProcessing(request, response, err)
+			return
+		}
+		migration.Moved++
+	}
+
+	migration.NextCursor = nextCursor(t, migration.Read, maxNumberOfEntitiesPerTask)
+	logInfof(ctx, "Shard migration of %s: %d read, %d moved", entityType, migration.Read, migration.Moved)
+
+	// continue with the next bucket in a new task (new request deadline)
+	if migration.NextCursor != "" {
+		task := taskqueue.NewPOSTTask(fmt.Sprint(request.Request.URL.Path, "?", url.Values{"cursor": {migration.NextCursor}}.Encode()), nil)
+		if _, err := taskqueue.Add(ctx, addRequestHeadersToTask(request.Request, task), ""); err != nil {
+			commonResponseErrorProcessing(request, response, err)
+			return
+		}
+	}
+
+	response.WriteHeaderAndEntity(http.StatusOK, migration)
+}
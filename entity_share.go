@@ -0,0 +1,293 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Share links (shareentity) which are stored in DB - a chart or gchart can be "unlisted" (not in the header
+// lists and the search, only its owner and curators read it by id) and shared with single persons by a link.
+// The token of the link names the entity, the share and the expiry, signed with HMAC-SHA256 - so it can't be
+// guessed or altered. The share is a child of the entity, deleting it revokes the link before it expires.
+// ---------------------------------------------------------------------------------------------------------------//
+type ShareEntity struct {
+	Expires   time.Time `datastore:",noindex"`
+	CreatorId string    `datastore:",noindex"` // client id of the caller who created the link
+	Created   time.Time `datastore:",noindex"`
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+// Response of POST - the url is GET /v1/share/{token}
+type ShareLinkAPIv1 struct {
+	Token   string `json:"token"`
+	Url     string `json:"url"`
+	Expires string `json:"expires"`
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Data Storage View
+// ---------------------------------------------------------------------------------------------------------------//
+
+const shareDBEntity = "shareentity"
+
+// the secret the tokens are signed with - the links of all tenants stop working if it's changed
+const shareLinkSecretConfig = "Share_Link_Secret"
+
+const defaultShareLinkHours = 7 * 24
+const maxShareLinkHours = 90 * 24
+
+var errInvalidShareToken = errors.New("Invalid share token")
+
+// supporting functions
+
+// isListedOrOwned is false if an unlisted entity is read by someone else than its owner or a curator
+func isListedOrOwned(ctx context.Context, request *restful.Request, header *CommonEntityHeader) bool {
+	return !header.Unlisted || isOwnerOrCurator(ctx, request, header)
+}
+
+func shareLinkSecret() []byte {
+	return []byte(os.Getenv(shareLinkSecretConfig))
+}
+
+func signShareLink(payload string) string {
+	mac := hmac.New(sha256.New, shareLinkSecret())
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newShareToken is "<payload>.<signature>" - the payload is "<type>.<entity id>.<share id>.<expiry>" base64url encoded
+func newShareToken(entityType string, key *datastore.Key, shareId int64, expires time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprint(entityType, ".", key.IntID(), ".", shareId, ".", expires.Unix())))
+	return payload + "." + signShareLink(payload)
+}
+
+// parseShareToken checks the signature and returns the key of the share - the expiry is checked by the caller
+func parseShareToken(ctx context.Context, token string) (string, *datastore.Key, time.Time, error) {
+	dot := strings.LastIndex(token, ".")
+	if dot < 0 || !hmac.Equal([]byte(token[dot+1:]), []byte(signShareLink(token[:dot]))) {
+		return "", nil, time.Time{}, errInvalidShareToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(token[:dot])
+	if err != nil {
+		return "", nil, time.Time{}, errInvalidShareToken
+	}
+	parts := strings.Split(string(payload), ".")
+	if len(parts) != 4 {
+		return "", nil, time.Time{}, errInvalidShareToken
+	}
+	sharedType, ok := sharedEntityTypes[parts[0]]
+	if !ok || parts[0] == sharedTypeUserMetric {
+		return "", nil, time.Time{}, errInvalidShareToken
+	}
+	key, err := sharedType.key(ctx, parts[1])
+	if err != nil {
+		return "", nil, time.Time{}, errInvalidShareToken
+	}
+	shareId, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return "", nil, time.Time{}, errInvalidShareToken
+	}
+	expires, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil {
+		return "", nil, time.Time{}, errInvalidShareToken
+	}
+	return parts[0], datastore.NewKey(ctx, shareDBEntity, "", shareId, key), time.Unix(expires, 0), nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+func shareChartById(request *restful.Request, response *restful.Response) {
+	createShareLink(request, response, sharedTypeChart)
+}
+
+func shareGChartById(request *restful.Request, response *restful.Response) {
+	createShareLink(request, response, sharedTypeGChart)
+}
+
+// getSharedByToken returns the shared chart or gchart - no authentication, the token is the permission
+func getSharedByToken(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	entityType, shareKey, expires, err := parseShareToken(ctx, request.PathParameter("token"))
+	if err != nil {
+		addError(request, response, http.StatusNotFound, errorCode_NotFound, err.Error())
+		return
+	}
+	if time.Now().After(expires) {
+		addError(request, response, http.StatusGone, errorCode_NotFound, "The share link is expired")
+		return
+	}
+
+	// revoked links have no share anymore
+	var shareDB ShareEntity
+	if err := datastore.Get(ctx, shareKey, &shareDB); err != nil && !isErrFieldMismatch(err) {
+		if err == datastore.ErrNoSuchEntity {
+			addError(request, response, http.StatusNotFound, errorCode_NotFound, "The share link was revoked")
+			return
+		}
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	entityDB := sharedEntityTypes[entityType].newEntity()
+	if err := getEntity(ctx, shareKey.Parent(), entityDB); err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+	if entityDB.commonHeader().Deleted {
+		addError(request, response, http.StatusNotFound, errorCode_NotFound, datastore.ErrNoSuchEntity.Error())
+		return
+	}
+	if holder, ok := entityDB.(blobHolder); ok {
+		if err := loadBlob(ctx, holder); err != nil {
+			commonResponseErrorProcessing(request, response, err)
+			return
+		}
+	}
+
+	// links are not public - they must not end up in shared caches
+	response.AddHeader("Cache-Control", "private, no-store")
+
+	switch db := entityDB.(type) {
+	case *ChartEntity:
+		chart := new(ChartAPIv1)
+		mapDBtoAPIChart(db, chart)
+		chart.Header.Id = shareKey.Parent().IntID()
+		writeEntity(request, response, http.StatusOK, chart)
+	case *GChartEntity:
+		chart := new(GChartAPIv1)
+		mapDBtoAPIGChart(db, chart)
+		chart.Header.Id = shareKey.Parent().IntID()
+		writeEntity(request, response, http.StatusOK, chart)
+	}
+}
+
+// revokeShareLink deletes the share of the token - only the owner of the entity or a curator
+func revokeShareLink(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	_, shareKey, _, err := parseShareToken(ctx, request.PathParameter("token"))
+	if err != nil {
+		addError(request, response, http.StatusNotFound, errorCode_NotFound, err.Error())
+		return
+	}
+
+	var headerDB CommonEntityHeaderOnly
+	if err := datastore.Get(ctx, shareKey.Parent(), &headerDB); err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+	if !isOwnerOrCurator(ctx, request, &headerDB.Header) {
+		addError(request, response, http.StatusForbidden, errorCode_Forbidden, "Forbidden - only the owner or a curator may revoke a share link")
+		return
+	}
+
+	// revoking twice is fine
+	if err := datastore.Delete(ctx, shareKey); err != nil && err != datastore.ErrNoSuchEntity {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	// Response is Empty for 204
+	response.WriteHeaderAndEntity(http.StatusNoContent, "")
+}
+
+// ------------------- supporting functions ------------------------------------------------
+
+// createShareLink stores a share for the entity and returns its signed link - only the owner or a curator
+func createShareLink(request *restful.Request, response *restful.Response, entityType string) {
+	ctx := newContext(request.Request)
+
+	if len(shareLinkSecret()) == 0 {
+		addError(request, response, http.StatusInternalServerError, errorCode_Internal, "Share link configuration missing on Server")
+		return
+	}
+
+	hours := defaultShareLinkHours
+	if hoursString := request.QueryParameter("expiresInHours"); hoursString != "" {
+		var err error
+		hours, err = strconv.Atoi(hoursString)
+		if err != nil || hours < 1 || hours > maxShareLinkHours {
+			addError(request, response, http.StatusBadRequest, errorCode_BadRequest, fmt.Sprint("expiresInHours must be between 1 and ", maxShareLinkHours))
+			return
+		}
+	}
+
+	key, err := sharedEntityTypes[entityType].key(ctx, request.PathParameter("id"))
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	var headerDB CommonEntityHeaderOnly
+	if err := datastore.Get(ctx, key, &headerDB); err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+	if headerDB.Header.Deleted {
+		addError(request, response, http.StatusNotFound, errorCode_NotFound, datastore.ErrNoSuchEntity.Error())
+		return
+	}
+	if !isOwnerOrCurator(ctx, request, &headerDB.Header) {
+		addError(request, response, http.StatusForbidden, errorCode_Forbidden, "Forbidden - only the owner or a curator may share this entity")
+		return
+	}
+
+	now := time.Now()
+	shareDB := ShareEntity{
+		Expires:   now.Add(time.Duration(hours) * time.Hour),
+		CreatorId: requestOwnerId(request),
+		Created:   now,
+	}
+	shareKey, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, shareDBEntity, key), &shareDB)
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	token := newShareToken(entityType, key, shareKey.IntID(), shareDB.Expires)
+	link := ShareLinkAPIv1{
+		Token:   token,
+		Url:     fmt.Sprint("https://", request.Request.Host, "/v1/share/", token),
+		Expires: shareDB.Expires.Format(dateTimeLayout),
+	}
+	response.WriteHeaderAndEntity(http.StatusCreated, link)
+}
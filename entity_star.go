@@ -0,0 +1,175 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Stars (starentity) which are stored in DB - the favourites of a client, so they follow the user to every
+// installation with the same client id. A star is a child of the starred entity, the key is the client id
+// (one star per client), and the number of stars is kept in the header of the entity.
+// ---------------------------------------------------------------------------------------------------------------//
+type StarEntity struct {
+	ClientId string
+	StarDate time.Time `datastore:",noindex"`
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+// the starred ids of the caller for GET
+type StarsAPIv1 struct {
+	Charts  []int64 `json:"charts"`
+	GCharts []int64 `json:"gcharts"`
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Data Storage View
+// ---------------------------------------------------------------------------------------------------------------//
+
+const starDBEntity = "starentity"
+
+const maxNumberOfStarsPerClient = 1000
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+func starChartById(request *restful.Request, response *restful.Response) {
+	starSharedEntity(request, response, sharedTypeChart, true)
+}
+
+func unstarChartById(request *restful.Request, response *restful.Response) {
+	starSharedEntity(request, response, sharedTypeChart, false)
+}
+
+func starGChartById(request *restful.Request, response *restful.Response) {
+	starSharedEntity(request, response, sharedTypeGChart, true)
+}
+
+func unstarGChartById(request *restful.Request, response *restful.Response) {
+	starSharedEntity(request, response, sharedTypeGChart, false)
+}
+
+// getStars returns the ids of all entities starred by the calling client
+func getStars(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	clientId := requestOwnerId(request)
+	if clientId == "" {
+		addError(request, response, http.StatusUnauthorized, errorCode_Unauthorized, missingClientMessage)
+		return
+	}
+
+	q := datastore.NewQuery(starDBEntity).Filter("ClientId =", clientId).KeysOnly().Limit(maxNumberOfStarsPerClient)
+	keys, err := q.GetAll(ctx, nil)
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	stars := StarsAPIv1{Charts: []int64{}, GCharts: []int64{}}
+	for _, key := range keys {
+		switch key.Parent().Kind() {
+		case chartDBEntity:
+			stars.Charts = append(stars.Charts, key.Parent().IntID())
+		case gChartDBEntity:
+			stars.GCharts = append(stars.GCharts, key.Parent().IntID())
+		}
+	}
+
+	response.WriteHeaderAndEntity(http.StatusOK, stars)
+}
+
+// ------------------- supporting functions ------------------------------------------------
+
+// starSharedEntity sets or removes the star of the calling client and updates the count of the entity in one
+// transaction - starring twice or removing a missing star changes nothing
+func starSharedEntity(request *restful.Request, response *restful.Response, entityType string, star bool) {
+	ctx := newContext(request.Request)
+
+	clientId := requestOwnerId(request)
+	if clientId == "" {
+		addError(request, response, http.StatusUnauthorized, errorCode_Unauthorized, missingClientMessage)
+		return
+	}
+
+	sharedType := sharedEntityTypes[entityType]
+	key, err := sharedType.key(ctx, request.PathParameter("id"))
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	err = runUnitOfWork(ctx, func(tc context.Context, uow *unitOfWork) error {
+		entityDB := sharedType.newEntity()
+		if err := getEntity(tc, key, entityDB); err != nil {
+			return err
+		}
+
+		starKey := datastore.NewKey(tc, starDBEntity, clientId, 0, key)
+		var starDB StarEntity
+		err := datastore.Get(tc, starKey, &starDB)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		starred := err == nil
+		if starred == star {
+			return nil
+		}
+
+		header := entityDB.commonHeader()
+		if star {
+			starDB.ClientId = clientId
+			starDB.StarDate = time.Now()
+			if _, err := datastore.Put(tc, starKey, &starDB); err != nil {
+				return err
+			}
+			header.StarCount++
+		} else {
+			if err := datastore.Delete(tc, starKey); err != nil {
+				return err
+			}
+			if header.StarCount > 0 {
+				header.StarCount--
+			}
+		}
+		if _, err := putEntity(tc, key, entityDB); err != nil {
+			return err
+		}
+		return logUpdate(tc, entityType, key, entityDB)
+	})
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	// Response is Empty for 204
+	response.WriteHeaderAndEntity(http.StatusNoContent, "")
+}
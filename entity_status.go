@@ -21,13 +21,16 @@ package goldencheetah
 import (
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 	"fmt"
+	"net/url"
 
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/memcache"
+	"google.golang.org/appengine/taskqueue"
 
 	"github.com/emicklei/go-restful"
 )
@@ -37,8 +40,9 @@ import (
 // Golden Cheetah curator (statusentity) which is stored in DB
 // ---------------------------------------------------------------------------------------------------------------//
 type StatusEntity struct {
-	Status     int
-	ChangeDate time.Time
+	Status        int
+	ChangeDate    time.Time
+	SchemaVersion int `datastore:",noindex"` // see "entity_mapper.go"
 }
 
 const (
@@ -70,9 +74,11 @@ type StatusEntityPostAPIv1 struct {
 }
 
 type StatusEntityGetAPIv1 struct {
-	Id         int64        `json:"id"`
-	Status     int        `json:"status"`
-	ChangeDate string        `json:"changeDate"`
+	Id          int64                   `json:"id"`
+	Status      int                     `json:"status"`
+	ChangeDate  string                  `json:"changeDate"`
+	Maintenance *MaintenanceWindowAPIv1 `json:"maintenance,omitempty"` // latest status only - the active window
+	Stale       bool                    `json:"stale,omitempty"`       // latest status only - the last known good status, the datastore is unavailable
 }
 
 type StatusEntityGetTextAPIv1 struct {
@@ -82,12 +88,37 @@ type StatusEntityGetTextAPIv1 struct {
 
 type StatusEntityGetAPIv1List []StatusEntityGetAPIv1
 
+// Aggregated statistics for GET - durations in seconds
+type StatusStatsAPIv1 struct {
+	DateFrom                 string         `json:"dateFrom"`
+	DateTo                   string         `json:"dateTo"`
+	UptimePercent            float64        `json:"uptimePercent"`
+	StatusCounts             map[string]int `json:"statusCounts"`
+	Incidents                int            `json:"incidents"`
+	LongestOutage            int64          `json:"longestOutage"`
+	MeanTimeBetweenIncidents int64          `json:"meanTimeBetweenIncidents"`
+}
+
+type StatusPurgeAPIv1 struct {
+	OlderThan string `json:"olderThan"`
+	Purged    int    `json:"purged"`
+}
+
 // ---------------------------------------------------------------------------------------------------------------//
 // Memcache constants
 // ---------------------------------------------------------------------------------------------------------------//
 
 const statusMemcacheKey = "currentstatus"
 
+// the last status read from the datastore - without expiration, served if the datastore is unavailable
+const statusLastKnownGoodMemcacheKey = "currentstatus/lastknowngood"
+
+// the last known good status per namespace of this instance - if memcache is unavailable as well
+var lastKnownGoodStatus = struct {
+	sync.Mutex
+	byNamespace map[string]StatusEntityGetAPIv1
+}{byNamespace: make(map[string]StatusEntityGetAPIv1)}
+
 // ---------------------------------------------------------------------------------------------------------------//
 // Data Storage View
 // ---------------------------------------------------------------------------------------------------------------//
@@ -111,6 +142,14 @@ func mapDBtoAPIStatus(db *StatusEntity, api *StatusEntityGetAPIv1) {
 	api.ChangeDate = db.ChangeDate.Format(dateTimeLayout)
 }
 
+func validateStatus(api *StatusEntityPostAPIv1) *validator {
+	v := new(validator)
+	v.oneOf("status", api.Status, Status_Ok, Status_PartialFailure, Status_Outage)
+	v.dateTime("changeDate", api.ChangeDate)
+	v.payloadSize("text", len(api.Text))
+	return v
+}
+
 
 // supporting functions
 
@@ -124,48 +163,72 @@ func statusEntityRootKey(ctx context.Context) *datastore.Key {
 // ---------------------------------------------------------------------------------------------------------------//
 
 func insertStatus(request *restful.Request, response *restful.Response) {
-	ctx := appengine.NewContext(request.Request)
+	ctx := newContext(request.Request)
 
 	status := new(StatusEntityPostAPIv1)
-	if err := request.ReadEntity(status); err != nil {
-		addPlainTextError(response, http.StatusInternalServerError, err.Error())
+	if err := readEntity(request, status); err != nil {
+		addReadEntityError(request, response, err)
 		return
 	}
 
-	// No checks if the necessary fields are filed or not - since GoldenCheetah is
-	// the only consumer of the APIs - any checks/response are to support this use-case
+	// all fields are checked before anything is stored
+	if v := validateStatus(status); !v.valid() {
+		addValidationError(request, response, v)
+		return
+	}
 
 	statusDB := new(StatusEntity)
 	mapAPItoDBStatus(status, statusDB)
 
-	// and now store it
-	key := datastore.NewIncompleteKey(ctx, statusDBEntity, statusEntityRootKey(ctx))
-	key, err := datastore.Put(ctx, key, statusDB);
+	// and now store it - with "ifChanged" only if the status differs from the latest one, compared
+	// in the same transaction so parallel posts can't both insert. The text is stored in the same unit
+	// of work, so there is no status without its text.
+	ifChanged := request.QueryParameter("ifChanged") == "true"
+	var key, unchangedKey *datastore.Key
+	previousStatus := Status_Ok
+	err := runUnitOfWork(ctx, func(tc context.Context, uow *unitOfWork) error {
+		unchangedKey = nil
+		latestKey, latest, err := internalGetLatestStatus(tc)
+		if err != nil {
+			return err
+		}
+		if latest != nil {
+			previousStatus = latest.Status
+		}
+		if ifChanged && latest != nil && latest.Status == statusDB.Status {
+			unchangedKey = latestKey
+			return nil
+		}
+		key, err = putEntity(tc, datastore.NewIncompleteKey(tc, statusDBEntity, statusEntityRootKey(tc)), statusDB)
+		if err != nil || status.Text == "" {
+			return err
+		}
+
+		// the text is stored as child of the status entry
+		statusDBText := new(StatusEntityText)
+		statusDBText.Text = status.Text
+		_, err = putEntity(tc, datastore.NewIncompleteKey(tc, statusDBEntityText, key), statusDBText)
+		return err
+	})
 	if err != nil {
 		if appengine.IsOverQuota(err) {
 			// return 503 and a text similar to what GAE is returning as well
-			addPlainTextError(response, http.StatusServiceUnavailable, "503 - Over Quota")
+			addError(request, response, http.StatusServiceUnavailable, errorCode_OverQuota, "503 - Over Quota")
 		} else {
-			addPlainTextError(response, http.StatusInternalServerError, err.Error())
+			addDatastoreError(request, response, err)
 		}
 		return
 	}
 
-	if status.Text != "" {
-		statusDBText := new(StatusEntityText)
-		statusDBText.Text = status.Text
-		// and now store it as child of statusEntry
-		key := datastore.NewIncompleteKey(ctx, statusDBEntityText, key)
-		key, err := datastore.Put(ctx, key, statusDBText);
-		if err != nil {
-			if appengine.IsOverQuota(err) {
-				// return 503 and a text similar to what GAE is returning as well
-				addPlainTextError(response, http.StatusServiceUnavailable, "503 - Over Quota")
-			} else {
-				addPlainTextError(response, http.StatusInternalServerError, err.Error())
-			}
-			return
-		}
+	// nothing stored - the latest status is still valid
+	if unchangedKey != nil {
+		response.WriteHeaderAndEntity(http.StatusOK, strconv.FormatInt(unchangedKey.IntID(), 10))
+		return
+	}
+
+	// operators are notified about changes only
+	if previousStatus != statusDB.Status {
+		internalFireStatusWebhooks(request, key, statusDB, previousStatus)
 	}
 
 	var in StatusEntityGetAPIv1
@@ -177,8 +240,10 @@ func insertStatus(request *restful.Request, response *restful.Response) {
 	item := &memcache.Item{
 		Key:   statusMemcacheKey,
 		Object: in,
+		Expiration: cacheExpiration(ctx),
 	}
 	memcache.Gob.Set(ctx, item)
+	internalSetLastKnownGoodStatus(ctx, in)
 
 	// send back the key
 	response.WriteHeaderAndEntity(http.StatusCreated, strconv.FormatInt(key.IntID(), 10))
@@ -186,21 +251,50 @@ func insertStatus(request *restful.Request, response *restful.Response) {
 }
 
 func getStatus(request *restful.Request, response *restful.Response) {
-	ctx := appengine.NewContext(request.Request)
+	ctx := newContext(request.Request)
 
 	var date time.Time
 	var err error
 	if dateString := request.QueryParameter("dateFrom"); dateString != "" {
 		date, err = time.Parse(time.RFC3339, dateString)
 		if err != nil {
-			addPlainTextError(response, http.StatusBadRequest, fmt.Sprint(err.Error(), " - Correct format is RFC3339"))
+			addError(request, response, http.StatusBadRequest, errorCode_BadRequest, fmt.Sprint(err.Error(), " - Correct format is RFC3339"))
 			return
 		}
 	} else {
 		date = time.Time{}
 	}
 
-	q := datastore.NewQuery(statusDBEntity).Filter("ChangeDate >=", date).Order("-ChangeDate")
+	q := datastore.NewQuery(statusDBEntity).Filter("ChangeDate >=", date)
+
+	if dateString := request.QueryParameter("dateTo"); dateString != "" {
+		dateTo, err := time.Parse(time.RFC3339, dateString)
+		if err != nil {
+			addError(request, response, http.StatusBadRequest, errorCode_BadRequest, fmt.Sprint(err.Error(), " - Correct format is RFC3339"))
+			return
+		}
+		q = q.Filter("ChangeDate <=", dateTo)
+	}
+
+	// the filters are part of the query - see "index.yaml" for the composite indexes
+	if codeString := request.QueryParameter("statusCode"); codeString != "" {
+		code, err := strconv.Atoi(codeString)
+		if err != nil || (code != Status_Ok && code != Status_PartialFailure && code != Status_Outage) {
+			addError(request, response, http.StatusBadRequest, errorCode_BadRequest, "statusCode must be 10, 20 or 30")
+			return
+		}
+		q = q.Filter("Status =", code)
+	}
+
+	switch request.QueryParameter("order") {
+	case "", "desc":
+		q = q.Order("-ChangeDate")
+	case "asc":
+		q = q.Order("ChangeDate")
+	default:
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, "order must be asc or desc")
+		return
+	}
 
 	var statusList StatusEntityGetAPIv1List
 
@@ -209,9 +303,9 @@ func getStatus(request *restful.Request, response *restful.Response) {
 	if err != nil && !isErrFieldMismatch(err) {
 		if appengine.IsOverQuota(err) {
 			// return 503 and a text similar to what GAE is returning as well
-			addPlainTextError(response, http.StatusServiceUnavailable, "503 - Over Quota")
+			addError(request, response, http.StatusServiceUnavailable, errorCode_OverQuota, "503 - Over Quota")
 		} else {
-			addPlainTextError(response, http.StatusInternalServerError, err.Error())
+			addDatastoreError(request, response, err)
 		}
 		return
 	}
@@ -224,17 +318,21 @@ func getStatus(request *restful.Request, response *restful.Response) {
 		statusList = append(statusList, statusAPI)
 	}
 
-	response.WriteHeaderAndEntity(http.StatusOK, statusList)
+	// the status list is not limited - so there is never a next bucket
+	writeListResponse(request, response, statusList, len(statusList), "")
 }
 
 func getCurrentStatus(request *restful.Request, response *restful.Response) {
-	ctx := appengine.NewContext(request.Request)
+	ctx := newContext(request.Request)
 
 	var statusAPI StatusEntityGetAPIv1
 
 	// first check Memcache
-	if _, err := memcache.Gob.Get(ctx, statusMemcacheKey, &statusAPI); err == nil {
-		response.WriteHeaderAndEntity(http.StatusOK, statusAPI)
+	_, err := memcache.Gob.Get(ctx, statusMemcacheKey, &statusAPI)
+	countCacheLookup("status", err == nil)
+	if err == nil {
+		statusAPI.Maintenance = internalGetActiveMaintenanceWindow(ctx)
+		writeEntity(request, response, http.StatusOK, statusAPI)
 		return
 	}
 
@@ -243,15 +341,32 @@ func getCurrentStatus(request *restful.Request, response *restful.Response) {
 	var statusOnDBList []StatusEntity
 	k, err := q.GetAll(ctx, &statusOnDBList)
 	if err != nil && !isErrFieldMismatch(err) {
+		// clients ask for the status during outages - the last known good status is better than an error
+		if lastKnownGood, ok := internalGetLastKnownGoodStatus(ctx); ok {
+			logWarningf(ctx, "Last known good status served: %v", err)
+			lastKnownGood.Stale = true
+			lastKnownGood.Maintenance = internalGetActiveMaintenanceWindow(ctx)
+			response.AddHeader("Warning", `110 - "Response is Stale"`)
+			writeEntity(request, response, http.StatusOK, lastKnownGood)
+			return
+		}
 		if appengine.IsOverQuota(err) {
 			// return 503 and a text similar to what GAE is returning as well
-			addPlainTextError(response, http.StatusServiceUnavailable, "503 - Over Quota")
+			addError(request, response, http.StatusServiceUnavailable, errorCode_OverQuota, "503 - Over Quota")
 		} else {
-			addPlainTextError(response, http.StatusInternalServerError, err.Error())
+			addDatastoreError(request, response, err)
 		}
 		return
 	}
 
+	// no status was ever stored - nothing is blocked (same as "internalGetCurrentStatus"), not cached
+	if len(statusOnDBList) == 0 {
+		statusAPI.Status = Status_Ok
+		statusAPI.Maintenance = internalGetActiveMaintenanceWindow(ctx)
+		writeEntity(request, response, http.StatusOK, statusAPI)
+		return
+	}
+
 	// DB Entity needs to be mapped back
 	mapDBtoAPIStatus(&statusOnDBList[0], &statusAPI)
 	statusAPI.Id = k[0].IntID()
@@ -260,19 +375,24 @@ func getCurrentStatus(request *restful.Request, response *restful.Response) {
 	item := &memcache.Item{
 		Key:   statusMemcacheKey,
 		Object: statusAPI,
+		Expiration: cacheExpiration(ctx),
 	}
 	memcache.Gob.Set(ctx, item)
+	internalSetLastKnownGoodStatus(ctx, statusAPI)
+
+	// the window is not cached with the status - it starts and ends without a status change
+	statusAPI.Maintenance = internalGetActiveMaintenanceWindow(ctx)
 
-	response.WriteHeaderAndEntity(http.StatusOK, statusAPI)
+	writeEntity(request, response, http.StatusOK, statusAPI)
 }
 
 func getStatusTextById(request *restful.Request, response *restful.Response) {
-	ctx := appengine.NewContext(request.Request)
+	ctx := newContext(request.Request)
 
 	id := request.PathParameter("id")
 	i, err := strconv.ParseInt(id, 10, 64)
 	if err != nil {
-		addPlainTextError(response, http.StatusBadRequest, err.Error())
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
 		return
 	}
 
@@ -285,22 +405,192 @@ func getStatusTextById(request *restful.Request, response *restful.Response) {
 	if err != nil && !isErrFieldMismatch(err) {
 		if appengine.IsOverQuota(err) {
 			// return 503 and a text similar to what GAE is returning as well
-			addPlainTextError(response, http.StatusServiceUnavailable, "503 - Over Quota")
+			addError(request, response, http.StatusServiceUnavailable, errorCode_OverQuota, "503 - Over Quota")
 		} else {
-			addPlainTextError(response, http.StatusInternalServerError, err.Error())
+			addDatastoreError(request, response, err)
 		}
 		return
 	}
 
+	// unknown status or a status without text
+	if len(statusTextOnDBList) == 0 {
+		addError(request, response, http.StatusNotFound, errorCode_NotFound, datastore.ErrNoSuchEntity.Error())
+		return
+	}
+
 	// DB Entity needs to be mapped back
 	var statusAPI StatusEntityGetTextAPIv1
 	statusAPI.Id = k[0].IntID()
-	statusAPI.Text = statusTextOnDBList[0].Text
+	statusAPI.Text = localizedMessage(ctx, request, response, statusKey, statusTextOnDBList[0].Text)
 
-	response.WriteHeaderAndEntity(http.StatusOK, statusAPI)
+	writeEntity(request, response, http.StatusOK, statusAPI)
 
 }
 
+// getStatusStats aggregates the status history of a period while reading it - every status is valid from
+// its ChangeDate until the next one. Each change from OK to any other status counts as incident.
+func getStatusStats(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	dateTo := time.Now()
+	dateFrom := dateTo.AddDate(0, 0, -30)
+	for param, date := range map[string]*time.Time{"dateFrom": &dateFrom, "dateTo": &dateTo} {
+		if dateString := request.QueryParameter(param); dateString != "" {
+			d, err := time.Parse(time.RFC3339, dateString)
+			if err != nil {
+				addError(request, response, http.StatusBadRequest, errorCode_BadRequest, fmt.Sprint(err.Error(), " - Correct format is RFC3339"))
+				return
+			}
+			*date = d
+		}
+	}
+	if !dateFrom.Before(dateTo) {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, "dateFrom must be before dateTo")
+		return
+	}
+
+	var stats StatusStatsAPIv1
+	stats.DateFrom = dateFrom.Format(time.RFC3339)
+	stats.DateTo = dateTo.Format(time.RFC3339)
+	stats.StatusCounts = make(map[string]int)
+
+	// the status valid at the begin of the period - without history everything was OK
+	current := Status_Ok
+	q := datastore.NewQuery(statusDBEntity).Filter("ChangeDate <", dateFrom).Order("-ChangeDate").Limit(1)
+	var before []StatusEntity
+	if _, err := q.GetAll(ctx, &before); err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+	if len(before) == 1 {
+		current = before[0].Status
+	}
+
+	var upTime, outage time.Duration
+	since := dateFrom
+	// adds the time from the last change up to {until} to the current status
+	account := func(until time.Time) {
+		d := until.Sub(since)
+		if current == Status_Ok {
+			upTime += d
+		} else {
+			outage += d
+			if outage > time.Duration(stats.LongestOutage)*time.Second {
+				stats.LongestOutage = int64(outage.Seconds())
+			}
+		}
+		since = until
+	}
+
+	q = datastore.NewQuery(statusDBEntity).Filter("ChangeDate >=", dateFrom).Filter("ChangeDate <", dateTo).Order("ChangeDate")
+	t := q.Run(ctx)
+	for {
+		var statusDB StatusEntity
+		_, err := t.Next(&statusDB)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil && !isErrFieldMismatch(err) {
+			commonResponseErrorProcessing(request, response, err)
+			return
+		}
+
+		account(statusDB.ChangeDate)
+		stats.StatusCounts[strconv.Itoa(statusDB.Status)]++
+		if current == Status_Ok && statusDB.Status != Status_Ok {
+			stats.Incidents++
+			outage = 0
+		}
+		current = statusDB.Status
+	}
+	account(dateTo)
+
+	stats.UptimePercent = 100 * upTime.Seconds() / dateTo.Sub(dateFrom).Seconds()
+	if stats.Incidents > 0 {
+		stats.MeanTimeBetweenIncidents = int64(upTime.Seconds()) / int64(stats.Incidents)
+	}
+
+	response.WriteHeaderAndEntity(http.StatusOK, stats)
+}
+
+// purgeStatus only checks the request and counts the matching status entries - the deletion itself
+// is done by task queue in buckets, to stay within the request deadline
+func purgeStatus(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	olderThan, err := time.Parse(time.RFC3339, request.QueryParameter("olderThan"))
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, fmt.Sprint(err.Error(), " - Correct format is RFC3339"))
+		return
+	}
+
+	q, err := statusPurgeQuery(ctx, olderThan)
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+	counter, err := q.Count(ctx)
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	var purge StatusPurgeAPIv1
+	purge.OlderThan = olderThan.Format(time.RFC3339)
+	purge.Purged = counter
+
+	if counter > 0 {
+		if err := queueStatusPurge(request, olderThan); err != nil {
+			commonResponseErrorProcessing(request, response, err)
+			return
+		}
+	}
+
+	response.WriteHeaderAndEntity(http.StatusAccepted, purge)
+}
+
+// processStatusPurge deletes one bucket of status entries (incl. their text) and re-queues itself
+// until no entries older than {olderThan} are left
+func processStatusPurge(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	olderThan, err := time.Parse(time.RFC3339, request.QueryParameter("olderThan"))
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, fmt.Sprint(err.Error(), " - Correct format is RFC3339"))
+		return
+	}
+
+	const maxNumberOfStatusPerTask = 100
+
+	q, err := statusPurgeQuery(ctx, olderThan)
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+	statusKeys, err := q.Limit(maxNumberOfStatusPerTask).GetAll(ctx, nil)
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	// the status texts are children of the status entry
+	if err := deleteWithChildren(ctx, statusKeys, statusDBEntityText, messageDBEntity); err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+	logInfof(ctx, "Status purge older than %s: %d status deleted", olderThan.Format(time.RFC3339), len(statusKeys))
+
+	// there may be more - continue in a new task (new request deadline)
+	if len(statusKeys) == maxNumberOfStatusPerTask {
+		if err := queueStatusPurge(request, olderThan); err != nil {
+			commonResponseErrorProcessing(request, response, err)
+			return
+		}
+	}
+
+	response.WriteHeaderAndEntity(http.StatusOK, StatusPurgeAPIv1{OlderThan: olderThan.Format(time.RFC3339), Purged: len(statusKeys)})
+}
+
 //---------------------------------------------------------------------------------------
 // internal functions
 //---------------------------------------------------------------------------------------
@@ -308,7 +598,9 @@ func getStatusTextById(request *restful.Request, response *restful.Response) {
 func internalGetCurrentStatus(ctx context.Context) int {
 
 	// first check Memcache
-	if item, err := memcache.Get(ctx, statusMemcacheKey); err == nil {
+	item, err := memcache.Get(ctx, statusMemcacheKey)
+	countCacheLookup("status", err == nil)
+	if err == nil {
 		if i64, err := strconv.ParseInt(string(item.Value), 10, 0); err == nil {
 			return int(i64)
 		}
@@ -317,7 +609,7 @@ func internalGetCurrentStatus(ctx context.Context) int {
 	q := datastore.NewQuery(statusDBEntity).Order("-ChangeDate").Limit(1)
 
 	var statusOnDBList []StatusEntity
-	_, err := q.GetAll(ctx, &statusOnDBList)
+	_, err = q.GetAll(ctx, &statusOnDBList)
 	if (err != nil && !isErrFieldMismatch(err)) || len(statusOnDBList) == 0 {
 		// we are not blocking to due problems in Status Management
 		return Status_Ok
@@ -328,3 +620,66 @@ func internalGetCurrentStatus(ctx context.Context) int {
 
 
 
+
+// internalSetLastKnownGoodStatus keeps a status read from or written to the datastore - errors are ignored
+func internalSetLastKnownGoodStatus(ctx context.Context, status StatusEntityGetAPIv1) {
+	status.Maintenance = nil
+	status.Stale = false
+	memcache.Gob.Set(ctx, &memcache.Item{Key: statusLastKnownGoodMemcacheKey, Object: status})
+
+	namespace := statusEntityRootKey(ctx).Namespace()
+	lastKnownGoodStatus.Lock()
+	lastKnownGoodStatus.byNamespace[namespace] = status
+	lastKnownGoodStatus.Unlock()
+}
+
+// internalGetLastKnownGoodStatus returns the last status which was read from the datastore - from memcache
+// or, if memcache doesn't have it, from this instance
+func internalGetLastKnownGoodStatus(ctx context.Context) (StatusEntityGetAPIv1, bool) {
+	var status StatusEntityGetAPIv1
+	if _, err := memcache.Gob.Get(ctx, statusLastKnownGoodMemcacheKey, &status); err == nil {
+		return status, true
+	}
+
+	namespace := statusEntityRootKey(ctx).Namespace()
+	lastKnownGoodStatus.Lock()
+	defer lastKnownGoodStatus.Unlock()
+	status, ok := lastKnownGoodStatus.byNamespace[namespace]
+	return status, ok
+}
+
+// internalGetLatestStatus returns the latest status in a strongly consistent way (usable in transactions)
+func internalGetLatestStatus(ctx context.Context) (*datastore.Key, *StatusEntity, error) {
+	q := datastore.NewQuery(statusDBEntity).Ancestor(statusEntityRootKey(ctx)).Order("-ChangeDate").Limit(1)
+
+	var statusOnDBList []StatusEntity
+	k, err := q.GetAll(ctx, &statusOnDBList)
+	if err != nil && !isErrFieldMismatch(err) {
+		return nil, nil, err
+	}
+	if len(statusOnDBList) == 0 {
+		return nil, nil, nil
+	}
+	return k[0], &statusOnDBList[0], nil
+}
+
+// statusPurgeQuery never matches the latest status - even if it's older than {olderThan}, the current status
+// must not be lost
+func statusPurgeQuery(ctx context.Context, olderThan time.Time) (*datastore.Query, error) {
+	_, latest, err := internalGetLatestStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if latest != nil && latest.ChangeDate.Before(olderThan) {
+		olderThan = latest.ChangeDate
+	}
+	return datastore.NewQuery(statusDBEntity).Filter("ChangeDate <", olderThan).KeysOnly(), nil
+}
+
+func queueStatusPurge(request *restful.Request, olderThan time.Time) error {
+	ctx := newContext(request.Request)
+
+	path := fmt.Sprint("/v1/tasks/purge/status?", url.Values{"olderThan": {olderThan.Format(time.RFC3339)}}.Encode())
+	_, err := taskqueue.Add(ctx, addRequestHeadersToTask(request.Request, taskqueue.NewPOSTTask(path, nil)), "")
+	return err
+}
@@ -0,0 +1,295 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Change log (changelogentity) which is stored in DB - one entry per mutation of a shared entity, written in the
+// same transaction as the entity (see "putSharedEntity"). Every entry is its own entity group, so the log
+// doesn't limit the write rate. The log is append-only - besides "/sync" it is tailed by replicas via
+// "/changelog", which compare the payload hash to skip entities they already have.
+// ---------------------------------------------------------------------------------------------------------------//
+type ChangeLogEntity struct {
+	Kind        string
+	EntityId    string       `datastore:",noindex"`
+	Operation   string       `datastore:",noindex"`
+	ChangeDate  time.Time
+	PayloadHash string       `datastore:",noindex"` // of the header - empty for older entries
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+type SyncAPIv1 struct {
+	Kind      string   `json:"kind"`
+	Created   []string `json:"created"`
+	Updated   []string `json:"updated"`
+	Deleted   []string `json:"deleted"`
+	NextToken string   `json:"nextToken"`
+	More      bool     `json:"more"`
+}
+
+// one entry of the change log for GET /changelog
+type ChangeLogAPIv1 struct {
+	Kind        string `json:"kind"`
+	EntityId    string `json:"entityId"`
+	Operation   string `json:"operation"`
+	ChangeDate  string `json:"changeDate"`
+	PayloadHash string `json:"payloadHash"`
+}
+
+type ChangeLogTailAPIv1 struct {
+	Changes   []ChangeLogAPIv1 `json:"changes"`
+	NextToken string           `json:"nextToken"`
+	More      bool             `json:"more"`
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Data Storage View
+// ---------------------------------------------------------------------------------------------------------------//
+
+const changeLogDBEntity = "changelogentity"
+
+const (
+	ChangeOperation_Created = "created"
+	ChangeOperation_Updated = "updated"
+	ChangeOperation_Deleted = "deleted"
+)
+
+const maxNumberOfChangesPerSync = 1000
+
+func mapDBtoAPIChangeLog(db *ChangeLogEntity, api *ChangeLogAPIv1) {
+	api.Kind = db.Kind
+	api.EntityId = db.EntityId
+	api.Operation = db.Operation
+	api.ChangeDate = db.ChangeDate.Format(dateTimeLayout)
+	api.PayloadHash = db.PayloadHash
+}
+
+// supporting functions
+
+func formatSyncToken(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 36)
+}
+
+func parseSyncToken(token string) (time.Time, error) {
+	if token == "" {
+		return time.Time{}, nil
+	}
+	nanos, err := strconv.ParseInt(token, 36, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid sync token")
+	}
+	return time.Unix(0, nanos).UTC(), nil
+}
+
+func entityIdOfKey(key *datastore.Key) string {
+	if key.StringID() != "" {
+		return key.StringID()
+	}
+	return strconv.FormatInt(key.IntID(), 10)
+}
+
+// logChange is called inside the transaction of the mutation - "existed" and "wasDeleted" describe the old state,
+// "db" is the entity as stored
+func logChange(ctx context.Context, entityType string, key *datastore.Key, db sharedEntity, existed bool, wasDeleted bool) error {
+	operation := ChangeOperation_Updated
+	switch {
+	case !existed:
+		operation = ChangeOperation_Created
+	case db.commonHeader().Deleted && !wasDeleted:
+		operation = ChangeOperation_Deleted
+	}
+
+	entry := ChangeLogEntity{Kind: entityType, EntityId: entityIdOfKey(key), Operation: operation, ChangeDate: time.Now(),
+		PayloadHash: db.commonHeader().PayloadHash}
+	_, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, changeLogDBEntity, nil), &entry)
+	return err
+}
+
+// logUpdate is "logChange" for server side updates of an existing entity (ratings, stars,...)
+func logUpdate(ctx context.Context, entityType string, key *datastore.Key, db sharedEntity) error {
+	return logChange(ctx, entityType, key, db, true, db.commonHeader().Deleted)
+}
+
+// settledSince is the time range a change log query can return - queries are eventually consistent, so only
+// changes older than "syncSettleSeconds" are returned and an entry which is not yet visible in the index can't
+// be skipped by the token. Empty if nothing settled since the token.
+func settledSince(ctx context.Context, since time.Time) (time.Time, bool) {
+	until := time.Now().Add(-configDuration(ctx, Config_SyncSettleSeconds, time.Second))
+	return until, since.Before(until)
+}
+
+// isSyncTokenExpired is true if the retention already deleted change log entries after the token - the
+// client has to do a full download
+func isSyncTokenExpired(ctx context.Context, since time.Time) bool {
+	if since.IsZero() {
+		return false
+	}
+	var retentionDB RetentionEntity
+	key := datastore.NewKey(ctx, retentionDBEntity, changeLogDBEntity, 0, retentionEntityRootKey(ctx))
+	if err := datastore.Get(ctx, key, &retentionDB); err != nil || retentionDB.MaxAgeDays <= 0 {
+		return false
+	}
+	return since.Before(time.Now().AddDate(0, 0, -retentionDB.MaxAgeDays))
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+// getChanges returns the ids of all entities of {kind} changed after the token - without token all
+// changes are returned. Each id is reported once with its final state.
+func getChanges(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	kind := request.PathParameter("kind")
+	if _, ok := sharedEntityTypes[kind]; !ok {
+		addError(request, response, http.StatusNotFound, errorCode_NotFound, "Unknown kind - must be chart, gchart or usermetric")
+		return
+	}
+
+	since, err := parseSyncToken(request.QueryParameter("since"))
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+	if isSyncTokenExpired(ctx, since) {
+		addError(request, response, http.StatusGone, errorCode_Conflict, "Sync token is older than the change log - a full download is required")
+		return
+	}
+
+	until, settled := settledSince(ctx, since)
+	sync := SyncAPIv1{Kind: kind, NextToken: formatSyncToken(until)}
+	if !settled {
+		// nothing settled since the last call
+		sync.NextToken = formatSyncToken(since)
+		response.WriteHeaderAndEntity(http.StatusOK, sync)
+		return
+	}
+
+	q := datastore.NewQuery(changeLogDBEntity).Filter("Kind =", kind).Filter("ChangeDate >", since).
+		Filter("ChangeDate <=", until).Order("ChangeDate").Limit(maxNumberOfChangesPerSync)
+
+	var changes []ChangeLogEntity
+	if _, err := q.GetAll(ctx, &changes); err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	// a full bucket - continue after the last entry (entries with the same timestamp are rare enough)
+	if len(changes) == maxNumberOfChangesPerSync {
+		sync.NextToken = formatSyncToken(changes[len(changes)-1].ChangeDate)
+		sync.More = true
+	}
+
+	// the final state of every id - "created" stays created if it is updated afterwards
+	final := make(map[string]string)
+	var order []string
+	for _, change := range changes {
+		previous, seen := final[change.EntityId]
+		if !seen {
+			order = append(order, change.EntityId)
+		}
+		if previous == ChangeOperation_Created && change.Operation == ChangeOperation_Updated {
+			continue
+		}
+		final[change.EntityId] = change.Operation
+	}
+	for _, id := range order {
+		switch final[id] {
+		case ChangeOperation_Created:
+			sync.Created = append(sync.Created, id)
+		case ChangeOperation_Deleted:
+			sync.Deleted = append(sync.Deleted, id)
+		default:
+			sync.Updated = append(sync.Updated, id)
+		}
+	}
+
+	response.WriteHeaderAndEntity(http.StatusOK, sync)
+}
+
+// getChangeLog returns the change log entries of all kinds (or of {kind}) after the token in the order of
+// their changes - every mutation is returned, so a replica can apply them one by one
+func getChangeLog(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	kind := request.QueryParameter("kind")
+	if _, ok := sharedEntityTypes[kind]; kind != "" && !ok {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, "Unknown kind - must be chart, gchart or usermetric")
+		return
+	}
+
+	since, err := parseSyncToken(request.QueryParameter("since"))
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+	if isSyncTokenExpired(ctx, since) {
+		addError(request, response, http.StatusGone, errorCode_Conflict, "Token is older than the change log - a full copy is required")
+		return
+	}
+
+	until, settled := settledSince(ctx, since)
+	tail := ChangeLogTailAPIv1{Changes: []ChangeLogAPIv1{}, NextToken: formatSyncToken(until)}
+	if !settled {
+		tail.NextToken = formatSyncToken(since)
+		response.WriteHeaderAndEntity(http.StatusOK, tail)
+		return
+	}
+
+	q := datastore.NewQuery(changeLogDBEntity)
+	if kind != "" {
+		q = q.Filter("Kind =", kind)
+	}
+	q = q.Filter("ChangeDate >", since).Filter("ChangeDate <=", until).Order("ChangeDate").Limit(maxNumberOfChangesPerSync)
+
+	var changes []ChangeLogEntity
+	if _, err := q.GetAll(ctx, &changes); err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	// a full bucket - continue after the last entry
+	if len(changes) == maxNumberOfChangesPerSync {
+		tail.NextToken = formatSyncToken(changes[len(changes)-1].ChangeDate)
+		tail.More = true
+	}
+	for i := range changes {
+		var change ChangeLogAPIv1
+		mapDBtoAPIChangeLog(&changes[i], &change)
+		tail.Changes = append(tail.Changes, change)
+	}
+
+	response.WriteHeaderAndEntity(http.StatusOK, tail)
+}
@@ -0,0 +1,317 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Tag usage (tagentity) which is stored in DB - the tag itself is the key
+// ---------------------------------------------------------------------------------------------------------------//
+type TagEntity struct {
+	Count int
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+type TagAPIv1 struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+type TagAPIv1List []TagAPIv1
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Data Storage View
+// ---------------------------------------------------------------------------------------------------------------//
+
+const tagDBEntity = "tagentity"
+const tagDBEntityRootKey = "tagroot"
+
+// supporting functions
+
+// tagEntityRootKey returns the key used for all tagEntity entries.
+func tagEntityRootKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, tagDBEntity, tagDBEntityRootKey, 0, nil)
+}
+
+// tags are stored lower case and without duplicates
+func normalizeTags(tags []string) []string {
+	var normalized []string
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	return normalized
+}
+
+// all tags requested by "tag=" must be set - the first one is part of the query, the others are checked here
+func hasAllTags(header *CommonEntityHeader, tags []string) bool {
+	for _, tag := range tags {
+		found := false
+		for _, t := range header.Tags {
+			if t == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func tagParameters(request *restful.Request) []string {
+	return normalizeTags(request.Request.URL.Query()["tag"])
+}
+
+// putSharedEntity stores the entity and writes the change log (see "entity_sync.go") in one unit of work (see
+// "transaction.go"), the tag usage is updated after the commit - deleted entities don't count
+func putSharedEntity(ctx context.Context, entityType string, key *datastore.Key, db sharedEntity) (*datastore.Key, error) {
+	return storeSharedEntity(ctx, entityType, key, db, nil, nil)
+}
+
+// putSharedEntityRevision is "putSharedEntity" for content changes - the stored version is kept as revision
+// (see "entity_revision.go"), the ownership is checked in the same unit of work (returns "errNotOwner")
+func putSharedEntityRevision(ctx context.Context, entityType string, key *datastore.Key, db sharedEntity, e *editor) (*datastore.Key, error) {
+	return storeSharedEntity(ctx, entityType, key, db, &RevisionEntity{EditorId: e.clientId}, e)
+}
+
+func storeSharedEntity(ctx context.Context, entityType string, key *datastore.Key, db sharedEntity, revision *RevisionEntity, e *editor) (*datastore.Key, error) {
+	key, err := offloadSharedEntityBlob(ctx, entityType, key, db)
+	if err != nil {
+		return nil, err
+	}
+
+	var storedKey *datastore.Key
+	err = runUnitOfWork(ctx, func(tc context.Context, uow *unitOfWork) error {
+		var err error
+		storedKey, err = putSharedEntityInUnitOfWork(tc, uow, entityType, key, db, revision, e)
+		return err
+	})
+	return storedKey, err
+}
+
+// offloadSharedEntityBlob moves large binary payloads to Cloud Storage - must be done before the transaction,
+// the blob is registered with its owner, so incomplete keys are completed
+func offloadSharedEntityBlob(ctx context.Context, entityType string, key *datastore.Key, db sharedEntity) (*datastore.Key, error) {
+	holder, hasBlob := db.(blobHolder)
+	if !hasBlob {
+		return key, nil
+	}
+	if key.Incomplete() {
+		low, _, err := datastore.AllocateIDs(ctx, key.Kind(), key.Parent(), 1)
+		if err != nil {
+			return nil, err
+		}
+		key = datastore.NewKey(ctx, key.Kind(), "", low, key.Parent())
+	}
+	if err := offloadBlob(ctx, entityType, key, holder); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// putSharedEntityInUnitOfWork is the transactional part of "putSharedEntity" - for mutations which write
+// further entities in the same unit of work (e.g. flags). Blobs must already be offloaded, a nil editor isn't checked.
+func putSharedEntityInUnitOfWork(tc context.Context, uow *unitOfWork, entityType string, key *datastore.Key, db sharedEntity, revision *RevisionEntity, e *editor) (*datastore.Key, error) {
+	deltas := make(map[string]int)
+	oldBlob := ""
+	revisionKept := false
+	existed, wasDeleted := false, false
+
+	if !key.Incomplete() {
+		old := sharedEntityTypes[entityType].newEntity()
+		err := getEntity(tc, key, old)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return nil, err
+		}
+		if err == nil && e != nil && !e.mayChange(old.commonHeader()) {
+			return nil, errNotOwner
+		}
+		if err == nil {
+			existed, wasDeleted = true, old.commonHeader().Deleted
+			// the rating aggregate, the stars and the owner are maintained by the server only
+			db.commonHeader().RatingCount = old.commonHeader().RatingCount
+			db.commonHeader().RatingAverage = old.commonHeader().RatingAverage
+			db.commonHeader().StarCount = old.commonHeader().StarCount
+			db.commonHeader().OwnerId = old.commonHeader().OwnerId
+			// content changes don't change the curation - only curators do (see "transitionCurationState")
+			if revision != nil {
+				db.commonHeader().Curated = old.commonHeader().Curated
+				db.commonHeader().CurationState = old.commonHeader().CurationState
+				db.commonHeader().CurationComment = old.commonHeader().CurationComment
+			}
+			if oldHolder, ok := old.(blobHolder); ok {
+				_, ref := oldHolder.blobPayload()
+				oldBlob = *ref
+			}
+			if revision != nil {
+				if err := keepRevision(tc, key, old, revision); err != nil {
+					return nil, err
+				}
+				revisionKept = true
+			}
+		}
+		// a PUT of a new id starts like an insert - not curated, whatever the client sent
+		if err == datastore.ErrNoSuchEntity && revision != nil {
+			db.commonHeader().Curated = false
+			db.commonHeader().CurationState = initialCurationState(false)
+			db.commonHeader().CurationComment = ""
+		}
+		if err == nil && !old.commonHeader().Deleted {
+			for _, tag := range old.commonHeader().Tags {
+				deltas[tag]--
+			}
+		}
+	}
+	if !db.commonHeader().Deleted {
+		for _, tag := range db.commonHeader().Tags {
+			deltas[tag]++
+		}
+	}
+
+	storedKey, err := putEntity(tc, key, db)
+	if err != nil {
+		return nil, err
+	}
+	if err := logChange(tc, entityType, storedKey, db, existed, wasDeleted); err != nil {
+		return nil, err
+	}
+	// all tags are one entity group which allows about one write per second - so they are updated after the
+	// commit in their own transaction, a failed update is logged and the count is off by the delta
+	uow.onCommit(func(ctx context.Context) {
+		err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+			return updateTagCounts(tc, deltas)
+		}, nil)
+		if err != nil {
+			logWarningf(ctx, "Tag counts not updated: %v", err)
+		}
+	})
+
+	if holder, ok := db.(blobHolder); ok {
+		if _, ref := holder.blobPayload(); *ref != oldBlob {
+			newBlob := *ref
+			uow.onCommit(func(ctx context.Context) {
+				changeBlobClaim(ctx, newBlob, true)
+				// the old blob is still used by the revision - released when the revision is pruned
+				if !revisionKept {
+					changeBlobClaim(ctx, oldBlob, false)
+				}
+			})
+		}
+	}
+	if revisionKept {
+		uow.onCommit(func(ctx context.Context) {
+			pruneRevisions(ctx, storedKey)
+		})
+	}
+
+	return storedKey, nil
+}
+
+func updateTagCounts(ctx context.Context, deltas map[string]int) error {
+	var keys []*datastore.Key
+	var changes []int
+	for tag, delta := range deltas {
+		if delta != 0 {
+			keys = append(keys, datastore.NewKey(ctx, tagDBEntity, tag, 0, tagEntityRootKey(ctx)))
+			changes = append(changes, delta)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	tags := make([]TagEntity, len(keys))
+	if err := datastore.GetMulti(ctx, keys, tags); err != nil {
+		multiErr, ok := err.(appengine.MultiError)
+		if !ok {
+			return err
+		}
+		// new tags simply start with 0
+		for _, e := range multiErr {
+			if e != nil && e != datastore.ErrNoSuchEntity {
+				return err
+			}
+		}
+	}
+
+	for i := range tags {
+		tags[i].Count += changes[i]
+		if tags[i].Count < 0 {
+			tags[i].Count = 0
+		}
+	}
+
+	_, err := datastore.PutMulti(ctx, keys, tags)
+	return err
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+func getTags(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	const maxNumberOfTagsPerCall = 100
+
+	limit := maxNumberOfTagsPerCall
+	if limitString := request.QueryParameter("n"); limitString != "" {
+		if n, err := strconv.Atoi(limitString); err == nil && n > 0 && n <= maxNumberOfTagsPerCall {
+			limit = n
+		}
+	}
+
+	q := datastore.NewQuery(tagDBEntity).Ancestor(tagEntityRootKey(ctx)).Filter("Count >", 0).Order("-Count").Limit(limit)
+
+	var tagOnDBList []TagEntity
+	k, err := q.GetAll(ctx, &tagOnDBList)
+	if err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	// DB Entity needs to be mapped back
+	var tagList TagAPIv1List
+	for i, tagDB := range tagOnDBList {
+		tagList = append(tagList, TagAPIv1{Tag: k[i].StringID(), Count: tagDB.Count})
+	}
+
+	response.WriteHeaderAndEntity(http.StatusOK, tagList)
+}
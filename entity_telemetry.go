@@ -0,0 +1,294 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/taskqueue"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Golden Cheetah anonymous usage metrics (telemetryentity) which are stored in DB
+// ---------------------------------------------------------------------------------------------------------------//
+type TelemetryEntity struct {
+	OS            string
+	ClientVersion string
+	FeatureNames  []string     `datastore:",noindex"`
+	FeatureCounts []int64      `datastore:",noindex"`
+	ReceivedDate  time.Time
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+// Full structure for POST
+type TelemetryAPIv1 struct {
+	OS            string           `json:"os"`
+	ClientVersion string           `json:"clientVersion"`
+	Features      map[string]int64 `json:"features"`
+}
+
+// Daily rollup for GET
+type TelemetryDailyAPIv1 struct {
+	Date           string           `json:"date"`
+	Reports        int              `json:"reports"`
+	OS             map[string]int   `json:"os"`
+	ClientVersions map[string]int   `json:"clientVersions"`
+	Features       map[string]int64 `json:"features"`
+}
+
+type TelemetryDailyAPIv1List []TelemetryDailyAPIv1
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Data Storage View
+// ---------------------------------------------------------------------------------------------------------------//
+
+const telemetryDBEntity = "telemetryentity"
+const telemetryDBEntityRootKey = "telemetryroot"
+
+// telemetry is collected in a pull queue and written in batches by "/tasks/telemetry" - see queue.yaml
+const telemetryQueue = "telemetry"
+const telemetryDateLayout = "2006-01-02"
+
+func mapAPItoDBTelemetry(api *TelemetryAPIv1, db *TelemetryEntity) {
+	db.OS = api.OS
+	db.ClientVersion = api.ClientVersion
+	db.FeatureNames = nil
+	db.FeatureCounts = nil
+	for name, count := range api.Features {
+		db.FeatureNames = append(db.FeatureNames, name)
+		db.FeatureCounts = append(db.FeatureCounts, count)
+	}
+}
+
+// supporting functions
+
+// telemetryEntityRootKey returns the key used for all telemetryEntity entries.
+func telemetryEntityRootKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, telemetryDBEntity, telemetryDBEntityRootKey, 0, nil)
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+// insertTelemetry only queues the metrics - all reports share one entity group, so they
+// must not be written one by one
+func insertTelemetry(request *restful.Request, response *restful.Response) {
+	ctx := newDefaultContext(request.Request)
+
+	telemetry := new(TelemetryAPIv1)
+	if err := request.ReadEntity(telemetry); err != nil {
+		addError(request, response, http.StatusInternalServerError, errorCode_InvalidPayload, err.Error())
+		return
+	}
+
+	payload, err := json.Marshal(telemetry)
+	if err != nil {
+		addError(request, response, http.StatusInternalServerError, errorCode_Internal, err.Error())
+		return
+	}
+
+	// the pull queue is shared by all tenants - the tag tells where the report is stored
+	task := &taskqueue.Task{
+		Method:  "PULL",
+		Payload: payload,
+		Tag:     request.Request.Header.Get(tenantHeader),
+	}
+	if _, err := taskqueue.Add(ctx, task, telemetryQueue); err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	// Response is Empty for 202
+	response.WriteHeaderAndEntity(http.StatusAccepted, "")
+}
+
+// the reports of one tenant in one lease - stored with one PutMulti in the namespace of the tenant
+type telemetryBatch struct {
+	tasks           []*taskqueue.Task
+	keys            []*datastore.Key
+	telemetryDBList []TelemetryEntity
+}
+
+// processTelemetry is called by cron - leases the queued reports of all tenants and stores them per tenant
+func processTelemetry(request *restful.Request, response *restful.Response) {
+	ctx := newDefaultContext(request.Request)
+
+	const maxNumberOfTasksPerLease = 500 // max. entities per PutMulti
+	const leaseSeconds = 60
+
+	stored := 0
+	var storeErr error
+	for {
+		tasks, err := taskqueue.Lease(ctx, maxNumberOfTasksPerLease, telemetryQueue, leaseSeconds)
+		if err != nil {
+			commonResponseErrorProcessing(request, response, err)
+			return
+		}
+		if len(tasks) == 0 {
+			break
+		}
+
+		now := time.Now()
+		var dropped []*taskqueue.Task
+		batches := make(map[string]*telemetryBatch)
+		for _, task := range tasks {
+			var telemetry TelemetryAPIv1
+			tc, err := tenantContext(ctx, task.Tag)
+			if err == nil {
+				err = json.Unmarshal(task.Payload, &telemetry)
+			}
+			if err != nil {
+				// broken payloads are dropped together with the task
+				logWarningf(ctx, "Telemetry task %s dropped: %v", task.Name, err)
+				dropped = append(dropped, task)
+				continue
+			}
+			batch, ok := batches[task.Tag]
+			if !ok {
+				batch = new(telemetryBatch)
+				batches[task.Tag] = batch
+			}
+			var telemetryDB TelemetryEntity
+			mapAPItoDBTelemetry(&telemetry, &telemetryDB)
+			telemetryDB.ReceivedDate = now
+			batch.tasks = append(batch.tasks, task)
+			batch.telemetryDBList = append(batch.telemetryDBList, telemetryDB)
+			batch.keys = append(batch.keys, datastore.NewIncompleteKey(tc, telemetryDBEntity, telemetryEntityRootKey(tc)))
+		}
+
+		done := dropped
+		for tenant, batch := range batches {
+			tc, _ := tenantContext(ctx, tenant)
+			if _, err := datastore.PutMulti(tc, batch.keys, batch.telemetryDBList); err != nil {
+				// tasks are not deleted - they are leased again after the lease expired
+				logErrorf(ctx, "Telemetry of tenant %q not stored: %v", tenant, err)
+				storeErr = err
+				continue
+			}
+			done = append(done, batch.tasks...)
+			stored += len(batch.keys)
+		}
+
+		if len(done) > 0 {
+			if err := taskqueue.DeleteMulti(ctx, done, telemetryQueue); err != nil {
+				logErrorf(ctx, "Telemetry tasks not deleted: %v", err)
+			}
+		}
+
+		if len(tasks) < maxNumberOfTasksPerLease || storeErr != nil {
+			break
+		}
+	}
+
+	logInfof(ctx, "Telemetry: %d reports stored", stored)
+	if storeErr != nil {
+		commonResponseErrorProcessing(request, response, storeErr)
+		return
+	}
+	response.WriteHeaderAndEntity(http.StatusOK, stored)
+}
+
+func getTelemetryDaily(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	var dateFrom, dateTo time.Time
+	var err error
+	if dateString := request.QueryParameter("dateFrom"); dateString != "" {
+		dateFrom, err = time.Parse(time.RFC3339, dateString)
+		if err != nil {
+			addError(request, response, http.StatusBadRequest, errorCode_BadRequest, fmt.Sprint(err.Error(), " - Correct format is RFC3339"))
+			return
+		}
+	} else {
+		dateFrom = time.Now().AddDate(0, 0, -30)
+	}
+	if dateString := request.QueryParameter("dateTo"); dateString != "" {
+		dateTo, err = time.Parse(time.RFC3339, dateString)
+		if err != nil {
+			addError(request, response, http.StatusBadRequest, errorCode_BadRequest, fmt.Sprint(err.Error(), " - Correct format is RFC3339"))
+			return
+		}
+	} else {
+		dateTo = time.Now()
+	}
+
+	q := datastore.NewQuery(telemetryDBEntity).Ancestor(telemetryEntityRootKey(ctx)).
+		Filter("ReceivedDate >=", dateFrom).Filter("ReceivedDate <", dateTo)
+
+	// aggregate while reading - the single reports are never sent to the client
+	rollups := make(map[string]*TelemetryDailyAPIv1)
+	t := q.Run(ctx)
+	for {
+		var telemetryDB TelemetryEntity
+		_, err := t.Next(&telemetryDB)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil && !isErrFieldMismatch(err) {
+			commonResponseErrorProcessing(request, response, err)
+			return
+		}
+
+		day := telemetryDB.ReceivedDate.UTC().Format(telemetryDateLayout)
+		rollup, ok := rollups[day]
+		if !ok {
+			rollup = &TelemetryDailyAPIv1{
+				Date:           day,
+				OS:             make(map[string]int),
+				ClientVersions: make(map[string]int),
+				Features:       make(map[string]int64),
+			}
+			rollups[day] = rollup
+		}
+		rollup.Reports++
+		rollup.OS[telemetryDB.OS]++
+		rollup.ClientVersions[telemetryDB.ClientVersion]++
+		for i, name := range telemetryDB.FeatureNames {
+			if i < len(telemetryDB.FeatureCounts) {
+				rollup.Features[name] += telemetryDB.FeatureCounts[i]
+			}
+		}
+	}
+
+	var days []string
+	for day := range rollups {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+
+	var rollupList TelemetryDailyAPIv1List
+	for _, day := range days {
+		rollupList = append(rollupList, *rollups[day])
+	}
+
+	response.WriteHeaderAndEntity(http.StatusOK, rollupList)
+}
@@ -0,0 +1,222 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strconv"
+
+	_ "image/gif"
+	_ "image/jpeg"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Thumbnails of chart images - a grid of charts only needs small previews, so a downscaled PNG is created
+// whenever the image of a chart is stored and kept in the chart entity ("Thumbnail"). Charts stored before
+// get their thumbnail with the first GET of it.
+// ---------------------------------------------------------------------------------------------------------------//
+
+const mimePNG = "image/png"
+
+// the longer side of a thumbnail in pixels - smaller images are their own thumbnail
+const thumbnailSize = 240
+
+// the thumbnail must fit into the space "maxPayloadSize" leaves in the entity - larger ones are not stored
+const maxThumbnailBytes = 32 * 1024
+
+// images with more pixels get no thumbnail - decoding allocates 4-8 bytes per pixel, whatever size the header
+// claims (GoldenCheetah charts have less than 4 megapixels)
+const maxThumbnailSourcePixels = 16 * 1000 * 1000
+
+// supporting functions
+
+// newThumbnail downscales a PNG, JPEG or GIF image - nil if the data is no image, the image or the thumbnail
+// too large
+func newThumbnail(data []byte) []byte {
+	if len(data) == 0 {
+		return nil
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || config.Width <= 0 || config.Height <= 0 {
+		return nil
+	}
+	if int64(config.Width)*int64(config.Height) > maxThumbnailSourcePixels {
+		return nil
+	}
+	if format == "png" && config.Width <= thumbnailSize && config.Height <= thumbnailSize && len(data) <= maxThumbnailBytes {
+		return data
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	width, height := thumbnailBounds(config.Width, config.Height)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, scaleImage(src, width, height)); err != nil || buf.Len() > maxThumbnailBytes {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// thumbnailBounds keeps the aspect ratio - no side is smaller than 1 pixel
+func thumbnailBounds(width, height int) (int, int) {
+	if width <= thumbnailSize && height <= thumbnailSize {
+		return width, height
+	}
+	if width >= height {
+		return thumbnailSize, maxInt(1, height*thumbnailSize/width)
+	}
+	return maxInt(1, width*thumbnailSize/height), thumbnailSize
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// scaleImage averages the source pixels of each target pixel (box filter) - good enough for a preview and
+// every source pixel is read only once
+func scaleImage(src image.Image, width, height int) image.Image {
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := b.Min.Y + y*b.Dy()/height
+		y1 := maxInt(y0+1, b.Min.Y+(y+1)*b.Dy()/height)
+		for x := 0; x < width; x++ {
+			x0 := b.Min.X + x*b.Dx()/width
+			x1 := maxInt(x0+1, b.Min.X+(x+1)*b.Dx()/width)
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(bl / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+func getChartThumbnailById(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	i, err := strconv.ParseInt(request.PathParameter("id"), 10, 64)
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+	key := chartEntityKey(ctx, i)
+
+	chartDB := new(ChartEntity)
+	if err := getEntity(ctx, key, chartDB); err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+	if !isListedOrOwned(ctx, request, &chartDB.Header) {
+		addError(request, response, http.StatusNotFound, errorCode_NotFound, datastore.ErrNoSuchEntity.Error())
+		return
+	}
+
+	// the thumbnail changes with the chart only - checked after the unlisted check, a 304 would tell that the
+	// chart exists
+	if isConditionalRequest(request) && isNotModified(request, &chartDB.Header) {
+		setConditionalHeaders(response, &chartDB.Header)
+		response.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	thumbnail := chartDB.Thumbnail
+	if len(thumbnail) == 0 {
+		if thumbnail, err = internalCreateChartThumbnail(ctx, key, chartDB); err != nil {
+			commonResponseErrorProcessing(request, response, err)
+			return
+		}
+	}
+	if len(thumbnail) == 0 {
+		addError(request, response, http.StatusNotFound, errorCode_NotFound, "The chart has no image which can be shown as thumbnail")
+		return
+	}
+
+	setConditionalHeaders(response, &chartDB.Header)
+	response.AddHeader("Content-Type", mimePNG)
+	// the thumbnail of an unlisted chart must not be kept by shared caches
+	if chartDB.Header.Unlisted {
+		response.AddHeader("Cache-Control", "private, max-age=3600")
+	} else {
+		response.AddHeader("Cache-Control", "public, max-age=3600")
+	}
+	response.WriteHeader(http.StatusOK)
+	response.Write(thumbnail)
+}
+
+//---------------------------------------------------------------------------------------
+// internal functions
+//---------------------------------------------------------------------------------------
+
+// internalCreateChartThumbnail creates the missing thumbnail of a chart stored before thumbnails existed - it's
+// stored only if the chart didn't change meanwhile, errors of the store are only logged
+func internalCreateChartThumbnail(ctx context.Context, key *datastore.Key, chartDB *ChartEntity) ([]byte, error) {
+	if err := loadBlob(ctx, chartDB); err != nil {
+		return nil, err
+	}
+	thumbnail := newThumbnail(chartDB.Image)
+	if len(thumbnail) == 0 {
+		return nil, nil
+	}
+
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		current := new(ChartEntity)
+		if err := getEntity(tc, key, current); err != nil && !isErrFieldMismatch(err) {
+			return err
+		}
+		if !current.Header.LastChanged.Equal(chartDB.Header.LastChanged) || len(current.Thumbnail) > 0 {
+			return nil
+		}
+		current.Thumbnail = thumbnail
+		if _, err := putEntity(tc, key, current); err != nil {
+			return err
+		}
+		return logUpdate(tc, sharedTypeChart, key, current)
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		logWarningf(ctx, "Thumbnail of chart %d not stored: %v", key.IntID(), err)
+	}
+	return thumbnail, nil
+}
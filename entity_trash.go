@@ -0,0 +1,228 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Trash - a DELETE only marks the entity as deleted and keeps the payload ("Header.Trashed"). The owner can
+// restore it for "trashRetentionDays", afterwards the payload is purged by cron and only the deleted header stays.
+// ---------------------------------------------------------------------------------------------------------------//
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+type TrashItemAPIv1 struct {
+	Id        string `json:"id"` // {type}:{id or key} - used for the restore
+	Type      string `json:"type"`
+	EntityId  string `json:"entityId"`
+	Name      string `json:"name"`
+	Trashed   string `json:"trashed"`
+	PurgeDate string `json:"purgeDate"`
+}
+
+type TrashAPIv1List []TrashItemAPIv1
+
+type TrashPurgeAPIv1 struct {
+	Purged int `json:"purged"`
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Data Storage View
+// ---------------------------------------------------------------------------------------------------------------//
+
+// the kinds in the trash - in a fixed order for the listing
+var trashTypes = []struct {
+	entityType string
+	kind       string
+}{
+	{sharedTypeChart, chartDBEntity},
+	{sharedTypeGChart, gChartDBEntity},
+	{sharedTypeUserMetric, usermetricDBEntity},
+}
+
+// supporting functions
+
+func isTrashed(header *CommonEntityHeader) bool {
+	return header.Deleted && !header.Trashed.IsZero()
+}
+
+func trashItemId(entityType string, key *datastore.Key) string {
+	return entityType + ":" + sharedEntityId(key)
+}
+
+// parseTrashItemId returns the type and the key of "{type}:{id or key}"
+func parseTrashItemId(ctx context.Context, id string) (string, *datastore.Key, bool) {
+	parts := strings.SplitN(id, ":", 2)
+	if len(parts) != 2 {
+		return "", nil, false
+	}
+	sharedType, ok := sharedEntityTypes[parts[0]]
+	if !ok {
+		return "", nil, false
+	}
+	key, err := sharedType.key(ctx, parts[1])
+	if err != nil {
+		return "", nil, false
+	}
+	return parts[0], key, true
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+// getTrash lists the restorable entities of the caller - oldest first
+func getTrash(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	clientId := requestOwnerId(request)
+	if clientId == "" {
+		addError(request, response, http.StatusUnauthorized, errorCode_Unauthorized, missingClientMessage)
+		return
+	}
+
+	retention := configDuration(ctx, Config_TrashRetentionDays, 24*time.Hour)
+	var trashList TrashAPIv1List
+	for _, t := range trashTypes {
+		entityType := t.entityType
+		err := queryOwned(ctx, t.kind, clientId, true, func(key *datastore.Key, header *CommonEntityHeader) {
+			if !isTrashed(header) {
+				return
+			}
+			trashList = append(trashList, TrashItemAPIv1{
+				Id:        trashItemId(entityType, key),
+				Type:      entityType,
+				EntityId:  sharedEntityId(key),
+				Name:      header.Name,
+				Trashed:   header.Trashed.Format(dateTimeLayout),
+				PurgeDate: header.Trashed.Add(retention).Format(dateTimeLayout),
+			})
+		})
+		if err != nil {
+			commonResponseErrorProcessing(request, response, err)
+			return
+		}
+	}
+
+	writeListResponse(request, response, trashList, len(trashList), "")
+}
+
+// restoreTrashItem undoes the delete - only the owner or a curator may restore
+func restoreTrashItem(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	entityType, key, ok := parseTrashItemId(ctx, request.PathParameter("id"))
+	if !ok {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, "Invalid id - must be {type}:{id or key}")
+		return
+	}
+
+	db := sharedEntityTypes[entityType].newEntity()
+	if err := getEntity(ctx, key, db); err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	if !requestEditor(ctx, request).mayChange(db.commonHeader()) {
+		addError(request, response, http.StatusForbidden, errorCode_Forbidden, "Forbidden - only the owner or a curator may restore this entity")
+		return
+	}
+	if !isTrashed(db.commonHeader()) {
+		addError(request, response, http.StatusNotFound, errorCode_NotFound, "Entity is not in the trash - it's not deleted or already purged")
+		return
+	}
+
+	db.commonHeader().Deleted = false
+	db.commonHeader().Trashed = time.Time{}
+	db.commonHeader().MergedInto = ""
+	db.commonHeader().LastChanged = time.Now()
+
+	if _, err := putSharedEntity(ctx, entityType, key, db); err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+	indexForSearch(ctx, entityType, key, db)
+
+	// Response is Empty for 204
+	response.WriteHeaderAndEntity(http.StatusNoContent, "")
+}
+
+// processTrashPurge is called by cron - removes the payload of all entities trashed longer than the retention
+func processTrashPurge(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	// the tenants are processed by their own tasks
+	if err := queueTenantRuns(request.Request); err != nil {
+		logErrorf(ctx, "Cron %s not queued for the tenants: %v", request.Request.URL.Path, err)
+	}
+
+	// cron requests have a 10 minute deadline - the rest is done by the next run
+	const maxRunTime = 8 * time.Minute
+	start := time.Now()
+
+	retention := configDuration(ctx, Config_TrashRetentionDays, 24*time.Hour)
+	var result TrashPurgeAPIv1
+	for _, t := range trashTypes {
+		q := datastore.NewQuery(t.kind).Filter("Header.Trashed >", time.Time{}).
+			Filter("Header.Trashed <", time.Now().Add(-retention)).KeysOnly()
+		keys, err := q.GetAll(ctx, nil)
+		if err != nil {
+			commonResponseErrorProcessing(request, response, err)
+			return
+		}
+
+		for _, key := range keys {
+			if time.Since(start) > maxRunTime {
+				break
+			}
+			db := sharedEntityTypes[t.entityType].newEntity()
+			if err := getEntity(ctx, key, db); err != nil && !isErrFieldMismatch(err) {
+				logWarningf(ctx, "Trashed entity %s not purged: %v", key, err)
+				continue
+			}
+			// restored in the meantime
+			if !isTrashed(db.commonHeader()) {
+				continue
+			}
+
+			db.clearPayload()
+			db.commonHeader().Trashed = time.Time{}
+			if _, err := putSharedEntity(ctx, t.entityType, key, db); err != nil {
+				logWarningf(ctx, "Trashed entity %s not purged: %v", key, err)
+				continue
+			}
+			result.Purged++
+		}
+	}
+
+	logInfof(ctx, "Trash purge - purged: %d", result.Purged)
+	response.WriteHeaderAndEntity(http.StatusOK, result)
+}
@@ -0,0 +1,357 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Upload session (uploadsessionentity) which is stored in DB - large payloads are sent in chunks (PUT with
+// Content-Range), each chunk is stored as child (uploadchunkentity). The commit assembles the chunks and
+// creates the entity exactly like the one-shot POST does. An interrupted upload is resumed at "Received".
+// ---------------------------------------------------------------------------------------------------------------//
+type UploadSessionEntity struct {
+	EntityType  string
+	Total       int64        `datastore:",noindex"`
+	Received    int64        `datastore:",noindex"`
+	CreatedDate time.Time    `datastore:",noindex"`
+	Expiry      time.Time
+}
+
+type UploadChunkEntity struct {
+	Offset int64
+	Data   []byte       `datastore:",noindex"`
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+// Full structure for POST (only entityType and total are used) and all responses
+type UploadSessionAPIv1 struct {
+	Id         int64  `json:"id"`
+	EntityType string `json:"entityType"`
+	Total      int64  `json:"total"`
+	Received   int64  `json:"received"`
+	Expiry     string `json:"expiry"`
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Data Storage View
+// ---------------------------------------------------------------------------------------------------------------//
+
+const uploadSessionDBEntity = "uploadsessionentity"
+const uploadChunkDBEntity = "uploadchunkentity"
+
+// a chunk must fit into one entity (max. 1MB)
+const maxUploadChunkSize = 900 * 1024
+
+// the assembled payload (JSON) - the image blob and the base64 encoding included
+const maxUploadSize = 32 * 1000 * 1000
+
+// the entities which can be uploaded - the commit is processed like the one-shot POST
+var uploadInserts = map[string]restful.RouteFunction{
+	sharedTypeChart:      insertChart,
+	sharedTypeGChart:     insertGChart,
+	sharedTypeUserMetric: insertUserMetric,
+}
+
+var errUploadRange = errors.New("Content-Range must be 'bytes <first>-<last>/<total>' or 'bytes <first>-<last>/*'")
+
+var contentRangeFormat = regexp.MustCompile(`^bytes (\d+)-(\d+)/(\d+|\*)$`)
+
+func mapDBtoAPIUploadSession(db *UploadSessionEntity, api *UploadSessionAPIv1) {
+	api.EntityType = db.EntityType
+	api.Total = db.Total
+	api.Received = db.Received
+	api.Expiry = db.Expiry.Format(dateTimeLayout)
+}
+
+func validateUploadSession(api *UploadSessionAPIv1) *validator {
+	v := new(validator)
+	if _, ok := uploadInserts[api.EntityType]; !ok {
+		v.fail("entityType", "must be one of chart, gchart, usermetric")
+	}
+	if api.Total < 0 || api.Total > maxUploadSize {
+		v.fail("total", fmt.Sprint("must be between 0 (unknown) and ", maxUploadSize))
+	}
+	return v
+}
+
+// supporting functions
+
+func uploadSessionKey(ctx context.Context, id string) (*datastore.Key, error) {
+	i, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return datastore.NewKey(ctx, uploadSessionDBEntity, "", i, nil), nil
+}
+
+// parseContentRange returns the first and last byte of the chunk and the total size (-1 if unknown)
+func parseContentRange(contentRange string) (int64, int64, int64, error) {
+	parts := contentRangeFormat.FindStringSubmatch(contentRange)
+	if parts == nil {
+		return 0, 0, 0, errUploadRange
+	}
+	first, _ := strconv.ParseInt(parts[1], 10, 64)
+	last, _ := strconv.ParseInt(parts[2], 10, 64)
+	total := int64(-1)
+	if parts[3] != "*" {
+		total, _ = strconv.ParseInt(parts[3], 10, 64)
+	}
+	if last < first || (total >= 0 && last >= total) {
+		return 0, 0, 0, errUploadRange
+	}
+	return first, last, total, nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+func insertUploadSession(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	session := new(UploadSessionAPIv1)
+	if err := request.ReadEntity(session); err != nil {
+		addError(request, response, http.StatusInternalServerError, errorCode_InvalidPayload, err.Error())
+		return
+	}
+
+	if v := validateUploadSession(session); !v.valid() {
+		addValidationError(request, response, v)
+		return
+	}
+
+	sessionDB := UploadSessionEntity{
+		EntityType:  session.EntityType,
+		Total:       session.Total,
+		CreatedDate: time.Now(),
+		Expiry:      time.Now().Add(configDuration(ctx, Config_UploadSessionHours, time.Hour)),
+	}
+
+	key, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, uploadSessionDBEntity, nil), &sessionDB)
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	mapDBtoAPIUploadSession(&sessionDB, session)
+	session.Id = key.IntID()
+	response.WriteHeaderAndEntity(http.StatusCreated, session)
+}
+
+func getUploadSession(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	key, err := uploadSessionKey(ctx, request.PathParameter("id"))
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	var sessionDB UploadSessionEntity
+	if err := datastore.Get(ctx, key, &sessionDB); err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	var session UploadSessionAPIv1
+	mapDBtoAPIUploadSession(&sessionDB, &session)
+	session.Id = key.IntID()
+	response.WriteHeaderAndEntity(http.StatusOK, session)
+}
+
+// uploadChunk stores the next chunk - chunks must be sent in order, a repeated chunk (lost response) is accepted
+func uploadChunk(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	key, err := uploadSessionKey(ctx, request.PathParameter("id"))
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	first, last, total, err := parseContentRange(request.Request.Header.Get("Content-Range"))
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(response, request.Request.Body, maxUploadChunkSize+1))
+	if err != nil || len(data) > maxUploadChunkSize {
+		addError(request, response, http.StatusRequestEntityTooLarge, errorCode_BadRequest, fmt.Sprint("Chunks must not be larger than ", maxUploadChunkSize, " bytes"))
+		return
+	}
+	if int64(len(data)) != last-first+1 {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, "Content-Range does not match the size of the chunk")
+		return
+	}
+
+	// sessions which are neither committed nor continued are deleted by cron
+	lifetime := configDuration(ctx, Config_UploadSessionHours, time.Hour)
+	var sessionDB UploadSessionEntity
+	var outOfOrder bool
+	err = datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		outOfOrder = false
+		if err := datastore.Get(tc, key, &sessionDB); err != nil && !isErrFieldMismatch(err) {
+			return err
+		}
+
+		// already received - the client didn't get the response
+		if last < sessionDB.Received {
+			return nil
+		}
+		if first != sessionDB.Received {
+			outOfOrder = true
+			return nil
+		}
+		if total >= 0 {
+			sessionDB.Total = total
+		}
+		if last+1 > maxUploadSize || (sessionDB.Total > 0 && last+1 > sessionDB.Total) {
+			return errUploadRange
+		}
+
+		// the offset is the id - so a retried chunk overwrites itself
+		chunkKey := datastore.NewKey(tc, uploadChunkDBEntity, "", first+1, key)
+		if _, err := datastore.Put(tc, chunkKey, &UploadChunkEntity{Offset: first, Data: data}); err != nil {
+			return err
+		}
+		sessionDB.Received = last + 1
+		sessionDB.Expiry = time.Now().Add(lifetime)
+		_, err := datastore.Put(tc, key, &sessionDB)
+		return err
+	}, nil)
+	if err == errUploadRange {
+		addError(request, response, http.StatusRequestedRangeNotSatisfiable, errorCode_BadRequest, fmt.Sprint("Upload must not be larger than total / ", maxUploadSize, " bytes"))
+		return
+	}
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	var session UploadSessionAPIv1
+	mapDBtoAPIUploadSession(&sessionDB, &session)
+	session.Id = key.IntID()
+
+	// the client has to continue at "received"
+	if sessionDB.Received > 0 {
+		response.AddHeader("Range", fmt.Sprint("bytes=0-", sessionDB.Received-1))
+	}
+	if outOfOrder {
+		response.WriteHeaderAndEntity(http.StatusConflict, session)
+		return
+	}
+	response.WriteHeaderAndEntity(http.StatusOK, session)
+}
+
+// commitUpload assembles the chunks and creates the entity - the response is the one of the one-shot POST
+func commitUpload(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	key, err := uploadSessionKey(ctx, request.PathParameter("id"))
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	var sessionDB UploadSessionEntity
+	if err := datastore.Get(ctx, key, &sessionDB); err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+	if sessionDB.Received == 0 || (sessionDB.Total > 0 && sessionDB.Received != sessionDB.Total) {
+		addError(request, response, http.StatusConflict, errorCode_Conflict, fmt.Sprint("Upload incomplete - received ", sessionDB.Received, " of ", sessionDB.Total, " bytes"))
+		return
+	}
+
+	var chunks []UploadChunkEntity
+	if _, err := datastore.NewQuery(uploadChunkDBEntity).Ancestor(key).Order("Offset").GetAll(ctx, &chunks); err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	var payload bytes.Buffer
+	for _, chunk := range chunks {
+		if chunk.Offset != int64(payload.Len()) {
+			addError(request, response, http.StatusConflict, errorCode_Conflict, fmt.Sprint("Upload has a gap at byte ", payload.Len()))
+			return
+		}
+		payload.Write(chunk.Data)
+	}
+
+	// hand the assembled payload to the one-shot POST processing
+	request.Request.Body = ioutil.NopCloser(&payload)
+	request.Request.ContentLength = int64(payload.Len())
+	request.Request.Header.Set("Content-Type", restful.MIME_JSON)
+	uploadInserts[sessionDB.EntityType](request, response)
+
+	// failed inserts can be committed again (e.g. after a 503) - the session expires anyway
+	if response.StatusCode() < http.StatusBadRequest {
+		if err := deleteWithChildren(ctx, []*datastore.Key{key}, uploadChunkDBEntity); err != nil {
+			logWarningf(ctx, "Upload session %d not deleted: %v", key.IntID(), err)
+		}
+	}
+}
+
+// processUploadExpiry is called by cron - deletes all sessions which are not continued in time
+func processUploadExpiry(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	// the tenants are processed by their own tasks
+	if err := queueTenantRuns(request.Request); err != nil {
+		logErrorf(ctx, "Cron %s not queued for the tenants: %v", request.Request.URL.Path, err)
+	}
+
+	const maxNumberOfSessionsPerRun = 100
+
+	keys, err := datastore.NewQuery(uploadSessionDBEntity).Filter("Expiry <", time.Now()).
+		KeysOnly().Limit(maxNumberOfSessionsPerRun).GetAll(ctx, nil)
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	for _, key := range keys {
+		if err := deleteWithChildren(ctx, []*datastore.Key{key}, uploadChunkDBEntity); err != nil {
+			commonResponseErrorProcessing(request, response, err)
+			return
+		}
+	}
+
+	logInfof(ctx, "Expired upload sessions deleted: %d", len(keys))
+	response.WriteHeaderAndEntity(http.StatusOK, len(keys))
+}
@@ -22,10 +22,10 @@ import (
 	"net/http"
 	"time"
 	"strconv"
+	"sort"
 	"fmt"
 
 	"golang.org/x/net/context"
-	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 
 	"github.com/emicklei/go-restful"
@@ -40,6 +40,7 @@ type UserMetricEntity struct {
 	MetricXML    string       `datastore:",noindex"`
 	CreatorNick  string       `datastore:",noindex"`
 	CreatorEmail string       `datastore:",noindex"`
+	SchemaVersion int         `datastore:",noindex"` // see "entity_mapper.go"
 }
 
 type UserMetricEntityHeaderOnly struct {
@@ -81,6 +82,9 @@ func mapAPItoDBUserMetric(api *UserMetricAPIv1, db *UserMetricEntity) {
 	db.MetricXML = api.MetricXML
 	db.CreatorNick = api.CreatorNick
 	db.CreatorEmail = api.CreatorEmail
+	db.Header.PayloadHash = payloadHash([]byte(db.MetricXML))
+	db.Header.PayloadSize = len(db.MetricXML)
+	db.Header.Unlisted = false // only charts and gcharts can be shared by link
 }
 
 
@@ -91,13 +95,26 @@ func mapDBtoAPIUserMetric(db* UserMetricEntity, api *UserMetricAPIv1) {
 	api.CreatorEmail = db.CreatorEmail
 }
 
+func validateUserMetric(api *UserMetricAPIv1) *validator {
+	v := new(validator)
+	validateCommonHeader(v, &api.Header)
+	v.required("metrictxml", api.MetricXML)
+	v.payloadSize("metrictxml", len(api.MetricXML))
+	return v
+}
+
 
 
 // supporting functions
 
-// usermetricEntityKey returns the key used for all usermetricEntity entries.
-func usermetricEntityRootKey(ctx context.Context) *datastore.Key {
-	return datastore.NewKey(ctx, usermetricDBEntity, usermetricDBEntityRootKey, 0, nil)
+// usermetricEntityKey returns the key of the usermetric - in the root shard of its key, see "entity_shard.go"
+func usermetricEntityKey(ctx context.Context, userKey string) *datastore.Key {
+	return shardedNameKey(ctx, usermetricDBEntity, usermetricDBEntityRootKey, userKey)
+}
+
+// usermetricEntityRootKeys returns the root keys of all shards
+func usermetricEntityRootKeys(ctx context.Context) []*datastore.Key {
+	return shardRootKeys(ctx, usermetricDBEntity, usermetricDBEntityRootKey)
 }
 
 // ---------------------------------------------------------------------------------------------------------------//
@@ -105,37 +122,40 @@ func usermetricEntityRootKey(ctx context.Context) *datastore.Key {
 // ---------------------------------------------------------------------------------------------------------------//
 
 func insertUserMetric(request *restful.Request, response *restful.Response) {
-	ctx := appengine.NewContext(request.Request)
+	ctx := newContext(request.Request)
 
 	metric := new(UserMetricAPIv1)
-	if err := request.ReadEntity(metric); err != nil {
-		addPlainTextError(response, http.StatusInternalServerError, err.Error())
+	if err := readEntity(request, metric); err != nil {
+		addReadEntityError(request, response, err)
 		return
 	}
 
 	if (metric.Header.Key == "") {
-		addPlainTextError(response, http.StatusBadRequest, "Mandatory Key for Insert is missing or invalid")
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, "Mandatory Key for Insert is missing or invalid")
 		return
 	}
 
 	// check for duplicates first
-	key := datastore.NewKey(ctx, usermetricDBEntity, metric.Header.Key, 0, usermetricEntityRootKey(ctx))
+	key := usermetricEntityKey(ctx, metric.Header.Key)
 	metricDB := new(UserMetricEntity)
-	err := datastore.Get(ctx, key, metricDB)
+	err := getEntity(ctx, key, metricDB)
 	if err != nil && !isErrFieldMismatch(err) {
 
 		// object with key does already exist
 		if err == datastore.ErrNoSuchEntity {
-			addPlainTextError(response, http.StatusConflict, err.Error())
+			addError(request, response, http.StatusConflict, errorCode_Conflict, err.Error())
 			return
 		}
 		// standard error processing
-		commonResponseErrorProcessing (response, err)
+		commonResponseErrorProcessing (request, response, err)
 		return
 	}
 
-	// No checks if the necessary fields are filed or not - since GoldenCheetah is
-	// the only consumer of the APIs - any checks/response are to support this use-case
+	// all fields are checked before anything is stored
+	if v := validateUserMetric(metric); !v.valid() {
+		addValidationError(request, response, v)
+		return
+	}
 
 	mapAPItoDBUserMetric(metric, metricDB)
 
@@ -145,18 +165,30 @@ func insertUserMetric(request *restful.Request, response *restful.Response) {
 	metricDB.Header.Deleted = false
 
 	// auto-curate if a registered "curator" is adding user metric
-	curatorQuery := datastore.NewQuery(curatorDBEntity).Filter("CuratorId =", metricDB.Header.CreatorId)
-	counter, _ := curatorQuery.Count(ctx) // ignore errors/just leave uncurated
-	if counter == 1 {
+	if internalIsCurator(ctx, requestCuratorId(request)) {
 		metricDB.Header.Curated = true
 	} else {
 		metricDB.Header.Curated = false
 	}
+	metricDB.Header.CurationState = initialCurationState(metricDB.Header.Curated)
+	metricDB.Header.CurationComment = ""
+	metricDB.Header.OwnerId = requestOwnerId(request)
+
+	// high volume - the entity is stored later by the task queue
+	if isAsyncInsert(sharedTypeUserMetric) {
+		key, err := queueInsert(ctx, request.Request, sharedTypeUserMetric, key, metricDB)
+		if err != nil {
+			commonResponseErrorProcessing (request, response, err)
+			return
+		}
+		response.WriteHeaderAndEntity(http.StatusAccepted, key.StringID())
+		return
+	}
 
 	// and now store it
-	key, err = datastore.Put(ctx, key, metricDB);
+	key, err = putSharedEntity(ctx, sharedTypeUserMetric, key, metricDB);
 	if err != nil {
-		commonResponseErrorProcessing (response, err)
+		commonResponseErrorProcessing (request, response, err)
 		return
 	}
 
@@ -166,32 +198,40 @@ func insertUserMetric(request *restful.Request, response *restful.Response) {
 }
 
 func updateUserMetric(request *restful.Request, response *restful.Response) {
-	ctx := appengine.NewContext(request.Request)
+	ctx := newContext(request.Request)
 
 	metric := new(UserMetricAPIv1)
-	if err := request.ReadEntity(metric); err != nil {
-		addPlainTextError(response, http.StatusInternalServerError, err.Error())
+	if err := readEntity(request, metric); err != nil {
+		addReadEntityError(request, response, err)
 		return
 	}
 
 	if (metric.Header.Key == "") {
-		addPlainTextError(response, http.StatusBadRequest, "Mandatory Key for Update is missing or invalid")
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, "Mandatory Key for Update is missing or invalid")
 		return
 	}
 
-	// No more checks if the necessary fields are filed or not - since GoldenCheetah is
-	// the only consumer of the APIs - any checks/response are to support this use-case
+	// all fields are checked before anything is stored
+	if v := validateUserMetric(metric); !v.valid() {
+		addValidationError(request, response, v)
+		return
+	}
 
 	metricDB := new(UserMetricEntity)
 	mapAPItoDBUserMetric(metric, metricDB)
 
+	metricDB.Header.OwnerId = requestOwnerId(request)
 	metricDB.Header.LastChanged = time.Now()
 
-	// and now store it
+	key := usermetricEntityKey(ctx, metric.Header.Key)
 
-	key := datastore.NewKey(ctx, usermetricDBEntity, metric.Header.Key, 0, usermetricEntityRootKey(ctx))
-	if _, err := datastore.Put(ctx, key, metricDB); err != nil {
-		commonResponseErrorProcessing (response, err)
+	// and now store it - only the owner or a curator may change an existing entity
+	if _, err := putSharedEntityRevision(ctx, sharedTypeUserMetric, key, metricDB, requestEditor(ctx, request)); err != nil {
+		if err == errNotOwner {
+			addError(request, response, http.StatusForbidden, errorCode_Forbidden, err.Error())
+			return
+		}
+		commonResponseErrorProcessing (request, response, err)
 		return
 	}
 
@@ -200,14 +240,14 @@ func updateUserMetric(request *restful.Request, response *restful.Response) {
 
 }
 func getUserMetricHeader(request *restful.Request, response *restful.Response) {
-	ctx := appengine.NewContext(request.Request)
+	ctx := newContext(request.Request)
 
 	var date time.Time
 	var err error
 	if dateString := request.QueryParameter("dateFrom"); dateString != "" {
 		date, err = time.Parse(time.RFC3339, dateString)
 		if err != nil {
-			addPlainTextError(response, http.StatusBadRequest, fmt.Sprint(err.Error(), " - Correct format is RFC3339"))
+			addError(request, response, http.StatusBadRequest, errorCode_BadRequest, fmt.Sprint(err.Error(), " - Correct format is RFC3339"))
 			return
 		}
 	} else {
@@ -216,38 +256,91 @@ func getUserMetricHeader(request *restful.Request, response *restful.Response) {
 
 	const maxNumberOfHeadersPerCall = 200; // this has to be equal to GoldenCheetah - CloudDBUserMetric class
 
-	q := datastore.NewQuery(usermetricDBEntity).Filter("Header.LastChanged >=", date).Order("Header.LastChanged").Limit(maxNumberOfHeadersPerCall)
+	// strong consistency reads the root shards with ancestor queries - slower, but includes the latest writes
+	strong, err := consistencyParameter(request)
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
 
-	var metricHeaderList UserMetricAPIv1HeaderOnlyList
+	q := datastore.NewQuery(usermetricDBEntity).Filter("Header.LastChanged >=", date).Order("Header.LastChanged")
+	tags := tagParameters(request)
+	if len(tags) > 0 {
+		q = q.Filter("Header.Tags =", tags[0])
+	}
 
-	var metricsOnDBList []UserMetricEntityHeaderOnly
-	k, err := q.GetAll(ctx, &metricsOnDBList)
-	if err != nil && !isErrFieldMismatch(err) {
-		commonResponseErrorProcessing (response, err)
+	// e.g. sync clients which only need ids and change dates - the projection only reads the index
+	if !strong && len(tags) == 0 && curationStateParameter(request) == "" && isHeaderProjectionPossible(request) {
+		q = q.Project(headerProjection...)
+	}
+
+	// total is only counted when the envelope is requested - it costs an additional query
+	totalApprox := 0
+	if isEnvelopeRequested(request) {
+		totalApprox, _ = q.Count(ctx) // ignore errors/just report what was read
+	}
+
+	q, err = applyCursorParameter(request, q.Limit(maxNumberOfHeadersPerCall))
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
 		return
 	}
 
-	// DB Entity needs to be mapped back
-	for i, metricDB := range metricsOnDBList {
-		var metric UserMetricAPIv1HeaderOnly
-		mapDBtoAPICommonHeader(&metricDB.Header, &metric.Header)
-		metric.Header.Key = k[i].StringID()
-		metricHeaderList = append(metricHeaderList, metric)
+	selectedState := curationStateParameter(request)
+
+	read := 0
+	var metricHeaderList UserMetricAPIv1HeaderOnlyList
+
+	iterators := runShardedQuery(ctx, q, strong, usermetricEntityRootKeys(ctx))
+	for _, t := range iterators {
+		for {
+			var metricDB UserMetricEntityHeaderOnly
+			key, err := t.Next(&metricDB)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil && !isErrFieldMismatch(err) {
+				commonResponseErrorProcessing (request, response, err)
+				return
+			}
+			read++
+			if !isCurationStateSelected(&metricDB.Header, selectedState) || !hasAllTags(&metricDB.Header, tags) {
+				continue
+			}
+
+			// DB Entity needs to be mapped back
+			var metric UserMetricAPIv1HeaderOnly
+			mapDBtoAPICommonHeader(&metricDB.Header, &metric.Header)
+			metric.Header.Key = key.StringID()
+			metricHeaderList = append(metricHeaderList, metric)
+		}
+	}
+
+	// the shards are merged by change date - the last one is the next dateFrom, a cursor is not returned
+	if len(iterators) > 1 {
+		sort.SliceStable(metricHeaderList, func(i, j int) bool { return metricHeaderList[i].Header.LastChanged < metricHeaderList[j].Header.LastChanged })
+		if len(metricHeaderList) > maxNumberOfHeadersPerCall {
+			metricHeaderList = metricHeaderList[:maxNumberOfHeadersPerCall]
+		}
+	}
+
+	if totalApprox < len(metricHeaderList) {
+		totalApprox = len(metricHeaderList)
 	}
 
-	response.WriteHeaderAndEntity(http.StatusOK, metricHeaderList)
+	writeListResponse(request, response, metricHeaderList, totalApprox, shardedNextCursor(iterators, read, maxNumberOfHeadersPerCall))
 
 }
 
 func getUserMetricHeaderCount(request *restful.Request, response *restful.Response) {
-	ctx := appengine.NewContext(request.Request)
+	ctx := newContext(request.Request)
 
 	var date time.Time
 	var err error
 	if dateString := request.QueryParameter("dateFrom"); dateString != "" {
 		date, err = time.Parse(time.RFC3339, dateString)
 		if err != nil {
-			addPlainTextError(response, http.StatusBadRequest, fmt.Sprint(err.Error(), " - Correct format is RFC3339"))
+			addError(request, response, http.StatusBadRequest, errorCode_BadRequest, fmt.Sprint(err.Error(), " - Correct format is RFC3339"))
 			return
 		}
 	} else {
@@ -262,20 +355,34 @@ func getUserMetricHeaderCount(request *restful.Request, response *restful.Respon
 }
 
 func getUserMetricByKey(request *restful.Request, response *restful.Response) {
-	ctx := appengine.NewContext(request.Request)
+	ctx := newContext(request.Request)
 
 	userKey := request.PathParameter("key")
 	if (userKey == "") {
-		addPlainTextError(response, http.StatusBadRequest, "Mandatory Key for Update is missing or invalid")
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, "Mandatory Key for Update is missing or invalid")
 		return
 	}
 
-	key := datastore.NewKey(ctx, usermetricDBEntity, userKey, 0, usermetricEntityRootKey(ctx))
+	key := usermetricEntityKey(ctx, userKey)
+
+	// the client's copy is current - the payload is not read
+	answered, err := checkNotModified(ctx, request, response, key)
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+	if answered {
+		return
+	}
 
 	metricDB := new(UserMetricEntity)
-	err := datastore.Get(ctx, key, metricDB)
+	err = getEntity(ctx, key, metricDB)
 	if err != nil && !isErrFieldMismatch(err) {
-		commonResponseErrorProcessing (response, err)
+		commonResponseErrorProcessing (request, response, err)
+		return
+	}
+	// a merged duplicate answers with the canonical entity - see "entity_duplicate.go"
+	if redirectMerged(request, response, &metricDB.Header) {
 		return
 	}
 
@@ -284,7 +391,8 @@ func getUserMetricByKey(request *restful.Request, response *restful.Response) {
 	mapDBtoAPIUserMetric(metricDB, metric)
 	metric.Header.Key= key.StringID()
 
-	response.WriteHeaderAndEntity(http.StatusOK, metric)
+	setConditionalHeaders(response, &metricDB.Header)
+	writeEntity(request, response, http.StatusOK, metric)
 }
 
 func deleteUserMetricByKey(request *restful.Request, response *restful.Response) {
@@ -298,30 +406,74 @@ func curateUserMetricByKey(request *restful.Request, response *restful.Response)
 	newStatusString := request.QueryParameter("newStatus")
 	b, err := strconv.ParseBool(newStatusString)
 	if err != nil {
-		addPlainTextError(response, http.StatusBadRequest, err.Error())
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
 		return
 	}
 	changeUserMetricByKey(request, response, false, true, b)
 
 }
 
+func transitionUserMetricCurationByKey(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	userKey := request.PathParameter("key")
+	if (userKey == "") {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, "Mandatory Key for Update is missing or invalid")
+		return
+	}
+
+	transition := new(CurationTransitionAPIv1)
+	if err := request.ReadEntity(transition); err != nil {
+		addError(request, response, http.StatusInternalServerError, errorCode_InvalidPayload, err.Error())
+		return
+	}
+
+	key := usermetricEntityKey(ctx, userKey)
+
+	metricDB := new(UserMetricEntity)
+	if err := getEntity(ctx, key, metricDB); err != nil {
+		commonResponseErrorProcessing (request, response, err)
+		return
+	}
+
+	if err := transitionCurationState(&metricDB.Header, transition); err != nil {
+		addError(request, response, http.StatusConflict, errorCode_Conflict, err.Error())
+		return
+	}
+
+	if _, err := putSharedEntity(ctx, sharedTypeUserMetric, key, metricDB); err != nil {
+		commonResponseErrorProcessing (request, response, err)
+		return
+	}
+
+	// Response is Empty for 204
+	response.WriteHeaderAndEntity(http.StatusNoContent, "")
+
+}
+
 // ------------------- supporting functions ------------------------------------------------
 
 func changeUserMetricByKey(request *restful.Request, response *restful.Response, changeDeleted bool, changeCurated bool, newStatus bool) {
-	c := appengine.NewContext(request.Request)
+	c := newContext(request.Request)
 
 	userKey := request.PathParameter("key")
 	if (userKey == "") {
-		addPlainTextError(response, http.StatusBadRequest, "Mandatory Key for Update is missing or invalid")
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, "Mandatory Key for Update is missing or invalid")
 		return
 	}
 
-	key := datastore.NewKey(c, usermetricDBEntity, userKey, 0, usermetricEntityRootKey(c))
+	key := usermetricEntityKey(c, userKey)
 
 	metricDB := new(UserMetricEntity)
-	err := datastore.Get(c, key, metricDB)
+	err := getEntity(c, key, metricDB)
 	if err != nil && !isErrFieldMismatch(err) {
-		commonResponseErrorProcessing (response, err)
+		commonResponseErrorProcessing (request, response, err)
+		return
+	}
+
+	// only the owner or a curator may delete
+	if changeDeleted && !requestEditor(c, request).mayChange(&metricDB.Header) {
+		addError(request, response, http.StatusForbidden, errorCode_Forbidden, "Forbidden - only the owner or a curator may delete this entity")
 		return
 	}
 
@@ -329,19 +481,23 @@ func changeUserMetricByKey(request *restful.Request, response *restful.Response,
 
 	if changeDeleted {
 		metricDB.Header.Deleted = newStatus
+		// the payload is kept in the trash until it's purged - see "entity_trash.go"
 		if newStatus {
-			metricDB.MetricXML = ""
+			metricDB.Header.Trashed = time.Now()
+		} else {
+			metricDB.Header.Trashed = time.Time{}
 		}
 		metricDB.Header.LastChanged = time.Now()
 	}
 
 	if changeCurated {
 		metricDB.Header.Curated = newStatus
+		metricDB.Header.CurationState = initialCurationState(newStatus)
 		metricDB.Header.LastChanged = time.Now()
 	}
 
-	if _, err := datastore.Put(c, key, metricDB); err != nil {
-		commonResponseErrorProcessing (response, err)
+	if _, err := putSharedEntity(c, sharedTypeUserMetric, key, metricDB); err != nil {
+		commonResponseErrorProcessing (request, response, err)
 		return
 	}
 
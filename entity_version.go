@@ -0,0 +1,222 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Golden Cheetah client version (versionentity) which is stored in DB
+// ---------------------------------------------------------------------------------------------------------------//
+type VersionEntity struct {
+	MinClientVersion   int
+	RecommendedVersion int
+	Message            string       `datastore:",noindex"`
+	ChangeDate         time.Time
+}
+
+const (
+	http_UpgradeRequired = 426
+)
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+// Full structure for GET and PUT
+type VersionAPIv1 struct {
+	MinClientVersion   int         `json:"minClientVersion"`
+	RecommendedVersion int         `json:"recommendedVersion"`
+	Message            string      `json:"message"`
+	ChangeDate         string      `json:"changeDate"`
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Memcache constants
+// ---------------------------------------------------------------------------------------------------------------//
+
+const versionMemcacheKey = "currentversion"
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Data Storage View
+// ---------------------------------------------------------------------------------------------------------------//
+
+const versionDBEntity = "versionentity"
+const versionDBEntityRootKey = "versionroot"
+const versionDBEntityCurrent = "current"
+
+// the client sends its build number (e.g. "3955") - either as header or as part of the User-Agent
+const clientVersionHeader = "X-GoldenCheetah-Version"
+
+var clientVersionUserAgent = regexp.MustCompile(`GoldenCheetah/(\d+)`)
+
+func mapAPItoDBVersion(api *VersionAPIv1, db *VersionEntity) {
+	db.MinClientVersion = api.MinClientVersion
+	db.RecommendedVersion = api.RecommendedVersion
+	db.Message = api.Message
+	db.ChangeDate = time.Now()
+}
+
+func mapDBtoAPIVersion(db *VersionEntity, api *VersionAPIv1) {
+	api.MinClientVersion = db.MinClientVersion
+	api.RecommendedVersion = db.RecommendedVersion
+	api.Message = db.Message
+	api.ChangeDate = db.ChangeDate.Format(dateTimeLayout)
+}
+
+// supporting functions
+
+// versionEntityRootKey returns the key used for all versionEntity entries.
+func versionEntityRootKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, versionDBEntity, versionDBEntityRootKey, 0, nil)
+}
+
+// there is only one version entity which is overwritten with every PUT
+func versionEntityCurrentKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, versionDBEntity, versionDBEntityCurrent, 0, versionEntityRootKey(ctx))
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+func updateVersion(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	version := new(VersionAPIv1)
+	if err := request.ReadEntity(version); err != nil {
+		addError(request, response, http.StatusInternalServerError, errorCode_InvalidPayload, err.Error())
+		return
+	}
+
+	versionDB := new(VersionEntity)
+	mapAPItoDBVersion(version, versionDB)
+
+	if _, err := datastore.Put(ctx, versionEntityCurrentKey(ctx), versionDB); err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	// replace the cached version / ignore errors
+	mapDBtoAPIVersion(versionDB, version)
+	item := &memcache.Item{
+		Key:    versionMemcacheKey,
+		Object: *version,
+		Expiration: cacheExpiration(ctx),
+	}
+	memcache.Gob.Set(ctx, item)
+
+	// Response is Empty for 204
+	response.WriteHeaderAndEntity(http.StatusNoContent, "")
+}
+
+func getCurrentVersion(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	version, err := internalGetCurrentVersion(ctx)
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+	version.Message = localizedMessage(ctx, request, response, versionEntityCurrentKey(ctx), version.Message)
+
+	response.WriteHeaderAndEntity(http.StatusOK, version)
+}
+
+//---------------------------------------------------------------------------------------
+// internal functions
+//---------------------------------------------------------------------------------------
+
+func internalGetCurrentVersion(ctx context.Context) (VersionAPIv1, error) {
+	var versionAPI VersionAPIv1
+
+	// first check Memcache
+	_, err := memcache.Gob.Get(ctx, versionMemcacheKey, &versionAPI)
+	countCacheLookup("version", err == nil)
+	if err == nil {
+		return versionAPI, nil
+	}
+
+	versionDB := new(VersionEntity)
+	if err := datastore.Get(ctx, versionEntityCurrentKey(ctx), versionDB); err != nil && !isErrFieldMismatch(err) {
+		return versionAPI, err
+	}
+	mapDBtoAPIVersion(versionDB, &versionAPI)
+
+	// add to memcache / overwrite existing / ignore errors
+	item := &memcache.Item{
+		Key:    versionMemcacheKey,
+		Object: versionAPI,
+		Expiration: cacheExpiration(ctx),
+	}
+	memcache.Gob.Set(ctx, item)
+
+	return versionAPI, nil
+}
+
+// clientVersion returns the build number of the calling GoldenCheetah - or 0 if unknown
+func clientVersion(req *http.Request) int {
+	versionString := req.Header.Get(clientVersionHeader)
+	if versionString == "" {
+		if match := clientVersionUserAgent.FindStringSubmatch(req.UserAgent()); match != nil {
+			versionString = match[1]
+		}
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(versionString))
+	if err != nil {
+		return 0
+	}
+	return version
+}
+
+//---------------------------------------------------------------------------------------
+// filter
+//---------------------------------------------------------------------------------------
+
+// clients which do not send their version (all builds before the version check was introduced) are
+// not blocked - the version itself can always be read, so that the client can show the message
+func filterClientVersion(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+
+	version := clientVersion(req.Request)
+	if version == 0 || strings.HasPrefix(req.Request.URL.Path, "/v1/version/") {
+		chain.ProcessFilter(req, resp)
+		return
+	}
+
+	ctx := newContext(req.Request)
+	current, err := internalGetCurrentVersion(ctx)
+	if err == nil && version < current.MinClientVersion {
+		addError(req, resp, http_UpgradeRequired, errorCode_UpgradeRequired, current.Message)
+		return
+	}
+
+	chain.ProcessFilter(req, resp)
+}
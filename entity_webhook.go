@@ -0,0 +1,450 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/taskqueue"
+	"google.golang.org/appengine/urlfetch"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Webhook (webhookentity) which is stored in DB - an operator endpoint which is called on status changes
+// ---------------------------------------------------------------------------------------------------------------//
+type WebhookEntity struct {
+	URL         string       `datastore:",noindex"`
+	Secret      string       `datastore:",noindex"`
+	Events      []string
+	CreatedDate time.Time
+}
+
+// one delivery attempt (webhookdeliveryentity) - child of the webhook
+type WebhookDeliveryEntity struct {
+	Event        string
+	StatusCode   int
+	Error        string       `datastore:",noindex"`
+	Attempt      int
+	DeliveryDate time.Time
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+// Full structure for POST, PUT and GET - the secret is never returned
+type WebhookAPIv1 struct {
+	Id          int64    `json:"id"`
+	URL         string   `json:"url"`
+	Secret      string   `json:"secret,omitempty"`
+	Events      []string `json:"events"`
+	CreatedDate string   `json:"createdDate"`
+}
+
+type WebhookAPIv1List []WebhookAPIv1
+
+type WebhookDeliveryAPIv1 struct {
+	Event        string `json:"event"`
+	StatusCode   int    `json:"statusCode"`
+	Error        string `json:"error"`
+	Attempt      int    `json:"attempt"`
+	DeliveryDate string `json:"deliveryDate"`
+}
+
+type WebhookDeliveryAPIv1List []WebhookDeliveryAPIv1
+
+// the body of the POST to the webhook URL
+type WebhookEventAPIv1 struct {
+	Event          string `json:"event"`
+	StatusId       int64  `json:"statusId"`
+	Status         int    `json:"status"`
+	PreviousStatus int    `json:"previousStatus"`
+	ChangeDate     string `json:"changeDate"`
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Data Storage View
+// ---------------------------------------------------------------------------------------------------------------//
+
+const webhookDBEntity = "webhookentity"
+const webhookDBEntityRootKey = "webhookroot"
+const webhookDeliveryDBEntity = "webhookdeliveryentity"
+
+// deliveries are retried by the task queue - see queue.yaml
+const webhookQueue = "webhook"
+
+// the receiver verifies the payload with HMAC-SHA256(secret, body)
+const webhookSignatureHeader = "X-CloudDB-Signature"
+
+const (
+	WebhookEvent_StatusChanged   = "status.changed"   // any change
+	WebhookEvent_StatusFailure   = "status.failure"   // changed from OK to partial failure or outage
+	WebhookEvent_StatusRecovered = "status.recovered" // changed back to OK
+)
+
+var webhookEvents = []string{WebhookEvent_StatusChanged, WebhookEvent_StatusFailure, WebhookEvent_StatusRecovered}
+
+func mapAPItoDBWebhook(api *WebhookAPIv1, db *WebhookEntity) {
+	db.URL = api.URL
+	db.Secret = api.Secret
+	db.Events = api.Events
+}
+
+func mapDBtoAPIWebhook(db *WebhookEntity, api *WebhookAPIv1) {
+	api.URL = db.URL
+	api.Events = db.Events
+	api.CreatedDate = db.CreatedDate.Format(dateTimeLayout)
+}
+
+func mapDBtoAPIWebhookDelivery(db *WebhookDeliveryEntity, api *WebhookDeliveryAPIv1) {
+	api.Event = db.Event
+	api.StatusCode = db.StatusCode
+	api.Error = db.Error
+	api.Attempt = db.Attempt
+	api.DeliveryDate = db.DeliveryDate.Format(dateTimeLayout)
+}
+
+func validateWebhook(api *WebhookAPIv1) *validator {
+	v := new(validator)
+	v.required("url", api.URL)
+	if u, err := url.Parse(api.URL); err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		v.fail("url", "must be an absolute http(s) URL")
+	}
+	v.required("secret", api.Secret)
+	if len(api.Events) == 0 {
+		v.fail("events", "at least one event is mandatory")
+	}
+	for _, event := range api.Events {
+		if !isWebhookEvent(event) {
+			v.fail("events", fmt.Sprint(event, " is not one of ", webhookEvents))
+		}
+	}
+	return v
+}
+
+// supporting functions
+
+// webhookEntityRootKey returns the key used for all webhookEntity entries.
+func webhookEntityRootKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, webhookDBEntity, webhookDBEntityRootKey, 0, nil)
+}
+
+func isWebhookEvent(event string) bool {
+	for _, e := range webhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func webhookSignature(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+func insertWebhook(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	webhook := new(WebhookAPIv1)
+	if err := request.ReadEntity(webhook); err != nil {
+		addError(request, response, http.StatusInternalServerError, errorCode_InvalidPayload, err.Error())
+		return
+	}
+
+	if v := validateWebhook(webhook); !v.valid() {
+		addValidationError(request, response, v)
+		return
+	}
+
+	webhookDB := new(WebhookEntity)
+	mapAPItoDBWebhook(webhook, webhookDB)
+	webhookDB.CreatedDate = time.Now()
+
+	key := datastore.NewIncompleteKey(ctx, webhookDBEntity, webhookEntityRootKey(ctx))
+	key, err := datastore.Put(ctx, key, webhookDB)
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	// send back the key
+	response.WriteHeaderAndEntity(http.StatusCreated, strconv.FormatInt(key.IntID(), 10))
+}
+
+func updateWebhook(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	key, err := webhookKey(ctx, request.PathParameter("id"))
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	webhook := new(WebhookAPIv1)
+	if err := request.ReadEntity(webhook); err != nil {
+		addError(request, response, http.StatusInternalServerError, errorCode_InvalidPayload, err.Error())
+		return
+	}
+
+	if v := validateWebhook(webhook); !v.valid() {
+		addValidationError(request, response, v)
+		return
+	}
+
+	err = datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		webhookDB := new(WebhookEntity)
+		if err := datastore.Get(tc, key, webhookDB); err != nil && !isErrFieldMismatch(err) {
+			return err
+		}
+		mapAPItoDBWebhook(webhook, webhookDB)
+		_, err := datastore.Put(tc, key, webhookDB)
+		return err
+	}, nil)
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	// Response is Empty for 204
+	response.WriteHeaderAndEntity(http.StatusNoContent, "")
+}
+
+func getWebhooks(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	q := datastore.NewQuery(webhookDBEntity).Ancestor(webhookEntityRootKey(ctx))
+
+	var webhookOnDBList []WebhookEntity
+	k, err := q.GetAll(ctx, &webhookOnDBList)
+	if err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	// DB Entity needs to be mapped back
+	var webhookList WebhookAPIv1List
+	for i, webhookDB := range webhookOnDBList {
+		var webhook WebhookAPIv1
+		mapDBtoAPIWebhook(&webhookDB, &webhook)
+		webhook.Id = k[i].IntID()
+		webhookList = append(webhookList, webhook)
+	}
+
+	response.WriteHeaderAndEntity(http.StatusOK, webhookList)
+}
+
+func deleteWebhook(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	key, err := webhookKey(ctx, request.PathParameter("id"))
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	// the delivery log goes together with the webhook
+	if err := deleteWithChildren(ctx, []*datastore.Key{key}, webhookDeliveryDBEntity); err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	// Response is Empty for 204
+	response.WriteHeaderAndEntity(http.StatusNoContent, "")
+}
+
+func getWebhookDeliveries(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	key, err := webhookKey(ctx, request.PathParameter("id"))
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	const maxNumberOfDeliveriesPerCall = 100
+
+	q := datastore.NewQuery(webhookDeliveryDBEntity).Ancestor(key).Order("-DeliveryDate").Limit(maxNumberOfDeliveriesPerCall)
+
+	var deliveryOnDBList []WebhookDeliveryEntity
+	if _, err := q.GetAll(ctx, &deliveryOnDBList); err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	// DB Entity needs to be mapped back
+	var deliveryList WebhookDeliveryAPIv1List
+	for _, deliveryDB := range deliveryOnDBList {
+		var delivery WebhookDeliveryAPIv1
+		mapDBtoAPIWebhookDelivery(&deliveryDB, &delivery)
+		deliveryList = append(deliveryList, delivery)
+	}
+
+	response.WriteHeaderAndEntity(http.StatusOK, deliveryList)
+}
+
+// processWebhookDelivery is the task queue worker - POSTs the signed event, any error response makes
+// the task queue retry, every attempt is logged
+func processWebhookDelivery(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	key, err := webhookKey(ctx, request.PathParameter("id"))
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	webhookDB := new(WebhookEntity)
+	if err := datastore.Get(ctx, key, webhookDB); err != nil && !isErrFieldMismatch(err) {
+		if err == datastore.ErrNoSuchEntity {
+			// webhook was deleted in the meantime - nothing to retry
+			response.WriteHeaderAndEntity(http.StatusOK, "")
+			return
+		}
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	payload, err := ioutil.ReadAll(request.Request.Body)
+	if err != nil {
+		addError(request, response, http.StatusInternalServerError, errorCode_InvalidPayload, err.Error())
+		return
+	}
+
+	delivery := new(WebhookDeliveryEntity)
+	delivery.Event = request.QueryParameter("event")
+	delivery.Attempt, _ = strconv.Atoi(request.Request.Header.Get("X-AppEngine-TaskRetryCount"))
+	delivery.Attempt++
+	delivery.DeliveryDate = time.Now()
+
+	post, err := http.NewRequest("POST", webhookDB.URL, bytes.NewReader(payload))
+	if err == nil {
+		post.Header.Set("Content-Type", restful.MIME_JSON)
+		post.Header.Set(webhookSignatureHeader, webhookSignature(webhookDB.Secret, payload))
+		var resp *http.Response
+		resp, err = urlfetch.Client(ctx).Do(post)
+		if err == nil {
+			resp.Body.Close()
+			delivery.StatusCode = resp.StatusCode
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				err = fmt.Errorf("Webhook responded with %d", resp.StatusCode)
+			}
+		}
+	}
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+
+	// the delivery log is only informational
+	if _, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, webhookDeliveryDBEntity, key), delivery); err != nil {
+		logWarningf(ctx, "Delivery of webhook %d not logged: %v", key.IntID(), err)
+	}
+
+	if err != nil {
+		logWarningf(ctx, "Delivery of webhook %d failed (attempt %d): %v", key.IntID(), delivery.Attempt, err)
+		addError(request, response, http.StatusBadGateway, errorCode_Internal, err.Error())
+		return
+	}
+
+	response.WriteHeaderAndEntity(http.StatusOK, "")
+}
+
+//---------------------------------------------------------------------------------------
+// internal functions
+//---------------------------------------------------------------------------------------
+
+func webhookKey(ctx context.Context, id string) (*datastore.Key, error) {
+	i, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return datastore.NewKey(ctx, webhookDBEntity, "", i, webhookEntityRootKey(ctx)), nil
+}
+
+// internalFireStatusWebhooks queues one delivery per event and subscribed webhook - errors are only
+// logged, the status itself is already stored
+func internalFireStatusWebhooks(request *restful.Request, statusKey *datastore.Key, status *StatusEntity, previousStatus int) {
+	ctx := newContext(request.Request)
+
+	events := []string{WebhookEvent_StatusChanged}
+	if previousStatus == Status_Ok && status.Status != Status_Ok {
+		events = append(events, WebhookEvent_StatusFailure)
+	}
+	if previousStatus != Status_Ok && status.Status == Status_Ok {
+		events = append(events, WebhookEvent_StatusRecovered)
+	}
+
+	var tasks []*taskqueue.Task
+	for _, event := range events {
+		var eventAPI WebhookEventAPIv1
+		eventAPI.Event = event
+		eventAPI.StatusId = statusKey.IntID()
+		eventAPI.Status = status.Status
+		eventAPI.PreviousStatus = previousStatus
+		eventAPI.ChangeDate = status.ChangeDate.Format(dateTimeLayout)
+		payload, err := json.Marshal(eventAPI)
+		if err != nil {
+			logErrorf(ctx, "Webhook event %s not created: %v", event, err)
+			continue
+		}
+
+		q := datastore.NewQuery(webhookDBEntity).Ancestor(webhookEntityRootKey(ctx)).Filter("Events =", event).KeysOnly()
+		keys, err := q.GetAll(ctx, nil)
+		if err != nil {
+			logErrorf(ctx, "Webhooks for %s not read: %v", event, err)
+			continue
+		}
+		for _, key := range keys {
+			path := fmt.Sprint("/v1/tasks/webhook/", key.IntID(), "?", url.Values{"event": {event}}.Encode())
+			task := &taskqueue.Task{
+				Path:    path,
+				Method:  "POST",
+				Payload: payload,
+				Header:  http.Header{"Content-Type": {restful.MIME_JSON}},
+			}
+			tasks = append(tasks, addRequestHeadersToTask(request.Request, task))
+		}
+	}
+
+	if len(tasks) > 0 {
+		if _, err := taskqueue.AddMulti(ctx, tasks, webhookQueue); err != nil {
+			logErrorf(ctx, "Webhook deliveries not queued: %v", err)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"google.golang.org/appengine/datastore"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Sparse field selection - "fields=header.id,header.name" returns only the listed JSON fields (lists: of every
+// item). Header lists which only request fields of "headerProjectionFields" are read with a projection query.
+// ---------------------------------------------------------------------------------------------------------------//
+
+const fieldsParameterName = "fields"
+
+// the JSON fields which can be served by "headerProjection" - only properties every entity has, since a
+// projection query silently skips entities without the property
+var headerProjectionFields = map[string]bool{
+	"header.id":         true,
+	"header.key":        true,
+	"header.lastChange": true,
+	"header.curated":    true,
+	"header.deleted":    true,
+}
+
+// the projected properties - in sync with the composite indexes in "index.yaml"
+var headerProjection = []string{"Header.LastChanged", "Header.Curated", "Header.Deleted"}
+
+func fieldsParameter(request *restful.Request) []string {
+	var fields []string
+	for _, field := range strings.Split(request.QueryParameter(fieldsParameterName), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// isFieldRequested is true if no fields are selected at all or the field is (part of) a selected one
+func isFieldRequested(request *restful.Request, field string) bool {
+	fields := fieldsParameter(request)
+	for _, f := range fields {
+		if f == field || strings.HasPrefix(f, field+".") || strings.HasPrefix(field, f+".") {
+			return true
+		}
+	}
+	return len(fields) == 0
+}
+
+// isHeaderProjectionPossible is true if all requested fields are part of the projection - the curation
+// state is not projected, so the caller must not select by curation state
+func isHeaderProjectionPossible(request *restful.Request) bool {
+	fields := fieldsParameter(request)
+	if len(fields) == 0 {
+		return false
+	}
+	for _, field := range fields {
+		if !headerProjectionFields[field] {
+			return false
+		}
+	}
+	return true
+}
+
+// projectFields reduces the JSON representation of value to the requested fields
+func projectFields(value interface{}, fields []string) (interface{}, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return nil, err
+	}
+
+	tree := make(map[string]interface{})
+	for _, field := range fields {
+		node := tree
+		parts := strings.Split(field, ".")
+		for i, part := range parts {
+			if i == len(parts)-1 {
+				node[part] = true
+				break
+			}
+			child, ok := node[part].(map[string]interface{})
+			if !ok {
+				child = make(map[string]interface{})
+				node[part] = child
+			}
+			node = child
+		}
+	}
+	return projectNode(generic, tree), nil
+}
+
+func projectNode(value interface{}, tree map[string]interface{}) interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		for i := range v {
+			v[i] = projectNode(v[i], tree)
+		}
+		return v
+	case map[string]interface{}:
+		projected := make(map[string]interface{})
+		for name, sub := range tree {
+			fieldValue, ok := v[name]
+			if !ok {
+				continue
+			}
+			if subTree, ok := sub.(map[string]interface{}); ok {
+				projected[name] = projectNode(fieldValue, subTree)
+			} else {
+				projected[name] = fieldValue
+			}
+		}
+		return projected
+	}
+	return value
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+func getChartHeaderById(request *restful.Request, response *restful.Response) {
+	getSharedEntityHeader(request, response, sharedTypeChart, "id")
+}
+
+func getGChartHeaderById(request *restful.Request, response *restful.Response) {
+	getSharedEntityHeader(request, response, sharedTypeGChart, "id")
+}
+
+func getUserMetricHeaderByKey(request *restful.Request, response *restful.Response) {
+	getSharedEntityHeader(request, response, sharedTypeUserMetric, "key")
+}
+
+// ------------------- supporting functions ------------------------------------------------
+
+// getSharedEntityHeader returns the header of one entity only - no payload, no blob is read. A conditional
+// request and a selection of metadata fields only (see "conditional.go") are answered by the projection.
+func getSharedEntityHeader(request *restful.Request, response *restful.Response, entityType string, param string) {
+	ctx := newContext(request.Request)
+
+	key, err := sharedEntityTypes[entityType].key(ctx, request.PathParameter(param))
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	// usermetrics are never unlisted - charts and gcharts are read first, "unlisted" is not in the projection
+	// and a 304 would tell that the entity exists
+	if entityType == sharedTypeUserMetric && (isConditionalRequest(request) || isHeaderMetaPossible(request)) {
+		meta, err := getHeaderMeta(ctx, key)
+		if err != nil {
+			commonResponseErrorProcessing(request, response, err)
+			return
+		}
+		if meta != nil {
+			setConditionalHeaders(response, meta)
+			if isNotModified(request, meta) {
+				response.WriteHeader(http.StatusNotModified)
+				return
+			}
+			if isHeaderMetaPossible(request) {
+				writeSharedEntityHeader(request, response, key, meta)
+				return
+			}
+		}
+	}
+
+	var headerDB CommonEntityHeaderOnly
+	if err := datastore.Get(ctx, key, &headerDB); err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+	if !isListedOrOwned(ctx, request, &headerDB.Header) {
+		addError(request, response, http.StatusNotFound, errorCode_NotFound, datastore.ErrNoSuchEntity.Error())
+		return
+	}
+
+	setConditionalHeaders(response, &headerDB.Header)
+	if isConditionalRequest(request) && isNotModified(request, &headerDB.Header) {
+		response.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeSharedEntityHeader(request, response, key, &headerDB.Header)
+}
+
+func writeSharedEntityHeader(request *restful.Request, response *restful.Response, key *datastore.Key, headerDB *CommonEntityHeader) {
+	header := new(CommonAPIHeaderOnlyV1)
+	mapDBtoAPICommonHeader(headerDB, &header.Header)
+	header.Header.Id = key.IntID()
+	header.Header.Key = key.StringID()
+
+	writeEntity(request, response, http.StatusOK, header)
+}
@@ -0,0 +1,318 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Ban list (banentity) which is stored in DB - requests of a banned client id or from a banned IP range are
+// answered with 403 before any processing. Bans apply to all tenants, so they are stored in the default
+// namespace.
+// ---------------------------------------------------------------------------------------------------------------//
+type BanEntity struct {
+	ClientId   string
+	IPRange    string    // CIDR notation
+	Reason     string    `datastore:",noindex"`
+	Expiry     time.Time // zero for a permanent ban
+	CuratorId  string    `datastore:",noindex"`
+	CreateDate time.Time
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+type BanAPIv1 struct {
+	Id         int64  `json:"id"`
+	ClientId   string `json:"clientId"`
+	IPRange    string `json:"ipRange"`
+	Reason     string `json:"reason"`
+	Expiry     string `json:"expiry"`
+	Active     bool   `json:"active"`     // output only
+	CuratorId  string `json:"curatorId"`  // output only
+	CreateDate string `json:"createDate"` // output only
+}
+
+type BanAPIv1List []BanAPIv1
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Memcache constants
+// ---------------------------------------------------------------------------------------------------------------//
+
+const banMemcacheKey = "bans"
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Data Storage View
+// ---------------------------------------------------------------------------------------------------------------//
+
+const banDBEntity = "banentity"
+const banDBEntityRootKey = "banroot"
+
+// the routes which stay available - a banned admin can still lift the ban, monitoring keeps working
+var banExemptPaths = []string{"/v1/admin/", "/v2/admin/", "/metrics", "/healthz", "/readyz", "/_ah/"}
+
+func mapAPItoDBBan(api *BanAPIv1, db *BanEntity) {
+	db.ClientId = strings.TrimSpace(api.ClientId)
+	db.IPRange = normalizeIPRange(api.IPRange)
+	db.Reason = api.Reason
+	db.Expiry = time.Time{}
+	if api.Expiry != "" {
+		db.Expiry, _ = time.Parse(dateTimeLayout, api.Expiry)
+	}
+	db.CreateDate = time.Now()
+}
+
+func mapDBtoAPIBan(db *BanEntity, api *BanAPIv1) {
+	api.ClientId = db.ClientId
+	api.IPRange = db.IPRange
+	api.Reason = db.Reason
+	if !db.Expiry.IsZero() {
+		api.Expiry = db.Expiry.Format(dateTimeLayout)
+	}
+	api.Active = db.Expiry.IsZero() || db.Expiry.After(time.Now())
+	api.CuratorId = db.CuratorId
+	api.CreateDate = db.CreateDate.Format(dateTimeLayout)
+}
+
+func validateBan(api *BanAPIv1) *validator {
+	v := new(validator)
+	if (strings.TrimSpace(api.ClientId) == "") == (api.IPRange == "") {
+		v.fail("clientId", "either clientId or ipRange is mandatory")
+	}
+	if api.IPRange != "" && normalizeIPRange(api.IPRange) == "" {
+		v.fail("ipRange", "must be an IP address or a range in CIDR notation e.g. 192.0.2.0/24")
+	}
+	v.required("reason", api.Reason)
+	v.maxLength("reason", api.Reason, 500)
+	v.dateTime("expiry", api.Expiry)
+	return v
+}
+
+// supporting functions
+
+func banEntityRootKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, banDBEntity, banDBEntityRootKey, 0, nil)
+}
+
+// normalizeIPRange returns the CIDR notation - a single address is a range of one - or "" if invalid
+func normalizeIPRange(ipRange string) string {
+	ipRange = strings.TrimSpace(ipRange)
+	if ip := net.ParseIP(ipRange); ip != nil {
+		if ip.To4() != nil {
+			return ip.String() + "/32"
+		}
+		return ip.String() + "/128"
+	}
+	_, network, err := net.ParseCIDR(ipRange)
+	if err != nil {
+		return ""
+	}
+	return network.String()
+}
+
+// remoteIP is the address of the caller - without the port outside of App Engine
+func remoteIP(req *http.Request) net.IP {
+	host := req.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return net.ParseIP(host)
+}
+
+func isBanExempt(path string) bool {
+	for _, prefix := range banExemptPaths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBanned returns the matching active ban
+func isBanned(bans BanAPIv1List, clientId string, ip net.IP) (BanAPIv1, bool) {
+	for _, ban := range bans {
+		if !ban.Active {
+			continue
+		}
+		if ban.ClientId != "" && ban.ClientId == clientId {
+			return ban, true
+		}
+		if ban.IPRange != "" && ip != nil {
+			if _, network, err := net.ParseCIDR(ban.IPRange); err == nil && network.Contains(ip) {
+				return ban, true
+			}
+		}
+	}
+	return BanAPIv1{}, false
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+// filterBan is checked for every request - the active bans are cached, so it's a memcache lookup only
+func filterBan(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	if isBanExempt(req.Request.URL.Path) {
+		chain.ProcessFilter(req, resp)
+		return
+	}
+
+	ctx := newDefaultContext(req.Request)
+	bans, err := internalGetActiveBans(ctx)
+	if err != nil {
+		// the service must not go down because the list can't be read
+		logWarningf(ctx, "Ban list not read: %v", err)
+	}
+	if ban, ok := isBanned(bans, req.Request.Header.Get(clientIdHeader), remoteIP(req.Request)); ok {
+		addError(req, resp, http.StatusForbidden, errorCode_Forbidden, "Banned - "+ban.Reason)
+		return
+	}
+
+	chain.ProcessFilter(req, resp)
+}
+
+func getBans(request *restful.Request, response *restful.Response) {
+	ctx := newDefaultContext(request.Request)
+
+	var banOnDBList []BanEntity
+	k, err := datastore.NewQuery(banDBEntity).Ancestor(banEntityRootKey(ctx)).GetAll(ctx, &banOnDBList)
+	if err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	var banList BanAPIv1List
+	for i, banDB := range banOnDBList {
+		var ban BanAPIv1
+		mapDBtoAPIBan(&banDB, &ban)
+		ban.Id = k[i].IntID()
+		banList = append(banList, ban)
+	}
+
+	writeListResponse(request, response, banList, len(banList), "")
+}
+
+func insertBan(request *restful.Request, response *restful.Response) {
+	ctx := newDefaultContext(request.Request)
+
+	ban := new(BanAPIv1)
+	if err := request.ReadEntity(ban); err != nil {
+		addError(request, response, http.StatusInternalServerError, errorCode_InvalidPayload, err.Error())
+		return
+	}
+
+	if v := validateBan(ban); !v.valid() {
+		addValidationError(request, response, v)
+		return
+	}
+
+	banDB := new(BanEntity)
+	mapAPItoDBBan(ban, banDB)
+	banDB.CuratorId = request.QueryParameter("curatorId")
+
+	key, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, banDBEntity, banEntityRootKey(ctx)), banDB)
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	// the next request reads the list again / ignore errors
+	memcache.Delete(ctx, banMemcacheKey)
+
+	logInfof(ctx, "Ban %d added: client %q, range %q - %s", key.IntID(), banDB.ClientId, banDB.IPRange, banDB.Reason)
+
+	// send back the id
+	response.WriteHeaderAndEntity(http.StatusCreated, strconv.FormatInt(key.IntID(), 10))
+}
+
+func deleteBan(request *restful.Request, response *restful.Response) {
+	ctx := newDefaultContext(request.Request)
+
+	id, err := strconv.ParseInt(request.PathParameter("id"), 10, 64)
+	if err != nil {
+		addError(request, response, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+		return
+	}
+
+	if err := datastore.Delete(ctx, datastore.NewKey(ctx, banDBEntity, "", id, banEntityRootKey(ctx))); err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	// the next request reads the list again / ignore errors
+	memcache.Delete(ctx, banMemcacheKey)
+
+	logInfof(ctx, "Ban %d lifted", id)
+
+	// Response is Empty for 204
+	response.WriteHeaderAndEntity(http.StatusNoContent, "")
+}
+
+//---------------------------------------------------------------------------------------
+// internal functions
+//---------------------------------------------------------------------------------------
+
+// internalGetActiveBans returns the bans which are not expired - the cache expires with the first ban which does
+func internalGetActiveBans(ctx context.Context) (BanAPIv1List, error) {
+	var bans BanAPIv1List
+
+	// first check Memcache
+	_, err := memcache.Gob.Get(ctx, banMemcacheKey, &bans)
+	countCacheLookup("ban", err == nil)
+	if err == nil {
+		return bans, nil
+	}
+
+	var banOnDBList []BanEntity
+	if _, err := datastore.NewQuery(banDBEntity).Ancestor(banEntityRootKey(ctx)).GetAll(ctx, &banOnDBList); err != nil && !isErrFieldMismatch(err) {
+		return nil, err
+	}
+
+	bans = BanAPIv1List{}
+	var expiration time.Duration
+	for _, banDB := range banOnDBList {
+		var ban BanAPIv1
+		mapDBtoAPIBan(&banDB, &ban)
+		if !ban.Active {
+			continue
+		}
+		if remaining := banDB.Expiry.Sub(time.Now()); !banDB.Expiry.IsZero() && (expiration == 0 || remaining < expiration) {
+			expiration = remaining
+		}
+		bans = append(bans, ban)
+	}
+
+	// add to memcache / overwrite existing / ignore errors - also the empty list, it's checked with every request
+	memcache.Gob.Set(ctx, &memcache.Item{Key: banMemcacheKey, Object: bans, Expiration: expiration})
+
+	return bans, nil
+}
@@ -0,0 +1,288 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Client version distribution (clientdailyentity) which is stored in DB - one entity per day with the number
+// of requests per GoldenCheetah build and API version. Every instance counts in memory and adds its counts
+// at most every "clientStatsFlushInterval" - the counts of the last interval are lost when an instance stops.
+// ---------------------------------------------------------------------------------------------------------------//
+type ClientDailyEntity struct {
+	Versions   []string `datastore:",noindex"` // client build, "unknown" for clients without version
+	V1Requests []int64  `datastore:",noindex"`
+	V2Requests []int64  `datastore:",noindex"`
+	ChangeDate time.Time
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+type ClientVersionAPIv1 struct {
+	Version    string `json:"version"`
+	V1Requests int64  `json:"v1Requests"`
+	V2Requests int64  `json:"v2Requests"`
+}
+
+type ClientDailyAPIv1 struct {
+	Date       string               `json:"date"`
+	V1Requests int64                `json:"v1Requests"`
+	V2Requests int64                `json:"v2Requests"`
+	Versions   []ClientVersionAPIv1 `json:"versions"`
+}
+
+type ClientDailyAPIv1List []ClientDailyAPIv1
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Data Storage View
+// ---------------------------------------------------------------------------------------------------------------//
+
+const clientDailyDBEntity = "clientdailyentity"
+const clientDailyDBEntityRootKey = "clientdailyroot"
+
+const clientStatsFlushInterval = time.Minute
+const clientVersionUnknown = "unknown"
+
+// the report reads one entity per day
+const maxNumberOfClientDays = 366
+
+type clientStatsCollector struct {
+	sync.Mutex
+	counts    map[clientStatsKey]int64
+	lastFlush time.Time
+}
+
+type clientStatsKey struct {
+	date       string
+	version    string
+	apiVersion string
+}
+
+var clientStats = &clientStatsCollector{
+	counts:    make(map[clientStatsKey]int64),
+	lastFlush: time.Now(),
+}
+
+func mapDBtoAPIClientDaily(db *ClientDailyEntity, api *ClientDailyAPIv1) {
+	api.V1Requests = 0
+	api.V2Requests = 0
+	api.Versions = nil
+	for i, version := range db.Versions {
+		v := ClientVersionAPIv1{Version: version}
+		if i < len(db.V1Requests) {
+			v.V1Requests = db.V1Requests[i]
+		}
+		if i < len(db.V2Requests) {
+			v.V2Requests = db.V2Requests[i]
+		}
+		api.V1Requests += v.V1Requests
+		api.V2Requests += v.V2Requests
+		api.Versions = append(api.Versions, v)
+	}
+}
+
+// supporting functions
+
+func clientDailyEntityKey(ctx context.Context, date string) *datastore.Key {
+	root := datastore.NewKey(ctx, clientDailyDBEntity, clientDailyDBEntityRootKey, 0, nil)
+	return datastore.NewKey(ctx, clientDailyDBEntity, date, 0, root)
+}
+
+// add counts one request into the entity - versions are kept in the order they were seen first
+func (db *ClientDailyEntity) add(version string, apiVersion string, count int64) {
+	i := 0
+	for i < len(db.Versions) && db.Versions[i] != version {
+		i++
+	}
+	if i == len(db.Versions) {
+		db.Versions = append(db.Versions, version)
+	}
+	for len(db.V1Requests) < len(db.Versions) {
+		db.V1Requests = append(db.V1Requests, 0)
+	}
+	for len(db.V2Requests) < len(db.Versions) {
+		db.V2Requests = append(db.V2Requests, 0)
+	}
+	if apiVersion == "v1" {
+		db.V1Requests[i] += count
+	} else {
+		db.V2Requests[i] += count
+	}
+}
+
+func (c *clientStatsCollector) add(key clientStatsKey) {
+	c.Lock()
+	c.counts[key]++
+	c.Unlock()
+}
+
+// flush adds the local counts to the daily entities - the local counts are only reset for what could be written
+func (c *clientStatsCollector) flush(ctx context.Context) {
+	c.Lock()
+	if time.Since(c.lastFlush) < clientStatsFlushInterval || len(c.counts) == 0 {
+		c.Unlock()
+		return
+	}
+	c.lastFlush = time.Now()
+	counts := c.counts
+	c.counts = make(map[clientStatsKey]int64)
+	c.Unlock()
+
+	byDate := make(map[string]map[clientStatsKey]int64)
+	for key, count := range counts {
+		if byDate[key.date] == nil {
+			byDate[key.date] = make(map[clientStatsKey]int64)
+		}
+		byDate[key.date][key] = count
+	}
+
+	for date, dateCounts := range byDate {
+		err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+			key := clientDailyEntityKey(tc, date)
+			var clientDailyDB ClientDailyEntity
+			if err := datastore.Get(tc, key, &clientDailyDB); err != nil && err != datastore.ErrNoSuchEntity && !isErrFieldMismatch(err) {
+				return err
+			}
+			for k, count := range dateCounts {
+				clientDailyDB.add(k.version, k.apiVersion, count)
+			}
+			clientDailyDB.ChangeDate = time.Now()
+			_, err := datastore.Put(tc, key, &clientDailyDB)
+			return err
+		}, nil)
+		if err != nil {
+			logWarningf(ctx, "Client versions of %s not stored: %v", date, err)
+			// keep the counts for the next flush
+			c.Lock()
+			for k, count := range dateCounts {
+				c.counts[k] += count
+			}
+			c.Unlock()
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// container filter
+// ---------------------------------------------------------------------------------------------------------------//
+
+// filterClientStats counts the API requests per client version - the counts are shared by all tenants
+func filterClientStats(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	chain.ProcessFilter(req, resp)
+
+	path := req.Request.URL.Path
+	var apiVersion string
+	switch {
+	case strings.HasPrefix(path, "/v1/"):
+		apiVersion = "v1"
+	case strings.HasPrefix(path, "/v2/"):
+		apiVersion = "v2"
+	default:
+		return
+	}
+	// tasks and cron are no clients
+	if req.Request.Header.Get("X-AppEngine-QueueName") != "" || req.Request.Header.Get("X-AppEngine-Cron") == "true" {
+		return
+	}
+
+	version := clientVersionUnknown
+	if build := clientVersion(req.Request); build > 0 {
+		version = strconv.Itoa(build)
+	}
+	clientStats.add(clientStatsKey{date: time.Now().UTC().Format(telemetryDateLayout), version: version, apiVersion: apiVersion})
+	clientStats.flush(newDefaultContext(req.Request))
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+// getClientVersions returns the requests per day and client version - newest day first
+func getClientVersions(request *restful.Request, response *restful.Response) {
+	// the counts are shared by all tenants - so always the default namespace
+	ctx := newDefaultContext(request.Request)
+
+	dateTo := time.Now().UTC()
+	if dateString := request.QueryParameter("dateTo"); dateString != "" {
+		date, err := time.Parse(time.RFC3339, dateString)
+		if err != nil {
+			addError(request, response, http.StatusBadRequest, errorCode_BadRequest, fmt.Sprint(err.Error(), " - Correct format is RFC3339"))
+			return
+		}
+		dateTo = date.UTC()
+	}
+	dateFrom := dateTo.AddDate(0, 0, -30)
+	if dateString := request.QueryParameter("dateFrom"); dateString != "" {
+		date, err := time.Parse(time.RFC3339, dateString)
+		if err != nil {
+			addError(request, response, http.StatusBadRequest, errorCode_BadRequest, fmt.Sprint(err.Error(), " - Correct format is RFC3339"))
+			return
+		}
+		dateFrom = date.UTC()
+	}
+
+	var dates []string
+	var keys []*datastore.Key
+	for day := dateTo; !day.Before(dateFrom) && len(keys) < maxNumberOfClientDays; day = day.AddDate(0, 0, -1) {
+		date := day.Format(telemetryDateLayout)
+		dates = append(dates, date)
+		keys = append(keys, clientDailyEntityKey(ctx, date))
+	}
+
+	clientDailyOnDBList := make([]ClientDailyEntity, len(keys))
+	found, err := getEntities(ctx, keys, func(i int) interface{} { return &clientDailyOnDBList[i] })
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	var clientDailyList ClientDailyAPIv1List
+	for i := range keys {
+		if !found[i] {
+			continue
+		}
+		clientDaily := ClientDailyAPIv1{Date: dates[i]}
+		mapDBtoAPIClientDaily(&clientDailyOnDBList[i], &clientDaily)
+		// newest build first - "unknown" is parsed as 0
+		sort.Slice(clientDaily.Versions, func(a, b int) bool {
+			buildA, _ := strconv.Atoi(clientDaily.Versions[a].Version)
+			buildB, _ := strconv.Atoi(clientDaily.Versions[b].Version)
+			return buildA > buildB
+		})
+		clientDailyList = append(clientDailyList, clientDaily)
+	}
+
+	writeListResponse(request, response, clientDailyList, len(clientDailyList), "")
+}
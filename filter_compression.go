@@ -0,0 +1,130 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strings"
+
+	"github.com/emicklei/go-restful"
+)
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Compression of request/response bodies (gzip only)
+// ---------------------------------------------------------------------------------------------------------------//
+
+// responses below this size (e.g. status) are sent uncompressed - gzip would only add overhead
+const compressionThreshold = 1024
+
+const encodingGzip = "gzip"
+
+func filterCompression(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+
+	// transparently decompress gzipped request bodies (large chart uploads)
+	if strings.EqualFold(req.Request.Header.Get("Content-Encoding"), encodingGzip) {
+		reader, err := gzip.NewReader(req.Request.Body)
+		if err != nil {
+			addError(req, resp, http.StatusBadRequest, errorCode_BadRequest, err.Error())
+			return
+		}
+		defer reader.Close()
+		req.Request.Body = reader
+		req.Request.Header.Del("Content-Encoding")
+		req.Request.Header.Del("Content-Length")
+		req.Request.ContentLength = -1
+	}
+
+	if !strings.Contains(req.Request.Header.Get("Accept-Encoding"), encodingGzip) {
+		chain.ProcessFilter(req, resp)
+		return
+	}
+
+	writer := &gzipResponseWriter{ResponseWriter: resp.ResponseWriter}
+	resp.ResponseWriter = writer
+	chain.ProcessFilter(req, resp)
+	writer.close()
+	resp.ResponseWriter = writer.ResponseWriter
+
+}
+
+// gzipResponseWriter buffers the response until the threshold is reached and only then
+// decides to compress - so the status code and headers have to be deferred as well
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	buffer        bytes.Buffer
+	gzipWriter    *gzip.Writer
+	statusCode    int
+	headerWritten bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+}
+
+func (w *gzipResponseWriter) Write(data []byte) (int, error) {
+	if w.gzipWriter != nil {
+		return w.gzipWriter.Write(data)
+	}
+
+	w.buffer.Write(data)
+	if w.buffer.Len() < compressionThreshold || w.Header().Get("Content-Encoding") != "" {
+		return len(data), nil
+	}
+
+	// threshold reached - switch to compression
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Encoding", encodingGzip)
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.writeHeader()
+
+	w.gzipWriter = gzip.NewWriter(w.ResponseWriter)
+	if _, err := w.gzipWriter.Write(w.buffer.Bytes()); err != nil {
+		return 0, err
+	}
+	w.buffer.Reset()
+
+	return len(data), nil
+}
+
+func (w *gzipResponseWriter) writeHeader() {
+	if w.headerWritten {
+		return
+	}
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(w.statusCode)
+	w.headerWritten = true
+}
+
+// flush whatever is left - compressed or as-is if the threshold was never reached
+func (w *gzipResponseWriter) close() {
+	if w.gzipWriter != nil {
+		w.gzipWriter.Close()
+		return
+	}
+	w.writeHeader()
+	if w.buffer.Len() > 0 {
+		w.ResponseWriter.Write(w.buffer.Bytes())
+	}
+}
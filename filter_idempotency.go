@@ -0,0 +1,262 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Idempotent POST requests (idempotencyentity) which are stored in DB - a client which retries a POST with the
+// same "Idempotency-Key" header gets the response of the first, successful request instead of creating the
+// entity again. The responses are kept for "idempotencyLifetime" in memcache and in the datastore (default
+// namespace - the tenant is part of the key).
+// ---------------------------------------------------------------------------------------------------------------//
+type IdempotencyEntity struct {
+	Fingerprint string    `datastore:",noindex"` // hash of the request body - a reused key with a different body is rejected
+	StatusCode  int       `datastore:",noindex"`
+	ContentType string    `datastore:",noindex"`
+	Body        []byte    `datastore:",noindex"`
+	Expiry      time.Time
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+type IdempotencyPurgeAPIv1 struct {
+	Deleted int `json:"deleted"`
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Memcache constants
+// ---------------------------------------------------------------------------------------------------------------//
+
+const idempotencyMemcachePrefix = "idempotency/"
+const idempotencyInProgressPrefix = "idempotency-running/"
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Data Storage View
+// ---------------------------------------------------------------------------------------------------------------//
+
+const idempotencyDBEntity = "idempotencyentity"
+
+const idempotencyKeyHeader = "Idempotency-Key"
+const idempotencyReplayedHeader = "Idempotent-Replayed"
+
+const idempotencyLifetime = 24 * time.Hour
+
+// a retry arriving while the first request is still processed is rejected - for at most this long
+const idempotencyInProgressTimeout = time.Minute
+
+// larger responses are not kept - POST responses are ids in general
+const maxIdempotentResponseSize = 512 * 1024
+
+const maxIdempotencyKeyLength = 255
+
+// the request size limit of App Engine
+const maxIdempotentRequestSize = 32 * 1024 * 1024
+
+// supporting functions
+
+// idempotencyRecordName identifies the request - the same key of another client, tenant or route is another request
+func idempotencyRecordName(req *restful.Request, idempotencyKey string) string {
+	h := sha256.New()
+	for _, part := range []string{req.Request.Header.Get(tenantHeader), requestOwnerId(req), req.Request.URL.Path, idempotencyKey} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func idempotencyFingerprint(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+func idempotencyEntityKey(ctx context.Context, name string) *datastore.Key {
+	return datastore.NewKey(ctx, idempotencyDBEntity, name, 0, nil)
+}
+
+// getIdempotencyRecord returns the stored response - nil if there is none or it's expired
+func getIdempotencyRecord(ctx context.Context, name string) *IdempotencyEntity {
+	record := new(IdempotencyEntity)
+	_, err := memcache.Gob.Get(ctx, idempotencyMemcachePrefix+name, record)
+	countCacheLookup("idempotency", err == nil)
+	if err != nil {
+		if err := datastore.Get(ctx, idempotencyEntityKey(ctx, name), record); err != nil && !isErrFieldMismatch(err) {
+			if err != datastore.ErrNoSuchEntity {
+				logWarningf(ctx, "Idempotency record not read: %v", err)
+			}
+			return nil
+		}
+	}
+	if record.Expiry.Before(time.Now()) {
+		return nil
+	}
+	return record
+}
+
+// recordingResponseWriter passes the response through and keeps a copy
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (w *recordingResponseWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *recordingResponseWriter) Write(data []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	if w.body.Len() <= maxIdempotentResponseSize {
+		w.body.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// container filter
+// ---------------------------------------------------------------------------------------------------------------//
+
+// filterIdempotency replays the response of a POST with a known "Idempotency-Key" - only successful responses
+// are kept, a failed request can be retried with the same key. The container filter runs before the route
+// filters, so requests without valid credentials are passed on unchanged (and rejected by "basicAuthenticate").
+func filterIdempotency(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	idempotencyKey := strings.TrimSpace(req.Request.Header.Get(idempotencyKeyHeader))
+	if req.Request.Method != "POST" || idempotencyKey == "" || !isBasicAuthenticated(req.Request) {
+		chain.ProcessFilter(req, resp)
+		return
+	}
+	if len(idempotencyKey) > maxIdempotencyKeyLength {
+		addError(req, resp, http.StatusBadRequest, errorCode_BadRequest, "Invalid "+idempotencyKeyHeader+" - must not be longer than 255 characters")
+		return
+	}
+
+	// the body is read for the fingerprint and handed on unchanged
+	body, err := ioutil.ReadAll(http.MaxBytesReader(resp.ResponseWriter, req.Request.Body, maxIdempotentRequestSize))
+	if err != nil {
+		addError(req, resp, http.StatusRequestEntityTooLarge, errorCode_BadRequest, err.Error())
+		return
+	}
+	req.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	fingerprint := idempotencyFingerprint(body)
+
+	ctx := newDefaultContext(req.Request)
+	name := idempotencyRecordName(req, idempotencyKey)
+
+	if record := getIdempotencyRecord(ctx, name); record != nil {
+		if record.Fingerprint != fingerprint {
+			addError(req, resp, http.StatusConflict, errorCode_Conflict, idempotencyKeyHeader+" was already used for a different request")
+			return
+		}
+		if record.ContentType != "" {
+			resp.AddHeader("Content-Type", record.ContentType)
+		}
+		resp.AddHeader(idempotencyReplayedHeader, "true")
+		resp.WriteHeader(record.StatusCode)
+		resp.Write(record.Body)
+		return
+	}
+
+	// the first request is still running - the client retried too early
+	inProgress := &memcache.Item{Key: idempotencyInProgressPrefix + name, Value: []byte(fingerprint), Expiration: idempotencyInProgressTimeout}
+	if err := memcache.Add(ctx, inProgress); err == memcache.ErrNotStored {
+		resp.AddHeader("Retry-After", "5")
+		addError(req, resp, http.StatusConflict, errorCode_Conflict, "A request with this "+idempotencyKeyHeader+" is in progress")
+		return
+	}
+	defer memcache.Delete(ctx, inProgress.Key)
+
+	writer := &recordingResponseWriter{ResponseWriter: resp.ResponseWriter}
+	resp.ResponseWriter = writer
+	chain.ProcessFilter(req, resp)
+	resp.ResponseWriter = writer.ResponseWriter
+
+	if writer.statusCode < 200 || writer.statusCode >= 300 || writer.body.Len() > maxIdempotentResponseSize {
+		return
+	}
+
+	record := &IdempotencyEntity{
+		Fingerprint: fingerprint,
+		StatusCode:  writer.statusCode,
+		ContentType: writer.Header().Get("Content-Type"),
+		Body:        writer.body.Bytes(),
+		Expiry:      time.Now().Add(idempotencyLifetime),
+	}
+	if _, err := datastore.Put(ctx, idempotencyEntityKey(ctx, name), record); err != nil {
+		logWarningf(ctx, "Idempotency record not stored: %v", err)
+	}
+	// add to memcache / overwrite existing / ignore errors
+	memcache.Gob.Set(ctx, &memcache.Item{Key: idempotencyMemcachePrefix + name, Object: *record, Expiration: idempotencyLifetime})
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+// processIdempotencyPurge is called by cron - deletes the expired records
+func processIdempotencyPurge(request *restful.Request, response *restful.Response) {
+	ctx := newDefaultContext(request.Request)
+
+	// cron requests have a 10 minute deadline - the rest is done by the next run
+	const maxRunTime = 8 * time.Minute
+	const maxNumberOfEntitiesPerDelete = 500
+	start := time.Now()
+
+	var result IdempotencyPurgeAPIv1
+	for time.Since(start) < maxRunTime {
+		keys, err := datastore.NewQuery(idempotencyDBEntity).Filter("Expiry <", time.Now()).KeysOnly().
+			Limit(maxNumberOfEntitiesPerDelete).GetAll(ctx, nil)
+		if err != nil {
+			commonResponseErrorProcessing(request, response, err)
+			return
+		}
+		if len(keys) == 0 {
+			break
+		}
+		if err := datastore.DeleteMulti(ctx, keys); err != nil {
+			commonResponseErrorProcessing(request, response, err)
+			return
+		}
+		result.Deleted += len(keys)
+	}
+
+	logInfof(ctx, "Idempotency purge - deleted: %d", result.Deleted)
+	response.WriteHeaderAndEntity(http.StatusOK, result)
+}
@@ -0,0 +1,221 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Maintenance mode (maintenanceentity) which is stored in DB - while active all requests except the admin
+// routes are answered with 503 and the curated message, so the service can be taken down without a deploy
+// ---------------------------------------------------------------------------------------------------------------//
+type MaintenanceEntity struct {
+	Active     bool
+	Message    string    `datastore:",noindex"`
+	RetryAfter int       `datastore:",noindex"` // seconds - sent as Retry-After, 0 for none
+	ChangeDate time.Time
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+type MaintenanceAPIv1 struct {
+	Active     bool   `json:"active"`
+	Message    string `json:"message"`
+	RetryAfter int    `json:"retryAfter"`
+	ChangeDate string `json:"changeDate"`
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Memcache constants
+// ---------------------------------------------------------------------------------------------------------------//
+
+const maintenanceMemcacheKey = "maintenancemode"
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Data Storage View
+// ---------------------------------------------------------------------------------------------------------------//
+
+const maintenanceDBEntity = "maintenanceentity"
+const maintenanceDBEntityRootKey = "maintenanceroot"
+const maintenanceDBEntityCurrent = "current"
+
+const maintenanceDefaultMessage = "CloudDB is down for maintenance - please try again later"
+
+// the routes which stay available - to switch the maintenance off again, and for monitoring
+var maintenanceExemptPaths = []string{"/v1/admin/", "/v2/admin/", "/metrics", "/healthz", "/readyz", "/_ah/"}
+
+func mapAPItoDBMaintenance(api *MaintenanceAPIv1, db *MaintenanceEntity) {
+	db.Active = api.Active
+	db.Message = api.Message
+	db.RetryAfter = api.RetryAfter
+	db.ChangeDate = time.Now()
+}
+
+func mapDBtoAPIMaintenance(db *MaintenanceEntity, api *MaintenanceAPIv1) {
+	api.Active = db.Active
+	api.Message = db.Message
+	api.RetryAfter = db.RetryAfter
+	if !db.ChangeDate.IsZero() {
+		api.ChangeDate = db.ChangeDate.Format(dateTimeLayout)
+	}
+}
+
+func validateMaintenance(api *MaintenanceAPIv1) *validator {
+	v := new(validator)
+	if api.RetryAfter < 0 {
+		v.fail("retryAfter", "must not be negative")
+	}
+	v.payloadSize("message", len(api.Message))
+	return v
+}
+
+// supporting functions
+
+// there is only one maintenance entity which is overwritten with every PUT - translations of the message
+// are children of it (see "entity_message.go")
+func maintenanceEntityCurrentKey(ctx context.Context) *datastore.Key {
+	root := datastore.NewKey(ctx, maintenanceDBEntity, maintenanceDBEntityRootKey, 0, nil)
+	return datastore.NewKey(ctx, maintenanceDBEntity, maintenanceDBEntityCurrent, 0, root)
+}
+
+func isMaintenanceExempt(path string) bool {
+	for _, prefix := range maintenanceExemptPaths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+// filterMaintenance is checked for every request - the state is cached, so it's a memcache lookup only
+func filterMaintenance(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	if isMaintenanceExempt(req.Request.URL.Path) {
+		chain.ProcessFilter(req, resp)
+		return
+	}
+
+	ctx := newContext(req.Request)
+	maintenance, err := internalGetMaintenance(ctx)
+	if err != nil {
+		// the service must not go down because the switch can't be read
+		logWarningf(ctx, "Maintenance mode not read: %v", err)
+	}
+	if !maintenance.Active {
+		chain.ProcessFilter(req, resp)
+		return
+	}
+
+	message := maintenance.Message
+	if message == "" {
+		message = maintenanceDefaultMessage
+	}
+	message = localizedMessage(ctx, req, resp, maintenanceEntityCurrentKey(ctx), message)
+	if maintenance.RetryAfter > 0 {
+		resp.AddHeader("Retry-After", strconv.Itoa(maintenance.RetryAfter))
+	}
+	addError(req, resp, http.StatusServiceUnavailable, errorCode_Maintenance, message)
+}
+
+func getMaintenance(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	maintenance, err := internalGetMaintenance(ctx)
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	response.WriteHeaderAndEntity(http.StatusOK, maintenance)
+}
+
+func updateMaintenance(request *restful.Request, response *restful.Response) {
+	ctx := newContext(request.Request)
+
+	maintenance := new(MaintenanceAPIv1)
+	if err := request.ReadEntity(maintenance); err != nil {
+		addError(request, response, http.StatusInternalServerError, errorCode_InvalidPayload, err.Error())
+		return
+	}
+
+	if v := validateMaintenance(maintenance); !v.valid() {
+		addValidationError(request, response, v)
+		return
+	}
+
+	maintenanceDB := new(MaintenanceEntity)
+	mapAPItoDBMaintenance(maintenance, maintenanceDB)
+
+	if _, err := datastore.Put(ctx, maintenanceEntityCurrentKey(ctx), maintenanceDB); err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	// replace the cached state / ignore errors
+	mapDBtoAPIMaintenance(maintenanceDB, maintenance)
+	memcache.Gob.Set(ctx, &memcache.Item{Key: maintenanceMemcacheKey, Object: *maintenance, Expiration: cacheExpiration(ctx)})
+
+	logInfof(ctx, "Maintenance mode switched to %v", maintenance.Active)
+
+	// Response is Empty for 204
+	response.WriteHeaderAndEntity(http.StatusNoContent, "")
+}
+
+//---------------------------------------------------------------------------------------
+// internal functions
+//---------------------------------------------------------------------------------------
+
+func internalGetMaintenance(ctx context.Context) (MaintenanceAPIv1, error) {
+	var maintenanceAPI MaintenanceAPIv1
+
+	// first check Memcache
+	_, err := memcache.Gob.Get(ctx, maintenanceMemcacheKey, &maintenanceAPI)
+	countCacheLookup("maintenance", err == nil)
+	if err == nil {
+		return maintenanceAPI, nil
+	}
+
+	// no entity - the maintenance mode was never switched on
+	maintenanceDB := new(MaintenanceEntity)
+	if err := datastore.Get(ctx, maintenanceEntityCurrentKey(ctx), maintenanceDB); err != nil && err != datastore.ErrNoSuchEntity && !isErrFieldMismatch(err) {
+		return maintenanceAPI, err
+	}
+	mapDBtoAPIMaintenance(maintenanceDB, &maintenanceAPI)
+
+	// add to memcache / overwrite existing / ignore errors
+	memcache.Gob.Set(ctx, &memcache.Item{Key: maintenanceMemcacheKey, Object: maintenanceAPI, Expiration: cacheExpiration(ctx)})
+
+	return maintenanceAPI, nil
+}
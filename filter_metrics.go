@@ -0,0 +1,326 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Metrics in the Prometheus text format - every instance collects its counters in memory and adds them
+// to shared memcache counters at most every "metricsFlushInterval", so GET /metrics shows the totals of
+// all instances. Memcache may evict the counters - Prometheus treats that as a counter reset.
+// ---------------------------------------------------------------------------------------------------------------//
+
+const metricsMemcachePrefix = "metrics/"
+const metricsSeriesKey = metricsMemcachePrefix + "#series"
+const metricsFlushInterval = 10 * time.Second
+const metricsContentType = "text/plain; version=0.0.4"
+
+// durations are counted in microseconds (memcache counters are integers) - series with this suffix
+// are converted to seconds when rendered
+const metricsSecondsSuffix = "_seconds_sum"
+
+type metricsCollector struct {
+	sync.Mutex
+	counters   map[string]uint64
+	registered map[string]bool
+	lastFlush  time.Time
+}
+
+var metrics = &metricsCollector{
+	counters:   make(map[string]uint64),
+	registered: make(map[string]bool),
+}
+
+// route templates ("/v1/chart/{id}") of all registered routes - to keep the label values bounded
+var (
+	knownRoutesOnce sync.Once
+	knownRoutes     map[string]bool
+)
+
+// ---------------------------------------------------------------------------------------------------------------//
+// collecting
+// ---------------------------------------------------------------------------------------------------------------//
+
+func metricsSeries(name string, labels ...string) string {
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return fmt.Sprint(name, "{", strings.Join(pairs, ","), "}")
+}
+
+func (m *metricsCollector) add(series string, delta uint64) {
+	m.Lock()
+	m.counters[series] += delta
+	m.Unlock()
+}
+
+func (m *metricsCollector) observe(name string, duration time.Duration, labels ...string) {
+	m.add(metricsSeries(name+"_seconds_count", labels...), 1)
+	m.add(metricsSeries(name+metricsSecondsSuffix, labels...), uint64(duration/time.Microsecond))
+}
+
+// countCacheLookup is called by all memcache lookups which have a datastore fallback
+func countCacheLookup(cache string, hit bool) {
+	metrics.add(metricsSeries("clouddb_cache_lookups_total", "cache", cache, "result", map[bool]string{true: "hit", false: "miss"}[hit]), 1)
+}
+
+// countError is called for every structured error response (see "addError")
+func countError(code string) {
+	metrics.add(metricsSeries("clouddb_errors_total", "code", code), 1)
+}
+
+// routeTemplate maps the request path back to the route path - path parameter values are replaced
+// by their names. Paths which don't belong to a route (404) are reported as "unmatched".
+func routeTemplate(req *restful.Request) string {
+	knownRoutesOnce.Do(func() {
+		knownRoutes = make(map[string]bool)
+		for _, ws := range apiContainer.RegisteredWebServices() {
+			for _, route := range ws.Routes() {
+				knownRoutes[route.Path] = true
+			}
+		}
+	})
+
+	segments := strings.Split(req.Request.URL.Path, "/")
+	for name, value := range req.PathParameters() {
+		for i, segment := range segments {
+			if segment == value && value != "" {
+				segments[i] = "{" + name + "}"
+			}
+		}
+	}
+	path := strings.Join(segments, "/")
+	if !knownRoutes[path] {
+		return "unmatched"
+	}
+	return path
+}
+
+// timeAPICall is installed in every context (see "newContext") - it times all datastore RPCs
+func timeAPICall(ctx context.Context, service, method string, in, out proto.Message) error {
+	start := time.Now()
+	err := appengine.APICall(ctx, service, method, in, out)
+	if service == "datastore_v3" {
+		metrics.observe("clouddb_datastore_call_duration", time.Since(start), "method", method)
+		if err != nil {
+			metrics.add(metricsSeries("clouddb_datastore_call_errors_total", "method", method), 1)
+		}
+	}
+	return err
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// container filter - must be the first filter so rejected requests are counted as well
+// ---------------------------------------------------------------------------------------------------------------//
+
+func filterMetrics(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	start := time.Now()
+
+	chain.ProcessFilter(req, resp)
+
+	status := resp.StatusCode()
+	if status == 0 {
+		status = http.StatusOK
+	}
+	route := routeTemplate(req)
+	metrics.add(metricsSeries("clouddb_requests_total", "method", req.Request.Method, "route", route, "code", strconv.Itoa(status)), 1)
+	metrics.observe("clouddb_request_duration", time.Since(start), "method", req.Request.Method, "route", route)
+
+	// metrics are shared by all tenants - so always the default namespace
+	metrics.flush(newDefaultContext(req.Request), false)
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// shared memcache counters
+// ---------------------------------------------------------------------------------------------------------------//
+
+// flush adds the local counters to memcache - the local counters are only reset for what could be written
+func (m *metricsCollector) flush(ctx context.Context, force bool) {
+	m.Lock()
+	if !force && time.Since(m.lastFlush) < metricsFlushInterval {
+		m.Unlock()
+		return
+	}
+	m.lastFlush = time.Now()
+	counters := m.counters
+	m.counters = make(map[string]uint64)
+	var newSeries []string
+	for series := range counters {
+		if !m.registered[series] {
+			newSeries = append(newSeries, series)
+		}
+	}
+	m.Unlock()
+
+	if len(newSeries) > 0 {
+		if err := registerMetricsSeries(ctx, newSeries); err != nil {
+			logWarningf(ctx, "Metrics series not registered: %v", err)
+		} else {
+			m.Lock()
+			for _, series := range newSeries {
+				m.registered[series] = true
+			}
+			m.Unlock()
+		}
+	}
+
+	for series, delta := range counters {
+		if _, err := memcache.Increment(ctx, metricsMemcachePrefix+series, int64(delta), 0); err != nil {
+			// keep the delta for the next flush
+			m.add(series, delta)
+		}
+	}
+}
+
+// registerMetricsSeries adds the series names to the shared list - memcache has no key listing
+func registerMetricsSeries(ctx context.Context, newSeries []string) error {
+	const maxNumberOfRetries = 3
+
+	var err error
+	for i := 0; i < maxNumberOfRetries; i++ {
+		series := make(map[string]bool)
+		item, getErr := memcache.Get(ctx, metricsSeriesKey)
+		if getErr == nil {
+			gob.NewDecoder(bytes.NewReader(item.Value)).Decode(&series)
+		} else if getErr != memcache.ErrCacheMiss {
+			return getErr
+		}
+		for _, s := range newSeries {
+			series[s] = true
+		}
+
+		var buffer bytes.Buffer
+		if err = gob.NewEncoder(&buffer).Encode(series); err != nil {
+			return err
+		}
+
+		if getErr == memcache.ErrCacheMiss {
+			err = memcache.Add(ctx, &memcache.Item{Key: metricsSeriesKey, Value: buffer.Bytes()})
+		} else {
+			item.Value = buffer.Bytes()
+			err = memcache.CompareAndSwap(ctx, item)
+		}
+		if err != memcache.ErrNotStored && err != memcache.ErrCASConflict {
+			return err
+		}
+	}
+	return err
+}
+
+// readMetricsCounters returns the shared value of every series - the own counters are flushed first, so they
+// are part of the result
+func readMetricsCounters(ctx context.Context) (map[string]uint64, error) {
+	metrics.flush(ctx, true)
+
+	var series map[string]bool
+	if _, err := memcache.Gob.Get(ctx, metricsSeriesKey, &series); err != nil && err != memcache.ErrCacheMiss {
+		return nil, err
+	}
+
+	var keys []string
+	for s := range series {
+		keys = append(keys, metricsMemcachePrefix+s)
+	}
+	items, err := memcache.GetMulti(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	counters := make(map[string]uint64)
+	for key, item := range items {
+		value, _ := strconv.ParseUint(string(item.Value), 10, 64)
+		counters[strings.TrimPrefix(key, metricsMemcachePrefix)] = value
+	}
+	return counters, nil
+}
+
+// sumMetricsCounters adds the series of a metric - all of them, or only the ones with the label value
+func sumMetricsCounters(counters map[string]uint64, name string, label string, value string) uint64 {
+	var sum uint64
+	for s, v := range counters {
+		if !strings.HasPrefix(s, name+"{") {
+			continue
+		}
+		if label != "" && !strings.Contains(s, fmt.Sprintf("%s=%q", label, value)) {
+			continue
+		}
+		sum += v
+	}
+	return sum
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+func getMetrics(request *restful.Request, response *restful.Response) {
+	ctx := newDefaultContext(request.Request)
+
+	counters, err := readMetricsCounters(ctx)
+	if err != nil {
+		commonResponseErrorProcessing(request, response, err)
+		return
+	}
+
+	var keys []string
+	for s := range counters {
+		keys = append(keys, s)
+	}
+
+	// group by metric name - Prometheus expects all series of a metric in one block
+	sort.Strings(keys)
+	var buffer bytes.Buffer
+	lastName := ""
+	for _, s := range keys {
+		name := s[:strings.Index(s, "{")]
+		if name != lastName {
+			fmt.Fprintf(&buffer, "# TYPE %s counter\n", name)
+			lastName = name
+		}
+		value := counters[s]
+		if strings.HasSuffix(name, metricsSecondsSuffix) {
+			fmt.Fprintf(&buffer, "%s %g\n", s, float64(value)/1e6)
+		} else {
+			fmt.Fprintf(&buffer, "%s %d\n", s, value)
+		}
+	}
+
+	response.Header().Set("Content-Type", metricsContentType)
+	response.WriteHeader(http.StatusOK)
+	response.Write(buffer.Bytes())
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"regexp"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Request ids - every request gets an id (or keeps the one the client/proxy sent in "X-Request-Id"). The id is
+// returned in the response header and in error responses, prefixes all log lines and is passed on to tasks,
+// so all log entries which belong to one client call can be found with one search.
+// ---------------------------------------------------------------------------------------------------------------//
+
+const requestIdHeader = "X-Request-Id"
+
+// ids from outside are only adopted if they are harmless in headers and logs
+var validRequestId = regexp.MustCompile(`^[0-9A-Za-z._:-]{1,128}$`)
+
+type requestIdContextKey struct{}
+
+func newRequestId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// the filter stores the id in the request header - so newContext and task creation pick it up from there
+func filterRequestId(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	id := req.Request.Header.Get(requestIdHeader)
+	if !validRequestId.MatchString(id) {
+		id = newRequestId()
+		req.Request.Header.Set(requestIdHeader, id)
+	}
+	resp.AddHeader(requestIdHeader, id)
+
+	chain.ProcessFilter(req, resp)
+}
+
+func requestId(req *restful.Request) string {
+	return req.Request.Header.Get(requestIdHeader)
+}
+
+func withRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIdContextKey{}, id)
+}
+
+func contextRequestId(ctx context.Context) string {
+	if id, ok := ctx.Value(requestIdContextKey{}).(string); ok {
+		return id
+	}
+	return "-"
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// logging - must be used instead of the appengine log functions, so every line carries the request id
+// ---------------------------------------------------------------------------------------------------------------//
+
+func withRequestIdPrefix(ctx context.Context, args []interface{}) []interface{} {
+	return append([]interface{}{contextRequestId(ctx)}, args...)
+}
+
+func logInfof(ctx context.Context, format string, args ...interface{}) {
+	log.Infof(ctx, "[%s] "+format, withRequestIdPrefix(ctx, args)...)
+}
+
+func logWarningf(ctx context.Context, format string, args ...interface{}) {
+	log.Warningf(ctx, "[%s] "+format, withRequestIdPrefix(ctx, args)...)
+}
+
+func logErrorf(ctx context.Context, format string, args ...interface{}) {
+	log.Errorf(ctx, "[%s] "+format, withRequestIdPrefix(ctx, args)...)
+}
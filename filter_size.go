@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Size guard - request bodies are limited per route (settings "maxRequestKB" and "maxContentKB", see
+// "entity_config.go") and every entity is measured before it's stored, so an oversized request is answered
+// with 413 and the limit instead of failing somewhere in the datastore near its 1MB limit.
+// ---------------------------------------------------------------------------------------------------------------//
+
+// the datastore limit of one entity - key and properties
+const maxEntitySize = 1024*1024 - 4
+
+// the routes which carry content (charts, images, metrics) - all other bodies are small
+var contentRoutes = map[string]bool{
+	"/v1/chart/":              true,
+	"/v1/gchart/":             true,
+	"/v1/usermetric/":         true,
+	"/v2/chart/":              true,
+	"/v2/gchart/":             true,
+	"/v2/usermetric/":         true,
+	"/v1/telemetry":           true,
+	"/v1/upload/session/{id}": true,
+}
+
+// errEntityTooLarge is returned by "putEntity" instead of storing the entity
+type errEntityTooLarge struct {
+	kind string
+	size int
+}
+
+func (err *errEntityTooLarge) Error() string {
+	return fmt.Sprintf("The %s has about %d bytes - the datastore stores max. %d bytes per entity, large images and payloads have to be reduced",
+		err.kind, err.size, maxEntitySize)
+}
+
+// supporting functions
+
+func isEntityTooLarge(err error) bool {
+	_, ok := err.(*errEntityTooLarge)
+	return ok
+}
+
+// isRequestTooLarge is true for reads of a body cut by "http.MaxBytesReader"
+func isRequestTooLarge(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "request body too large")
+}
+
+// checkEntitySize estimates the stored size of an entity - generous for the encoding overhead, so an entity
+// which passes is not rejected by the datastore
+func checkEntitySize(key *datastore.Key, props []datastore.Property) error {
+	size := len(key.Encode())
+	for _, p := range props {
+		size += len(p.Name) + 8
+		switch v := p.Value.(type) {
+		case string:
+			size += len(v)
+		case []byte:
+			size += len(v)
+		case *datastore.Key:
+			if v != nil {
+				size += len(v.Encode())
+			}
+		case time.Time, int64, float64, bool:
+			size += 8
+		}
+	}
+	if size > maxEntitySize {
+		return &errEntityTooLarge{kind: key.Kind(), size: size}
+	}
+	return nil
+}
+
+func addEntityTooLargeError(request *restful.Request, response *restful.Response, err error) {
+	addError(request, response, http.StatusRequestEntityTooLarge, errorCode_TooLarge, err.Error())
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// container filter
+// ---------------------------------------------------------------------------------------------------------------//
+
+// filterRequestSize rejects a body above the limit of the route - by its Content-Length before it's read,
+// bodies without length (e.g. gzipped, see "filter_compression.go") are cut at the limit
+func filterRequestSize(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	method := req.Request.Method
+	if req.Request.Body == nil || (method != "POST" && method != "PUT" && method != "PATCH") {
+		chain.ProcessFilter(req, resp)
+		return
+	}
+
+	setting := Config_MaxRequestKB
+	if contentRoutes[routeTemplate(req)] {
+		setting = Config_MaxContentKB
+	}
+	limit := int64(configInt(newContext(req.Request), setting)) * 1024
+
+	if req.Request.ContentLength > limit {
+		addError(req, resp, http.StatusRequestEntityTooLarge, errorCode_TooLarge,
+			fmt.Sprintf("The request body has %d bytes - max. %d bytes are accepted by this route (setting %s)", req.Request.ContentLength, limit, setting))
+		return
+	}
+	req.Request.Body = http.MaxBytesReader(resp.ResponseWriter, req.Request.Body, limit)
+
+	chain.ProcessFilter(req, resp)
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"net/http"
+	"regexp"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/taskqueue"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Multi-tenant support - every GoldenCheetah deployment (test, beta, production, private team instances) may
+// send its own tenant, which is mapped 1:1 to a GAE namespace. Datastore, memcache, search and task queue
+// are then fully isolated. Requests without tenant use the default namespace (as before).
+// ---------------------------------------------------------------------------------------------------------------//
+
+const tenantHeader = "X-CloudDB-Tenant"
+
+// same restrictions as for GAE namespaces
+var validTenant = regexp.MustCompile(`^[0-9A-Za-z._-]{0,100}$`)
+
+// newContext must be used instead of appengine.NewContext - so all keys and queries are tenant aware
+func newContext(req *http.Request) context.Context {
+	ctx := newDefaultContext(req)
+	if tenant := req.Header.Get(tenantHeader); tenant != "" {
+		if namespaced, err := appengine.Namespace(ctx, tenant); err == nil {
+			return namespaced
+		}
+	}
+	return ctx
+}
+
+// newRequestContext is the base context of a request - replaceable with "NewAPI"
+var newRequestContext = appengine.NewContext
+
+// newDefaultContext is the context of the default namespace - for the data of all tenants (admin, bans,
+// backups,...). Datastore calls are timed and retried (see "retry.go").
+func newDefaultContext(req *http.Request) context.Context {
+	ctx := appengine.WithAPICallFunc(newRequestContext(req), retryAPICall)
+	return withRequestId(ctx, req.Header.Get(requestIdHeader))
+}
+
+// tenantContext is the context of the namespace of a tenant - for work which is not started by a request of
+// the tenant (cron, pull queues)
+func tenantContext(ctx context.Context, tenant string) (context.Context, error) {
+	if tenant == "" {
+		return ctx, nil
+	}
+	return appengine.Namespace(ctx, tenant)
+}
+
+// tasks are executed in new requests - the tenant and the request id have to be passed on to the worker
+func addRequestHeadersToTask(req *http.Request, task *taskqueue.Task) *taskqueue.Task {
+	for _, header := range []string{tenantHeader, requestIdHeader} {
+		if value := req.Header.Get(header); value != "" {
+			if task.Header == nil {
+				task.Header = make(http.Header)
+			}
+			task.Header.Set(header, value)
+		}
+	}
+	return task
+}
+
+// queueTenantRuns queues the cron request once for each tenant - the tasks call the same path with the tenant
+// header, so the handler runs in the namespace of the tenant. The cron request itself does the default namespace.
+func queueTenantRuns(req *http.Request) error {
+	const maxNumberOfTasksPerAdd = 100
+
+	if req.Header.Get("X-AppEngine-Cron") != "true" {
+		return nil
+	}
+
+	ctx := newDefaultContext(req)
+	keys, err := datastore.NewQuery("__namespace__").KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	var tasks []*taskqueue.Task
+	for _, key := range keys {
+		// the default namespace has no name
+		tenant := key.StringID()
+		if tenant == "" || !validTenant.MatchString(tenant) {
+			continue
+		}
+		task := addRequestHeadersToTask(req, &taskqueue.Task{Path: req.URL.Path, Method: "GET"})
+		if task.Header == nil {
+			task.Header = make(http.Header)
+		}
+		task.Header.Set(tenantHeader, tenant)
+		tasks = append(tasks, task)
+	}
+
+	queued := len(tasks)
+	for len(tasks) > 0 {
+		n := len(tasks)
+		if n > maxNumberOfTasksPerAdd {
+			n = maxNumberOfTasksPerAdd
+		}
+		if _, err := taskqueue.AddMulti(ctx, tasks[:n], ""); err != nil {
+			return err
+		}
+		tasks = tasks[n:]
+	}
+	logInfof(ctx, "Cron %s queued for %d tenants", req.URL.Path, queued)
+	return nil
+}
+
+// invalid tenants are rejected before any processing - instead of silently using the default namespace
+func filterTenant(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	if !validTenant.MatchString(req.Request.Header.Get(tenantHeader)) {
+		addError(req, resp, http.StatusBadRequest, errorCode_BadRequest, "Invalid "+tenantHeader+" - only 0-9, A-Z, a-z, '.', '_' and '-' are allowed")
+		return
+	}
+
+	chain.ProcessFilter(req, resp)
+}
@@ -24,14 +24,31 @@ import (
 	"os"
 	"fmt"
 	"net/http"
+	"strings"
 
-	"google.golang.org/appengine"
+	"golang.org/x/net/context"
 
 	"github.com/emicklei/go-restful"  // @Version Tag  v1.2
+	"github.com/emicklei/go-restful/swagger"
 )
 
+// the container all routes are registered in - see "NewAPI"
+var apiContainer = restful.DefaultContainer
+
 // init the Webserver within the GAE framework
 func init() {
+	NewAPI(restful.DefaultContainer, nil)
+} // init()
+
+// NewAPI registers all web services, the API documentation and the container filters in "container" - GAE
+// uses the default container. "requestContext" replaces appengine.NewContext as the base context of every
+// request (nil keeps appengine.NewContext) - e.g. with a context whose API calls are served by a fake, so
+// the handlers can run outside of GAE.
+func NewAPI(container *restful.Container, requestContext func(*http.Request) context.Context) {
+	apiContainer = container
+	if requestContext != nil {
+		newRequestContext = requestContext
+	}
 
 	ws := new(restful.WebService)
 
@@ -42,54 +59,176 @@ func init() {
 	ws.
 	Path("/v1").
 	Doc("Manage Charts").
-	Consumes(restful.MIME_JSON).
-	Produces(restful.MIME_JSON) // you can specify this per route as well
+	Consumes(apiMimeTypes...).
+	Produces(apiMimeTypes...) // you can specify this per route as well - see "encoding.go"
 
 	ws.Route(ws.POST("/chart/").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(insertChart).
 	// docs
 	Doc("creates a chart").
 	Operation("createChart").
+	Returns(http.StatusAccepted, "Accepted", nil).
+	Returns(http.StatusCreated, "Created", nil).
+	Returns(http.StatusOK, "OK - an identical chart exists, its id is returned", nil).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller - the owner of the entities it creates").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "curator adding the entity - it is curated at once").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Param(ws.HeaderParameter("Idempotency-Key", "unique key of the request - a retry with the same key and payload within 24 hours returns the first response").DataType("string")).
+	Param(ws.QueryParameter("strict", "true: the body is checked against the JSON Schema of /schemas/{kind}.json - unknown fields are rejected").DataType("bool")).
 	Reads(ChartAPIv1{})) // from the request
 
 	ws.Route(ws.PUT("/chart/").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(updateChart).
 	// docs
 	Doc("updates a chart").
 	Operation("updatedChart").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Returns(http.StatusForbidden, "Forbidden - only the owner or a curator may change the entity", nil).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller - the owner of the entities it creates").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "curator changing an entity of another owner").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Param(ws.QueryParameter("strict", "true: the body is checked against the JSON Schema of /schemas/{kind}.json - unknown fields are rejected").DataType("bool")).
 	Reads(ChartAPIv1{})) // from the request
 
+	ws.Route(ws.GET("/chart").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getChartsByIds).
+	// docs
+	Doc("gets the charts of a list of ids (max. 100) - ids which don't exist are returned as missing").
+	Operation("getChartsByIds").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.QueryParameter("ids", "comma separated list of chart ids").DataType("string")).
+	Param(ws.QueryParameter("fields", "comma separated JSON fields of the response e.g. header.id,header.name").DataType("string")).
+	Writes(ChartAPIv1Bulk{})) // on the response
+
 	ws.Route(ws.GET("/chart/{id}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getChartById).
 	// docs
 	Doc("get a chart").
 	Operation("getChartbyId").
+	Returns(http.StatusOK, "OK", nil).
+	Returns(http.StatusNotModified, "Not Modified - the copy of the client is current", nil).
 	Param(ws.PathParameter("id", "identifier of the chart").DataType("string")).
+	Param(ws.QueryParameter("fields", "comma separated JSON fields of the response e.g. header.id,header.name").DataType("string")).
+	Param(ws.HeaderParameter("If-None-Match", "ETag of the copy of the client").DataType("string")).
+	Param(ws.HeaderParameter("If-Modified-Since", "lastChange of the copy of the client (HTTP date)").DataType("string")).
 	Writes(ChartAPIv1{})) // on the response
 
+	ws.Route(ws.GET("/chart/{id}/thumbnail").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getChartThumbnailById).Produces(mimePNG).
+	// docs
+	Doc("gets the thumbnail of the chart image as PNG (max. 240 pixels) - 404 if the chart has no image").
+	Operation("getChartThumbnail").
+	Returns(http.StatusOK, "OK", nil).
+	Returns(http.StatusNotModified, "Not Modified", nil).
+	Param(ws.PathParameter("id", "identifier of the chart").DataType("string")).
+	Param(ws.HeaderParameter("If-None-Match", "ETag of the copy of the client").DataType("string")).
+	Param(ws.HeaderParameter("If-Modified-Since", "lastChange of the copy of the client (HTTP date)").DataType("string")))
+
+	ws.Route(ws.GET("/chart/{id}/header").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getChartHeaderById).
+	// docs
+	Doc("gets only the header of a chart - without payload").
+	Operation("getChartHeaderById").
+	Returns(http.StatusOK, "OK", nil).
+	Returns(http.StatusNotModified, "Not Modified - the copy of the client is current", nil).
+	Param(ws.PathParameter("id", "identifier of the chart").DataType("string")).
+	Param(ws.QueryParameter("fields", "comma separated JSON fields of the response e.g. header.name,header.lastChange,header.size,header.hash (metadata only, read without the entity)").DataType("string")).
+	Param(ws.HeaderParameter("If-None-Match", "ETag of the copy of the client").DataType("string")).
+	Param(ws.HeaderParameter("If-Modified-Since", "lastChange of the copy of the client (HTTP date)").DataType("string")).
+	Writes(CommonAPIHeaderOnlyV1{})) // on the response
+
+	ws.Route(ws.GET("/chart/{id}/revisions").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getChartRevisions).
+	// docs
+	Doc("gets the previous versions of the chart - newest first, max. 20").
+	Operation("getChartRevisions").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.PathParameter("id", "identifier of the chart").DataType("string")).
+	Param(ws.QueryParameter("envelope", "true: wrap the list with paging metadata").DataType("bool")).
+	Writes(RevisionAPIv1List{})) // on the response
+
+	ws.Route(ws.POST("/chart/{id}/revert/{rev}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(revertChart).
+	// docs
+	Doc("replaces the content of the chart with the one of revision {rev} - only the owner or a curator").
+	Operation("revertChart").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Returns(http.StatusForbidden, "Forbidden - only the owner or a curator may revert the entity", nil).
+	Param(ws.PathParameter("id", "identifier of the chart").DataType("string")).
+	Param(ws.PathParameter("rev", "revision as listed by /chart/{id}/revisions").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "curator reverting an entity of another owner").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")))
+
 	ws.Route(ws.DELETE("/chart/{id}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(deleteChartById).
 	// docs
-	Doc("delete a chart by setting the deleted status").
+	Doc("delete a chart by setting the deleted status - it can be restored from the trash for 30 days").
 	Operation("deleteChartbyId").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Returns(http.StatusForbidden, "Forbidden - only the owner or a curator may change the entity", nil).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller - the owner of the entities it creates").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "curator changing an entity of another owner").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
 	Param(ws.PathParameter("id", "identifier of the chart").DataType("string")))
 
-	ws.Route(ws.PUT("/chartcuration/{id}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(curateChartById).
+	ws.Route(ws.PUT("/chartcuration/{id}").Filter(basicAuthenticate).Filter(curatorAuthenticate).Filter(filterCloudDBStatus).To(curateChartById).
 	// docs
-	Doc("set the curation status of the chart to {newStatus} which must be 'true' or 'false' ").
+	Doc("set the curation status of the chart to {newStatus} which must be 'true' or 'false' - curators only").
 	Operation("updateChartCurationStatus").
+	Returns(http.StatusNoContent, "No Content", nil).
 	Param(ws.PathParameter("id", "identifier of the chart").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
 	Param(ws.QueryParameter("newStatus", "true/false curation status").DataType("bool")))
 
+	ws.Route(ws.PUT("/chartcuration/{id}/state").Filter(basicAuthenticate).Filter(curatorAuthenticate).Filter(filterCloudDBStatus).To(transitionChartCurationById).
+	// docs
+	Doc("moves the chart to a new curation state (Submitted, UnderReview, Approved, Rejected) - curators only").
+	Operation("transitionChartCurationState").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Param(ws.PathParameter("id", "identifier of the chart").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Reads(CurationTransitionAPIv1{})) // from the request
+
 	// Endpoint for ChartHeader only (no JPG or LTMSettings)
 	ws.Route(ws.GET("/chartheader").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getChartHeader).
 	// docs
 	Doc("gets a collection of charts header - in buckets of x charts - table sort is new to old").
 	Operation("getChartHeader").
+	Returns(http.StatusOK, "OK", nil).
 	Param(ws.QueryParameter("dateFrom", "Date of last change").DataType("string")).
+	Param(ws.QueryParameter("tag", "only entities with this tag - can be repeated").DataType("string")).
+	Param(ws.QueryParameter("curationState", "Submitted, UnderReview, Approved (default) or all").DataType("string")).
+	Param(ws.QueryParameter("cursor", "nextCursor of the previous call").DataType("string")).
+	Param(ws.QueryParameter("consistency", "eventual (default) or strong - strong reads all root shards, with several shards the list is paged by dateFrom only").DataType("string")).
+	Param(ws.QueryParameter("envelope", "true: wrap the list with paging metadata").DataType("bool")).
+	Param(ws.QueryParameter("fields", "comma separated JSON fields of the response e.g. header.id,header.name").DataType("string")).
 	Writes(ChartAPIv1HeaderOnlyList{})) // on the response
 
+	// Most downloaded - totals are consolidated by cron
+	ws.Route(ws.GET("/chart/top").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getTopCharts).
+	// docs
+	Doc("gets the most downloaded charts - most downloads first").
+	Operation("getTopCharts").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.QueryParameter("n", "number of charts (default 25, max. 100)").DataType("int")).
+	Writes(DownloadAPIv1List{})) // on the response
+
+	// Full text search over name, description, author
+	ws.Route(ws.GET("/chart/search").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(searchCharts).
+	// docs
+	Doc("searches the chart headers - best matches first").
+	Operation("searchCharts").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.QueryParameter("q", "search query (GAE search syntax)").DataType("string")).
+	Param(ws.QueryParameter("limit", "max. number of results (max. 50)").DataType("int")).
+	Param(ws.QueryParameter("cursor", "nextCursor of the previous call").DataType("string")).
+	Param(ws.QueryParameter("curationState", "Submitted, UnderReview, Approved (default) or all").DataType("string")).
+	Writes(SearchResultAPIv1{})) // on the response
+
 	// Count Chart Headers to be retrieved
 	ws.Route(ws.GET("/chartheader/count").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getChartHeaderCount).
 	// docs
 	Doc("gets the number of chart headers for testing,... selection").
 	Operation("getChartHeader").
+	Returns(http.StatusOK, "OK", nil).
 	Param(ws.QueryParameter("dateFrom", "Date of last change").DataType("string")))
 
 	// ----------------------------------------------------------------------------------
@@ -98,54 +237,166 @@ func init() {
 	ws.
 	Path("/v1").
 	Doc("Manage GCharts").
-	Consumes(restful.MIME_JSON).
-	Produces(restful.MIME_JSON) // you can specify this per route as well
+	Consumes(apiMimeTypes...).
+	Produces(apiMimeTypes...) // you can specify this per route as well - see "encoding.go"
 
 	ws.Route(ws.POST("/gchart/").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(insertGChart).
 	// docs
 	Doc("creates a gchart").
 	Operation("createGChart").
+	Returns(http.StatusAccepted, "Accepted", nil).
+	Returns(http.StatusCreated, "Created", nil).
+	Returns(http.StatusOK, "OK - an identical gchart exists, its id is returned", nil).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller - the owner of the entities it creates").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "curator adding the entity - it is curated at once").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Param(ws.HeaderParameter("Idempotency-Key", "unique key of the request - a retry with the same key and payload within 24 hours returns the first response").DataType("string")).
+	Param(ws.QueryParameter("strict", "true: the body is checked against the JSON Schema of /schemas/{kind}.json - unknown fields are rejected").DataType("bool")).
 	Reads(GChartAPIv1{})) // from the request
 
 	ws.Route(ws.PUT("/gchart/").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(updateGChart).
 	// docs
 	Doc("updates a gchart").
 	Operation("updatedGChart").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Returns(http.StatusForbidden, "Forbidden - only the owner or a curator may change the entity", nil).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller - the owner of the entities it creates").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "curator changing an entity of another owner").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Param(ws.QueryParameter("strict", "true: the body is checked against the JSON Schema of /schemas/{kind}.json - unknown fields are rejected").DataType("bool")).
 	Reads(GChartAPIv1{})) // from the request
 
+	ws.Route(ws.GET("/gchart").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getGChartsByIds).
+	// docs
+	Doc("gets the gcharts of a list of ids (max. 100) - ids which don't exist are returned as missing").
+	Operation("getGChartsByIds").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.QueryParameter("ids", "comma separated list of gchart ids").DataType("string")).
+	Param(ws.QueryParameter("fields", "comma separated JSON fields of the response e.g. header.id,header.name").DataType("string")).
+	Writes(GChartAPIv1Bulk{})) // on the response
+
 	ws.Route(ws.GET("/gchart/{id}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getGChartById).
 	// docs
 	Doc("get a gchart").
 	Operation("getGChartbyId").
+	Returns(http.StatusOK, "OK", nil).
+	Returns(http.StatusNotModified, "Not Modified - the copy of the client is current", nil).
 	Param(ws.PathParameter("id", "identifier of the gchart").DataType("string")).
+	Param(ws.QueryParameter("fields", "comma separated JSON fields of the response e.g. header.id,header.name").DataType("string")).
+	Param(ws.HeaderParameter("If-None-Match", "ETag of the copy of the client").DataType("string")).
+	Param(ws.HeaderParameter("If-Modified-Since", "lastChange of the copy of the client (HTTP date)").DataType("string")).
 	Writes(GChartAPIv1{})) // on the response
 
+	ws.Route(ws.GET("/gchart/{id}/header").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getGChartHeaderById).
+	// docs
+	Doc("gets only the header of a gchart - without payload").
+	Operation("getGChartHeaderById").
+	Returns(http.StatusOK, "OK", nil).
+	Returns(http.StatusNotModified, "Not Modified - the copy of the client is current", nil).
+	Param(ws.PathParameter("id", "identifier of the gchart").DataType("string")).
+	Param(ws.QueryParameter("fields", "comma separated JSON fields of the response e.g. header.name,header.lastChange,header.size,header.hash (metadata only, read without the entity)").DataType("string")).
+	Param(ws.HeaderParameter("If-None-Match", "ETag of the copy of the client").DataType("string")).
+	Param(ws.HeaderParameter("If-Modified-Since", "lastChange of the copy of the client (HTTP date)").DataType("string")).
+	Writes(CommonAPIHeaderOnlyV1{})) // on the response
+
+	ws.Route(ws.GET("/gchart/{id}/revisions").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getGChartRevisions).
+	// docs
+	Doc("gets the previous versions of the gchart - newest first, max. 20").
+	Operation("getGChartRevisions").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.PathParameter("id", "identifier of the gchart").DataType("string")).
+	Param(ws.QueryParameter("envelope", "true: wrap the list with paging metadata").DataType("bool")).
+	Writes(RevisionAPIv1List{})) // on the response
+
+	ws.Route(ws.POST("/gchart/{id}/revert/{rev}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(revertGChart).
+	// docs
+	Doc("replaces the content of the gchart with the one of revision {rev} - only the owner or a curator").
+	Operation("revertGChart").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Returns(http.StatusForbidden, "Forbidden - only the owner or a curator may revert the entity", nil).
+	Param(ws.PathParameter("id", "identifier of the gchart").DataType("string")).
+	Param(ws.PathParameter("rev", "revision as listed by /gchart/{id}/revisions").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "curator reverting an entity of another owner").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")))
+
 	ws.Route(ws.DELETE("/gchart/{id}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(deleteGChartById).
 	// docs
-	Doc("delete a gchart by setting the deleted status").
+	Doc("delete a gchart by setting the deleted status - it can be restored from the trash for 30 days").
 	Operation("deleteGChartbyId").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Returns(http.StatusForbidden, "Forbidden - only the owner or a curator may change the entity", nil).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller - the owner of the entities it creates").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "curator changing an entity of another owner").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
 	Param(ws.PathParameter("id", "identifier of the chart").DataType("string")))
 
-	ws.Route(ws.PUT("/gchartcuration/{id}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(curateGChartById).
+	ws.Route(ws.PUT("/gchartcuration/{id}").Filter(basicAuthenticate).Filter(curatorAuthenticate).Filter(filterCloudDBStatus).To(curateGChartById).
 	// docs
-	Doc("set the curation status of the gchart to {newStatus} which must be 'true' or 'false' ").
+	Doc("set the curation status of the gchart to {newStatus} which must be 'true' or 'false' - curators only").
 	Operation("updateGChartCurationStatus").
+	Returns(http.StatusNoContent, "No Content", nil).
 	Param(ws.PathParameter("id", "identifier of the gchart").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
 	Param(ws.QueryParameter("newStatus", "true/false curation status").DataType("bool")))
 
+	ws.Route(ws.PUT("/gchartcuration/{id}/state").Filter(basicAuthenticate).Filter(curatorAuthenticate).Filter(filterCloudDBStatus).To(transitionGChartCurationById).
+	// docs
+	Doc("moves the gchart to a new curation state (Submitted, UnderReview, Approved, Rejected) - curators only").
+	Operation("transitionGChartCurationState").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Param(ws.PathParameter("id", "identifier of the gchart").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Reads(CurationTransitionAPIv1{})) // from the request
+
 	// Endpoint for GChartHeader only (no JPG or Definition)
 	ws.Route(ws.GET("/gchartheader").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getGChartHeader).
 	// docs
 	Doc("gets a collection of gcharts header - in buckets of x charts - table sort is new to old").
 	Operation("getGChartHeader").
+	Returns(http.StatusOK, "OK", nil).
 	Param(ws.QueryParameter("dateFrom", "Date of last change").DataType("string")).
+	Param(ws.QueryParameter("tag", "only entities with this tag - can be repeated").DataType("string")).
+	Param(ws.QueryParameter("curationState", "Submitted, UnderReview, Approved (default) or all").DataType("string")).
+	Param(ws.QueryParameter("cursor", "nextCursor of the previous call").DataType("string")).
+	Param(ws.QueryParameter("consistency", "eventual (default) or strong - strong reads all root shards, with several shards the list is paged by dateFrom only").DataType("string")).
+	Param(ws.QueryParameter("envelope", "true: wrap the list with paging metadata").DataType("bool")).
+	Param(ws.QueryParameter("fields", "comma separated JSON fields of the response e.g. header.id,header.name").DataType("string")).
 	Writes(GChartAPIv1HeaderOnlyList{})) // on the response
 
+	// Most downloaded - totals are consolidated by cron
+	ws.Route(ws.GET("/gchart/top").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getTopGCharts).
+	// docs
+	Doc("gets the most downloaded gcharts - most downloads first").
+	Operation("getTopGCharts").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.QueryParameter("n", "number of gcharts (default 25, max. 100)").DataType("int")).
+	Writes(DownloadAPIv1List{})) // on the response
+
+	// Full text search over name, description, author
+	ws.Route(ws.GET("/gchart/search").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(searchGCharts).
+	// docs
+	Doc("searches the gchart headers - best matches first").
+	Operation("searchGCharts").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.QueryParameter("q", "search query (GAE search syntax)").DataType("string")).
+	Param(ws.QueryParameter("limit", "max. number of results (max. 50)").DataType("int")).
+	Param(ws.QueryParameter("cursor", "nextCursor of the previous call").DataType("string")).
+	Param(ws.QueryParameter("curationState", "Submitted, UnderReview, Approved (default) or all").DataType("string")).
+	Writes(SearchResultAPIv1{})) // on the response
+
 	// Count Chart Headers to be retrieved
 	ws.Route(ws.GET("/gchartheader/count").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getGChartHeaderCount).
 	// docs
 	Doc("gets the number of gchart headers for testing,... selection").
 	Operation("getGChartHeader").
+	Returns(http.StatusOK, "OK", nil).
 	Param(ws.QueryParameter("dateFrom", "Date of last change").DataType("string")))
 
 
@@ -155,47 +406,136 @@ func init() {
 	ws.
 	Path("/v1").
 	Doc("Manage User Metrics").
-	Consumes(restful.MIME_JSON).
-	Produces(restful.MIME_JSON) // you can specify this per route as well
+	Consumes(apiMimeTypes...).
+	Produces(apiMimeTypes...) // you can specify this per route as well - see "encoding.go"
 
 	ws.Route(ws.POST("/usermetric/").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(insertUserMetric).
 	// docs
 	Doc("creates a usermetric").
 	Operation("createUserMetric").
+	Returns(http.StatusAccepted, "Accepted", nil).
+	Returns(http.StatusCreated, "Created", nil).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller - the owner of the entities it creates").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "curator adding the entity - it is curated at once").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Param(ws.HeaderParameter("Idempotency-Key", "unique key of the request - a retry with the same key and payload within 24 hours returns the first response").DataType("string")).
+	Param(ws.QueryParameter("strict", "true: the body is checked against the JSON Schema of /schemas/{kind}.json - unknown fields are rejected").DataType("bool")).
 	Reads(UserMetricAPIv1{})) // from the request
 
 	ws.Route(ws.PUT("/usermetric/").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(updateUserMetric).
 	// docs
 	Doc("updates a usermetric").
 	Operation("updateUserMetric").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Returns(http.StatusForbidden, "Forbidden - only the owner or a curator may change the entity", nil).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller - the owner of the entities it creates").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "curator changing an entity of another owner").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Param(ws.QueryParameter("strict", "true: the body is checked against the JSON Schema of /schemas/{kind}.json - unknown fields are rejected").DataType("bool")).
 	Reads(UserMetricAPIv1{})) // from the request
 
+	ws.Route(ws.GET("/usermetric").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getUserMetricsByKeys).
+	// docs
+	Doc("gets the usermetrics of a list of keys (max. 100) - keys which don't exist are returned as missing").
+	Operation("getUserMetricsByKeys").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.QueryParameter("keys", "comma separated list of usermetric keys").DataType("string")).
+	Param(ws.QueryParameter("fields", "comma separated JSON fields of the response e.g. header.id,header.name").DataType("string")).
+	Writes(UserMetricAPIv1Bulk{})) // on the response
+
 	ws.Route(ws.GET("/usermetric/{id}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getUserMetricByKey).
 	// docs
 	Doc("get a usermetric").
 	Operation("getUserMetricbyId").
+	Returns(http.StatusOK, "OK", nil).
+	Returns(http.StatusNotModified, "Not Modified - the copy of the client is current", nil).
 	Param(ws.PathParameter("key", "identifier of the user metric").DataType("string")).
+	Param(ws.QueryParameter("fields", "comma separated JSON fields of the response e.g. header.id,header.name").DataType("string")).
+	Param(ws.HeaderParameter("If-None-Match", "ETag of the copy of the client").DataType("string")).
+	Param(ws.HeaderParameter("If-Modified-Since", "lastChange of the copy of the client (HTTP date)").DataType("string")).
 	Writes(UserMetricAPIv1{})) // on the response
 
+	ws.Route(ws.GET("/usermetric/{key}/header").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getUserMetricHeaderByKey).
+	// docs
+	Doc("gets only the header of a usermetric - without payload").
+	Operation("getUserMetricHeaderByKey").
+	Returns(http.StatusOK, "OK", nil).
+	Returns(http.StatusNotModified, "Not Modified - the copy of the client is current", nil).
+	Param(ws.PathParameter("key", "identifier of the usermetric").DataType("string")).
+	Param(ws.QueryParameter("fields", "comma separated JSON fields of the response e.g. header.name,header.lastChange,header.size,header.hash (metadata only, read without the entity)").DataType("string")).
+	Param(ws.HeaderParameter("If-None-Match", "ETag of the copy of the client").DataType("string")).
+	Param(ws.HeaderParameter("If-Modified-Since", "lastChange of the copy of the client (HTTP date)").DataType("string")).
+	Writes(CommonAPIHeaderOnlyV1{})) // on the response
+
+	ws.Route(ws.GET("/usermetric/{key}/revisions").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getUserMetricRevisions).
+	// docs
+	Doc("gets the previous versions of the usermetric - newest first, max. 20").
+	Operation("getUserMetricRevisions").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.PathParameter("key", "key of the usermetric").DataType("string")).
+	Param(ws.QueryParameter("envelope", "true: wrap the list with paging metadata").DataType("bool")).
+	Writes(RevisionAPIv1List{})) // on the response
+
+	ws.Route(ws.POST("/usermetric/{key}/revert/{rev}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(revertUserMetric).
+	// docs
+	Doc("replaces the content of the usermetric with the one of revision {rev} - only the owner or a curator").
+	Operation("revertUserMetric").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Returns(http.StatusForbidden, "Forbidden - only the owner or a curator may revert the entity", nil).
+	Param(ws.PathParameter("key", "key of the usermetric").DataType("string")).
+	Param(ws.PathParameter("rev", "revision as listed by /usermetric/{key}/revisions").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "curator reverting an entity of another owner").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")))
+
 	ws.Route(ws.DELETE("/usermetric/{key}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(deleteUserMetricByKey).
 	// docs
-	Doc("delete a usermetric by setting the deleted status").
+	Doc("delete a usermetric by setting the deleted status - it can be restored from the trash for 30 days").
 	Operation("deleteUserMetricbyKey").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Returns(http.StatusForbidden, "Forbidden - only the owner or a curator may change the entity", nil).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller - the owner of the entities it creates").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "curator changing an entity of another owner").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
 	Param(ws.PathParameter("key", "identifier of the usermetric").DataType("string")))
 
-	ws.Route(ws.PUT("/usermetriccuration/{key}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(curateUserMetricByKey).
+	ws.Route(ws.PUT("/usermetriccuration/{key}").Filter(basicAuthenticate).Filter(curatorAuthenticate).Filter(filterCloudDBStatus).To(curateUserMetricByKey).
 	// docs
-	Doc("set the curation status of the usermetric to {newStatus} which must be 'true' or 'false' ").
+	Doc("set the curation status of the usermetric to {newStatus} which must be 'true' or 'false' - curators only").
 	Operation("updateUserMetricCurationStatus").
+	Returns(http.StatusNoContent, "No Content", nil).
 	Param(ws.PathParameter("key", "identifier of the usermetric").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
 	Param(ws.QueryParameter("newStatus", "true/false curation status").DataType("bool")))
 
+	ws.Route(ws.PUT("/usermetriccuration/{key}/state").Filter(basicAuthenticate).Filter(curatorAuthenticate).Filter(filterCloudDBStatus).To(transitionUserMetricCurationByKey).
+	// docs
+	Doc("moves the usermetric to a new curation state (Submitted, UnderReview, Approved, Rejected) - curators only").
+	Operation("transitionUserMetricCurationState").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Param(ws.PathParameter("key", "identifier of the usermetric").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Reads(CurationTransitionAPIv1{})) // from the request
+
 	// Endpoint for ChartHeader only (no JPG or LTMSettings)
 	ws.Route(ws.GET("/usermetricheader").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getUserMetricHeader).
 	// docs
 	Doc("gets a collection of usermetric header - in buckets of x headers - table sort is new to old").
 	Operation("getUserMetricHeader").
+	Returns(http.StatusOK, "OK", nil).
 	Param(ws.QueryParameter("dateFrom", "Date of last change").DataType("string")).
+	Param(ws.QueryParameter("tag", "only entities with this tag - can be repeated").DataType("string")).
+	Param(ws.QueryParameter("curationState", "Submitted, UnderReview, Approved (default) or all").DataType("string")).
+	Param(ws.QueryParameter("cursor", "nextCursor of the previous call").DataType("string")).
+	Param(ws.QueryParameter("consistency", "eventual (default) or strong - strong reads all root shards, with several shards the list is paged by dateFrom only").DataType("string")).
+	Param(ws.QueryParameter("envelope", "true: wrap the list with paging metadata").DataType("bool")).
+	Param(ws.QueryParameter("fields", "comma separated JSON fields of the response e.g. header.id,header.name").DataType("string")).
 	Writes(UserMetricAPIv1HeaderOnlyList{})) // on the response
 
 	// Count Chart Headers to be retrieved
@@ -203,6 +543,7 @@ func init() {
 	// docs
 	Doc("gets the number of usermetric headers for testing,... selection").
 	Operation("getUserMetricHeader").
+	Returns(http.StatusOK, "OK", nil).
 	Param(ws.QueryParameter("dateFrom", "Date of last change").DataType("string")))
 
 	// ----------------------------------------------------------------------------------
@@ -210,53 +551,1399 @@ func init() {
 	// ----------------------------------------------------------------------------------
 	ws.Route(ws.GET("/curator").Filter(basicAuthenticate).To(getCurator).
 	// docs
-	Doc("gets a collection of curators").
+	Doc("gets the curator of the curatorId - admins (with the secret) get all curators").
 	Operation("getCurator").
+	Returns(http.StatusOK, "OK", nil).
 	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - only needed by admins").DataType("string")).
+	Param(ws.QueryParameter("envelope", "true: wrap the list with paging metadata").DataType("bool")).
 	Writes(CuratorAPIv1List{})) // on the response
 
 	ws.Route(ws.POST("/curator").Filter(basicAuthenticate).To(insertCurator).
 	// docs
-	Doc("creates a curator").
+	Doc("creates a curator - without any role (granted by an admin), the secret of the curator is returned in X-CloudDB-Curator-Secret").
 	Operation("createCurator").
+	Returns(http.StatusCreated, "Created", nil).
+	Returns(http.StatusConflict, "Conflict - the curatorId is already registered", nil).
 	Reads(CuratorAPIv1{})) // from the request
 
+	ws.Route(ws.GET("/curator/{id}/secret").Filter(basicAuthenticate).Filter(adminAuthenticate).To(getCuratorSecret).
+	// docs
+	Doc("gets the curator with its secret - for curators registered before the secrets existed - admins only").
+	Operation("getCuratorSecret").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.PathParameter("id", "identifier of the curator").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Writes(CuratorAPIv1{})) // on the response
+
+	ws.Route(ws.PUT("/curator/{id}/roles/{role}").Filter(basicAuthenticate).Filter(adminAuthenticate).To(grantCuratorRole).
+	// docs
+	Doc("grants the role (admin, curator or reader) to the curator - admins only").
+	Operation("grantCuratorRole").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.PathParameter("id", "identifier of the curator").DataType("string")).
+	Param(ws.PathParameter("role", "admin, curator or reader").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Writes(CuratorAPIv1{})) // on the response
+
+	ws.Route(ws.DELETE("/curator/{id}/roles/{role}").Filter(basicAuthenticate).Filter(adminAuthenticate).To(revokeCuratorRole).
+	// docs
+	Doc("revokes the role (admin, curator or reader) of the curator - admins only").
+	Operation("revokeCuratorRole").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.PathParameter("id", "identifier of the curator").DataType("string")).
+	Param(ws.PathParameter("role", "admin, curator or reader").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Writes(CuratorAPIv1{})) // on the response
+
 	// ----------------------------------------------------------------------------------
-	// setup the status endpoints - processing see "entity_status.go"
+	// setup the status endpoints - processing see "entity_status.go", "entity_message.go"
 	// ----------------------------------------------------------------------------------
 
 	ws.Route(ws.POST("/status").Filter(basicAuthenticate).To(insertStatus).
 	// docs
 	Doc("creates a new status entity").
 	Operation("createStatus").
+	Returns(http.StatusOK, "OK", nil).
+	Returns(http.StatusCreated, "Created", nil).
+	Param(ws.QueryParameter("ifChanged", "true: only stored if the status differs from the latest one").DataType("bool")).
+	Param(ws.QueryParameter("strict", "true: the body is checked against the JSON Schema of /schemas/{kind}.json - unknown fields are rejected").DataType("bool")).
 	Reads(StatusEntityPostAPIv1{})) // from the request
 
 	ws.Route(ws.GET("/status").Filter(basicAuthenticate).To(getStatus).
 	// docs
-	Doc("gets a collection of status").
+	Doc("gets a collection of status - filtered by status code and date range").
 	Operation("getStatus").
+	Returns(http.StatusOK, "OK", nil).
 	Param(ws.QueryParameter("dateFrom", "Status Validity").DataType("string")).
+	Param(ws.QueryParameter("dateTo", "RFC3339 date of the last status").DataType("string")).
+	Param(ws.QueryParameter("statusCode", "only status with this code - 10 ok, 20 partial failure, 30 outage").DataType("int")).
+	Param(ws.QueryParameter("order", "asc or desc (default) by changeDate").DataType("string")).
+	Param(ws.QueryParameter("envelope", "true: wrap the list with paging metadata").DataType("bool")).
 	Writes(StatusEntityGetAPIv1List{})) // on the response
 
 	ws.Route(ws.GET("/status/latest").Filter(basicAuthenticate).To(getCurrentStatus).
 	// docs
-	Doc("gets the current/latest status").
+	Doc("gets the current/latest status - with the active maintenance window if there is one, the last known good status (stale) if the datastore is unavailable").
 	Operation("getStatus").
+	Returns(http.StatusOK, "OK", nil).
 	Writes(StatusEntityGetAPIv1{})) // on the response
 
+	ws.Route(ws.GET("/status/stats").Filter(basicAuthenticate).To(getStatusStats).
+	// docs
+	Doc("gets the uptime, status counts, longest outage and mean time between incidents (in seconds) of a period").
+	Operation("getStatusStats").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.QueryParameter("dateFrom", "RFC3339 begin of the period (default 30 days ago)").DataType("string")).
+	Param(ws.QueryParameter("dateTo", "RFC3339 end of the period (default now)").DataType("string")).
+	Writes(StatusStatsAPIv1{})) // on the response
+
+	ws.Route(ws.GET("/status/export.csv").Filter(basicAuthenticate).To(getStatusExport).Produces(mimeCSV).
+	// docs
+	Doc("gets the status history as CSV (id, status, description, changeDate) - oldest first, timestamps in RFC3339").
+	Operation("getStatusExport").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.QueryParameter("dateFrom", "RFC3339 begin of the period (default: the whole history)").DataType("string")).
+	Param(ws.QueryParameter("dateTo", "RFC3339 end of the period (default: now)").DataType("string")))
+
+	ws.Route(ws.GET("/status/feed.atom").To(getStatusFeed).Produces(mimeAtom).
+	// docs
+	Doc("gets the latest status changes as Atom feed - no authorization, for feed readers").
+	Operation("getStatusFeed").
+	Returns(http.StatusOK, "OK", nil))
+
 	ws.Route(ws.GET("/statustext/{id}").Filter(basicAuthenticate).To(getStatusTextById).
 	// docs
-	Doc("gets the text for a specific status entity").
+	Doc("gets the text for a specific status entity - in the best language of Accept-Language").
 	Operation("getStatusText").
+	Returns(http.StatusOK, "OK", nil).
+	Returns(http.StatusNotFound, "Not Found - unknown status or no text", nil).
 	Param(ws.PathParameter("id", "identifier of the chart").DataType("string")).
+	Param(ws.HeaderParameter("Accept-Language", "preferred languages of the client - default is en").DataType("string")).
 	Writes(StatusEntityGetTextAPIv1{})) // on the response
 
+	ws.Route(ws.GET("/statustext/{id}/messages").Filter(basicAuthenticate).To(getStatusMessages).
+	// docs
+	Doc("gets all translations of the text of a status entity").
+	Operation("getStatusMessages").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.PathParameter("id", "identifier of the status").DataType("string")).
+	Param(ws.QueryParameter("envelope", "true: wrap the list with paging metadata").DataType("bool")).
+	Writes(MessageAPIv1List{})) // on the response
+
+	ws.Route(ws.PUT("/statustext/{id}/messages/{locale}").Filter(basicAuthenticate).Filter(curatorAuthenticate).To(updateStatusMessage).
+	// docs
+	Doc("stores the translation of the text of a status entity - an empty text deletes it - curators only").
+	Operation("updateStatusMessage").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Param(ws.PathParameter("id", "identifier of the status").DataType("string")).
+	Param(ws.PathParameter("locale", "locale of the translation e.g. de or pt-br").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Reads(MessageAPIv1{})) // from the request
+
+
+	// ----------------------------------------------------------------------------------
+	// setup the webhook endpoints - processing see "entity_webhook.go"
+	// ----------------------------------------------------------------------------------
+	ws.Route(ws.POST("/webhook").Filter(basicAuthenticate).Filter(curatorAuthenticate).To(insertWebhook).
+	// docs
+	Doc("registers a webhook which is called on status changes - curators only").
+	Operation("createWebhook").
+	Returns(http.StatusCreated, "Created", nil).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Reads(WebhookAPIv1{})) // from the request
+
+	ws.Route(ws.GET("/webhook").Filter(basicAuthenticate).Filter(readerAuthenticate).To(getWebhooks).
+	// docs
+	Doc("gets all registered webhooks - without secrets - readers only").
+	Operation("getWebhooks").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Writes(WebhookAPIv1List{})) // on the response
+
+	ws.Route(ws.PUT("/webhook/{id}").Filter(basicAuthenticate).Filter(curatorAuthenticate).To(updateWebhook).
+	// docs
+	Doc("updates url, secret and events of a webhook - curators only").
+	Operation("updateWebhook").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Param(ws.PathParameter("id", "identifier of the webhook").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Reads(WebhookAPIv1{})) // from the request
+
+	ws.Route(ws.DELETE("/webhook/{id}").Filter(basicAuthenticate).Filter(curatorAuthenticate).To(deleteWebhook).
+	// docs
+	Doc("deletes a webhook and its delivery log - curators only").
+	Operation("deleteWebhook").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Param(ws.PathParameter("id", "identifier of the webhook").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")))
+
+	ws.Route(ws.GET("/webhook/{id}/deliveries").Filter(basicAuthenticate).Filter(readerAuthenticate).To(getWebhookDeliveries).
+	// docs
+	Doc("gets the latest delivery attempts of a webhook - newest first - readers only").
+	Operation("getWebhookDeliveries").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.PathParameter("id", "identifier of the webhook").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Writes(WebhookDeliveryAPIv1List{})) // on the response
+
+	ws.Route(ws.POST("/tasks/webhook/{id}").Filter(taskAuthenticate).To(processWebhookDelivery).
+	// docs
+	Doc("task queue - posts a status event to a webhook").
+	Operation("processWebhookDelivery").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.PathParameter("id", "identifier of the webhook").DataType("string")).
+	Param(ws.QueryParameter("event", "the event which is delivered").DataType("string")))
+
+	// ----------------------------------------------------------------------------------
+	// setup the incident endpoints - processing see "entity_incident.go"
+	// ----------------------------------------------------------------------------------
+	ws.Route(ws.POST("/incident").Filter(basicAuthenticate).Filter(curatorAuthenticate).To(insertIncident).
+	// docs
+	Doc("creates an incident which explains an outage - linked to its status entries - curators only").
+	Operation("createIncident").
+	Returns(http.StatusCreated, "Created", nil).
+	Returns(http_UnprocessableEntity, "Validation failed", nil).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Reads(IncidentAPIv1{})) // from the request
+
+	ws.Route(ws.PUT("/incident/{id}").Filter(basicAuthenticate).Filter(curatorAuthenticate).To(updateIncident).
+	// docs
+	Doc("updates an incident e.g. with the time it was resolved - curators only").
+	Operation("updateIncident").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Returns(http_UnprocessableEntity, "Validation failed", nil).
+	Param(ws.PathParameter("id", "identifier of the incident").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Reads(IncidentAPIv1{})) // from the request
+
+	ws.Route(ws.DELETE("/incident/{id}").Filter(basicAuthenticate).Filter(curatorAuthenticate).To(deleteIncident).
+	// docs
+	Doc("deletes an incident - the status entries stay - curators only").
+	Operation("deleteIncident").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Param(ws.PathParameter("id", "identifier of the incident").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")))
+
+	ws.Route(ws.GET("/incident/{id}").To(getIncidentById).
+	// docs
+	Doc("gets an incident - no authorization, for the GoldenCheetah website").
+	Operation("getIncidentById").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.PathParameter("id", "identifier of the incident").DataType("string")).
+	Writes(IncidentAPIv1{})) // on the response
+
+	ws.Route(ws.GET("/incidents").To(getIncidents).
+	// docs
+	Doc("gets the incident timeline - newest first - no authorization, for the GoldenCheetah website").
+	Operation("getIncidents").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.QueryParameter("dateFrom", "incidents started at or after - format 2006-01-02T15:04:05Z").DataType("string")).
+	Param(ws.QueryParameter("cursor", "nextCursor of the previous call").DataType("string")).
+	Param(ws.QueryParameter("envelope", "true: wrap the list with paging metadata").DataType("bool")).
+	Writes(IncidentAPIv1List{})) // on the response
+
+	// ----------------------------------------------------------------------------------
+	// setup the maintenance window endpoints - processing see "entity_maintenancewindow.go"
+	// ----------------------------------------------------------------------------------
+	ws.Route(ws.POST("/maintenance").Filter(basicAuthenticate).Filter(curatorAuthenticate).To(insertMaintenanceWindow).
+	// docs
+	Doc("announces a planned maintenance window - curators only").
+	Operation("createMaintenanceWindow").
+	Returns(http.StatusCreated, "Created", nil).
+	Returns(http_UnprocessableEntity, "Validation failed", nil).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Reads(MaintenanceWindowAPIv1{})) // from the request
+
+	ws.Route(ws.PUT("/maintenance/{id}").Filter(basicAuthenticate).Filter(curatorAuthenticate).To(updateMaintenanceWindow).
+	// docs
+	Doc("updates a maintenance window e.g. when it is postponed - curators only").
+	Operation("updateMaintenanceWindow").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Returns(http_UnprocessableEntity, "Validation failed", nil).
+	Param(ws.PathParameter("id", "identifier of the maintenance window").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Reads(MaintenanceWindowAPIv1{})) // from the request
+
+	ws.Route(ws.DELETE("/maintenance/{id}").Filter(basicAuthenticate).Filter(curatorAuthenticate).To(deleteMaintenanceWindow).
+	// docs
+	Doc("cancels a maintenance window - curators only").
+	Operation("deleteMaintenanceWindow").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Param(ws.PathParameter("id", "identifier of the maintenance window").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")))
+
+	ws.Route(ws.GET("/maintenance/upcoming").Filter(basicAuthenticate).To(getUpcomingMaintenanceWindows).
+	// docs
+	Doc("gets the active and planned maintenance windows - the next one first").
+	Operation("getUpcomingMaintenanceWindows").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.QueryParameter("envelope", "true: wrap the list with paging metadata").DataType("bool")).
+	Writes(MaintenanceWindowAPIv1List{})) // on the response
+
+	// ----------------------------------------------------------------------------------
+	// setup the download counter consolidation - processing see "entity_counter.go"
+	// ----------------------------------------------------------------------------------
+	ws.Route(ws.GET("/tasks/downloads").Filter(taskAuthenticate).To(processDownloads).
+	// docs
+	Doc("cron - consolidates the download counters for the top lists").
+	Operation("processDownloads").
+	Returns(http.StatusOK, "OK", nil))
+
+	// ----------------------------------------------------------------------------------
+	// setup the tag endpoints - processing see "entity_tag.go"
+	// ----------------------------------------------------------------------------------
+	ws.Route(ws.GET("/tags").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getTags).
+	// docs
+	Doc("gets the most used tags - most popular first").
+	Operation("getTags").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.QueryParameter("n", "max. number of tags (max. 100)").DataType("int")).
+	Writes(TagAPIv1List{})) // on the response
+
+	// ----------------------------------------------------------------------------------
+	// setup the flag endpoints - processing see "entity_flag.go"
+	// ----------------------------------------------------------------------------------
+	ws.Route(ws.POST("/chart/{id}/flag").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(flagChartById).
+	// docs
+	Doc("reports a chart as inappropriate or broken").
+	Operation("flagChart").
+	Returns(http.StatusCreated, "Created", nil).
+	Param(ws.PathParameter("id", "identifier of the chart").DataType("string")).
+	Reads(FlagPostAPIv1{})) // from the request
+
+	ws.Route(ws.POST("/gchart/{id}/flag").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(flagGChartById).
+	// docs
+	Doc("reports a gchart as inappropriate or broken").
+	Operation("flagGChart").
+	Returns(http.StatusCreated, "Created", nil).
+	Param(ws.PathParameter("id", "identifier of the gchart").DataType("string")).
+	Reads(FlagPostAPIv1{})) // from the request
+
+	ws.Route(ws.POST("/usermetric/{key}/flag").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(flagUserMetricByKey).
+	// docs
+	Doc("reports a usermetric as inappropriate or broken").
+	Operation("flagUserMetric").
+	Returns(http.StatusCreated, "Created", nil).
+	Param(ws.PathParameter("key", "identifier of the usermetric").DataType("string")).
+	Reads(FlagPostAPIv1{})) // from the request
+
+	ws.Route(ws.GET("/flags").Filter(basicAuthenticate).Filter(readerAuthenticate).To(getFlags).
+	// docs
+	Doc("gets the reported content - newest first - readers only").
+	Operation("getFlags").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Param(ws.QueryParameter("type", "chart, gchart or usermetric").DataType("string")).
+	Writes(FlagAPIv1List{})) // on the response
+
+	// ----------------------------------------------------------------------------------
+	// setup the rating and comment endpoints - processing see "entity_rating.go"
+	// ----------------------------------------------------------------------------------
+	ws.Route(ws.POST("/chart/{id}/rating").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(rateChartById).
+	// docs
+	Doc("rates a chart with 1 to 5 stars - one vote per client").
+	Operation("rateChart").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Param(ws.PathParameter("id", "identifier of the chart").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")).
+	Reads(RatingPostAPIv1{})) // from the request
+
+	ws.Route(ws.GET("/chart/{id}/rating").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getChartRatingById).
+	// docs
+	Doc("gets the average rating of a chart").
+	Operation("getChartRating").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.PathParameter("id", "identifier of the chart").DataType("string")).
+	Writes(RatingAPIv1{})) // on the response
+
+	ws.Route(ws.POST("/chart/{id}/comments").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(insertChartComment).
+	// docs
+	Doc("adds a comment to a chart").
+	Operation("createChartComment").
+	Returns(http.StatusCreated, "Created", nil).
+	Param(ws.PathParameter("id", "identifier of the chart").DataType("string")).
+	Reads(CommentAPIv1{})) // from the request
+
+	ws.Route(ws.GET("/chart/{id}/comments").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getChartComments).
+	// docs
+	Doc("gets the comments of a chart - oldest first").
+	Operation("getChartComments").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.PathParameter("id", "identifier of the chart").DataType("string")).
+	Writes(CommentAPIv1List{})) // on the response
+
+	ws.Route(ws.POST("/gchart/{id}/rating").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(rateGChartById).
+	// docs
+	Doc("rates a gchart with 1 to 5 stars - one vote per client").
+	Operation("rateGChart").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Param(ws.PathParameter("id", "identifier of the gchart").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")).
+	Reads(RatingPostAPIv1{})) // from the request
+
+	ws.Route(ws.GET("/gchart/{id}/rating").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getGChartRatingById).
+	// docs
+	Doc("gets the average rating of a gchart").
+	Operation("getGChartRating").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.PathParameter("id", "identifier of the gchart").DataType("string")).
+	Writes(RatingAPIv1{})) // on the response
+
+	ws.Route(ws.POST("/gchart/{id}/comments").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(insertGChartComment).
+	// docs
+	Doc("adds a comment to a gchart").
+	Operation("createGChartComment").
+	Returns(http.StatusCreated, "Created", nil).
+	Param(ws.PathParameter("id", "identifier of the gchart").DataType("string")).
+	Reads(CommentAPIv1{})) // from the request
+
+	ws.Route(ws.GET("/gchart/{id}/comments").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getGChartComments).
+	// docs
+	Doc("gets the comments of a gchart - oldest first").
+	Operation("getGChartComments").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.PathParameter("id", "identifier of the gchart").DataType("string")).
+	Writes(CommentAPIv1List{})) // on the response
+
+	ws.Route(ws.POST("/usermetric/{key}/rating").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(rateUserMetricByKey).
+	// docs
+	Doc("rates a usermetric with 1 to 5 stars - one vote per client").
+	Operation("rateUserMetric").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Param(ws.PathParameter("key", "identifier of the usermetric").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")).
+	Reads(RatingPostAPIv1{})) // from the request
+
+	ws.Route(ws.GET("/usermetric/{key}/rating").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getUserMetricRatingByKey).
+	// docs
+	Doc("gets the average rating of a usermetric").
+	Operation("getUserMetricRating").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.PathParameter("key", "identifier of the usermetric").DataType("string")).
+	Writes(RatingAPIv1{})) // on the response
+
+	// ----------------------------------------------------------------------------------
+	// setup the star endpoints - processing see "entity_star.go"
+	// ----------------------------------------------------------------------------------
+	ws.Route(ws.POST("/chart/{id}/star").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(starChartById).
+	// docs
+	Doc("stars a chart for the calling client - starring again changes nothing").
+	Operation("starChart").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Param(ws.PathParameter("id", "identifier of the chart").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")))
+
+	ws.Route(ws.DELETE("/chart/{id}/star").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(unstarChartById).
+	// docs
+	Doc("removes the star of the calling client from a chart").
+	Operation("unstarChart").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Param(ws.PathParameter("id", "identifier of the chart").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")))
+
+	ws.Route(ws.POST("/gchart/{id}/star").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(starGChartById).
+	// docs
+	Doc("stars a gchart for the calling client - starring again changes nothing").
+	Operation("starGChart").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Param(ws.PathParameter("id", "identifier of the gchart").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")))
+
+	ws.Route(ws.DELETE("/gchart/{id}/star").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(unstarGChartById).
+	// docs
+	Doc("removes the star of the calling client from a gchart").
+	Operation("unstarGChart").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Param(ws.PathParameter("id", "identifier of the gchart").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")))
+
+	ws.Route(ws.GET("/stars").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getStars).
+	// docs
+	Doc("gets the ids of the charts and gcharts starred by the calling client").
+	Operation("getStars").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")).
+	Writes(StarsAPIv1{})) // on the response
+
+	// ----------------------------------------------------------------------------------
+	// setup the share link endpoints - processing see "entity_share.go"
+	// ----------------------------------------------------------------------------------
+	ws.Route(ws.POST("/chart/{id}/share").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(shareChartById).
+	// docs
+	Doc("creates a signed link to a chart (e.g. an unlisted one) which expires - only the owner or a curator").
+	Operation("shareChart").
+	Returns(http.StatusCreated, "Created", ShareLinkAPIv1{}).
+	Param(ws.PathParameter("id", "identifier of the chart").DataType("string")).
+	Param(ws.QueryParameter("expiresInHours", "hours until the link expires - default 168, max. 2160").DataType("integer")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")).
+	Writes(ShareLinkAPIv1{})) // on the response
+
+	ws.Route(ws.POST("/gchart/{id}/share").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(shareGChartById).
+	// docs
+	Doc("creates a signed link to a gchart (e.g. an unlisted one) which expires - only the owner or a curator").
+	Operation("shareGChart").
+	Returns(http.StatusCreated, "Created", ShareLinkAPIv1{}).
+	Param(ws.PathParameter("id", "identifier of the gchart").DataType("string")).
+	Param(ws.QueryParameter("expiresInHours", "hours until the link expires - default 168, max. 2160").DataType("integer")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")).
+	Writes(ShareLinkAPIv1{})) // on the response
+
+	ws.Route(ws.GET("/share/{token}").Filter(filterCloudDBStatus).To(getSharedByToken).
+	// docs
+	Doc("gets the chart or gchart of a share link - no authentication, 410 if the link is expired").
+	Operation("getShared").
+	Param(ws.PathParameter("token", "token of the share link").DataType("string")))
+
+	ws.Route(ws.DELETE("/share/{token}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(revokeShareLink).
+	// docs
+	Doc("revokes a share link before it expires - only the owner or a curator").
+	Operation("revokeShareLink").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Param(ws.PathParameter("token", "token of the share link").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")))
+
+	// ----------------------------------------------------------------------------------
+	// setup the version endpoints - processing see "entity_version.go", "entity_message.go"
+	// ----------------------------------------------------------------------------------
+	ws.Route(ws.GET("/version/current").Filter(basicAuthenticate).To(getCurrentVersion).
+	// docs
+	Doc("gets the minimum and the recommended GoldenCheetah version - the message in the best language of Accept-Language").
+	Operation("getCurrentVersion").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.HeaderParameter("Accept-Language", "preferred languages of the client - default is en").DataType("string")).
+	Writes(VersionAPIv1{})) // on the response
+
+	ws.Route(ws.GET("/version/current/messages").Filter(basicAuthenticate).To(getVersionMessages).
+	// docs
+	Doc("gets all translations of the version message").
+	Operation("getVersionMessages").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.QueryParameter("envelope", "true: wrap the list with paging metadata").DataType("bool")).
+	Writes(MessageAPIv1List{})) // on the response
+
+	ws.Route(ws.PUT("/version/current/messages/{locale}").Filter(basicAuthenticate).Filter(adminAuthenticate).To(updateVersionMessage).
+	// docs
+	Doc("stores the translation of the version message - an empty text deletes it - admins only").
+	Operation("updateVersionMessage").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Param(ws.PathParameter("locale", "locale of the translation e.g. de or pt-br").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Reads(MessageAPIv1{})) // from the request
+
+	ws.Route(ws.PUT("/version/current").Filter(basicAuthenticate).Filter(adminAuthenticate).To(updateVersion).
+	// docs
+	Doc("updates the minimum and the recommended GoldenCheetah version - admins only").
+	Operation("updateVersion").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Reads(VersionAPIv1{})) // from the request
+
+	// ----------------------------------------------------------------------------------
+	// setup the telemetry endpoints - processing see "entity_telemetry.go"
+	// ----------------------------------------------------------------------------------
+	ws.Route(ws.POST("/telemetry").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(insertTelemetry).
+	// docs
+	Doc("queues anonymous usage metrics - they are stored in batches").
+	Operation("createTelemetry").
+	Returns(http.StatusAccepted, "Accepted", nil).
+	Reads(TelemetryAPIv1{})) // from the request
+
+	ws.Route(ws.GET("/telemetry/daily").Filter(basicAuthenticate).Filter(readerAuthenticate).To(getTelemetryDaily).
+	// docs
+	Doc("gets the daily rollups of the usage metrics - readers only").
+	Operation("getTelemetryDaily").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Param(ws.QueryParameter("dateFrom", "Start of the period (default 30 days back)").DataType("string")).
+	Param(ws.QueryParameter("dateTo", "End of the period (default now)").DataType("string")).
+	Writes(TelemetryDailyAPIv1List{})) // on the response
+
+	ws.Route(ws.GET("/tasks/telemetry").Filter(taskAuthenticate).To(processTelemetry).
+	// docs
+	Doc("cron - stores the queued usage metrics").
+	Operation("processTelemetry").
+	Returns(http.StatusOK, "OK", nil))
+
+	// ----------------------------------------------------------------------------------
+	// setup the asynchronous insert worker - processing see "entity_async.go"
+	// ----------------------------------------------------------------------------------
+	ws.Route(ws.POST("/tasks/insert/{type}").Filter(taskAuthenticate).To(processInsert).
+	// docs
+	Doc("task queue - stores the entity staged by an asynchronous insert").
+	Operation("processInsert").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Param(ws.PathParameter("type", "chart, gchart or usermetric").DataType("string")).
+	Param(ws.QueryParameter("key", "encoded datastore key of the new entity").DataType("string")))
+
+	// ----------------------------------------------------------------------------------
+	// setup the sync endpoints - processing see "entity_sync.go"
+	// ----------------------------------------------------------------------------------
+	ws.Route(ws.GET("/sync/{kind}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getChanges).
+	// docs
+	Doc("gets the ids of all created, updated and deleted entities of {kind} since the token of the previous call").
+	Operation("getChanges").
+	Returns(http.StatusOK, "OK", nil).
+	Returns(http.StatusGone, "Gone - the token is older than the change log, a full download is required", nil).
+	Param(ws.PathParameter("kind", "chart, gchart or usermetric").DataType("string")).
+	Param(ws.QueryParameter("since", "nextToken of the previous call - empty for all changes").DataType("string")).
+	Writes(SyncAPIv1{})) // on the response
+
+	ws.Route(ws.GET("/changelog").Filter(basicAuthenticate).Filter(readerAuthenticate).To(getChangeLog).
+	// docs
+	Doc("gets all change log entries since the token of the previous call in the order of the changes - to tail the log for replication").
+	Operation("getChangeLog").
+	Returns(http.StatusOK, "OK", nil).
+	Returns(http.StatusGone, "Gone - the token is older than the change log, a full copy is required", nil).
+	Param(ws.QueryParameter("since", "nextToken of the previous call - empty for the complete log").DataType("string")).
+	Param(ws.QueryParameter("kind", "only entries of chart, gchart or usermetric - empty for all kinds").DataType("string")).
+	Writes(ChangeLogTailAPIv1{})) // on the response
+
+	// ----------------------------------------------------------------------------------
+	// setup the ownership endpoints - processing see "entity_owner.go"
+	// ----------------------------------------------------------------------------------
+	ws.Route(ws.POST("/client").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(registerClient).
+	// docs
+	Doc("registers an installation - returns a new client id and its secret, both are sent with every call which needs the caller").
+	Operation("registerClient").
+	Returns(http.StatusCreated, "Created", nil).
+	Writes(ClientAPIv1{})) // on the response
+
+	ws.Route(ws.GET("/mine").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getMine).
+	// docs
+	Doc("gets the headers of all charts, gcharts and usermetrics owned by the calling client").
+	Operation("getMine").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")).
+	Writes(MineAPIv1{})) // on the response
+
+	// ----------------------------------------------------------------------------------
+	// setup the trash endpoints - processing see "entity_trash.go"
+	// ----------------------------------------------------------------------------------
+	ws.Route(ws.GET("/trash").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getTrash).
+	// docs
+	Doc("gets the deleted charts, gcharts and usermetrics of the calling client which can still be restored").
+	Operation("getTrash").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")).
+	Param(ws.QueryParameter("envelope", "true: wrap the list with paging metadata").DataType("bool")).
+	Writes(TrashAPIv1List{})) // on the response
+
+	ws.Route(ws.POST("/trash/{id}/restore").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(restoreTrashItem).
+	// docs
+	Doc("restores a deleted chart, gchart or usermetric - only the owner or a curator").
+	Operation("restoreTrashItem").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Returns(http.StatusForbidden, "Forbidden - only the owner or a curator may restore the entity", nil).
+	Returns(http.StatusNotFound, "Not Found - not in the trash (anymore)", nil).
+	Param(ws.PathParameter("id", "id of the trash item - {type}:{id or key}").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "curator restoring an entity of another owner").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")))
+
+	ws.Route(ws.GET("/tasks/trash/purge").Filter(taskAuthenticate).To(processTrashPurge).
+	// docs
+	Doc("cron - removes the payload of all entities deleted more than 30 days ago").
+	Operation("processTrashPurge").
+	Returns(http.StatusOK, "OK", nil).
+	Writes(TrashPurgeAPIv1{})) // on the response
+
+	// ----------------------------------------------------------------------------------
+	// setup the chunked upload endpoints - processing see "entity_upload.go"
+	// ----------------------------------------------------------------------------------
+	ws.Route(ws.POST("/upload/session").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(insertUploadSession).
+	// docs
+	Doc("starts a chunked upload of a chart, gchart or usermetric - the session expires after 24 hours without chunk").
+	Operation("createUploadSession").
+	Returns(http.StatusCreated, "Created", nil).
+	Reads(UploadSessionAPIv1{}). // from the request
+	Writes(UploadSessionAPIv1{})) // on the response
+
+	ws.Route(ws.GET("/upload/session/{id}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getUploadSession).
+	// docs
+	Doc("gets the upload progress - an interrupted upload continues at {received}").
+	Operation("getUploadSession").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.PathParameter("id", "identifier of the upload session").DataType("string")).
+	Writes(UploadSessionAPIv1{})) // on the response
+
+	ws.Route(ws.PUT("/upload/session/{id}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(uploadChunk).Consumes("*/*").
+	// docs
+	Doc("adds the next chunk (raw bytes of the JSON payload, max. 900KB) - the position is sent as Content-Range").
+	Operation("uploadChunk").
+	Returns(http.StatusOK, "OK", nil).
+	Returns(http.StatusConflict, "Conflict - chunk is not the next one, continue at {received}", nil).
+	Param(ws.PathParameter("id", "identifier of the upload session").DataType("string")).
+	Param(ws.HeaderParameter("Content-Range", "bytes <first>-<last>/<total or *>").DataType("string")).
+	Writes(UploadSessionAPIv1{})) // on the response
+
+	ws.Route(ws.POST("/upload/session/{id}/commit").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(commitUpload).Consumes("*/*").
+	// docs
+	Doc("creates the entity from the uploaded chunks - the response is the same as for the one-shot POST").
+	Operation("commitUpload").
+	Returns(http.StatusCreated, "Created", nil).
+	Returns(http.StatusAccepted, "Accepted", nil).
+	Param(ws.PathParameter("id", "identifier of the upload session").DataType("string")))
+
+	ws.Route(ws.GET("/tasks/upload/expire").Filter(taskAuthenticate).To(processUploadExpiry).
+	// docs
+	Doc("cron - deletes the expired upload sessions and their chunks").
+	Operation("processUploadExpiry").
+	Returns(http.StatusOK, "OK", nil))
+
+	// ----------------------------------------------------------------------------------
+	// setup the schema endpoints - processing see "schema.go"
+	// ----------------------------------------------------------------------------------
+	ws.Route(ws.GET("/schemas/{file}").Filter(basicAuthenticate).To(getSchema).
+	// docs
+	Doc("gets the JSON Schema of the v1 view of an entity - chart.json, gchart.json, usermetric.json or status.json").
+	Operation("getSchema").
+	Returns(http.StatusOK, "OK", nil).
+	Returns(http.StatusNotFound, "Not Found - no schema for the kind", nil).
+	Param(ws.PathParameter("file", "{kind}.json").DataType("string")))
+
+	// ----------------------------------------------------------------------------------
+	// setup the idempotency endpoints - processing see "filter_idempotency.go"
+	// ----------------------------------------------------------------------------------
+	ws.Route(ws.GET("/tasks/idempotency/purge").Filter(taskAuthenticate).To(processIdempotencyPurge).
+	// docs
+	Doc("cron - deletes the stored responses of Idempotency-Key requests which are older than 24 hours").
+	Operation("processIdempotencyPurge").
+	Returns(http.StatusOK, "OK", nil).
+	Writes(IdempotencyPurgeAPIv1{})) // on the response
+
+	// ----------------------------------------------------------------------------------
+	// setup the admin endpoints - processing see "entity_mapper.go", "entity_status.go", "entity_retention.go",
+	// "entity_blob.go", "filter_maintenance.go", "entity_config.go", "entity_reindex.go", "entity_shard.go",
+	// "filter_clients.go", "filter_ban.go", "entity_backup.go", "entity_restore.go"
+	// ----------------------------------------------------------------------------------
+	ws.Route(ws.POST("/admin/migrate/{kind}").Filter(taskOrAdminAuthenticate).To(migrateEntities).
+	// docs
+	Doc("rewrites legacy entities of {kind} to the current schema version - continues as task until done - admins only").
+	Operation("migrateEntities").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.PathParameter("kind", "datastore kind of the entities").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Param(ws.QueryParameter("cursor", "position to continue the migration").DataType("string")).
+	Writes(MigrationAPIv1{})) // on the response
+
+	ws.Route(ws.POST("/admin/shards/{type}").Filter(taskOrAdminAuthenticate).To(migrateShards).
+	// docs
+	Doc("moves the entities of {type} to the root shard of their id after Root_Shards was changed - continues as task until done - admins only").
+	Operation("migrateShards").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.PathParameter("type", "chart, gchart or usermetric").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Param(ws.QueryParameter("cursor", "position to continue the migration").DataType("string")).
+	Writes(ShardMigrationAPIv1{})) // on the response
+
+	ws.Route(ws.GET("/admin/clients").Filter(basicAuthenticate).Filter(readerAuthenticate).To(getClientVersions).
+	// docs
+	Doc("gets the requests per day, GoldenCheetah build and API version (default last 30 days) - readers only").
+	Operation("getClientVersions").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.QueryParameter("dateFrom", "RFC3339 date of the first day").DataType("string")).
+	Param(ws.QueryParameter("dateTo", "RFC3339 date of the last day").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Writes(ClientDailyAPIv1List{})) // on the response
+
+	ws.Route(ws.GET("/admin/bans").Filter(basicAuthenticate).Filter(readerAuthenticate).To(getBans).
+	// docs
+	Doc("gets all bans, also the expired ones - readers only").
+	Operation("getBans").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Writes(BanAPIv1List{})) // on the response
+
+	ws.Route(ws.POST("/admin/bans").Filter(basicAuthenticate).Filter(adminAuthenticate).To(insertBan).
+	// docs
+	Doc("bans a client id or an IP range - their requests are answered with 403 until the expiry - admins only").
+	Operation("insertBan").
+	Returns(http.StatusCreated, "Created", nil).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Reads(BanAPIv1{})) // from the request
+
+	ws.Route(ws.DELETE("/admin/bans/{id}").Filter(basicAuthenticate).Filter(adminAuthenticate).To(deleteBan).
+	// docs
+	Doc("lifts a ban - admins only").
+	Operation("deleteBan").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Param(ws.PathParameter("id", "id of the ban").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")))
+
+	ws.Route(ws.GET("/admin/maintenance").Filter(basicAuthenticate).Filter(adminAuthenticate).To(getMaintenance).
+	// docs
+	Doc("gets the maintenance mode - admins only").
+	Operation("getMaintenance").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Writes(MaintenanceAPIv1{})) // on the response
+
+	ws.Route(ws.PUT("/admin/maintenance").Filter(basicAuthenticate).Filter(adminAuthenticate).To(updateMaintenance).
+	// docs
+	Doc("switches the maintenance mode - while active all but the admin routes answer 503 with the message - admins only").
+	Operation("updateMaintenance").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Reads(MaintenanceAPIv1{})) // from the request
+
+	ws.Route(ws.PUT("/admin/maintenance/messages/{locale}").Filter(basicAuthenticate).Filter(adminAuthenticate).To(updateMaintenanceMessage).
+	// docs
+	Doc("stores the translation of the maintenance message - an empty text deletes it - admins only").
+	Operation("updateMaintenanceMessage").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Param(ws.PathParameter("locale", "locale of the translation e.g. de or pt-br").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Reads(MessageAPIv1{})) // from the request
+
+	ws.Route(ws.GET("/admin/config").Filter(basicAuthenticate).Filter(readerAuthenticate).To(getConfig).
+	// docs
+	Doc("gets all settings with their value, default and limits - readers only").
+	Operation("getConfig").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Writes(ConfigAPIv1List{})) // on the response
+
+	ws.Route(ws.PUT("/admin/config").Filter(basicAuthenticate).Filter(adminAuthenticate).To(updateConfig).
+	// docs
+	Doc("changes the listed settings e.g. {\"maxRevisions\": 10} - null resets a setting to its default - admins only").
+	Operation("updateConfig").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Reads(ConfigPutAPIv1{})) // from the request
+
+	ws.Route(ws.GET("/admin/reindex").Filter(basicAuthenticate).Filter(readerAuthenticate).To(getReindexRuns).
+	// docs
+	Doc("gets the progress of the re-index runs of all kinds - readers only").
+	Operation("getReindexRuns").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Writes(ReindexAPIv1List{})) // on the response
+
+	ws.Route(ws.POST("/admin/reindex/{kind}").Filter(basicAuthenticate).Filter(adminAuthenticate).To(startReindex).
+	// docs
+	Doc("stores all entities of {kind} again, so new indexed fields get indexed - runs as task, admins only").
+	Operation("startReindex").
+	Returns(http.StatusAccepted, "Accepted", nil).
+	Returns(http.StatusConflict, "Re-index of {kind} is already running", nil).
+	Param(ws.PathParameter("kind", "datastore kind of the entities").DataType("string")).
+	Param(ws.QueryParameter("restart", "true to start a running re-index again").DataType("bool")).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Writes(ReindexAPIv1{})) // on the response
+
+	ws.Route(ws.DELETE("/admin/status").Filter(basicAuthenticate).Filter(adminAuthenticate).To(purgeStatus).
+	// docs
+	Doc("deletes the status history older than {olderThan} - done by task queue - admins only").
+	Operation("purgeStatus").
+	Returns(http.StatusAccepted, "Accepted", nil).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Param(ws.QueryParameter("olderThan", "RFC3339 date - status changed before are deleted").DataType("string")).
+	Writes(StatusPurgeAPIv1{})) // on the response
+
+	ws.Route(ws.POST("/tasks/purge/status").Filter(taskAuthenticate).To(processStatusPurge).
+	// docs
+	Doc("task queue - deletes one bucket of the status history and continues until done").
+	Operation("processStatusPurge").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.QueryParameter("olderThan", "RFC3339 date - status changed before are deleted").DataType("string")).
+	Writes(StatusPurgeAPIv1{})) // on the response
+
+	ws.Route(ws.GET("/admin/retention").Filter(basicAuthenticate).Filter(readerAuthenticate).To(getRetention).
+	// docs
+	Doc("gets the retention configuration of all time-series kinds - readers only").
+	Operation("getRetention").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Writes(RetentionAPIv1List{})) // on the response
+
+	ws.Route(ws.PUT("/admin/retention/{kind}").Filter(basicAuthenticate).Filter(adminAuthenticate).To(updateRetention).
+	// docs
+	Doc("sets the max. age in days of {kind} - 0 switches the cleanup off - admins only").
+	Operation("updateRetention").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Param(ws.PathParameter("kind", "datastore kind (statusentity, telemetryentity, changelogentity, clientdailyentity)").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Reads(RetentionAPIv1{})) // from the request
+
+	ws.Route(ws.GET("/tasks/retention").Filter(taskAuthenticate).To(processRetention).
+	// docs
+	Doc("cron - deletes the expired entries of all configured kinds").
+	Operation("processRetention").
+	Returns(http.StatusOK, "OK", nil))
+
+	ws.Route(ws.POST("/tasks/reindex/{kind}").Filter(taskAuthenticate).To(processReindex).
+	// docs
+	Doc("task queue - stores one batch of {kind} again and queues the next one until done").
+	Operation("processReindex").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.PathParameter("kind", "datastore kind of the entities").DataType("string")).
+	Param(ws.QueryParameter("batch", "number of the batch - outdated tasks are ignored").DataType("int")).
+	Writes(ReindexAPIv1{})) // on the response
+
+	ws.Route(ws.GET("/admin/backups").Filter(basicAuthenticate).Filter(readerAuthenticate).To(getBackups).
+	// docs
+	Doc("gets the latest backup runs with their files, sizes and SHA-256 hashes - newest first").
+	Operation("getBackups").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.QueryParameter("limit", "number of runs (default 10, max. 100)").DataType("int")).
+	Writes(BackupRunAPIv1List{})) // on the response
+
+	ws.Route(ws.GET("/tasks/backup").Filter(taskAuthenticate).To(processBackup).
+	// docs
+	Doc("cron - starts a backup of all kinds to NDJSON files in Cloud Storage").
+	Operation("processBackup").
+	Returns(http.StatusOK, "OK", nil).
+	Writes(BackupRunAPIv1{})) // on the response
+
+	ws.Route(ws.POST("/tasks/backup/{id}/{kind}").Filter(taskAuthenticate).To(processBackupPart).
+	// docs
+	Doc("task - writes the next part of a kind of a backup run").
+	Operation("processBackupPart").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.PathParameter("id", "identifier of the backup run").DataType("string")).
+	Param(ws.PathParameter("kind", "datastore kind").DataType("string")).
+	Param(ws.QueryParameter("part", "number of the part").DataType("int")).
+	Param(ws.QueryParameter("cursor", "position of the part in the kind").DataType("string")))
+
+	ws.Route(ws.GET("/admin/restore").Filter(basicAuthenticate).Filter(readerAuthenticate).To(getRestores).
+	// docs
+	Doc("gets the latest restore runs with the progress of every kind - newest first").
+	Operation("getRestores").
+	Returns(http.StatusOK, "OK", nil).
+	Writes(RestoreAPIv1List{})) // on the response
+
+	ws.Route(ws.POST("/admin/restore").Filter(basicAuthenticate).Filter(adminAuthenticate).To(startRestore).
+	// docs
+	Doc("restores kinds of a complete backup run - existing entities are skipped, overwritten or duplicated (policy) - admins only").
+	Operation("startRestore").
+	Returns(http.StatusAccepted, "Accepted", nil).
+	Returns(http.StatusConflict, "Backup is not finished", nil).
+	Returns(http_UnprocessableEntity, "Validation failed", nil).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Reads(RestoreAPIv1{})) // from the request
+
+	ws.Route(ws.GET("/admin/duplicates/{kind}").Filter(basicAuthenticate).Filter(curatorAuthenticate).To(getDuplicates).
+	// docs
+	Doc("gets clusters of likely duplicates (same payload or similar name) with the merge candidate - curators only").
+	Operation("getDuplicates").
+	Returns(http.StatusOK, "OK", DuplicatesAPIv1{}).
+	Param(ws.PathParameter("kind", "chart, gchart or usermetric").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Writes(DuplicatesAPIv1{})) // on the response
+
+	ws.Route(ws.POST("/admin/merge").Filter(basicAuthenticate).Filter(curatorAuthenticate).Filter(filterCloudDBStatus).To(mergeDuplicates).
+	// docs
+	Doc("merges duplicates into a canonical entity - they are deleted and a GET of their ids is redirected (301) - curators only").
+	Operation("mergeDuplicates").
+	Returns(http.StatusOK, "OK", MergeResultAPIv1{}).
+	Returns(http.StatusConflict, "An entity is deleted", nil).
+	Returns(http_UnprocessableEntity, "Validation failed", nil).
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Reads(MergeAPIv1{}). // from the request
+	Writes(MergeResultAPIv1{})) // on the response
+
+	ws.Route(ws.POST("/tasks/restore/{id}/{kind}").Filter(taskAuthenticate).To(processRestore).
+	// docs
+	Doc("task - restores the next batch of a kind of a restore run").
+	Operation("processRestore").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws.PathParameter("id", "identifier of the restore run").DataType("string")).
+	Param(ws.PathParameter("kind", "datastore kind").DataType("string")).
+	Param(ws.QueryParameter("part", "number of the part of the backup").DataType("int")).
+	Param(ws.QueryParameter("offset", "position in the file of the part - outdated tasks are ignored").DataType("int")))
+
+	ws.Route(ws.GET("/tasks/blobs/gc").Filter(taskAuthenticate).To(processBlobGC).
+	// docs
+	Doc("cron - deletes the Cloud Storage blobs which are no longer referenced").
+	Operation("processBlobGC").
+	Returns(http.StatusOK, "OK", nil).
+	Writes(BlobGCAPIv1{})) // on the response
+
 
 	// all routes defined - let's go
 
-	restful.Add(ws)
+	container.Add(ws)
 
-} // init()
+	// ----------------------------------------------------------------------------------
+	// setup the v2 endpoints - same processing as v1, the views see "api_v2.go"
+	// ids are strings, dates are RFC3339 - v1 is unchanged
+	// ----------------------------------------------------------------------------------
+	ws2 := new(restful.WebService)
+	ws2.
+	Path("/v2").
+	Doc("CloudDB API v2").
+	Consumes(apiMimeTypes...).
+	Produces(apiMimeTypes...)
+
+	ws2.Route(ws2.POST("/chart/").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(insertChart).
+	// docs
+	Doc("creates a chart").
+	Operation("createChartV2").
+	Returns(http.StatusAccepted, "Accepted", nil).
+	Returns(http.StatusCreated, "Created", nil).
+	Returns(http.StatusOK, "OK - an identical chart exists, its id is returned", nil).
+	Param(ws2.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller - the owner of the entities it creates").DataType("string")).
+	Param(ws2.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")).
+	Param(ws2.QueryParameter("curatorId", "curator adding the entity - it is curated at once").DataType("string")).
+	Param(ws2.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Param(ws2.HeaderParameter("Idempotency-Key", "unique key of the request - a retry with the same key and payload within 24 hours returns the first response").DataType("string")).
+	Param(ws2.QueryParameter("strict", "true: the body is checked against the JSON Schema of /schemas/{kind}.json - unknown fields are rejected").DataType("bool")).
+	Reads(ChartAPIv2{})) // from the request
+
+	ws2.Route(ws2.PUT("/chart/").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(updateChart).
+	// docs
+	Doc("updates a chart").
+	Operation("updatedChartV2").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Returns(http.StatusForbidden, "Forbidden - only the owner or a curator may change the entity", nil).
+	Param(ws2.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller - the owner of the entities it creates").DataType("string")).
+	Param(ws2.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")).
+	Param(ws2.QueryParameter("curatorId", "curator changing an entity of another owner").DataType("string")).
+	Param(ws2.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Param(ws2.QueryParameter("strict", "true: the body is checked against the JSON Schema of /schemas/{kind}.json - unknown fields are rejected").DataType("bool")).
+	Reads(ChartAPIv2{})) // from the request
+
+	ws2.Route(ws2.GET("/chart").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getChartsByIds).
+	// docs
+	Doc("gets the charts of a list of ids (max. 100) - ids which don't exist are returned as missing").
+	Operation("getChartsByIdsV2").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws2.QueryParameter("ids", "comma separated list of chart ids").DataType("string")).
+	Param(ws2.QueryParameter("fields", "comma separated JSON fields of the response e.g. header.id,header.name").DataType("string")).
+	Writes(ChartAPIv2Bulk{})) // on the response
+
+	ws2.Route(ws2.GET("/chart/{id}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getChartById).
+	// docs
+	Doc("get a chart").
+	Operation("getChartbyIdV2").
+	Returns(http.StatusOK, "OK", nil).
+	Returns(http.StatusNotModified, "Not Modified - the copy of the client is current", nil).
+	Param(ws2.PathParameter("id", "identifier of the chart").DataType("string")).
+	Param(ws2.QueryParameter("fields", "comma separated JSON fields of the response e.g. header.id,header.name").DataType("string")).
+	Param(ws2.HeaderParameter("If-None-Match", "ETag of the copy of the client").DataType("string")).
+	Param(ws2.HeaderParameter("If-Modified-Since", "lastChange of the copy of the client (HTTP date)").DataType("string")).
+	Writes(ChartAPIv2{})) // on the response
+
+	ws2.Route(ws2.GET("/chart/{id}/header").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getChartHeaderById).
+	// docs
+	Doc("gets only the header of a chart - without payload").
+	Operation("getChartHeaderByIdV2").
+	Returns(http.StatusOK, "OK", nil).
+	Returns(http.StatusNotModified, "Not Modified - the copy of the client is current", nil).
+	Param(ws2.PathParameter("id", "identifier of the chart").DataType("string")).
+	Param(ws2.QueryParameter("fields", "comma separated JSON fields of the response e.g. header.name,header.lastChange,header.size,header.hash (metadata only, read without the entity)").DataType("string")).
+	Param(ws2.HeaderParameter("If-None-Match", "ETag of the copy of the client").DataType("string")).
+	Param(ws2.HeaderParameter("If-Modified-Since", "lastChange of the copy of the client (HTTP date)").DataType("string")).
+	Writes(CommonAPIHeaderOnlyV2{})) // on the response
+
+	ws2.Route(ws2.DELETE("/chart/{id}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(deleteChartById).
+	// docs
+	Doc("delete a chart by setting the deleted status - it can be restored from the trash for 30 days").
+	Operation("deleteChartbyIdV2").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Returns(http.StatusForbidden, "Forbidden - only the owner or a curator may change the entity", nil).
+	Param(ws2.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller - the owner of the entities it creates").DataType("string")).
+	Param(ws2.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")).
+	Param(ws2.QueryParameter("curatorId", "curator changing an entity of another owner").DataType("string")).
+	Param(ws2.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Param(ws2.PathParameter("id", "identifier of the chart").DataType("string")))
+
+	ws2.Route(ws2.GET("/chartheader").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getChartHeader).
+	// docs
+	Doc("gets a collection of charts header - in buckets of x charts - table sort is new to old").
+	Operation("getChartHeaderV2").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws2.QueryParameter("dateFrom", "Date of last change").DataType("string")).
+	Param(ws2.QueryParameter("tag", "only entities with this tag - can be repeated").DataType("string")).
+	Param(ws2.QueryParameter("curationState", "Submitted, UnderReview, Approved (default) or all").DataType("string")).
+	Param(ws2.QueryParameter("cursor", "nextCursor of the previous call").DataType("string")).
+	Param(ws2.QueryParameter("consistency", "eventual (default) or strong - strong reads all root shards, with several shards the list is paged by dateFrom only").DataType("string")).
+	Param(ws2.QueryParameter("envelope", "true: wrap the list with paging metadata").DataType("bool")).
+	Param(ws2.QueryParameter("fields", "comma separated JSON fields of the response e.g. header.id,header.name").DataType("string")).
+	Writes([]CommonAPIHeaderOnlyV2{})) // on the response
+
+	ws2.Route(ws2.POST("/gchart/").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(insertGChart).
+	// docs
+	Doc("creates a gchart").
+	Operation("createGChartV2").
+	Returns(http.StatusAccepted, "Accepted", nil).
+	Returns(http.StatusCreated, "Created", nil).
+	Returns(http.StatusOK, "OK - an identical gchart exists, its id is returned", nil).
+	Param(ws2.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller - the owner of the entities it creates").DataType("string")).
+	Param(ws2.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")).
+	Param(ws2.QueryParameter("curatorId", "curator adding the entity - it is curated at once").DataType("string")).
+	Param(ws2.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Param(ws2.HeaderParameter("Idempotency-Key", "unique key of the request - a retry with the same key and payload within 24 hours returns the first response").DataType("string")).
+	Param(ws2.QueryParameter("strict", "true: the body is checked against the JSON Schema of /schemas/{kind}.json - unknown fields are rejected").DataType("bool")).
+	Reads(GChartAPIv2{})) // from the request
+
+	ws2.Route(ws2.PUT("/gchart/").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(updateGChart).
+	// docs
+	Doc("updates a gchart").
+	Operation("updatedGChartV2").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Returns(http.StatusForbidden, "Forbidden - only the owner or a curator may change the entity", nil).
+	Param(ws2.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller - the owner of the entities it creates").DataType("string")).
+	Param(ws2.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")).
+	Param(ws2.QueryParameter("curatorId", "curator changing an entity of another owner").DataType("string")).
+	Param(ws2.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Param(ws2.QueryParameter("strict", "true: the body is checked against the JSON Schema of /schemas/{kind}.json - unknown fields are rejected").DataType("bool")).
+	Reads(GChartAPIv2{})) // from the request
+
+	ws2.Route(ws2.GET("/gchart").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getGChartsByIds).
+	// docs
+	Doc("gets the gcharts of a list of ids (max. 100) - ids which don't exist are returned as missing").
+	Operation("getGChartsByIdsV2").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws2.QueryParameter("ids", "comma separated list of gchart ids").DataType("string")).
+	Param(ws2.QueryParameter("fields", "comma separated JSON fields of the response e.g. header.id,header.name").DataType("string")).
+	Writes(GChartAPIv2Bulk{})) // on the response
+
+	ws2.Route(ws2.GET("/gchart/{id}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getGChartById).
+	// docs
+	Doc("get a gchart").
+	Operation("getGChartbyIdV2").
+	Returns(http.StatusOK, "OK", nil).
+	Returns(http.StatusNotModified, "Not Modified - the copy of the client is current", nil).
+	Param(ws2.PathParameter("id", "identifier of the gchart").DataType("string")).
+	Param(ws2.QueryParameter("fields", "comma separated JSON fields of the response e.g. header.id,header.name").DataType("string")).
+	Param(ws2.HeaderParameter("If-None-Match", "ETag of the copy of the client").DataType("string")).
+	Param(ws2.HeaderParameter("If-Modified-Since", "lastChange of the copy of the client (HTTP date)").DataType("string")).
+	Writes(GChartAPIv2{})) // on the response
+
+	ws2.Route(ws2.GET("/gchart/{id}/header").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getGChartHeaderById).
+	// docs
+	Doc("gets only the header of a gchart - without payload").
+	Operation("getGChartHeaderByIdV2").
+	Returns(http.StatusOK, "OK", nil).
+	Returns(http.StatusNotModified, "Not Modified - the copy of the client is current", nil).
+	Param(ws2.PathParameter("id", "identifier of the gchart").DataType("string")).
+	Param(ws2.QueryParameter("fields", "comma separated JSON fields of the response e.g. header.name,header.lastChange,header.size,header.hash (metadata only, read without the entity)").DataType("string")).
+	Param(ws2.HeaderParameter("If-None-Match", "ETag of the copy of the client").DataType("string")).
+	Param(ws2.HeaderParameter("If-Modified-Since", "lastChange of the copy of the client (HTTP date)").DataType("string")).
+	Writes(CommonAPIHeaderOnlyV2{})) // on the response
+
+	ws2.Route(ws2.DELETE("/gchart/{id}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(deleteGChartById).
+	// docs
+	Doc("delete a gchart by setting the deleted status - it can be restored from the trash for 30 days").
+	Operation("deleteGChartbyIdV2").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Returns(http.StatusForbidden, "Forbidden - only the owner or a curator may change the entity", nil).
+	Param(ws2.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller - the owner of the entities it creates").DataType("string")).
+	Param(ws2.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")).
+	Param(ws2.QueryParameter("curatorId", "curator changing an entity of another owner").DataType("string")).
+	Param(ws2.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Param(ws2.PathParameter("id", "identifier of the chart").DataType("string")))
+
+	ws2.Route(ws2.GET("/gchartheader").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getGChartHeader).
+	// docs
+	Doc("gets a collection of gcharts header - in buckets of x charts - table sort is new to old").
+	Operation("getGChartHeaderV2").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws2.QueryParameter("dateFrom", "Date of last change").DataType("string")).
+	Param(ws2.QueryParameter("tag", "only entities with this tag - can be repeated").DataType("string")).
+	Param(ws2.QueryParameter("curationState", "Submitted, UnderReview, Approved (default) or all").DataType("string")).
+	Param(ws2.QueryParameter("cursor", "nextCursor of the previous call").DataType("string")).
+	Param(ws2.QueryParameter("consistency", "eventual (default) or strong - strong reads all root shards, with several shards the list is paged by dateFrom only").DataType("string")).
+	Param(ws2.QueryParameter("envelope", "true: wrap the list with paging metadata").DataType("bool")).
+	Param(ws2.QueryParameter("fields", "comma separated JSON fields of the response e.g. header.id,header.name").DataType("string")).
+	Writes([]GChartAPIv2HeaderOnly{})) // on the response
+
+	ws2.Route(ws2.POST("/usermetric/").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(insertUserMetric).
+	// docs
+	Doc("creates a usermetric").
+	Operation("createUserMetricV2").
+	Returns(http.StatusAccepted, "Accepted", nil).
+	Returns(http.StatusCreated, "Created", nil).
+	Param(ws2.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller - the owner of the entities it creates").DataType("string")).
+	Param(ws2.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")).
+	Param(ws2.QueryParameter("curatorId", "curator adding the entity - it is curated at once").DataType("string")).
+	Param(ws2.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Param(ws2.HeaderParameter("Idempotency-Key", "unique key of the request - a retry with the same key and payload within 24 hours returns the first response").DataType("string")).
+	Param(ws2.QueryParameter("strict", "true: the body is checked against the JSON Schema of /schemas/{kind}.json - unknown fields are rejected").DataType("bool")).
+	Reads(UserMetricAPIv2{})) // from the request
+
+	ws2.Route(ws2.PUT("/usermetric/").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(updateUserMetric).
+	// docs
+	Doc("updates a usermetric").
+	Operation("updateUserMetricV2").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Returns(http.StatusForbidden, "Forbidden - only the owner or a curator may change the entity", nil).
+	Param(ws2.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller - the owner of the entities it creates").DataType("string")).
+	Param(ws2.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")).
+	Param(ws2.QueryParameter("curatorId", "curator changing an entity of another owner").DataType("string")).
+	Param(ws2.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Param(ws2.QueryParameter("strict", "true: the body is checked against the JSON Schema of /schemas/{kind}.json - unknown fields are rejected").DataType("bool")).
+	Reads(UserMetricAPIv2{})) // from the request
+
+	ws2.Route(ws2.GET("/usermetric").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getUserMetricsByKeys).
+	// docs
+	Doc("gets the usermetrics of a list of keys (max. 100) - keys which don't exist are returned as missing").
+	Operation("getUserMetricsByKeysV2").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws2.QueryParameter("keys", "comma separated list of usermetric keys").DataType("string")).
+	Param(ws2.QueryParameter("fields", "comma separated JSON fields of the response e.g. header.id,header.name").DataType("string")).
+	Writes(UserMetricAPIv2Bulk{})) // on the response
+
+	ws2.Route(ws2.GET("/usermetric/{id}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getUserMetricByKey).
+	// docs
+	Doc("get a usermetric").
+	Operation("getUserMetricbyIdV2").
+	Returns(http.StatusOK, "OK", nil).
+	Returns(http.StatusNotModified, "Not Modified - the copy of the client is current", nil).
+	Param(ws2.PathParameter("key", "identifier of the user metric").DataType("string")).
+	Param(ws2.QueryParameter("fields", "comma separated JSON fields of the response e.g. header.id,header.name").DataType("string")).
+	Param(ws2.HeaderParameter("If-None-Match", "ETag of the copy of the client").DataType("string")).
+	Param(ws2.HeaderParameter("If-Modified-Since", "lastChange of the copy of the client (HTTP date)").DataType("string")).
+	Writes(UserMetricAPIv2{})) // on the response
+
+	ws2.Route(ws2.GET("/usermetric/{key}/header").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getUserMetricHeaderByKey).
+	// docs
+	Doc("gets only the header of a usermetric - without payload").
+	Operation("getUserMetricHeaderByKeyV2").
+	Returns(http.StatusOK, "OK", nil).
+	Returns(http.StatusNotModified, "Not Modified - the copy of the client is current", nil).
+	Param(ws2.PathParameter("key", "identifier of the usermetric").DataType("string")).
+	Param(ws2.QueryParameter("fields", "comma separated JSON fields of the response e.g. header.name,header.lastChange,header.size,header.hash (metadata only, read without the entity)").DataType("string")).
+	Param(ws2.HeaderParameter("If-None-Match", "ETag of the copy of the client").DataType("string")).
+	Param(ws2.HeaderParameter("If-Modified-Since", "lastChange of the copy of the client (HTTP date)").DataType("string")).
+	Writes(CommonAPIHeaderOnlyV2{})) // on the response
+
+	ws2.Route(ws2.DELETE("/usermetric/{key}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(deleteUserMetricByKey).
+	// docs
+	Doc("delete a usermetric by setting the deleted status - it can be restored from the trash for 30 days").
+	Operation("deleteUserMetricbyKeyV2").
+	Returns(http.StatusNoContent, "No Content", nil).
+	Returns(http.StatusForbidden, "Forbidden - only the owner or a curator may change the entity", nil).
+	Param(ws2.HeaderParameter("X-CloudDB-Client-Id", "client id of the caller - the owner of the entities it creates").DataType("string")).
+	Param(ws2.HeaderParameter("X-CloudDB-Client-Secret", "secret of the client id - see POST /client").DataType("string")).
+	Param(ws2.QueryParameter("curatorId", "curator changing an entity of another owner").DataType("string")).
+	Param(ws2.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")).
+	Param(ws2.PathParameter("key", "identifier of the usermetric").DataType("string")))
+
+	ws2.Route(ws2.GET("/usermetricheader").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getUserMetricHeader).
+	// docs
+	Doc("gets a collection of usermetric header - in buckets of x headers - table sort is new to old").
+	Operation("getUserMetricHeaderV2").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws2.QueryParameter("dateFrom", "Date of last change").DataType("string")).
+	Param(ws2.QueryParameter("tag", "only entities with this tag - can be repeated").DataType("string")).
+	Param(ws2.QueryParameter("curationState", "Submitted, UnderReview, Approved (default) or all").DataType("string")).
+	Param(ws2.QueryParameter("cursor", "nextCursor of the previous call").DataType("string")).
+	Param(ws2.QueryParameter("consistency", "eventual (default) or strong - strong reads all root shards, with several shards the list is paged by dateFrom only").DataType("string")).
+	Param(ws2.QueryParameter("envelope", "true: wrap the list with paging metadata").DataType("bool")).
+	Param(ws2.QueryParameter("fields", "comma separated JSON fields of the response e.g. header.id,header.name").DataType("string")).
+	Writes([]CommonAPIHeaderOnlyV2{})) // on the response
+
+	ws2.Route(ws2.POST("/status").Filter(basicAuthenticate).To(insertStatus).
+	// docs
+	Doc("creates a new status entity").
+	Operation("createStatusV2").
+	Returns(http.StatusOK, "OK", nil).
+	Returns(http.StatusCreated, "Created", nil).
+	Param(ws2.QueryParameter("ifChanged", "true: only stored if the status differs from the latest one").DataType("bool")).
+	Param(ws2.QueryParameter("strict", "true: the body is checked against the JSON Schema of /schemas/{kind}.json - unknown fields are rejected").DataType("bool")).
+	Reads(StatusEntityPostAPIv2{})) // from the request
+
+	ws2.Route(ws2.GET("/status").Filter(basicAuthenticate).To(getStatus).
+	// docs
+	Doc("gets a collection of status - filtered by status code and date range").
+	Operation("getStatusV2").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws2.QueryParameter("dateFrom", "Status Validity").DataType("string")).
+	Param(ws2.QueryParameter("dateTo", "RFC3339 date of the last status").DataType("string")).
+	Param(ws2.QueryParameter("statusCode", "only status with this code - 10 ok, 20 partial failure, 30 outage").DataType("int")).
+	Param(ws2.QueryParameter("order", "asc or desc (default) by changeDate").DataType("string")).
+	Param(ws2.QueryParameter("envelope", "true: wrap the list with paging metadata").DataType("bool")).
+	Writes([]StatusEntityGetAPIv2{})) // on the response
+
+	ws2.Route(ws2.GET("/status/latest").Filter(basicAuthenticate).To(getCurrentStatus).
+	// docs
+	Doc("gets the current/latest status - with the active maintenance window if there is one, the last known good status (stale) if the datastore is unavailable").
+	Operation("getStatusV2").
+	Returns(http.StatusOK, "OK", nil).
+	Writes(StatusEntityGetAPIv2{})) // on the response
+
+	ws2.Route(ws2.GET("/maintenance/upcoming").Filter(basicAuthenticate).To(getUpcomingMaintenanceWindows).
+	// docs
+	Doc("gets the active and planned maintenance windows - the next one first").
+	Operation("getUpcomingMaintenanceWindowsV2").
+	Returns(http.StatusOK, "OK", nil).
+	Param(ws2.QueryParameter("envelope", "true: wrap the list with paging metadata").DataType("bool")).
+	Writes([]MaintenanceWindowAPIv2{})) // on the response
+
+	ws2.Route(ws2.GET("/schemas/{file}").Filter(basicAuthenticate).To(getSchema).
+	// docs
+	Doc("gets the JSON Schema of the v2 view of an entity - chart.json, gchart.json, usermetric.json or status.json").
+	Operation("getSchemaV2").
+	Returns(http.StatusOK, "OK", nil).
+	Returns(http.StatusNotFound, "Not Found - no schema for the kind", nil).
+	Param(ws2.PathParameter("file", "{kind}.json").DataType("string")))
+
+	container.Add(ws2)
+
+	// ----------------------------------------------------------------------------------
+	// setup the operations endpoints (not versioned) - processing see "filter_metrics.go"
+	// ----------------------------------------------------------------------------------
+	wsOps := new(restful.WebService)
+	wsOps.
+	Path("/").
+	Doc("CloudDB operations")
+
+	wsOps.Route(wsOps.GET("/metrics").Filter(basicAuthenticate).To(getMetrics).Produces("text/plain").
+	// docs
+	Doc("gets the request, error, datastore and cache counters of all instances in the Prometheus text format").
+	Operation("getMetrics").
+	Returns(http.StatusOK, "OK", nil))
+
+	wsOps.Route(wsOps.GET("/dashboard").Filter(basicAuthenticate).Filter(curatorAuthenticate).To(getDashboard).Produces("text/html").
+	// docs
+	Doc("shows the status, the content pending curation, the flag queue and the usage as HTML page - curators only").
+	Operation("getDashboard").
+	Returns(http.StatusOK, "OK", nil).
+	Param(wsOps.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(wsOps.HeaderParameter("X-CloudDB-Curator-Secret", "secret of the curatorId - see POST /curator").DataType("string")))
+
+	// processing see "health.go"
+	wsOps.Route(wsOps.GET("/healthz").To(getHealth).Produces("text/plain").
+	// docs
+	Doc("liveness - answers as long as the instance serves requests, no backend is called").
+	Operation("getHealth").
+	Returns(http.StatusOK, "OK", nil))
+
+	wsOps.Route(wsOps.GET("/readyz").To(getReadiness).
+	// docs
+	Doc("readiness - checks the datastore and memcache and reports the state of each").
+	Operation("getReadiness").
+	Returns(http.StatusOK, "OK", ReadinessAPIv1{}).
+	Returns(http.StatusServiceUnavailable, "A dependency failed", ReadinessAPIv1{}).
+	Writes(ReadinessAPIv1{})) // on the response
+
+	wsOps.Route(wsOps.GET("/_ah/warmup").To(warmup).
+	// docs
+	Doc("warmup of a new instance - runs the readiness checks as startup self-check and logs the result").
+	Operation("warmup").
+	Returns(http.StatusOK, "OK", nil))
+
+	container.Add(wsOps)
+
+	// ----------------------------------------------------------------------------------
+	// API documentation - generated from the route definitions above
+	// the swagger-ui assets are served as static files - see "app.yaml.in"
+	// ----------------------------------------------------------------------------------
+	swagger.RegisterSwaggerService(swagger.Config{
+		WebServices: container.RegisteredWebServices(),
+		ApiPath:     "/apidocs.json",
+		ApiVersion:  "v1",
+	}, container)
+
+	// ----------------------------------------------------------------------------------
+	// container filters - executed for all routes - processing see "filter_*.go"
+	// ----------------------------------------------------------------------------------
+	container.Filter(filterRequestId)
+	container.Filter(filterMetrics)
+	container.Filter(filterClientStats)
+	container.Filter(filterBan)
+	container.Filter(filterTenant)
+	container.Filter(filterMaintenance)
+	container.Filter(filterCompression)
+	container.Filter(filterRequestSize)
+	container.Filter(filterIdempotency)
+	container.Filter(filterClientVersion)
+
+} // NewAPI()
 
 
 // global declarations
@@ -266,27 +1953,83 @@ const dateTimeLayout = "2006-01-02T15:04:05Z"
 
 
 func basicAuthenticate(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
-	headerClientId := req.Request.Header.Get(authorization)
 	if secretClientId := os.Getenv(basicauth); secretClientId != "" {
-		if fmt.Sprint("Basic ",secretClientId) != headerClientId {
+		if !isBasicAuthenticated(req.Request) {
 			resp.AddHeader("WWW-Authenticate", "Basic realm=Protected Area")
-			resp.WriteErrorString(http.StatusUnauthorized, "Not Authorized")
+			addError(req, resp, http.StatusUnauthorized, errorCode_Unauthorized, "Not Authorized")
 			return
 		}
 	} else {
 		resp.AddHeader("WWW-Authenticate", "Basic realm=Protected Area")
-		resp.WriteErrorString(http.StatusInternalServerError, "Authorization configuration missing on Server")
+		addError(req, resp, http.StatusInternalServerError, errorCode_Internal, "Authorization configuration missing on Server")
 		return
 	}
 
 	chain.ProcessFilter(req, resp)
 } // basicAuthenticate
 
+// isBasicAuthenticated checks the credentials only - for container filters which run before the route filters
+func isBasicAuthenticated(req *http.Request) bool {
+	secretClientId := os.Getenv(basicauth)
+	return secretClientId != "" && fmt.Sprint("Basic ", secretClientId) == req.Header.Get(authorization)
+}
+
+// task queue and cron requests carry no credentials - GAE strips these headers from external requests, so
+// they can't be sent by clients (the Basic_Auth secret is part of every GoldenCheetah installation)
+func isTaskRequest(req *http.Request) bool {
+	return req.Header.Get("X-AppEngine-QueueName") != "" || req.Header.Get("X-AppEngine-Cron") == "true"
+}
+
+func taskAuthenticate(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	if !isTaskRequest(req.Request) {
+		addError(req, resp, http.StatusForbidden, errorCode_Forbidden, "Forbidden - task queue and cron only")
+		return
+	}
+	chain.ProcessFilter(req, resp)
+} // taskAuthenticate
+
+// long running admin jobs are started by an admin and continue as tasks
+func taskOrAdminAuthenticate(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	if isTaskRequest(req.Request) {
+		chain.ProcessFilter(req, resp)
+		return
+	}
+	basicAuthenticate(req, resp, &restful.FilterChain{
+		Filters: []restful.FilterFunction{adminAuthenticate},
+		Target:  func(req *restful.Request, resp *restful.Response) { chain.ProcessFilter(req, resp) },
+	})
+} // taskOrAdminAuthenticate
+
+// role based endpoints - the caller identifies with the "curatorId" of a registered curator and its secret, see
+// "entity_curator.go"
+func adminAuthenticate(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	roleAuthenticate(req, resp, chain, Role_Admin)
+} // adminAuthenticate
+
+func curatorAuthenticate(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	roleAuthenticate(req, resp, chain, Role_Curator)
+} // curatorAuthenticate
+
+func readerAuthenticate(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	roleAuthenticate(req, resp, chain, Role_Reader)
+} // readerAuthenticate
+
+func roleAuthenticate(req *restful.Request, resp *restful.Response, chain *restful.FilterChain, role string) {
+	ctx := newContext(req.Request)
+
+	if !internalHasRole(ctx, requestCuratorId(req), role) {
+		addError(req, resp, http.StatusForbidden, errorCode_Forbidden, "Forbidden - "+role+" role required")
+		return
+	}
+
+	chain.ProcessFilter(req, resp)
+}
+
 func filterCloudDBStatus(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
-	ctx := appengine.NewContext(req.Request)
+	ctx := newContext(req.Request)
 
 	if internalGetCurrentStatus(ctx) != Status_Ok {
-		addPlainTextError(resp, http_UnprocessableEntity, status_unprocessable)
+		addError(req, resp, http_UnprocessableEntity, errorCode_CloudDBStatus, status_unprocessable)
 		return
 	}
 
@@ -294,8 +2037,77 @@ func filterCloudDBStatus(req *restful.Request, resp *restful.Response, chain *re
 }
 
 
+// ---------------------------------------------------------------------------------------------------------------//
+// Error responses - {code, message, detail, requestId} as JSON, the "code" is stable and can be
+// evaluated by clients, "detail" is for humans only. Old clients (no Accept header, or explicitly
+// asking for "text/plain") still get the plain text detail.
+// ---------------------------------------------------------------------------------------------------------------//
+type ErrorAPIv1 struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Detail    string `json:"detail"`
+	RequestId string `json:"requestId"`
+	Fields    []FieldErrorAPIv1 `json:"fields,omitempty"`
+}
+
+const (
+	errorCode_BadRequest      = "bad_request"
+	errorCode_InvalidPayload  = "invalid_payload"
+	errorCode_Validation      = "validation_failed"
+	errorCode_Unauthorized    = "unauthorized"
+	errorCode_Forbidden       = "forbidden"
+	errorCode_NotFound        = "not_found"
+	errorCode_Conflict        = "conflict"
+	errorCode_CloudDBStatus   = "clouddb_status"
+	errorCode_UpgradeRequired = "upgrade_required"
+	errorCode_OverQuota       = "over_quota"
+	errorCode_Datastore       = "datastore_error"
+	errorCode_Unavailable     = "datastore_unavailable"
+	errorCode_TooLarge        = "too_large"
+	errorCode_Merged          = "merged"
+	errorCode_Internal        = "internal_error"
+	errorCode_Maintenance     = "maintenance"
+)
+
+var errorMessages = map[string]string{
+	errorCode_BadRequest:      "The request is invalid",
+	errorCode_InvalidPayload:  "The request body can not be read",
+	errorCode_Validation:      "The request contains invalid fields",
+	errorCode_Unauthorized:    "Authorization required",
+	errorCode_Forbidden:       "Access denied",
+	errorCode_NotFound:        "The entity does not exist",
+	errorCode_Conflict:        "The request conflicts with stored data",
+	errorCode_CloudDBStatus:   "CloudDB status does not allow processing the request",
+	errorCode_UpgradeRequired: "GoldenCheetah version no longer supported",
+	errorCode_OverQuota:       "CloudDB is over quota - try again later",
+	errorCode_Datastore:       "Datastore operation failed",
+	errorCode_Unavailable:     "Datastore is temporarily unavailable - try again later",
+	errorCode_TooLarge:        "Request or entity is too large",
+	errorCode_Merged:          "The entity was merged into another one - see Location",
+	errorCode_Internal:        "Internal server error",
+	errorCode_Maintenance:     "CloudDB is down for maintenance - try again later",
+}
+
 // Convenience functions for error handling
-func addPlainTextError( r *restful.Response, httpStatus int, errorReason string ) {
-	r.AddHeader("Content-Type", "text/plain")
-	r.WriteErrorString(httpStatus, errorReason)
+func addError(req *restful.Request, resp *restful.Response, httpStatus int, code string, detail string) {
+	countError(code)
+
+	if isPlainTextErrorRequested(req) {
+		resp.AddHeader("Content-Type", "text/plain")
+		resp.WriteErrorString(httpStatus, detail)
+		return
+	}
+
+	var apiError ErrorAPIv1
+	apiError.Code = code
+	apiError.Message = errorMessages[code]
+	apiError.Detail = detail
+	apiError.RequestId = requestId(req)
+
+	resp.WriteHeaderAndJson(httpStatus, apiError, restful.MIME_JSON)
+}
+
+func isPlainTextErrorRequested(req *restful.Request) bool {
+	accept := req.Request.Header.Get("Accept")
+	return accept == "" || (strings.Contains(accept, "text/plain") && !strings.Contains(accept, restful.MIME_JSON))
 }
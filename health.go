@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Health checks - GET /healthz only tells that the instance serves requests (no datastore, no memcache), GET
+// /readyz checks the backends with one small datastore query and one memcache lookup each. Both need no
+// authentication and are not stopped by maintenance or bans, so load balancers and uptime monitors can tell a
+// dead instance from an unavailable backend. The warmup request of a new instance runs the same self-check
+// and logs the result, the cron health-check (see "cron.yaml") calls /readyz - failures show in the cron log.
+// ---------------------------------------------------------------------------------------------------------------//
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+type DependencyStateAPIv1 struct {
+	State     string `json:"state"` // "ok" or "failed"
+	LatencyMs int64  `json:"latencyMs"`
+}
+
+type ReadinessAPIv1 struct {
+	State        string                          `json:"state"` // "ok" if all dependencies are ok, else "failed"
+	Checked      string                          `json:"checked"`
+	Dependencies map[string]DependencyStateAPIv1 `json:"dependencies"`
+}
+
+const (
+	Health_Ok     = "ok"
+	Health_Failed = "failed"
+)
+
+// a backend which doesn't answer within the timeout is not ready - load balancers give up after a few seconds
+const readinessTimeout = 3 * time.Second
+
+const healthMemcacheKey = "healthz"
+
+// the checks by dependency name - the errors are only logged, the response is public
+var readinessChecks = map[string]func(ctx context.Context) error{
+	"datastore": func(ctx context.Context) error {
+		_, err := datastore.NewQuery(statusDBEntity).KeysOnly().Limit(1).GetAll(ctx, nil)
+		return err
+	},
+	"memcache": func(ctx context.Context) error {
+		if _, err := memcache.Get(ctx, healthMemcacheKey); err != nil && err != memcache.ErrCacheMiss {
+			return err
+		}
+		return nil
+	},
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+// getHealth answers as long as the instance serves requests
+func getHealth(request *restful.Request, response *restful.Response) {
+	response.AddHeader("Cache-Control", "no-store")
+	response.AddHeader("Content-Type", "text/plain")
+	response.WriteHeader(http.StatusOK)
+	response.Write([]byte(Health_Ok))
+}
+
+// getReadiness answers 503 if one of the backends fails
+func getReadiness(request *restful.Request, response *restful.Response) {
+	readiness := internalCheckReadiness(newRequestContext(request.Request))
+
+	status := http.StatusOK
+	if readiness.State != Health_Ok {
+		status = http.StatusServiceUnavailable
+	}
+	response.AddHeader("Cache-Control", "no-store")
+	response.WriteHeaderAndEntity(status, readiness)
+}
+
+// warmup is called by GAE before a new instance gets traffic - it never fails, an instance with an unavailable
+// backend still answers /healthz and recovers when the backend is back
+func warmup(request *restful.Request, response *restful.Response) {
+	ctx := newRequestContext(request.Request)
+
+	readiness := internalCheckReadiness(ctx)
+	if readiness.State != Health_Ok {
+		logErrorf(ctx, "Startup self-check failed: %v", readiness.Dependencies)
+	} else {
+		logInfof(ctx, "Startup self-check ok: %v", readiness.Dependencies)
+	}
+
+	response.WriteHeader(http.StatusOK)
+}
+
+//---------------------------------------------------------------------------------------
+// internal functions
+//---------------------------------------------------------------------------------------
+
+// internalCheckReadiness runs all checks in the default namespace and without retries (see "retry.go") - a
+// readiness check must report a slow backend, not hide it
+func internalCheckReadiness(ctx context.Context) *ReadinessAPIv1 {
+	readiness := &ReadinessAPIv1{
+		State:        Health_Ok,
+		Checked:      time.Now().Format(dateTimeLayout),
+		Dependencies: make(map[string]DependencyStateAPIv1),
+	}
+
+	for name, check := range readinessChecks {
+		tc, cancel := context.WithTimeout(ctx, readinessTimeout)
+		start := time.Now()
+		err := check(tc)
+		cancel()
+
+		state := DependencyStateAPIv1{State: Health_Ok, LatencyMs: int64(time.Since(start) / time.Millisecond)}
+		if err != nil {
+			logWarningf(ctx, "Readiness check of %s failed: %v", name, err)
+			metrics.add(metricsSeries("clouddb_readiness_check_failures_total", "dependency", name), 1)
+			state.State = Health_Failed
+			readiness.State = Health_Failed
+		}
+		readiness.Dependencies[name] = state
+	}
+	return readiness
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Retry of transient datastore errors - timeouts and internal errors of the datastore are retried with
+// exponential backoff for all calls which can be repeated without changing the result (reads, deletes, new
+// transactions). Writes are not repeated - a write which timed out may still have been applied, e.g. an insert
+// would be stored twice. If the retries are exhausted or the call can't be repeated, the request is answered
+// with 503 and Retry-After, so the client repeats it (safely with an "Idempotency-Key").
+// ---------------------------------------------------------------------------------------------------------------//
+
+// attempts of one call - the first one included
+const datastoreCallAttempts = 4
+
+// the first backoff, doubled for every retry - with a random part so retries of parallel requests spread
+const datastoreRetryBackoff = 50 * time.Millisecond
+
+// the retries of one call stop early if the request would run out of time
+const maxDatastoreRetryTime = 2 * time.Second
+
+// seconds - sent as Retry-After if the datastore is still unavailable
+const datastoreRetryAfter = 5
+
+// the datastore_v3 methods which can be repeated
+var retryableDatastoreMethods = map[string]bool{
+	"Get":              true,
+	"RunQuery":         true,
+	"Count":            true,
+	"AllocateIds":      true,
+	"Delete":           true,
+	"BeginTransaction": true,
+}
+
+// supporting functions
+
+// isTransientDatastoreError classifies an error - true if repeating the request later can succeed
+func isTransientDatastoreError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if appengine.IsTimeoutError(err) || err == datastore.ErrConcurrentTransaction {
+		return true
+	}
+	// API errors have no exported type - "API error 5 (datastore_v3: TIMEOUT)"
+	message := err.Error()
+	for _, code := range []string{"datastore_v3: TIMEOUT", "datastore_v3: INTERNAL_ERROR", "datastore_v3: CONCURRENT_TRANSACTION"} {
+		if strings.Contains(message, code) {
+			return true
+		}
+	}
+	return false
+}
+
+// datastoreBackoff is the wait before retry "n" (1, 2,...) - half of it is random
+func datastoreBackoff(n int) time.Duration {
+	backoff := datastoreRetryBackoff << uint(n-1)
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// retryAPICall is installed in every context (see "newContext") - each attempt is timed by "timeAPICall"
+func retryAPICall(ctx context.Context, service, method string, in, out proto.Message) error {
+	err := timeAPICall(ctx, service, method, in, out)
+	if service != "datastore_v3" || !retryableDatastoreMethods[method] {
+		return err
+	}
+
+	start := time.Now()
+	for attempt := 1; attempt < datastoreCallAttempts && isTransientDatastoreError(err); attempt++ {
+		wait := datastoreBackoff(attempt)
+		if time.Since(start)+wait > maxDatastoreRetryTime {
+			break
+		}
+		if deadline, ok := ctx.Deadline(); ok && deadline.Sub(time.Now()) < 2*wait {
+			break
+		}
+
+		time.Sleep(wait)
+		metrics.add(metricsSeries("clouddb_datastore_call_retries_total", "method", method), 1)
+		out.Reset()
+		err = timeAPICall(ctx, service, method, in, out)
+	}
+	if err != nil && isTransientDatastoreError(err) {
+		logWarningf(ctx, "Datastore %s failed after retries: %v", method, err)
+	}
+	return err
+}
+
+// addDatastoreError answers a failed datastore call - 503 with Retry-After if it's worth to repeat the request
+func addDatastoreError(request *restful.Request, response *restful.Response, err error) {
+	if isEntityTooLarge(err) {
+		addEntityTooLargeError(request, response, err)
+		return
+	}
+	if isTransientDatastoreError(err) {
+		response.AddHeader("Retry-After", strconv.Itoa(datastoreRetryAfter))
+		addError(request, response, http.StatusServiceUnavailable, errorCode_Unavailable, err.Error())
+		return
+	}
+	addError(request, response, http.StatusInternalServerError, errorCode_Datastore, err.Error())
+}
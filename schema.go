@@ -0,0 +1,282 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// JSON Schemas (draft-04) of the API views - generated from the structs, so they can't differ from what the
+// handlers read. With "strict=true" a request body is checked against the schema before it is read: unknown
+// fields and wrong types are rejected with 422 instead of being silently ignored.
+// ---------------------------------------------------------------------------------------------------------------//
+
+const jsonSchemaDraft = "http://json-schema.org/draft-04/schema#"
+
+type jsonSchema map[string]interface{}
+
+// the API views per kind - v1 and v2
+var schemaKinds = map[string][2]interface{}{
+	sharedTypeChart:      {ChartAPIv1{}, ChartAPIv2{}},
+	sharedTypeGChart:     {GChartAPIv1{}, GChartAPIv2{}},
+	sharedTypeUserMetric: {UserMetricAPIv1{}, UserMetricAPIv2{}},
+	"status":             {StatusEntityPostAPIv1{}, StatusEntityPostAPIv2{}},
+}
+
+// supporting functions
+
+func isStrictRequest(request *restful.Request) bool {
+	strict, _ := strconv.ParseBool(request.QueryParameter("strict"))
+	return strict
+}
+
+// schemaView returns the view of the API version for the v1 view "entity" - nil if it has no schema
+func schemaView(request *restful.Request, entity interface{}) interface{} {
+	t := reflect.Indirect(reflect.ValueOf(entity)).Type()
+	for _, views := range schemaKinds {
+		if reflect.TypeOf(views[0]) == t {
+			if isAPIv2(request) {
+				return views[1]
+			}
+			return views[0]
+		}
+	}
+	return nil
+}
+
+// newJSONSchema describes a Go type the way encoding/json writes it
+func newJSONSchema(t reflect.Type) jsonSchema {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return newJSONSchema(t.Elem())
+	case reflect.String:
+		return jsonSchema{"type": "string"}
+	case reflect.Bool:
+		return jsonSchema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return jsonSchema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return jsonSchema{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		// a nil slice is written as null
+		return jsonSchema{"type": []string{"array", "null"}, "items": newJSONSchema(t.Elem())}
+	case reflect.Map:
+		return jsonSchema{"type": []string{"object", "null"}, "additionalProperties": newJSONSchema(t.Elem())}
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		addJSONSchemaProperties(t, properties)
+		return jsonSchema{"type": "object", "properties": properties, "additionalProperties": false}
+	}
+	return jsonSchema{}
+}
+
+// addJSONSchemaProperties adds the fields of embedded structs first - the fields of the outer struct replace
+// them, the same as encoding/json does (e.g. the v2 header of "ChartAPIv2")
+func addJSONSchemaProperties(t reflect.Type, properties map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); f.Anonymous && f.Type.Kind() == reflect.Struct && f.Tag.Get("json") == "" {
+			addJSONSchemaProperties(f.Type, properties)
+		}
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || (f.Anonymous && f.Tag.Get("json") == "") {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = newJSONSchema(f.Type)
+	}
+}
+
+// isJSONType checks a decoded JSON value against the "type" of a schema
+func isJSONType(value interface{}, schemaType interface{}) bool {
+	var types []string
+	switch st := schemaType.(type) {
+	case string:
+		types = []string{st}
+	case []string:
+		types = st
+	default:
+		return true
+	}
+	for _, t := range types {
+		switch v := value.(type) {
+		case nil:
+			if t == "null" {
+				return true
+			}
+		case string:
+			if t == "string" {
+				return true
+			}
+		case bool:
+			if t == "boolean" {
+				return true
+			}
+		case float64:
+			if t == "number" || (t == "integer" && v == float64(int64(v))) {
+				return true
+			}
+		case []interface{}:
+			if t == "array" {
+				return true
+			}
+		case map[string]interface{}:
+			if t == "object" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateJSONSchema adds a field error for every deviation - "path" is the JSON path as used by the validator
+func validateJSONSchema(v *validator, path string, value interface{}, schema jsonSchema) {
+	if !isJSONType(value, schema["type"]) {
+		v.fail(path, fmt.Sprint("must be of type ", schema["type"]))
+		return
+	}
+	switch val := value.(type) {
+	case []interface{}:
+		if items, ok := schema["items"].(jsonSchema); ok {
+			for i, item := range val {
+				validateJSONSchema(v, fmt.Sprint(path, "[", i, "]"), item, items)
+			}
+		}
+	case map[string]interface{}:
+		properties, _ := schema["properties"].(map[string]interface{})
+		names := make([]string, 0, len(val))
+		for name := range val {
+			names = append(names, name)
+		}
+		// stable order of the field errors
+		sort.Strings(names)
+		for _, name := range names {
+			field := name
+			if path != "" {
+				field = path + "." + name
+			}
+			if property, ok := properties[name].(jsonSchema); ok {
+				validateJSONSchema(v, field, val[name], property)
+			} else if additional, ok := schema["additionalProperties"].(jsonSchema); ok {
+				validateJSONSchema(v, field, val[name], additional)
+			} else {
+				v.fail(field, "is not a known field")
+			}
+		}
+	}
+}
+
+// validateStrictRequest checks the request body against the schema of the view - the body stays readable.
+// XML and MessagePack bodies are not checked (see "encoding.go").
+func validateStrictRequest(request *restful.Request, entity interface{}) error {
+	view := schemaView(request, entity)
+	if view == nil || !isJSONRequest(request) {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(request.Request.Body)
+	if err != nil {
+		return err
+	}
+	request.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return err
+	}
+
+	v := new(validator)
+	validateJSONSchema(v, "", value, newJSONSchema(reflect.TypeOf(view)))
+	if !v.valid() {
+		return v
+	}
+	return nil
+}
+
+func isJSONRequest(request *restful.Request) bool {
+	contentType := request.HeaderParameter("Content-Type")
+	return contentType == "" || strings.HasPrefix(contentType, restful.MIME_JSON)
+}
+
+// a failed schema check is returned by readEntity as error
+func (v *validator) Error() string {
+	var reasons []string
+	for _, e := range v.errors {
+		reasons = append(reasons, fmt.Sprint(e.Field, " ", e.Reason))
+	}
+	return "Validation failed: " + strings.Join(reasons, ", ")
+}
+
+// addReadEntityError answers a request body which could not be read - schema violations with the field errors
+func addReadEntityError(request *restful.Request, response *restful.Response, err error) {
+	if v, ok := err.(*validator); ok {
+		addValidationError(request, response, v)
+		return
+	}
+	if isRequestTooLarge(err) {
+		addError(request, response, http.StatusRequestEntityTooLarge, errorCode_TooLarge, "The request body is larger than the limit of this route - see settings maxRequestKB and maxContentKB")
+		return
+	}
+	addError(request, response, http.StatusInternalServerError, errorCode_InvalidPayload, err.Error())
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+// getSchema returns the schema of "{kind}.json" - of the view of the API version which is called
+func getSchema(request *restful.Request, response *restful.Response) {
+	file := request.PathParameter("file")
+	kind := strings.TrimSuffix(file, ".json")
+	views, ok := schemaKinds[kind]
+	if !ok || kind == file {
+		addError(request, response, http.StatusNotFound, errorCode_NotFound, "No schema "+file+" - available are chart.json, gchart.json, usermetric.json and status.json")
+		return
+	}
+
+	view := views[0]
+	if isAPIv2(request) {
+		view = views[1]
+	}
+	schema := newJSONSchema(reflect.TypeOf(view))
+	schema["$schema"] = jsonSchemaDraft
+	schema["title"] = reflect.TypeOf(view).Name()
+
+	response.WriteHeaderAndEntity(http.StatusOK, schema)
+}
@@ -0,0 +1,63 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Unit of work - all mutations which write more than one entity (the entity and its tag counts, change log,
+// revision, flag,...) run in one XG transaction, so a failure can't leave the derived data half written.
+// Side effects outside the datastore (blob claims, memcache, search index) are registered with "onCommit"
+// and only run once the transaction is committed - a retried transaction doesn't run them twice.
+// ---------------------------------------------------------------------------------------------------------------//
+
+// XG transactions are limited to 25 entity groups - the shared entities, the tag counts and the change log
+// entries of one mutation stay far below
+const unitOfWorkAttempts = 3
+
+type unitOfWork struct {
+	afterCommit []func(ctx context.Context)
+}
+
+// onCommit registers a function which is called with the non-transactional context after the commit
+func (uow *unitOfWork) onCommit(f func(ctx context.Context)) {
+	uow.afterCommit = append(uow.afterCommit, f)
+}
+
+// runUnitOfWork runs f in an XG transaction - f may be called several times (concurrent modification), so
+// it must not have side effects outside of "tc" other than the ones registered with "onCommit"
+func runUnitOfWork(ctx context.Context, f func(tc context.Context, uow *unitOfWork) error) error {
+	uow := new(unitOfWork)
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		uow.afterCommit = nil
+		return f(tc, uow)
+	}, &datastore.TransactionOptions{XG: true, Attempts: unitOfWorkAttempts})
+	if err != nil {
+		return err
+	}
+
+	for _, after := range uow.afterCommit {
+		after(ctx)
+	}
+	return nil
+}
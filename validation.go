@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2016 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+
+package goldencheetah
+
+import (
+	b64 "encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/emicklei/go-restful"
+)
+
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Request validation - every API entity has its own validateXXX function (see "entity_*.go") which is
+// called before anything is written to the datastore. All field errors are collected and returned
+// together with 422.
+// ---------------------------------------------------------------------------------------------------------------//
+
+// one field which failed the validation - "field" is the JSON path e.g. "header.name"
+type FieldErrorAPIv1 struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// datastore entities are limited to 1MB - some space is left for the header
+const maxPayloadSize = 1000 * 1000
+
+type validator struct {
+	errors []FieldErrorAPIv1
+}
+
+func (v *validator) fail(field string, reason string) {
+	v.errors = append(v.errors, FieldErrorAPIv1{Field: field, Reason: reason})
+}
+
+func (v *validator) valid() bool {
+	return len(v.errors) == 0
+}
+
+func (v *validator) required(field string, value string) {
+	if strings.TrimSpace(value) == "" {
+		v.fail(field, "is mandatory")
+	}
+}
+
+// empty dates are allowed - the server sets them
+func (v *validator) dateTime(field string, value string) {
+	if value == "" {
+		return
+	}
+	if _, err := time.Parse(dateTimeLayout, value); err != nil {
+		v.fail(field, fmt.Sprint("must have the format ", dateTimeLayout))
+	}
+}
+
+func (v *validator) intRange(field string, value int, min int, max int) {
+	if value < min || value > max {
+		v.fail(field, fmt.Sprint("must be between ", min, " and ", max))
+	}
+}
+
+func (v *validator) oneOf(field string, value int, allowed ...int) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.fail(field, fmt.Sprint("must be one of ", allowed))
+}
+
+func (v *validator) maxLength(field string, value string, max int) {
+	if len(value) > max {
+		v.fail(field, fmt.Sprint("must not be longer than ", max, " bytes"))
+	}
+}
+
+// base64 encoded binaries (images) - returns the decoded size for the payload check
+func (v *validator) base64(field string, value string) int {
+	data, err := b64.StdEncoding.DecodeString(value)
+	if err != nil {
+		v.fail(field, "must be base64 encoded")
+		return 0
+	}
+	return len(data)
+}
+
+func (v *validator) payloadSize(field string, size int) {
+	if size > maxPayloadSize {
+		v.fail(field, fmt.Sprint("content must not be larger than ", maxPayloadSize, " bytes"))
+	}
+}
+
+// large binaries are stored as blob (see "entity_blob.go") - they have their own limit
+func (v *validator) blobSize(field string, size int) {
+	if size > maxBlobSize {
+		v.fail(field, fmt.Sprint("must not be larger than ", maxBlobSize, " bytes"))
+	}
+}
+
+// addValidationError returns all field errors with 422
+func addValidationError(req *restful.Request, resp *restful.Response, v *validator) {
+	countError(errorCode_Validation)
+
+	if isPlainTextErrorRequested(req) {
+		var reasons []string
+		for _, e := range v.errors {
+			reasons = append(reasons, fmt.Sprint(e.Field, " ", e.Reason))
+		}
+		resp.AddHeader("Content-Type", "text/plain")
+		resp.WriteErrorString(http_UnprocessableEntity, "Validation failed: "+strings.Join(reasons, ", "))
+		return
+	}
+
+	var apiError ErrorAPIv1
+	apiError.Code = errorCode_Validation
+	apiError.Message = errorMessages[errorCode_Validation]
+	apiError.Detail = fmt.Sprint(len(v.errors), " field(s) invalid")
+	apiError.RequestId = requestId(req)
+	apiError.Fields = v.errors
+
+	resp.WriteHeaderAndJson(http_UnprocessableEntity, apiError, restful.MIME_JSON)
+}